@@ -3,12 +3,15 @@ package main
 import (
 	"archive/zip"
 	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"runtime"
@@ -28,6 +31,14 @@ type loggerData struct {
 
 var numWorkerCount = runtime.NumCPU()
 
+// tieredBlobStores are the tiered stores created for block stores, their hit and miss counts are shown with --show-store-stats
+var tieredBlobStores []longtailstorelib.TierStatsProvider
+
+// remoteBlockStores are the remote block stores created for block stores, their store index update and
+// checksum mismatch counts do not pass through the native block store stats and are shown separately
+// with --show-store-stats
+var remoteBlockStores []longtaillib.BlockStoreAPI
+
 var logLevelNames = [...]string{"DEBUG", "INFO", "WARNING", "ERROR", "OFF"}
 
 func (l *loggerData) OnLog(file string, function string, line int, level int, logFields []longtaillib.LogField, message string) {
@@ -147,6 +158,24 @@ func (a *getStoredBlockCompletionAPI) OnComplete(storedBlock longtaillib.Longtai
 	a.wg.Done()
 }
 
+func printTierStats(stats []longtailstorelib.TierStats) {
+	log.Printf("Tiers:\n")
+	log.Printf("------------------\n")
+	for _, tier := range stats {
+		log.Printf("%s: %s hits, %s misses\n", tier.Name, byteCountDecimal(tier.Hits), byteCountDecimal(tier.Misses))
+	}
+}
+
+func printRemoteStoreStats(stats longtaillib.BlockStoreStats) {
+	log.Printf("Remote store:\n")
+	log.Printf("------------------\n")
+	log.Printf("UpdateStoreIndex_Count:        %s\n", byteCountDecimal(stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_UpdateStoreIndex_Count]))
+	log.Printf("UpdateStoreIndex_RetryCount:   %s\n", byteCountDecimal(stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_UpdateStoreIndex_RetryCount]))
+	log.Printf("UpdateStoreIndex_FailCount:    %s\n", byteCountDecimal(stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_UpdateStoreIndex_FailCount]))
+	log.Printf("ChecksumMismatch_RetryCount:   %s\n", byteCountDecimal(stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_ChecksumMismatch_RetryCount]))
+	log.Printf("------------------\n")
+}
+
 func printStats(name string, stats longtaillib.BlockStoreStats) {
 	log.Printf("%s:\n", name)
 	log.Printf("------------------\n")
@@ -185,46 +214,48 @@ func getExistingStoreIndexSync(indexStore longtaillib.Longtail_BlockStoreAPI, ch
 	return getExistingContentComplete.storeIndex, getExistingContentComplete.err
 }
 
-func createBlockStoreForURI(uri string, optionalStoreIndexPath string, jobAPI longtaillib.Longtail_JobAPI, targetBlockSize uint32, maxChunksPerBlock uint32, accessType longtailstorelib.AccessType) (longtaillib.Longtail_BlockStoreAPI, error) {
+// getRetryPolicy returns the retry policy for remote storage requests set on the command line
+func getRetryPolicy() longtailstorelib.RetryPolicy {
+	retryPolicy := longtailstorelib.DefaultRetryPolicy()
+	retryPolicy.MaxAttempts = *maxRetryAttempts
+	retryPolicy.MaxElapsedTime = *maxRetryTime
+	return retryPolicy
+}
+
+func createBlockStoreForURI(ctx context.Context, uri string, optionalStoreIndexPath string, jobAPI longtaillib.Longtail_JobAPI, targetBlockSize uint32, maxChunksPerBlock uint32, accessType longtailstorelib.AccessType, maxDownloadRate int64, maxUploadRate int64) (longtaillib.Longtail_BlockStoreAPI, error) {
 	blobStoreURL, err := url.Parse(uri)
 	if err == nil {
-		switch blobStoreURL.Scheme {
-		case "gs":
-			gcsBlobStore, err := longtailstorelib.NewGCSBlobStore(blobStoreURL)
+		if blobStoreURL.Scheme == "file" {
+			return longtaillib.CreateFSBlockStore(jobAPI, longtaillib.CreateFSStorageAPI(), blobStoreURL.Path[1:], targetBlockSize, maxChunksPerBlock), nil
+		}
+		if longtailstorelib.IsBlobStoreSchemeRegistered(blobStoreURL.Scheme) {
+			blobStore, err := longtailstorelib.CreateBlobStoreForURI(uri, longtailstorelib.BlobStoreOptions{AccessType: accessType})
 			if err != nil {
 				return longtaillib.Longtail_BlockStoreAPI{}, err
 			}
-			gcsBlockStore, err := longtailstorelib.NewRemoteBlockStore(
-				jobAPI,
-				gcsBlobStore,
-				optionalStoreIndexPath,
-				numWorkerCount,
-				accessType)
-			if err != nil {
-				return longtaillib.Longtail_BlockStoreAPI{}, err
+			if tiered, ok := blobStore.(longtailstorelib.TierStatsProvider); ok {
+				tieredBlobStores = append(tieredBlobStores, tiered)
 			}
-			return longtaillib.CreateBlockStoreAPI(gcsBlockStore), nil
-		case "s3":
-			s3BlobStore, err := longtailstorelib.NewS3BlobStore(blobStoreURL)
-			if err != nil {
-				return longtaillib.Longtail_BlockStoreAPI{}, err
+			if maxDownloadRate > 0 || maxUploadRate > 0 {
+				blobStore, err = longtailstorelib.NewThrottledBlobStore(blobStore, maxDownloadRate, maxUploadRate)
+				if err != nil {
+					return longtaillib.Longtail_BlockStoreAPI{}, err
+				}
 			}
-			s3BlockStore, err := longtailstorelib.NewRemoteBlockStore(
+			remoteBlockStore, err := longtailstorelib.NewRemoteBlockStoreWithStoreIndexDeltas(
+				ctx,
 				jobAPI,
-				s3BlobStore,
+				blobStore,
 				optionalStoreIndexPath,
 				numWorkerCount,
-				accessType)
+				accessType,
+				getRetryPolicy(),
+				*storeIndexDeltaLimit)
 			if err != nil {
 				return longtaillib.Longtail_BlockStoreAPI{}, err
 			}
-			return longtaillib.CreateBlockStoreAPI(s3BlockStore), nil
-		case "abfs":
-			return longtaillib.Longtail_BlockStoreAPI{}, fmt.Errorf("azure Gen1 storage not yet implemented")
-		case "abfss":
-			return longtaillib.Longtail_BlockStoreAPI{}, fmt.Errorf("azure Gen2 storage not yet implemented")
-		case "file":
-			return longtaillib.CreateFSBlockStore(jobAPI, longtaillib.CreateFSStorageAPI(), blobStoreURL.Path[1:], targetBlockSize, maxChunksPerBlock), nil
+			remoteBlockStores = append(remoteBlockStores, remoteBlockStore)
+			return longtaillib.CreateBlockStoreAPI(remoteBlockStore), nil
 		}
 	}
 	return longtaillib.CreateFSBlockStore(jobAPI, longtaillib.CreateFSStorageAPI(), uri, targetBlockSize, maxChunksPerBlock), nil
@@ -398,6 +429,7 @@ func (scanner *asyncFolderScanner) get() (longtaillib.Longtail_FileInfos, time.D
 }
 
 func getFolderIndex(
+	ctx context.Context,
 	sourceFolderPath string,
 	sourceIndexPath *string,
 	targetChunkSize uint32,
@@ -429,7 +461,8 @@ func getFolderIndex(
 
 		createVersionIndexProgress := CreateProgress("Indexing version")
 		defer createVersionIndexProgress.Dispose()
-		vindex, errno := longtaillib.CreateVersionIndex(
+		vindex, err := longtaillib.CreateVersionIndexWithContext(
+			ctx,
 			fs,
 			hash,
 			chunker,
@@ -439,15 +472,15 @@ func getFolderIndex(
 			fileInfos,
 			compressionTypes,
 			targetChunkSize)
-		if errno != 0 {
-			return longtaillib.Longtail_VersionIndex{}, longtaillib.Longtail_HashAPI{}, scanTime + time.Since(startTime), errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "longtaillib.CreateVersionIndex(%s)", sourceFolderPath)
+		if err != nil {
+			return longtaillib.Longtail_VersionIndex{}, longtaillib.Longtail_HashAPI{}, scanTime + time.Since(startTime), errors.Wrapf(err, "longtaillib.CreateVersionIndex(%s)", sourceFolderPath)
 		}
 
 		return vindex, hash, scanTime + time.Since(startTime), nil
 	}
 	startTime := time.Now()
 
-	vbuffer, err := longtailstorelib.ReadFromURI(*sourceIndexPath)
+	vbuffer, err := longtailstorelib.ReadFromURI(ctx, *sourceIndexPath)
 	if err != nil {
 		return longtaillib.Longtail_VersionIndex{}, longtaillib.Longtail_HashAPI{}, time.Since(startTime), err
 	}
@@ -474,6 +507,7 @@ type asyncVersionIndexReader struct {
 }
 
 func (indexReader *asyncVersionIndexReader) read(
+	ctx context.Context,
 	sourceFolderPath string,
 	sourceIndexPath *string,
 	targetChunkSize uint32,
@@ -487,6 +521,7 @@ func (indexReader *asyncVersionIndexReader) read(
 	indexReader.wg.Add(1)
 	go func() {
 		indexReader.versionIndex, indexReader.hashAPI, indexReader.elapsedTime, indexReader.err = getFolderIndex(
+			ctx,
 			sourceFolderPath,
 			sourceIndexPath,
 			targetChunkSize,
@@ -507,6 +542,7 @@ func (indexReader *asyncVersionIndexReader) get() (longtaillib.Longtail_VersionI
 }
 
 func upSyncVersion(
+	ctx context.Context,
 	blobStoreURI string,
 	sourceFolderPath string,
 	sourceIndexPath *string,
@@ -519,7 +555,9 @@ func upSyncVersion(
 	includeFilterRegEx *string,
 	excludeFilterRegEx *string,
 	minBlockUsagePercent uint32,
-	versionLocalStoreIndexPath *string) ([]storeStat, []timeStat, error) {
+	versionLocalStoreIndexPath *string,
+	maxDownloadRate int64,
+	maxUploadRate int64) ([]storeStat, []timeStat, error) {
 
 	storeStats := []storeStat{}
 	timeStats := []timeStat{}
@@ -574,7 +612,7 @@ func upSyncVersion(
 	timeStats = append(timeStats, timeStat{"Setup", setupTime})
 
 	sourceIndexReader := asyncVersionIndexReader{}
-	sourceIndexReader.read(sourceFolderPath,
+	sourceIndexReader.read(ctx, sourceFolderPath,
 		sourceIndexPath,
 		targetChunkSize,
 		compressionType,
@@ -585,7 +623,7 @@ func upSyncVersion(
 		hashRegistry,
 		&sourceFolderScanner)
 
-	remoteStore, err := createBlockStoreForURI(blobStoreURI, "", jobs, targetBlockSize, maxChunksPerBlock, longtailstorelib.ReadWrite)
+	remoteStore, err := createBlockStoreForURI(ctx, blobStoreURI, "", jobs, targetBlockSize, maxChunksPerBlock, longtailstorelib.ReadWrite, maxDownloadRate, maxUploadRate)
 	if err != nil {
 		return storeStats, timeStats, err
 	}
@@ -630,7 +668,8 @@ func upSyncVersion(
 		writeContentProgress := CreateProgress("Writing content blocks")
 		defer writeContentProgress.Dispose()
 
-		errno = longtaillib.WriteContent(
+		err = longtaillib.WriteContentWithContext(
+			ctx,
 			fs,
 			indexStore,
 			jobs,
@@ -638,8 +677,8 @@ func upSyncVersion(
 			versionMissingStoreIndex,
 			vindex,
 			normalizePath(sourceFolderPath))
-		if errno != 0 {
-			return storeStats, timeStats, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "upSyncVersion: longtaillib.WriteContent(%s) failed", sourceFolderPath)
+		if err != nil {
+			return storeStats, timeStats, errors.Wrapf(err, "upSyncVersion: longtaillib.WriteContent(%s) failed", sourceFolderPath)
 		}
 	}
 	writeContentTime := time.Since(writeContentStartTime)
@@ -684,13 +723,20 @@ func upSyncVersion(
 		storeStats = append(storeStats, storeStat{"Remote", remoteStoreStats})
 	}
 
+	// Do not write the version index unless the store index changes were saved
+	indexStore.Dispose()
+	err = remoteStore.Close()
+	if err != nil {
+		return storeStats, timeStats, errors.Wrapf(err, "upSyncVersion: remoteStore.Close: Failed for `%s` failed", blobStoreURI)
+	}
+
 	writeVersionIndexStartTime := time.Now()
 	vbuffer, errno := longtaillib.WriteVersionIndexToBuffer(vindex)
 	if errno != 0 {
 		return storeStats, timeStats, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "upSyncVersion: longtaillib.WriteVersionIndexToBuffer() failed")
 	}
 
-	err = longtailstorelib.WriteToURI(targetFilePath, vbuffer)
+	err = longtailstorelib.WriteToURI(ctx, targetFilePath, vbuffer)
 	if err != nil {
 		return storeStats, timeStats, errors.Wrapf(err, "upSyncVersion: longtaillib.longtailstorelib.WriteToURL() failed")
 	}
@@ -708,7 +754,7 @@ func upSyncVersion(
 		if errno != 0 {
 			return storeStats, timeStats, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "upSyncVersion: longtaillib.WriteStoreIndexToBuffer() failed")
 		}
-		err = longtailstorelib.WriteToURI(*versionLocalStoreIndexPath, versionLocalStoreIndexBuffer)
+		err = longtailstorelib.WriteToURI(ctx, *versionLocalStoreIndexPath, versionLocalStoreIndexBuffer)
 		if err != nil {
 			return storeStats, timeStats, errors.Wrapf(err, "upSyncVersion: longtailstorelib.WriteToURL() failed")
 		}
@@ -720,6 +766,7 @@ func upSyncVersion(
 }
 
 func downSyncVersion(
+	ctx context.Context,
 	blobStoreURI string,
 	sourceFilePath string,
 	targetFolderPath string,
@@ -731,7 +778,9 @@ func downSyncVersion(
 	validate bool,
 	versionLocalStoreIndexPath *string,
 	includeFilterRegEx *string,
-	excludeFilterRegEx *string) ([]storeStat, []timeStat, error) {
+	excludeFilterRegEx *string,
+	maxDownloadRate int64,
+	maxUploadRate int64) ([]storeStat, []timeStat, error) {
 
 	storeStats := []storeStat{}
 	timeStats := []timeStat{}
@@ -777,7 +826,7 @@ func downSyncVersion(
 
 	readSourceStartTime := time.Now()
 
-	vbuffer, err := longtailstorelib.ReadFromURI(sourceFilePath)
+	vbuffer, err := longtailstorelib.ReadFromURI(ctx, sourceFilePath)
 	if err != nil {
 		return storeStats, timeStats, err
 	}
@@ -794,7 +843,7 @@ func downSyncVersion(
 	targetChunkSize := sourceVersionIndex.GetTargetChunkSize()
 
 	targetIndexReader := asyncVersionIndexReader{}
-	targetIndexReader.read(targetFolderPath,
+	targetIndexReader.read(ctx, targetFolderPath,
 		targetIndexPath,
 		targetChunkSize,
 		noCompressionType,
@@ -812,7 +861,7 @@ func downSyncVersion(
 	defer localFS.Dispose()
 
 	// MaxBlockSize and MaxChunksPerBlock are just temporary values until we get the remote index settings
-	remoteIndexStore, err := createBlockStoreForURI(blobStoreURI, *versionLocalStoreIndexPath, jobs, 8388608, 1024, longtailstorelib.ReadOnly)
+	remoteIndexStore, err := createBlockStoreForURI(ctx, blobStoreURI, *versionLocalStoreIndexPath, jobs, 8388608, 1024, longtailstorelib.ReadOnly, maxDownloadRate, maxUploadRate)
 	if err != nil {
 		return storeStats, timeStats, err
 	}
@@ -884,7 +933,8 @@ func downSyncVersion(
 	changeVersionStartTime := time.Now()
 	changeVersionProgress := CreateProgress("Updating version")
 	defer changeVersionProgress.Dispose()
-	errno = longtaillib.ChangeVersion(
+	err = longtaillib.ChangeVersionWithContext(
+		ctx,
 		indexStore,
 		fs,
 		hash,
@@ -896,8 +946,8 @@ func downSyncVersion(
 		versionDiff,
 		normalizePath(targetFolderPath),
 		retainPermissions)
-	if errno != 0 {
-		return storeStats, timeStats, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "downSyncVersion: longtaillib.ChangeVersion() failed")
+	if err != nil {
+		return storeStats, timeStats, errors.Wrapf(err, "downSyncVersion: longtaillib.ChangeVersion() failed")
 	}
 
 	changeVersionTime := time.Since(changeVersionStartTime)
@@ -1027,7 +1077,8 @@ func downSyncVersion(
 
 		createVersionIndexProgress := CreateProgress("Validating version")
 		defer createVersionIndexProgress.Dispose()
-		validateVersionIndex, errno := longtaillib.CreateVersionIndex(
+		validateVersionIndex, err := longtaillib.CreateVersionIndexWithContext(
+			ctx,
 			fs,
 			hash,
 			chunker,
@@ -1037,8 +1088,8 @@ func downSyncVersion(
 			validateFileInfos,
 			nil,
 			targetChunkSize)
-		if errno != 0 {
-			return storeStats, timeStats, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "downSyncVersion: longtaillib.CreateVersionIndex() failed")
+		if err != nil {
+			return storeStats, timeStats, errors.Wrapf(err, "downSyncVersion: longtaillib.CreateVersionIndex() failed")
 		}
 		defer validateVersionIndex.Dispose()
 		if validateVersionIndex.GetAssetCount() != sourceVersionIndex.GetAssetCount() {
@@ -1103,6 +1154,7 @@ func hashIdentifierToString(hashIdentifier uint32) string {
 }
 
 func validateVersion(
+	ctx context.Context,
 	blobStoreURI string,
 	versionIndexPath string,
 	targetBlockSize uint32,
@@ -1117,7 +1169,7 @@ func validateVersion(
 	defer jobs.Dispose()
 
 	// MaxBlockSize and MaxChunksPerBlock are just temporary values until we get the remote index settings
-	indexStore, err := createBlockStoreForURI(blobStoreURI, "", jobs, 8388608, 1024, longtailstorelib.ReadOnly)
+	indexStore, err := createBlockStoreForURI(ctx, blobStoreURI, "", jobs, 8388608, 1024, longtailstorelib.ReadOnly, 0, 0)
 	if err != nil {
 		return storeStats, timeStats, err
 	}
@@ -1126,7 +1178,7 @@ func validateVersion(
 	timeStats = append(timeStats, timeStat{"Setup", setupTime})
 
 	readSourceStartTime := time.Now()
-	vbuffer, err := longtailstorelib.ReadFromURI(versionIndexPath)
+	vbuffer, err := longtailstorelib.ReadFromURI(ctx, versionIndexPath)
 	if err != nil {
 		return storeStats, timeStats, err
 	}
@@ -1158,13 +1210,13 @@ func validateVersion(
 	return storeStats, timeStats, nil
 }
 
-func showVersionIndex(versionIndexPath string, compact bool) ([]storeStat, []timeStat, error) {
+func showVersionIndex(ctx context.Context, versionIndexPath string, compact bool) ([]storeStat, []timeStat, error) {
 	storeStats := []storeStat{}
 	timeStats := []timeStat{}
 
 	readSourceStartTime := time.Now()
 
-	vbuffer, err := longtailstorelib.ReadFromURI(versionIndexPath)
+	vbuffer, err := longtailstorelib.ReadFromURI(ctx, versionIndexPath)
 	if err != nil {
 		return storeStats, timeStats, err
 	}
@@ -1241,13 +1293,13 @@ func showVersionIndex(versionIndexPath string, compact bool) ([]storeStat, []tim
 	return storeStats, timeStats, nil
 }
 
-func showStoreIndex(storeIndexPath string, compact bool) ([]storeStat, []timeStat, error) {
+func showStoreIndex(ctx context.Context, storeIndexPath string, compact bool) ([]storeStat, []timeStat, error) {
 	storeStats := []storeStat{}
 	timeStats := []timeStat{}
 
 	readStoreIndexStartTime := time.Now()
 
-	vbuffer, err := longtailstorelib.ReadFromURI(storeIndexPath)
+	vbuffer, err := longtailstorelib.ReadFromURI(ctx, storeIndexPath)
 	if err != nil {
 		return storeStats, timeStats, err
 	}
@@ -1337,12 +1389,12 @@ func getDetailsString(path string, size uint64, permissions uint16, isDir bool,
 	return fmt.Sprintf("%s %s %s", bits, sizeString, path)
 }
 
-func dumpVersionIndex(versionIndexPath string, showDetails bool) ([]storeStat, []timeStat, error) {
+func dumpVersionIndex(ctx context.Context, versionIndexPath string, showDetails bool) ([]storeStat, []timeStat, error) {
 	storeStats := []storeStat{}
 	timeStats := []timeStat{}
 
 	readSourceStartTime := time.Now()
-	vbuffer, err := longtailstorelib.ReadFromURI(versionIndexPath)
+	vbuffer, err := longtailstorelib.ReadFromURI(ctx, versionIndexPath)
 	if err != nil {
 		return storeStats, timeStats, err
 	}
@@ -1384,13 +1436,16 @@ func dumpVersionIndex(versionIndexPath string, showDetails bool) ([]storeStat, [
 }
 
 func cpVersionIndex(
+	ctx context.Context,
 	blobStoreURI string,
 	versionIndexPath string,
 	localCachePath *string,
 	targetBlockSize uint32,
 	maxChunksPerBlock uint32,
 	sourcePath string,
-	targetPath string) ([]storeStat, []timeStat, error) {
+	targetPath string,
+	maxDownloadRate int64,
+	maxUploadRate int64) ([]storeStat, []timeStat, error) {
 
 	storeStats := []storeStat{}
 	timeStats := []timeStat{}
@@ -1405,7 +1460,7 @@ func cpVersionIndex(
 	defer hashRegistry.Dispose()
 
 	// MaxBlockSize and MaxChunksPerBlock are just temporary values until we get the remote index settings
-	remoteIndexStore, err := createBlockStoreForURI(blobStoreURI, "", jobs, 8388608, 1024, longtailstorelib.ReadOnly)
+	remoteIndexStore, err := createBlockStoreForURI(ctx, blobStoreURI, "", jobs, 8388608, 1024, longtailstorelib.ReadOnly, maxDownloadRate, maxUploadRate)
 	if err != nil {
 		return storeStats, timeStats, err
 	}
@@ -1441,7 +1496,7 @@ func cpVersionIndex(
 	timeStats = append(timeStats, timeStat{"Setup", setupTime})
 
 	readSourceStartTime := time.Now()
-	vbuffer, err := longtailstorelib.ReadFromURI(versionIndexPath)
+	vbuffer, err := longtailstorelib.ReadFromURI(ctx, versionIndexPath)
 	if err != nil {
 		return storeStats, timeStats, err
 	}
@@ -1629,6 +1684,7 @@ func cpVersionIndex(
 }
 
 func initRemoteStore(
+	ctx context.Context,
 	blobStoreURI string,
 	hashAlgorithm *string) ([]storeStat, []timeStat, error) {
 
@@ -1640,7 +1696,7 @@ func initRemoteStore(
 	jobs := longtaillib.CreateBikeshedJobAPI(uint32(numWorkerCount), 0)
 	defer jobs.Dispose()
 
-	remoteIndexStore, err := createBlockStoreForURI(blobStoreURI, "", jobs, 8388608, 1024, longtailstorelib.Init)
+	remoteIndexStore, err := createBlockStoreForURI(ctx, blobStoreURI, "", jobs, 8388608, 1024, longtailstorelib.Init, 0, 0)
 	if err != nil {
 		return storeStats, timeStats, err
 	}
@@ -1679,10 +1735,16 @@ func initRemoteStore(
 		storeStats = append(storeStats, storeStat{"Remote", remoteStoreStats})
 	}
 
+	err = remoteIndexStore.Close()
+	if err != nil {
+		return storeStats, timeStats, errors.Wrapf(err, "initRemoteStore: remoteStore.Close: Failed for `%s` failed", blobStoreURI)
+	}
+
 	return storeStats, timeStats, nil
 }
 
 func lsVersionIndex(
+	ctx context.Context,
 	versionIndexPath string,
 	commandLSVersionDir *string) ([]storeStat, []timeStat, error) {
 	storeStats := []storeStat{}
@@ -1694,7 +1756,7 @@ func lsVersionIndex(
 	defer hashRegistry.Dispose()
 
 	readSourceStartTime := time.Now()
-	vbuffer, err := longtailstorelib.ReadFromURI(versionIndexPath)
+	vbuffer, err := longtailstorelib.ReadFromURI(ctx, versionIndexPath)
 	if err != nil {
 		return storeStats, timeStats, err
 	}
@@ -1773,6 +1835,7 @@ func lsVersionIndex(
 }
 
 func stats(
+	ctx context.Context,
 	blobStoreURI string,
 	versionIndexPath string,
 	localCachePath *string) ([]storeStat, []timeStat, error) {
@@ -1789,7 +1852,7 @@ func stats(
 
 	var indexStore longtaillib.Longtail_BlockStoreAPI
 
-	remoteIndexStore, err := createBlockStoreForURI(blobStoreURI, "", jobs, 8388608, 1024, longtailstorelib.ReadOnly)
+	remoteIndexStore, err := createBlockStoreForURI(ctx, blobStoreURI, "", jobs, 8388608, 1024, longtailstorelib.ReadOnly, 0, 0)
 	if err != nil {
 		return storeStats, timeStats, err
 	}
@@ -1819,7 +1882,7 @@ func stats(
 	timeStats = append(timeStats, timeStat{"Setup", setupTime})
 
 	readSourceStartTime := time.Now()
-	vbuffer, err := longtailstorelib.ReadFromURI(versionIndexPath)
+	vbuffer, err := longtailstorelib.ReadFromURI(ctx, versionIndexPath)
 	if err != nil {
 		return storeStats, timeStats, err
 	}
@@ -1978,6 +2041,7 @@ func stats(
 }
 
 func createVersionStoreIndex(
+	ctx context.Context,
 	blobStoreURI string,
 	sourceFilePath string,
 	versionLocalStoreIndexPath string) ([]storeStat, []timeStat, error) {
@@ -1989,7 +2053,7 @@ func createVersionStoreIndex(
 	jobs := longtaillib.CreateBikeshedJobAPI(uint32(numWorkerCount), 0)
 	defer jobs.Dispose()
 
-	indexStore, err := createBlockStoreForURI(blobStoreURI, "", jobs, 8388608, 1024, longtailstorelib.ReadOnly)
+	indexStore, err := createBlockStoreForURI(ctx, blobStoreURI, "", jobs, 8388608, 1024, longtailstorelib.ReadOnly, 0, 0)
 	if err != nil {
 		return storeStats, timeStats, err
 	}
@@ -1999,7 +2063,7 @@ func createVersionStoreIndex(
 	timeStats = append(timeStats, timeStat{"Setup", setupTime})
 
 	readSourceStartTime := time.Now()
-	vbuffer, err := longtailstorelib.ReadFromURI(sourceFilePath)
+	vbuffer, err := longtailstorelib.ReadFromURI(ctx, sourceFilePath)
 	if err != nil {
 		return storeStats, timeStats, err
 	}
@@ -2027,7 +2091,7 @@ func createVersionStoreIndex(
 	if errno != 0 {
 		return storeStats, timeStats, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "upSyncVersion: longtaillib.WriteStoreIndexToBuffer() failed")
 	}
-	err = longtailstorelib.WriteToURI(versionLocalStoreIndexPath, versionLocalStoreIndexBuffer)
+	err = longtailstorelib.WriteToURI(ctx, versionLocalStoreIndexPath, versionLocalStoreIndexBuffer)
 	if err != nil {
 		return storeStats, timeStats, errors.Wrapf(err, "upSyncVersion: longtaillib.longtailstorelib.WriteToURL() failed")
 	}
@@ -2037,7 +2101,201 @@ func createVersionStoreIndex(
 	return storeStats, timeStats, nil
 }
 
+// getKeptVersionIndexPaths returns versionIndexPaths and the version indexes found under versionIndexPrefix
+func getKeptVersionIndexPaths(ctx context.Context, command string, versionIndexPaths []string, versionIndexPrefix string) ([]string, error) {
+	if len(versionIndexPaths) == 0 && versionIndexPrefix == "" {
+		return nil, errors.Wrapf(longtaillib.ErrEINVAL, "%s: no versions to keep, give --version-index-path or --version-index-prefix", command)
+	}
+	if versionIndexPrefix == "" {
+		return versionIndexPaths, nil
+	}
+	prefixPaths, err := longtailstorelib.ListVersionIndexURIs(ctx, versionIndexPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(prefixPaths) == 0 {
+		return nil, errors.Wrapf(longtaillib.ErrENOENT, "%s: no version indexes found in `%s`", command, versionIndexPrefix)
+	}
+	return append(versionIndexPaths, prefixPaths...), nil
+}
+
+// createMaintenanceBlobStore returns the blob store for a remote store to prune, repack or scrub
+func createMaintenanceBlobStore(command string, blobStoreURI string, accessType longtailstorelib.AccessType) (longtailstorelib.BlobStore, error) {
+	blobStoreURL, err := url.Parse(blobStoreURI)
+	if err != nil || blobStoreURL.Scheme == "file" || !longtailstorelib.IsBlobStoreSchemeRegistered(blobStoreURL.Scheme) {
+		return nil, errors.Wrapf(longtaillib.ErrEINVAL, "%s: `%s` is not a remote store", command, blobStoreURI)
+	}
+	return longtailstorelib.CreateBlobStoreForURI(blobStoreURI, longtailstorelib.BlobStoreOptions{AccessType: accessType})
+}
+
+func pruneStore(
+	ctx context.Context,
+	blobStoreURI string,
+	versionIndexPaths []string,
+	versionIndexPrefix string,
+	gracePeriod time.Duration,
+	dryRun bool) ([]storeStat, []timeStat, error) {
+	storeStats := []storeStat{}
+	timeStats := []timeStat{}
+
+	setupStartTime := time.Now()
+	blobStore, err := createMaintenanceBlobStore("pruneStore", blobStoreURI, longtailstorelib.ReadWrite)
+	if err != nil {
+		return storeStats, timeStats, err
+	}
+	versionIndexPaths, err = getKeptVersionIndexPaths(ctx, "pruneStore", versionIndexPaths, versionIndexPrefix)
+	if err != nil {
+		return storeStats, timeStats, err
+	}
+	setupTime := time.Since(setupStartTime)
+	timeStats = append(timeStats, timeStat{"Setup", setupTime})
+
+	if gracePeriod == 0 {
+		gracePeriod = longtailstorelib.NoPruneGracePeriod
+	}
+	pruneStartTime := time.Now()
+	result, err := longtailstorelib.PruneStore(
+		ctx,
+		blobStore,
+		versionIndexPaths,
+		longtailstorelib.PruneOptions{
+			DryRun:      dryRun,
+			GracePeriod: gracePeriod,
+			WorkerCount: numWorkerCount,
+			RetryPolicy: getRetryPolicy()})
+	if err != nil {
+		return storeStats, timeStats, errors.Wrapf(err, "pruneStore: failed pruning `%s`", blobStoreURI)
+	}
+	pruneTime := time.Since(pruneStartTime)
+	timeStats = append(timeStats, timeStat{"Prune", pruneTime})
+
+	fmt.Printf("Versions kept:      %d\n", len(versionIndexPaths))
+	fmt.Printf("Blocks:             %d\n", result.BlockCount)
+	fmt.Printf("Referenced blocks:  %d\n", result.ReferencedBlockCount)
+	fmt.Printf("Recent blocks kept: %d\n", result.RecentBlockCount)
+	if dryRun {
+		fmt.Printf("Reclaimable blocks: %d (%s)\n", result.PrunedBlockCount, byteCountBinary(uint64(result.PrunedByteCount)))
+	} else {
+		fmt.Printf("Pruned blocks:      %d (%s)\n", result.PrunedBlockCount, byteCountBinary(uint64(result.PrunedByteCount)))
+	}
+	return storeStats, timeStats, nil
+}
+
+func repackStore(
+	ctx context.Context,
+	blobStoreURI string,
+	versionIndexPaths []string,
+	versionIndexPrefix string,
+	minBlockUsagePercent uint32,
+	targetBlockSize uint32,
+	maxChunksPerBlock uint32,
+	retireOldBlocks bool,
+	dryRun bool) ([]storeStat, []timeStat, error) {
+	storeStats := []storeStat{}
+	timeStats := []timeStat{}
+
+	setupStartTime := time.Now()
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(numWorkerCount), 0)
+	defer jobs.Dispose()
+
+	blobStore, err := createMaintenanceBlobStore("repackStore", blobStoreURI, longtailstorelib.ReadWrite)
+	if err != nil {
+		return storeStats, timeStats, err
+	}
+	versionIndexPaths, err = getKeptVersionIndexPaths(ctx, "repackStore", versionIndexPaths, versionIndexPrefix)
+	if err != nil {
+		return storeStats, timeStats, err
+	}
+	setupTime := time.Since(setupStartTime)
+	timeStats = append(timeStats, timeStat{"Setup", setupTime})
+
+	repackStartTime := time.Now()
+	result, err := longtailstorelib.RepackStore(
+		ctx,
+		jobs,
+		blobStore,
+		versionIndexPaths,
+		longtailstorelib.RepackOptions{
+			MinBlockUsagePercent: minBlockUsagePercent,
+			TargetBlockSize:      targetBlockSize,
+			MaxChunksPerBlock:    maxChunksPerBlock,
+			RetireOldBlocks:      retireOldBlocks,
+			DryRun:               dryRun,
+			WorkerCount:          numWorkerCount,
+			RetryPolicy:          getRetryPolicy()})
+	if err != nil {
+		return storeStats, timeStats, errors.Wrapf(err, "repackStore: failed repacking `%s`", blobStoreURI)
+	}
+	repackTime := time.Since(repackStartTime)
+	timeStats = append(timeStats, timeStat{"Repack", repackTime})
+
+	fmt.Printf("Versions kept:      %d\n", len(versionIndexPaths))
+	fmt.Printf("Referenced blocks:  %d\n", result.ReferencedBlockCount)
+	fmt.Printf("Sparse blocks:      %d (%s, %s used)\n", result.SparseBlockCount, byteCountBinary(uint64(result.SparseByteCount)), byteCountBinary(uint64(result.LiveByteCount)))
+	if !dryRun {
+		fmt.Printf("New blocks:         %d\n", result.NewBlockCount)
+		fmt.Printf("Retired blocks:     %d\n", result.RetiredBlockCount)
+	}
+	return storeStats, timeStats, nil
+}
+
+func scrubStore(
+	ctx context.Context,
+	blobStoreURI string,
+	quarantinePrefix string,
+	reportPath string) ([]storeStat, []timeStat, error) {
+	storeStats := []storeStat{}
+	timeStats := []timeStat{}
+
+	setupStartTime := time.Now()
+	accessType := longtailstorelib.ReadOnly
+	if quarantinePrefix != "" {
+		accessType = longtailstorelib.ReadWrite
+	}
+	blobStore, err := createMaintenanceBlobStore("scrubStore", blobStoreURI, accessType)
+	if err != nil {
+		return storeStats, timeStats, err
+	}
+	setupTime := time.Since(setupStartTime)
+	timeStats = append(timeStats, timeStat{"Setup", setupTime})
+
+	scrubStartTime := time.Now()
+	report, err := longtailstorelib.ScrubStore(
+		ctx,
+		blobStore,
+		longtailstorelib.ScrubOptions{
+			QuarantinePrefix: quarantinePrefix,
+			WorkerCount:      numWorkerCount,
+			RetryPolicy:      getRetryPolicy()})
+	if err != nil {
+		return storeStats, timeStats, errors.Wrapf(err, "scrubStore: failed scrubbing `%s`", blobStoreURI)
+	}
+	scrubTime := time.Since(scrubStartTime)
+	timeStats = append(timeStats, timeStat{"Scrub", scrubTime})
+
+	reportJSON, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return storeStats, timeStats, errors.Wrap(err, "scrubStore: json.MarshalIndent() failed")
+	}
+	if reportPath == "" {
+		fmt.Printf("%s\n", reportJSON)
+	} else {
+		err = longtailstorelib.WriteToURI(ctx, reportPath, reportJSON)
+		if err != nil {
+			return storeStats, timeStats, errors.Wrapf(err, "scrubStore: failed writing report to `%s`", reportPath)
+		}
+		fmt.Printf("Blocks:          %d\n", report.BlockCount)
+		fmt.Printf("Verified blocks: %d\n", report.VerifiedBlockCount)
+		fmt.Printf("Bad blocks:      %d\n", len(report.BadBlocks))
+	}
+	if len(report.BadBlocks) > 0 {
+		return storeStats, timeStats, errors.Wrapf(longtaillib.ErrEBADF, "scrubStore: found %d bad blocks in `%s`", len(report.BadBlocks), blobStoreURI)
+	}
+	return storeStats, timeStats, nil
+}
+
 func cloneStore(
+	ctx context.Context,
 	sourceStoreURI string,
 	targetStoreURI string,
 	localCachePath string,
@@ -2051,7 +2309,9 @@ func cloneStore(
 	createVersionLocalStoreIndex bool,
 	hashing string,
 	compression string,
-	minBlockUsagePercent uint32) ([]storeStat, []timeStat, error) {
+	minBlockUsagePercent uint32,
+	maxDownloadRate int64,
+	maxUploadRate int64) ([]storeStat, []timeStat, error) {
 
 	storeStats := []storeStat{}
 	timeStats := []timeStat{}
@@ -2071,7 +2331,7 @@ func cloneStore(
 	localFS := longtaillib.CreateFSStorageAPI()
 	defer localFS.Dispose()
 
-	sourceRemoteIndexStore, err := createBlockStoreForURI(sourceStoreURI, "", jobs, 8388608, 1024, longtailstorelib.ReadOnly)
+	sourceRemoteIndexStore, err := createBlockStoreForURI(ctx, sourceStoreURI, "", jobs, 8388608, 1024, longtailstorelib.ReadOnly, maxDownloadRate, maxUploadRate)
 	if err != nil {
 		return storeStats, timeStats, err
 	}
@@ -2099,7 +2359,7 @@ func cloneStore(
 	sourceStore := longtaillib.CreateShareBlockStore(sourceLRUBlockStore)
 	defer sourceStore.Dispose()
 
-	targetRemoteStore, err := createBlockStoreForURI(targetStoreURI, "", jobs, targetBlockSize, maxChunksPerBlock, longtailstorelib.ReadWrite)
+	targetRemoteStore, err := createBlockStoreForURI(ctx, targetStoreURI, "", jobs, targetBlockSize, maxChunksPerBlock, longtailstorelib.ReadWrite, maxDownloadRate, maxUploadRate)
 	if err != nil {
 		return storeStats, timeStats, err
 	}
@@ -2145,7 +2405,7 @@ func cloneStore(
 		sourceFileZipPath := sourcesZipScanner.Text()
 		targetFilePath := targetsScanner.Text()
 
-		tbuffer, err := longtailstorelib.ReadFromURI(targetFilePath)
+		tbuffer, err := longtailstorelib.ReadFromURI(ctx, targetFilePath)
 		if err == nil {
 			fmt.Printf("Validating `%s` as `%s`\n", sourceFilePath, targetFilePath)
 			targetVersionIndex, errno := longtaillib.ReadVersionIndexFromBuffer(tbuffer)
@@ -2169,7 +2429,7 @@ func cloneStore(
 
 		fmt.Printf("`%s` -> `%s`\n", sourceFilePath, targetFilePath)
 
-		vbuffer, err := longtailstorelib.ReadFromURI(sourceFilePath)
+		vbuffer, err := longtailstorelib.ReadFromURI(ctx, sourceFilePath)
 		if err != nil {
 			fileInfos, _, _ := targetFolderScanner.get()
 			fileInfos.Dispose()
@@ -2186,7 +2446,7 @@ func cloneStore(
 		targetChunkSize := sourceVersionIndex.GetTargetChunkSize()
 
 		targetIndexReader := asyncVersionIndexReader{}
-		targetIndexReader.read(targetPath,
+		targetIndexReader.read(ctx, targetPath,
 			nil,
 			targetChunkSize,
 			noCompressionType,
@@ -2230,7 +2490,8 @@ func cloneStore(
 		}
 
 		changeVersionProgress := CreateProgress("Updating version")
-		errno = longtaillib.ChangeVersion(
+		err = longtaillib.ChangeVersionWithContext(
+			ctx,
 			sourceStore,
 			fs,
 			hash,
@@ -2245,10 +2506,14 @@ func cloneStore(
 		changeVersionProgress.Dispose()
 		existingStoreIndex.Dispose()
 		targetVersionIndex.Dispose()
-		if errno != 0 {
+		if err != nil && ctx.Err() != nil {
+			sourceVersionIndex.Dispose()
+			return storeStats, timeStats, errors.Wrapf(err, "cloneStore: longtaillib.ChangeVersion() failed")
+		}
+		if err != nil {
 			fmt.Printf("Falling back to reading ZIP source from `%s`\n", sourceFileZipPath)
 			sourceVersionIndex.Dispose()
-			zipBytes, err := longtailstorelib.ReadFromURI(sourceFileZipPath)
+			zipBytes, err := longtailstorelib.ReadFromURI(ctx, sourceFileZipPath)
 			if err != nil {
 				sourceVersionIndex.Dispose()
 				continue
@@ -2382,7 +2647,8 @@ func cloneStore(
 		if versionMissingStoreIndex.GetBlockCount() > 0 {
 			writeContentProgress := CreateProgress("Writing content blocks")
 
-			errno = longtaillib.WriteContent(
+			err = longtaillib.WriteContentWithContext(
+				ctx,
 				fs,
 				targetStore,
 				jobs,
@@ -2391,11 +2657,11 @@ func cloneStore(
 				sourceVersionIndex,
 				normalizePath(targetPath))
 			writeContentProgress.Dispose()
-			if errno != 0 {
+			if err != nil {
 				versionMissingStoreIndex.Dispose()
 				existingStoreIndex.Dispose()
 				sourceVersionIndex.Dispose()
-				return storeStats, timeStats, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "cloneStore: longtaillib.WriteContent() failed")
+				return storeStats, timeStats, errors.Wrapf(err, "cloneStore: longtaillib.WriteContent() failed")
 			}
 		}
 
@@ -2419,7 +2685,7 @@ func cloneStore(
 			return storeStats, timeStats, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "cloneStore: indexStore.Flush: Failed for `%s` failed", sourceStoreURI)
 		}
 
-		err = longtailstorelib.WriteToURI(targetFilePath, vbuffer)
+		err = longtailstorelib.WriteToURI(ctx, targetFilePath, vbuffer)
 		if err != nil {
 			versionMissingStoreIndex.Dispose()
 			existingStoreIndex.Dispose()
@@ -2444,7 +2710,7 @@ func cloneStore(
 				return storeStats, timeStats, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "cloneStore: longtaillib.WriteStoreIndexToBuffer() failed")
 			}
 			versionLocalStoreIndexPath := strings.Replace(targetFilePath, ".lvi", ".lsi", -1) // TODO: This should use a file with path names instead of this rename hack!
-			err = longtailstorelib.WriteToURI(versionLocalStoreIndexPath, versionLocalStoreIndexBuffer)
+			err = longtailstorelib.WriteToURI(ctx, versionLocalStoreIndexPath, versionLocalStoreIndexBuffer)
 			if err != nil {
 				versionMissingStoreIndex.Dispose()
 				existingStoreIndex.Dispose()
@@ -2477,22 +2743,31 @@ func cloneStore(
 		log.Fatal(err)
 	}
 
+	targetStore.Dispose()
+	err = targetRemoteStore.Close()
+	if err != nil {
+		return storeStats, timeStats, errors.Wrapf(err, "cloneStore: targetRemoteStore.Close: Failed for `%s` failed", targetStoreURI)
+	}
+
 	return storeStats, timeStats, nil
 }
 
 var (
-	logLevel           = kingpin.Flag("log-level", "Log level").Default("warn").Enum("debug", "info", "warn", "error")
-	showStats          = kingpin.Flag("show-stats", "Output brief stats summary").Bool()
-	showStoreStats     = kingpin.Flag("show-store-stats", "Output detailed stats for block stores").Bool()
-	includeFilterRegEx = kingpin.Flag("include-filter-regex", "Optional include regex filter for assets in --source-path on upsync and --target-path on downsync. Separate regexes with **").String()
-	excludeFilterRegEx = kingpin.Flag("exclude-filter-regex", "Optional exclude regex filter for assets in --source-path on upsync and --target-path on downsync. Separate regexes with **").String()
-	memTrace           = kingpin.Flag("mem-trace", "Output summary memory statistics from longtail").Bool()
-	memTraceDetailed   = kingpin.Flag("mem-trace-detailed", "Output detailed memory statistics from longtail").Bool()
-	memTraceCSV        = kingpin.Flag("mem-trace-csv", "Output path for detailed memory statistics from longtail in csv format").String()
-	workerCount        = kingpin.Flag("worker-count", "Limit number of workers created, defaults to match number of logical CPUs").Int()
+	logLevel             = kingpin.Flag("log-level", "Log level").Default("warn").Enum("debug", "info", "warn", "error")
+	showStats            = kingpin.Flag("show-stats", "Output brief stats summary").Bool()
+	showStoreStats       = kingpin.Flag("show-store-stats", "Output detailed stats for block stores").Bool()
+	includeFilterRegEx   = kingpin.Flag("include-filter-regex", "Optional include regex filter for assets in --source-path on upsync and --target-path on downsync. Separate regexes with **").String()
+	excludeFilterRegEx   = kingpin.Flag("exclude-filter-regex", "Optional exclude regex filter for assets in --source-path on upsync and --target-path on downsync. Separate regexes with **").String()
+	memTrace             = kingpin.Flag("mem-trace", "Output summary memory statistics from longtail").Bool()
+	memTraceDetailed     = kingpin.Flag("mem-trace-detailed", "Output detailed memory statistics from longtail").Bool()
+	memTraceCSV          = kingpin.Flag("mem-trace-csv", "Output path for detailed memory statistics from longtail in csv format").String()
+	workerCount          = kingpin.Flag("worker-count", "Limit number of workers created, defaults to match number of logical CPUs").Int()
+	maxRetryAttempts     = kingpin.Flag("max-retry-attempts", "Maximum number of attempts for each remote storage request").Default("5").Int()
+	maxRetryTime         = kingpin.Flag("max-retry-time", "Stop retrying a remote storage request after this long").Default("1m").Duration()
+	storeIndexDeltaLimit = kingpin.Flag("store-index-delta-limit", "Number of store index deltas kept before they are compacted into store.lsi, clients that only read store.lsi do not see blocks in deltas").Default("1").Int()
 
 	commandUpsync           = kingpin.Command("upsync", "Upload a folder")
-	commandUpsyncStorageURI = commandUpsync.Flag("storage-uri", "Storage URI (only local file system and GCS bucket URI supported)").Required().String()
+	commandUpsyncStorageURI = commandUpsync.Flag("storage-uri", "Storage URI (local file system, GCS, S3 and Azure URI supported)").Required().String()
 	commandUpsyncHashing    = commandUpsync.Flag("hash-algorithm", "upsync hash algorithm: blake2, blake3, meow").
 				Default("blake3").
 				Enum("meow", "blake2", "blake3")
@@ -2518,9 +2793,11 @@ var (
 			"zstd_max")
 	commandUpsyncMinBlockUsagePercent       = commandUpsync.Flag("min-block-usage-percent", "Minimum percent of block content than must match for it to be considered \"existing\". Default is zero = use all").Default("0").Uint32()
 	commandUpsyncVersionLocalStoreIndexPath = commandUpsync.Flag("version-local-store-index-path", "Generate an store index optimized for this particular version").String()
+	commandUpsyncMaxDownloadRate            = commandUpsync.Flag("max-download-rate", "Maximum rate in bytes per second for reading blocks from a remote store, zero means unlimited").Default("0").Int64()
+	commandUpsyncMaxUploadRate              = commandUpsync.Flag("max-upload-rate", "Maximum rate in bytes per second for writing blocks to a remote store, zero means unlimited").Default("0").Int64()
 
 	commandDownsync                           = kingpin.Command("downsync", "Download a folder")
-	commandDownsyncStorageURI                 = commandDownsync.Flag("storage-uri", "Storage URI (only local file system and GCS bucket URI supported)").Required().String()
+	commandDownsyncStorageURI                 = commandDownsync.Flag("storage-uri", "Storage URI (local file system, GCS, S3 and Azure URI supported)").Required().String()
 	commandDownsyncCachePath                  = commandDownsync.Flag("cache-path", "Location for cached blocks").String()
 	commandDownsyncTargetPath                 = commandDownsync.Flag("target-path", "Target folder path").Required().String()
 	commandDownsyncTargetIndexPath            = commandDownsync.Flag("target-index-path", "Optional pre-computed index of target-path").String()
@@ -2530,9 +2807,11 @@ var (
 	commandDownsyncNoRetainPermissions        = commandDownsync.Flag("no-retain-permissions", "Disable setting permission on file/directories from source").Bool()
 	commandDownsyncValidate                   = commandDownsync.Flag("validate", "Validate target path once completed").Bool()
 	commandDownsyncVersionLocalStoreIndexPath = commandDownsync.Flag("version-local-store-index-path", "Path to an optimized store index for this particular version. If the file can't be read it will fall back to the master store index").String()
+	commandDownsyncMaxDownloadRate            = commandDownsync.Flag("max-download-rate", "Maximum rate in bytes per second for reading blocks from a remote store, zero means unlimited").Default("0").Int64()
+	commandDownsyncMaxUploadRate              = commandDownsync.Flag("max-upload-rate", "Maximum rate in bytes per second for writing blocks to a remote store, zero means unlimited").Default("0").Int64()
 
 	commandValidate                         = kingpin.Command("validate", "Validate a version index against a content store")
-	commandValidateStorageURI               = commandValidate.Flag("storage-uri", "Storage URI (only local file system and GCS bucket URI supported)").Required().String()
+	commandValidateStorageURI               = commandValidate.Flag("storage-uri", "Storage URI (local file system, GCS, S3 and Azure URI supported)").Required().String()
 	commandValidateVersionIndexPath         = commandValidate.Flag("version-index-path", "Path to a version index file").Required().String()
 	commandValidateVersionTargetBlockSize   = commandValidate.Flag("target-block-size", "Target block size").Default("8388608").Uint32()
 	commandValidateVersionMaxChunksPerBlock = commandValidate.Flag("max-chunks-per-block", "Max chunks per block").Default("1024").Uint32()
@@ -2555,32 +2834,56 @@ var (
 
 	commandCPVersion           = kingpin.Command("cp", "list the content of a path inside a version index")
 	commandCPVersionIndexPath  = commandCPVersion.Flag("version-index-path", "Path to a version index file").Required().String()
-	commandCPStorageURI        = commandCPVersion.Flag("storage-uri", "Storage URI (only local file system and GCS bucket URI supported)").Required().String()
+	commandCPStorageURI        = commandCPVersion.Flag("storage-uri", "Storage URI (local file system, GCS, S3 and Azure URI supported)").Required().String()
 	commandCPCachePath         = commandCPVersion.Flag("cache-path", "Location for cached blocks").String()
 	commandCPSourcePath        = commandCPVersion.Arg("source path", "source path inside the version index to list").String()
 	commandCPTargetPath        = commandCPVersion.Arg("target path", "target uri path").String()
 	commandCPTargetBlockSize   = commandCPVersion.Flag("target-block-size", "Target block size").Default("8388608").Uint32()
 	commandCPMaxChunksPerBlock = commandCPVersion.Flag("max-chunks-per-block", "Max chunks per block").Default("1024").Uint32()
+	commandCPMaxDownloadRate   = commandCPVersion.Flag("max-download-rate", "Maximum rate in bytes per second for reading blocks from a remote store, zero means unlimited").Default("0").Int64()
+	commandCPMaxUploadRate     = commandCPVersion.Flag("max-upload-rate", "Maximum rate in bytes per second for writing blocks to a remote store, zero means unlimited").Default("0").Int64()
 
 	commandInitRemoteStore           = kingpin.Command("init", "open/create a remote store and force rebuild the store index")
-	commandInitRemoteStoreStorageURI = commandInitRemoteStore.Flag("storage-uri", "Storage URI (only local file system and GCS bucket URI supported)").Required().String()
+	commandInitRemoteStoreStorageURI = commandInitRemoteStore.Flag("storage-uri", "Storage URI (local file system, GCS, S3 and Azure URI supported)").Required().String()
 	commandInitRemoteStoreHashing    = commandInitRemoteStore.Flag("hash-algorithm", "upsync hash algorithm: blake2, blake3, meow").
 						Default("blake3").
 						Enum("meow", "blake2", "blake3")
 
 	commandStats                 = kingpin.Command("stats", "Show fragmenation stats about a version index")
-	commandStatsStorageURI       = commandStats.Flag("storage-uri", "Storage URI (only local file system and GCS bucket URI supported)").Required().String()
+	commandStatsStorageURI       = commandStats.Flag("storage-uri", "Storage URI (local file system, GCS, S3 and Azure URI supported)").Required().String()
 	commandStatsVersionIndexPath = commandStats.Flag("version-index-path", "Path to a version index file").Required().String()
 	commandStatsCachePath        = commandStats.Flag("cache-path", "Location for cached blocks").String()
 
 	commandCreateVersionStoreIndex           = kingpin.Command("createVersionStoreIndex", "Create a store index optimized for a version index")
-	commandCreateVersionStoreIndexStorageURI = commandCreateVersionStoreIndex.Flag("storage-uri", "Storage URI (only local file system and GCS bucket URI supported)").Required().String()
+	commandCreateVersionStoreIndexStorageURI = commandCreateVersionStoreIndex.Flag("storage-uri", "Storage URI (local file system, GCS, S3 and Azure URI supported)").Required().String()
 	commandCreateVersionStoreIndexSourcePath = commandCreateVersionStoreIndex.Flag("source-path", "Source file uri").Required().String()
 	commandCreateVersionStoreIndexPath       = commandCreateVersionStoreIndex.Flag("version-local-store-index-path", "Generate an store index optimized for this particular version").String()
 
+	commandPrune                   = kingpin.Command("prune", "Remove the blocks in a store that are not used by a set of versions")
+	commandPruneStorageURI         = commandPrune.Flag("storage-uri", "Storage URI (GCS, S3, Azure and fsblob URI supported)").Required().String()
+	commandPruneVersionIndexPaths  = commandPrune.Flag("version-index-path", "Version index uri of a version to keep, repeat to keep several").Strings()
+	commandPruneVersionIndexPrefix = commandPrune.Flag("version-index-prefix", "Keep all version indexes found under this uri").String()
+	commandPruneGracePeriod        = commandPrune.Flag("grace-period", "Keep unused blocks written more recently than this, they may belong to an upload in progress").Default("24h").Duration()
+	commandPruneDryRun             = commandPrune.Flag("dry-run", "Show what would be removed without changing the store").Bool()
+
+	commandRepack                     = kingpin.Command("repack", "Rewrite the chunks a set of versions use in sparsely used blocks into new blocks")
+	commandRepackStorageURI           = commandRepack.Flag("storage-uri", "Storage URI (GCS, S3, Azure and fsblob URI supported)").Required().String()
+	commandRepackVersionIndexPaths    = commandRepack.Flag("version-index-path", "Version index uri of a version to keep, repeat to keep several").Strings()
+	commandRepackVersionIndexPrefix   = commandRepack.Flag("version-index-prefix", "Keep all version indexes found under this uri").String()
+	commandRepackMinBlockUsagePercent = commandRepack.Flag("min-block-usage-percent", "Repack blocks where the kept versions use less than this percent of the content").Default("50").Uint32()
+	commandRepackTargetBlockSize      = commandRepack.Flag("target-block-size", "Target block size").Default("8388608").Uint32()
+	commandRepackMaxChunksPerBlock    = commandRepack.Flag("max-chunks-per-block", "Max chunks per block").Default("1024").Uint32()
+	commandRepackRetireOldBlocks      = commandRepack.Flag("retire-old-blocks", "Delete the repacked blocks from the store").Bool()
+	commandRepackDryRun               = commandRepack.Flag("dry-run", "Show what would be repacked without changing the store").Bool()
+
+	commandScrub                 = kingpin.Command("scrub", "Download and verify every block in a store")
+	commandScrubStorageURI       = commandScrub.Flag("storage-uri", "Storage URI (GCS, S3, Azure and fsblob URI supported)").Required().String()
+	commandScrubQuarantinePrefix = commandScrub.Flag("quarantine-prefix", "Move bad blocks under this prefix in the store and remove them from the store index").String()
+	commandScrubReportPath       = commandScrub.Flag("report-path", "Write the JSON report to this uri instead of stdout").String()
+
 	commandCloneStore                             = kingpin.Command("cloneStore", "Clone all the data needed to cover a set of versions from one store into a new store")
-	commandCloneStoreSourceStoreURI               = commandCloneStore.Flag("source-storage-uri", "Source storage URI (only local file system and GCS bucket URI supported)").Required().String()
-	commandCloneStoreTargetStoreURI               = commandCloneStore.Flag("target-storage-uri", "Target storage URI (only local file system and GCS bucket URI supported)").Required().String()
+	commandCloneStoreSourceStoreURI               = commandCloneStore.Flag("source-storage-uri", "Source storage URI (local file system, GCS, S3 and Azure URI supported)").Required().String()
+	commandCloneStoreTargetStoreURI               = commandCloneStore.Flag("target-storage-uri", "Target storage URI (local file system, GCS, S3 and Azure URI supported)").Required().String()
 	ommandCloneStoreCachePath                     = commandCloneStore.Flag("cache-path", "Location for cached blocks").String()
 	commandCloneStoreTargetPath                   = commandCloneStore.Flag("target-path", "Target folder path").Required().String()
 	commandCloneStoreSourcePaths                  = commandCloneStore.Flag("source-paths", "File containing list of source longtail uris").Required().String()
@@ -2608,6 +2911,8 @@ var (
 			"zstd_min",
 			"zstd_max")
 	commandCloneStoreMinBlockUsagePercent = commandCloneStore.Flag("min-block-usage-percent", "Minimum percent of block content than must match for it to be considered \"existing\". Default is zero = use all").Default("0").Uint32()
+	commandCloneStoreMaxDownloadRate      = commandCloneStore.Flag("max-download-rate", "Maximum rate in bytes per second for reading blocks from a remote store, zero means unlimited").Default("0").Int64()
+	commandCloneStoreMaxUploadRate        = commandCloneStore.Flag("max-upload-rate", "Maximum rate in bytes per second for writing blocks to a remote store, zero means unlimited").Default("0").Int64()
 )
 
 func main() {
@@ -2625,6 +2930,15 @@ func main() {
 			for _, s := range commandStoreStat {
 				printStats(s.name, s.stats)
 			}
+			for _, tiered := range tieredBlobStores {
+				printTierStats(tiered.GetTierStats())
+			}
+			for _, remoteBlockStore := range remoteBlockStores {
+				stats, errno := remoteBlockStore.GetStats()
+				if errno == 0 {
+					printRemoteStoreStats(stats)
+				}
+			}
 		}
 
 		if *showStats {
@@ -2685,11 +2999,25 @@ func main() {
 		numWorkerCount = *workerCount
 	}
 
+	// The first interrupt cancels outstanding store requests so the command can stop
+	// cleanly, a second interrupt terminates the process as usual
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		signal.Stop(interrupt)
+		log.Printf("Interrupted, cancelling store requests")
+		cancel()
+	}()
+
 	initTime := time.Since(initStartTime)
 
 	switch p {
 	case commandUpsync.FullCommand():
 		commandStoreStat, commandTimeStat, err = upSyncVersion(
+			ctx,
 			*commandUpsyncStorageURI,
 			*commandUpsyncSourcePath,
 			commandUpsyncSourceIndexPath,
@@ -2702,9 +3030,12 @@ func main() {
 			includeFilterRegEx,
 			excludeFilterRegEx,
 			*commandUpsyncMinBlockUsagePercent,
-			commandUpsyncVersionLocalStoreIndexPath)
+			commandUpsyncVersionLocalStoreIndexPath,
+			*commandUpsyncMaxDownloadRate,
+			*commandUpsyncMaxUploadRate)
 	case commandDownsync.FullCommand():
 		commandStoreStat, commandTimeStat, err = downSyncVersion(
+			ctx,
 			*commandDownsyncStorageURI,
 			*commandDownsyncSourcePath,
 			*commandDownsyncTargetPath,
@@ -2716,46 +3047,81 @@ func main() {
 			*commandDownsyncValidate,
 			commandDownsyncVersionLocalStoreIndexPath,
 			includeFilterRegEx,
-			excludeFilterRegEx)
+			excludeFilterRegEx,
+			*commandDownsyncMaxDownloadRate,
+			*commandDownsyncMaxUploadRate)
 	case commandValidate.FullCommand():
 		commandStoreStat, commandTimeStat, err = validateVersion(
+			ctx,
 			*commandValidateStorageURI,
 			*commandValidateVersionIndexPath,
 			*commandValidateVersionTargetBlockSize,
 			*commandValidateVersionMaxChunksPerBlock)
 	case commandPrintVersionIndex.FullCommand():
-		commandStoreStat, commandTimeStat, err = showVersionIndex(*commandPrintVersionIndexPath, *commandPrintVersionIndexCompact)
+		commandStoreStat, commandTimeStat, err = showVersionIndex(ctx, *commandPrintVersionIndexPath, *commandPrintVersionIndexCompact)
 	case commandPrintStoreIndex.FullCommand():
-		commandStoreStat, commandTimeStat, err = showStoreIndex(*commandPrintStoreIndexPath, *commandPrintStoreIndexCompact)
+		commandStoreStat, commandTimeStat, err = showStoreIndex(ctx, *commandPrintStoreIndexPath, *commandPrintStoreIndexCompact)
 	case commandDump.FullCommand():
-		commandStoreStat, commandTimeStat, err = dumpVersionIndex(*commandDumpVersionIndexPath, *commandDumpDetails)
+		commandStoreStat, commandTimeStat, err = dumpVersionIndex(ctx, *commandDumpVersionIndexPath, *commandDumpDetails)
 	case commandLSVersion.FullCommand():
-		commandStoreStat, commandTimeStat, err = lsVersionIndex(*commandLSVersionIndexPath, commandLSVersionDir)
+		commandStoreStat, commandTimeStat, err = lsVersionIndex(ctx, *commandLSVersionIndexPath, commandLSVersionDir)
 	case commandCPVersion.FullCommand():
 		commandStoreStat, commandTimeStat, err = cpVersionIndex(
+			ctx,
 			*commandCPStorageURI,
 			*commandCPVersionIndexPath,
 			commandCPCachePath,
 			*commandCPTargetBlockSize,
 			*commandCPMaxChunksPerBlock,
 			*commandCPSourcePath,
-			*commandCPTargetPath)
+			*commandCPTargetPath,
+			*commandCPMaxDownloadRate,
+			*commandCPMaxUploadRate)
 	case commandInitRemoteStore.FullCommand():
 		commandStoreStat, commandTimeStat, err = initRemoteStore(
+			ctx,
 			*commandInitRemoteStoreStorageURI,
 			commandInitRemoteStoreHashing)
 	case commandStats.FullCommand():
 		commandStoreStat, commandTimeStat, err = stats(
+			ctx,
 			*commandStatsStorageURI,
 			*commandStatsVersionIndexPath,
 			commandStatsCachePath)
 	case commandCreateVersionStoreIndex.FullCommand():
 		commandStoreStat, commandTimeStat, err = createVersionStoreIndex(
+			ctx,
 			*commandCreateVersionStoreIndexStorageURI,
 			*commandCreateVersionStoreIndexSourcePath,
 			*commandCreateVersionStoreIndexPath)
+	case commandPrune.FullCommand():
+		commandStoreStat, commandTimeStat, err = pruneStore(
+			ctx,
+			*commandPruneStorageURI,
+			*commandPruneVersionIndexPaths,
+			*commandPruneVersionIndexPrefix,
+			*commandPruneGracePeriod,
+			*commandPruneDryRun)
+	case commandRepack.FullCommand():
+		commandStoreStat, commandTimeStat, err = repackStore(
+			ctx,
+			*commandRepackStorageURI,
+			*commandRepackVersionIndexPaths,
+			*commandRepackVersionIndexPrefix,
+			*commandRepackMinBlockUsagePercent,
+			*commandRepackTargetBlockSize,
+			*commandRepackMaxChunksPerBlock,
+			*commandRepackRetireOldBlocks,
+			*commandRepackDryRun)
+	case commandScrub.FullCommand():
+		commandStoreStat, commandTimeStat, err = scrubStore(
+			ctx,
+			*commandScrubStorageURI,
+			*commandScrubQuarantinePrefix,
+			*commandScrubReportPath)
 	case commandCloneStore.FullCommand():
 		commandStoreStat, commandTimeStat, err = cloneStore(
+			ctx,
 			*commandCloneStoreSourceStoreURI,
 			*commandCloneStoreTargetStoreURI,
 			*ommandCloneStoreCachePath,
@@ -2769,7 +3135,9 @@ func main() {
 			*commandCloneStoreCreateVersionLocalStoreIndex,
 			*commandCloneStoreHashing,
 			*commandCloneStoreCompression,
-			*commandCloneStoreMinBlockUsagePercent)
+			*commandCloneStoreMinBlockUsagePercent,
+			*commandCloneStoreMaxDownloadRate,
+			*commandCloneStoreMaxUploadRate)
 	}
 
 	commandTimeStat = append([]timeStat{{"Init", initTime}}, commandTimeStat...)
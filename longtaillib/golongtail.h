@@ -2,6 +2,7 @@
     #define _GNU_SOURCE
 #endif
 #include "longtail/include/src/longtail.h"
+#include "longtail/include/lib/atomiccancel/longtail_atomiccancel.h"
 #include "longtail/include/lib/bikeshed/longtail_bikeshed.h"
 #include "longtail/include/lib/blake2/longtail_blake2.h"
 #include "longtail/include/lib/blake3/longtail_blake3.h"
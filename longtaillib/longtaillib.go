@@ -4,8 +4,11 @@ package longtaillib
 // #include "golongtail.h"
 import "C"
 import (
+	"context"
 	"errors"
+	"log"
 	"reflect"
+	"sync"
 	"sync/atomic"
 	"unsafe"
 )
@@ -304,9 +307,21 @@ const (
 	Longtail_BlockStoreAPI_StatU64_Flush_FailCount = 17
 
 	Longtail_BlockStoreAPI_StatU64_GetStats_Count = 18
-	Longtail_BlockStoreAPI_StatU64_Count          = 19
+
+	// The store index update and checksum stats are only kept by block stores implemented in Go, they are
+	// not part of the native stats and do not pass through native block stores
+	Longtail_BlockStoreAPI_StatU64_UpdateStoreIndex_Count      = 19
+	Longtail_BlockStoreAPI_StatU64_UpdateStoreIndex_RetryCount = 20
+	Longtail_BlockStoreAPI_StatU64_UpdateStoreIndex_FailCount  = 21
+
+	Longtail_BlockStoreAPI_StatU64_ChecksumMismatch_RetryCount = 22
+
+	Longtail_BlockStoreAPI_StatU64_Count = 23
 )
 
+// nativeBlockStoreStatU64Count is the number of stats in the native struct Longtail_BlockStore_Stats
+const nativeBlockStoreStatU64Count = Longtail_BlockStoreAPI_StatU64_GetStats_Count + 1
+
 type BlockStoreStats struct {
 	StatU64 [Longtail_BlockStoreAPI_StatU64_Count]uint64
 }
@@ -318,7 +333,7 @@ type BlockStoreAPI interface {
 	GetExistingContent(chunkHashes []uint64, minBlockUsagePercent uint32, asyncCompleteAPI Longtail_AsyncGetExistingContentAPI) int
 	GetStats() (BlockStoreStats, int)
 	Flush(asyncCompleteAPI Longtail_AsyncFlushAPI) int
-	Close()
+	Close() error
 }
 
 type Longtail_FileInfos struct {
@@ -349,6 +364,14 @@ type Longtail_JobAPI struct {
 	cJobAPI *C.struct_Longtail_JobAPI
 }
 
+type Longtail_CancelAPI struct {
+	cCancelAPI *C.struct_Longtail_CancelAPI
+}
+
+type Longtail_CancelAPI_HCancelToken struct {
+	cCancelToken C.Longtail_CancelAPI_HCancelToken
+}
+
 type Longtail_CompressionRegistryAPI struct {
 	cCompressionRegistryAPI *C.struct_Longtail_CompressionRegistryAPI
 }
@@ -638,6 +661,17 @@ func (hashAPI *Longtail_HashAPI) GetIdentifier() uint32 {
 	return uint32(C.Longtail_Hash_GetIdentifier(hashAPI.cHashAPI))
 }
 
+// HashBuffer returns the hash of data
+func (hashAPI *Longtail_HashAPI) HashBuffer(data []byte) (uint64, int) {
+	cData := unsafe.Pointer(nil)
+	if len(data) > 0 {
+		cData = unsafe.Pointer(&data[0])
+	}
+	var hash C.uint64_t
+	errno := C.Longtail_Hash_HashBuffer(hashAPI.cHashAPI, C.uint32_t(len(data)), cData, &hash)
+	return uint64(hash), int(errno)
+}
+
 func (storeIndex *Longtail_StoreIndex) Copy() (Longtail_StoreIndex, error) {
 	if storeIndex.cStoreIndex == nil {
 		return Longtail_StoreIndex{}, nil
@@ -686,6 +720,30 @@ func (storeIndex *Longtail_StoreIndex) GetChunkHashes() []uint64 {
 	return carray2slice64(storeIndex.cStoreIndex.m_ChunkHashes, size)
 }
 
+// GetBlockChunksOffsets returns the offset of the first chunk of each block in GetChunkHashes() and GetChunkSizes()
+func (storeIndex *Longtail_StoreIndex) GetBlockChunksOffsets() []uint32 {
+	size := int(*storeIndex.cStoreIndex.m_BlockCount)
+	return carray2slice32(storeIndex.cStoreIndex.m_BlockChunksOffsets, size)
+}
+
+// GetBlockChunkCounts returns the number of chunks in each block
+func (storeIndex *Longtail_StoreIndex) GetBlockChunkCounts() []uint32 {
+	size := int(*storeIndex.cStoreIndex.m_BlockCount)
+	return carray2slice32(storeIndex.cStoreIndex.m_BlockChunkCounts, size)
+}
+
+// GetBlockTags returns the tag of each block
+func (storeIndex *Longtail_StoreIndex) GetBlockTags() []uint32 {
+	size := int(*storeIndex.cStoreIndex.m_BlockCount)
+	return carray2slice32(storeIndex.cStoreIndex.m_BlockTags, size)
+}
+
+// GetChunkSizes returns the size of each chunk, in the same order as GetChunkHashes()
+func (storeIndex *Longtail_StoreIndex) GetChunkSizes() []uint32 {
+	size := int(*storeIndex.cStoreIndex.m_ChunkCount)
+	return carray2slice32(storeIndex.cStoreIndex.m_ChunkSizes, size)
+}
+
 func (versionIndex *Longtail_VersionIndex) Dispose() {
 	if versionIndex.cVersionIndex != nil {
 		C.Longtail_Free(unsafe.Pointer(versionIndex.cVersionIndex))
@@ -937,6 +995,25 @@ func (blockStoreAPI *Longtail_BlockStoreAPI) Dispose() {
 	}
 }
 
+// blockStoreCloseErrors holds where to put the error from closing a BlockStoreAPI proxy
+// that is being disposed by Longtail_BlockStoreAPI.Close()
+var blockStoreCloseErrors sync.Map
+
+// Close disposes the block store and returns the error from closing the BlockStoreAPI
+// behind it if it is a proxy created with CreateBlockStoreAPI()
+func (blockStoreAPI *Longtail_BlockStoreAPI) Close() error {
+	if blockStoreAPI.cBlockStoreAPI == nil {
+		return nil
+	}
+	var closeErr error
+	key := uintptr(unsafe.Pointer(&blockStoreAPI.cBlockStoreAPI.m_API))
+	blockStoreCloseErrors.Store(key, &closeErr)
+	C.Longtail_DisposeAPI(&blockStoreAPI.cBlockStoreAPI.m_API)
+	blockStoreCloseErrors.Delete(key)
+	blockStoreAPI.cBlockStoreAPI = nil
+	return closeErr
+}
+
 //// PutStoredBlock() ...
 func (blockStoreAPI *Longtail_BlockStoreAPI) PutStoredBlock(
 	storedBlock Longtail_StoredBlock,
@@ -991,7 +1068,7 @@ func (blockStoreAPI *Longtail_BlockStoreAPI) GetStats() (BlockStoreStats, int) {
 		&cStats)
 
 	stats := BlockStoreStats{}
-	for s := 0; s < Longtail_BlockStoreAPI_StatU64_Count; s++ {
+	for s := 0; s < nativeBlockStoreStatU64Count; s++ {
 		stats.StatU64[s] = uint64(cStats.m_StatU64[s])
 	}
 	return stats, int(errno)
@@ -1237,6 +1314,95 @@ func (jobAPI *Longtail_JobAPI) Dispose() {
 	}
 }
 
+// CreateAtomicCancelAPI ...
+func CreateAtomicCancelAPI() Longtail_CancelAPI {
+	return Longtail_CancelAPI{cCancelAPI: C.Longtail_CreateAtomicCancelAPI()}
+}
+
+// Longtail_CancelAPI.Dispose() ...
+func (cancelAPI *Longtail_CancelAPI) Dispose() {
+	if cancelAPI.cCancelAPI != nil {
+		C.Longtail_DisposeAPI(&cancelAPI.cCancelAPI.m_API)
+		cancelAPI.cCancelAPI = nil
+	}
+}
+
+// CreateToken ...
+func (cancelAPI *Longtail_CancelAPI) CreateToken() (Longtail_CancelAPI_HCancelToken, int) {
+	var cCancelToken C.Longtail_CancelAPI_HCancelToken
+	errno := C.Longtail_CancelAPI_CreateToken(cancelAPI.cCancelAPI, &cCancelToken)
+	if errno != 0 {
+		return Longtail_CancelAPI_HCancelToken{}, int(errno)
+	}
+	return Longtail_CancelAPI_HCancelToken{cCancelToken: cCancelToken}, 0
+}
+
+// Cancel ...
+func (cancelAPI *Longtail_CancelAPI) Cancel(token Longtail_CancelAPI_HCancelToken) int {
+	return int(C.Longtail_CancelAPI_Cancel(cancelAPI.cCancelAPI, token.cCancelToken))
+}
+
+// IsCancelled returns ECANCELED if token is cancelled
+func (cancelAPI *Longtail_CancelAPI) IsCancelled(token Longtail_CancelAPI_HCancelToken) int {
+	return int(C.Longtail_CancelAPI_IsCancelled(cancelAPI.cCancelAPI, token.cCancelToken))
+}
+
+// DisposeToken ...
+func (cancelAPI *Longtail_CancelAPI) DisposeToken(token Longtail_CancelAPI_HCancelToken) int {
+	return int(C.Longtail_CancelAPI_DisposeToken(cancelAPI.cCancelAPI, token.cCancelToken))
+}
+
+// contextCancelToken is a cancel token that is cancelled when a context is done
+type contextCancelToken struct {
+	cancelAPI Longtail_CancelAPI
+	token     Longtail_CancelAPI_HCancelToken
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+func newContextCancelToken(ctx context.Context) (*contextCancelToken, int) {
+	cancelAPI := CreateAtomicCancelAPI()
+	token, errno := cancelAPI.CreateToken()
+	if errno != 0 {
+		cancelAPI.Dispose()
+		return nil, errno
+	}
+	c := &contextCancelToken{
+		cancelAPI: cancelAPI,
+		token:     token,
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{})}
+	go func() {
+		defer close(c.stopped)
+		select {
+		case <-ctx.Done():
+			c.cancelAPI.Cancel(c.token)
+		case <-c.stop:
+		}
+	}()
+	return c, 0
+}
+
+// dispose waits until the token can no longer be cancelled before disposing it
+func (c *contextCancelToken) dispose() {
+	close(c.stop)
+	<-c.stopped
+	c.cancelAPI.DisposeToken(c.token)
+	c.cancelAPI.Dispose()
+}
+
+// contextError converts errno from a call that was passed a token for ctx to an error,
+// a call that failed because ctx is done returns ctx.Err()
+func contextError(ctx context.Context, errno int, fallback error) error {
+	if errno == 0 {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return ErrnoToError(errno, fallback)
+}
+
 // CreateFullCompressionRegistry ...
 func CreateFullCompressionRegistry() Longtail_CompressionRegistryAPI {
 	return Longtail_CompressionRegistryAPI{cCompressionRegistryAPI: C.Longtail_CreateFullCompressionRegistry()}
@@ -1369,6 +1535,32 @@ func CreateVersionIndex(
 	fileInfos Longtail_FileInfos,
 	assetCompressionTypes []uint32,
 	maxChunkSize uint32) (Longtail_VersionIndex, int) {
+	return createVersionIndex(
+		storageAPI,
+		hashAPI,
+		chunkerAPI,
+		jobAPI,
+		progressAPI,
+		rootPath,
+		fileInfos,
+		assetCompressionTypes,
+		maxChunkSize,
+		Longtail_CancelAPI{},
+		Longtail_CancelAPI_HCancelToken{})
+}
+
+func createVersionIndex(
+	storageAPI Longtail_StorageAPI,
+	hashAPI Longtail_HashAPI,
+	chunkerAPI Longtail_ChunkerAPI,
+	jobAPI Longtail_JobAPI,
+	progressAPI *Longtail_ProgressAPI,
+	rootPath string,
+	fileInfos Longtail_FileInfos,
+	assetCompressionTypes []uint32,
+	maxChunkSize uint32,
+	cancelAPI Longtail_CancelAPI,
+	cancelToken Longtail_CancelAPI_HCancelToken) (Longtail_VersionIndex, int) {
 
 	var cProgressAPI *C.struct_Longtail_ProgressAPI
 	if progressAPI != nil {
@@ -1390,8 +1582,8 @@ func CreateVersionIndex(
 		chunkerAPI.cChunkerAPI,
 		jobAPI.cJobAPI,
 		cProgressAPI,
-		nil,
-		nil,
+		cancelAPI.cCancelAPI,
+		cancelToken.cCancelToken,
 		cRootPath,
 		fileInfos.cFileInfos,
 		(*C.uint32_t)(cCompressionTypes),
@@ -1405,6 +1597,41 @@ func CreateVersionIndex(
 	return Longtail_VersionIndex{cVersionIndex: vindex}, 0
 }
 
+// CreateVersionIndexWithContext is CreateVersionIndex that stops when ctx is done, it then returns ctx.Err()
+func CreateVersionIndexWithContext(
+	ctx context.Context,
+	storageAPI Longtail_StorageAPI,
+	hashAPI Longtail_HashAPI,
+	chunkerAPI Longtail_ChunkerAPI,
+	jobAPI Longtail_JobAPI,
+	progressAPI *Longtail_ProgressAPI,
+	rootPath string,
+	fileInfos Longtail_FileInfos,
+	assetCompressionTypes []uint32,
+	maxChunkSize uint32) (Longtail_VersionIndex, error) {
+	if err := ctx.Err(); err != nil {
+		return Longtail_VersionIndex{}, err
+	}
+	cancelToken, errno := newContextCancelToken(ctx)
+	if errno != 0 {
+		return Longtail_VersionIndex{}, ErrnoToError(errno, ErrENOMEM)
+	}
+	defer cancelToken.dispose()
+	vindex, errno := createVersionIndex(
+		storageAPI,
+		hashAPI,
+		chunkerAPI,
+		jobAPI,
+		progressAPI,
+		rootPath,
+		fileInfos,
+		assetCompressionTypes,
+		maxChunkSize,
+		cancelToken.cancelAPI,
+		cancelToken.token)
+	return vindex, contextError(ctx, errno, ErrEIO)
+}
+
 // WriteVersionIndexToBuffer ...
 func WriteVersionIndexToBuffer(index Longtail_VersionIndex) ([]byte, int) {
 	var buffer unsafe.Pointer
@@ -1726,6 +1953,28 @@ func WriteContent(
 	store_index Longtail_StoreIndex,
 	versionIndex Longtail_VersionIndex,
 	versionFolderPath string) int {
+	return writeContent(
+		sourceStorageAPI,
+		targetBlockStoreAPI,
+		jobAPI,
+		progressAPI,
+		store_index,
+		versionIndex,
+		versionFolderPath,
+		Longtail_CancelAPI{},
+		Longtail_CancelAPI_HCancelToken{})
+}
+
+func writeContent(
+	sourceStorageAPI Longtail_StorageAPI,
+	targetBlockStoreAPI Longtail_BlockStoreAPI,
+	jobAPI Longtail_JobAPI,
+	progressAPI *Longtail_ProgressAPI,
+	store_index Longtail_StoreIndex,
+	versionIndex Longtail_VersionIndex,
+	versionFolderPath string,
+	cancelAPI Longtail_CancelAPI,
+	cancelToken Longtail_CancelAPI_HCancelToken) int {
 
 	var cProgressAPI *C.struct_Longtail_ProgressAPI
 	if progressAPI != nil {
@@ -1740,8 +1989,8 @@ func WriteContent(
 		targetBlockStoreAPI.cBlockStoreAPI,
 		jobAPI.cJobAPI,
 		cProgressAPI,
-		nil,
-		nil,
+		cancelAPI.cCancelAPI,
+		cancelToken.cCancelToken,
 		store_index.cStoreIndex,
 		versionIndex.cVersionIndex,
 		cVersionFolderPath)
@@ -1751,6 +2000,37 @@ func WriteContent(
 	return 0
 }
 
+// WriteContentWithContext is WriteContent that stops when ctx is done, it then returns ctx.Err()
+func WriteContentWithContext(
+	ctx context.Context,
+	sourceStorageAPI Longtail_StorageAPI,
+	targetBlockStoreAPI Longtail_BlockStoreAPI,
+	jobAPI Longtail_JobAPI,
+	progressAPI *Longtail_ProgressAPI,
+	store_index Longtail_StoreIndex,
+	versionIndex Longtail_VersionIndex,
+	versionFolderPath string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cancelToken, errno := newContextCancelToken(ctx)
+	if errno != 0 {
+		return ErrnoToError(errno, ErrENOMEM)
+	}
+	defer cancelToken.dispose()
+	errno = writeContent(
+		sourceStorageAPI,
+		targetBlockStoreAPI,
+		jobAPI,
+		progressAPI,
+		store_index,
+		versionIndex,
+		versionFolderPath,
+		cancelToken.cancelAPI,
+		cancelToken.token)
+	return contextError(ctx, errno, ErrEIO)
+}
+
 // CreateMissingContent ...
 func CreateMissingContent(
 	hashAPI Longtail_HashAPI,
@@ -1783,6 +2063,30 @@ func WriteVersion(
 	versionIndex Longtail_VersionIndex,
 	versionFolderPath string,
 	retainPermissions bool) int {
+	return writeVersion(
+		contentBlockStoreAPI,
+		versionStorageAPI,
+		jobAPI,
+		progressAPI,
+		storeIndex,
+		versionIndex,
+		versionFolderPath,
+		retainPermissions,
+		Longtail_CancelAPI{},
+		Longtail_CancelAPI_HCancelToken{})
+}
+
+func writeVersion(
+	contentBlockStoreAPI Longtail_BlockStoreAPI,
+	versionStorageAPI Longtail_StorageAPI,
+	jobAPI Longtail_JobAPI,
+	progressAPI *Longtail_ProgressAPI,
+	storeIndex Longtail_StoreIndex,
+	versionIndex Longtail_VersionIndex,
+	versionFolderPath string,
+	retainPermissions bool,
+	cancelAPI Longtail_CancelAPI,
+	cancelToken Longtail_CancelAPI_HCancelToken) int {
 
 	var cProgressAPI *C.struct_Longtail_ProgressAPI
 	if progressAPI != nil {
@@ -1802,8 +2106,8 @@ func WriteVersion(
 		versionStorageAPI.cStorageAPI,
 		jobAPI.cJobAPI,
 		cProgressAPI,
-		nil,
-		nil,
+		cancelAPI.cCancelAPI,
+		cancelToken.cCancelToken,
 		storeIndex.cStoreIndex,
 		versionIndex.cVersionIndex,
 		cVersionFolderPath,
@@ -1814,6 +2118,39 @@ func WriteVersion(
 	return 0
 }
 
+// WriteVersionWithContext is WriteVersion that stops when ctx is done, it then returns ctx.Err()
+func WriteVersionWithContext(
+	ctx context.Context,
+	contentBlockStoreAPI Longtail_BlockStoreAPI,
+	versionStorageAPI Longtail_StorageAPI,
+	jobAPI Longtail_JobAPI,
+	progressAPI *Longtail_ProgressAPI,
+	storeIndex Longtail_StoreIndex,
+	versionIndex Longtail_VersionIndex,
+	versionFolderPath string,
+	retainPermissions bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cancelToken, errno := newContextCancelToken(ctx)
+	if errno != 0 {
+		return ErrnoToError(errno, ErrENOMEM)
+	}
+	defer cancelToken.dispose()
+	errno = writeVersion(
+		contentBlockStoreAPI,
+		versionStorageAPI,
+		jobAPI,
+		progressAPI,
+		storeIndex,
+		versionIndex,
+		versionFolderPath,
+		retainPermissions,
+		cancelToken.cancelAPI,
+		cancelToken.token)
+	return contextError(ctx, errno, ErrEIO)
+}
+
 //CreateVersionDiff do we really need this? Maybe ChangeVersion should create one on the fly?
 func CreateVersionDiff(
 	hashAPI Longtail_HashAPI,
@@ -1844,6 +2181,36 @@ func ChangeVersion(
 	versionDiff Longtail_VersionDiff,
 	versionFolderPath string,
 	retainPermissions bool) int {
+	return changeVersion(
+		contentBlockStoreAPI,
+		versionStorageAPI,
+		hashAPI,
+		jobAPI,
+		progressAPI,
+		storeIndex,
+		sourceVersionIndex,
+		targetVersionIndex,
+		versionDiff,
+		versionFolderPath,
+		retainPermissions,
+		Longtail_CancelAPI{},
+		Longtail_CancelAPI_HCancelToken{})
+}
+
+func changeVersion(
+	contentBlockStoreAPI Longtail_BlockStoreAPI,
+	versionStorageAPI Longtail_StorageAPI,
+	hashAPI Longtail_HashAPI,
+	jobAPI Longtail_JobAPI,
+	progressAPI *Longtail_ProgressAPI,
+	storeIndex Longtail_StoreIndex,
+	sourceVersionIndex Longtail_VersionIndex,
+	targetVersionIndex Longtail_VersionIndex,
+	versionDiff Longtail_VersionDiff,
+	versionFolderPath string,
+	retainPermissions bool,
+	cancelAPI Longtail_CancelAPI,
+	cancelToken Longtail_CancelAPI_HCancelToken) int {
 
 	var cProgressAPI *C.struct_Longtail_ProgressAPI
 	if progressAPI != nil {
@@ -1864,8 +2231,8 @@ func ChangeVersion(
 		hashAPI.cHashAPI,
 		jobAPI.cJobAPI,
 		cProgressAPI,
-		nil,
-		nil,
+		cancelAPI.cCancelAPI,
+		cancelToken.cCancelToken,
 		storeIndex.cStoreIndex,
 		sourceVersionIndex.cVersionIndex,
 		targetVersionIndex.cVersionIndex,
@@ -1878,6 +2245,45 @@ func ChangeVersion(
 	return 0
 }
 
+// ChangeVersionWithContext is ChangeVersion that stops when ctx is done, it then returns ctx.Err()
+func ChangeVersionWithContext(
+	ctx context.Context,
+	contentBlockStoreAPI Longtail_BlockStoreAPI,
+	versionStorageAPI Longtail_StorageAPI,
+	hashAPI Longtail_HashAPI,
+	jobAPI Longtail_JobAPI,
+	progressAPI *Longtail_ProgressAPI,
+	storeIndex Longtail_StoreIndex,
+	sourceVersionIndex Longtail_VersionIndex,
+	targetVersionIndex Longtail_VersionIndex,
+	versionDiff Longtail_VersionDiff,
+	versionFolderPath string,
+	retainPermissions bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cancelToken, errno := newContextCancelToken(ctx)
+	if errno != 0 {
+		return ErrnoToError(errno, ErrENOMEM)
+	}
+	defer cancelToken.dispose()
+	errno = changeVersion(
+		contentBlockStoreAPI,
+		versionStorageAPI,
+		hashAPI,
+		jobAPI,
+		progressAPI,
+		storeIndex,
+		sourceVersionIndex,
+		targetVersionIndex,
+		versionDiff,
+		versionFolderPath,
+		retainPermissions,
+		cancelToken.cancelAPI,
+		cancelToken.token)
+	return contextError(ctx, errno, ErrEIO)
+}
+
 //export LogProxy_Log
 func LogProxy_Log(log_context *C.struct_Longtail_LogContext, log *C.char) {
 	logger := RestorePointer(log_context.context).(Logger)
@@ -1894,7 +2300,12 @@ func LogProxy_Log(log_context *C.struct_Longtail_LogContext, log *C.char) {
 func BlockStoreAPIProxy_Dispose(api *C.struct_Longtail_API) {
 	context := C.BlockStoreAPIProxy_GetContext(unsafe.Pointer(api))
 	blockStore := RestorePointer(context).(BlockStoreAPI)
-	blockStore.Close()
+	err := blockStore.Close()
+	if closeErr, ok := blockStoreCloseErrors.Load(uintptr(unsafe.Pointer(api))); ok {
+		*closeErr.(*error) = err
+	} else if err != nil {
+		log.Printf("WARNING: Failed to close block store: %v\n", err)
+	}
 	UnrefPointer(context)
 	C.Longtail_Free(unsafe.Pointer(api))
 }
@@ -1947,7 +2358,7 @@ func BlockStoreAPIProxy_GetStats(api *C.struct_Longtail_BlockStoreAPI, out_stats
 	blockStore := RestorePointer(context).(BlockStoreAPI)
 	stats, errno := blockStore.GetStats()
 	if errno == 0 {
-		for s := 0; s < Longtail_BlockStoreAPI_StatU64_Count; s++ {
+		for s := 0; s < nativeBlockStoreStatU64Count; s++ {
 			out_stats.m_StatU64[s] = C.uint64_t(stats.StatU64[s])
 		}
 	}
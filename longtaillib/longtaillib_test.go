@@ -1,11 +1,13 @@
 package longtaillib
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
 	"runtime"
 	"sync"
 	"testing"
+	"time"
 )
 
 type testProgress struct {
@@ -267,6 +269,194 @@ func Test_ReadWriteStoredBlockBuffer(t *testing.T) {
 	validateStoredBlock(t, copyBlock, 0xdeadbeef)
 }
 
+func TestStoreIndexBlocks(t *testing.T) {
+	SetLogger(&testLogger{t: t})
+	defer SetLogger(nil)
+	SetAssert(&testAssert{t: t})
+	defer SetAssert(nil)
+	SetLogLevel(1)
+
+	storedBlock1, _ := createStoredBlock(1, 0xdeadbeef)
+	defer storedBlock1.Dispose()
+	storedBlock2, _ := createStoredBlock(3, 0xdeadbeef)
+	defer storedBlock2.Dispose()
+	storeIndex, errno := CreateStoreIndexFromBlocks([]Longtail_BlockIndex{storedBlock1.GetBlockIndex(), storedBlock2.GetBlockIndex()})
+	if errno != 0 {
+		t.Errorf("TestStoreIndexBlocks() CreateStoreIndexFromBlocks() %d != %d", errno, 0)
+	}
+	defer storeIndex.Dispose()
+
+	chunksOffsets := storeIndex.GetBlockChunksOffsets()
+	if len(chunksOffsets) != 2 || chunksOffsets[0] != 0 || chunksOffsets[1] != 1 {
+		t.Errorf("TestStoreIndexBlocks() GetBlockChunksOffsets() %v != %v", chunksOffsets, []uint32{0, 1})
+	}
+	chunkCounts := storeIndex.GetBlockChunkCounts()
+	if len(chunkCounts) != 2 || chunkCounts[0] != 1 || chunkCounts[1] != 3 {
+		t.Errorf("TestStoreIndexBlocks() GetBlockChunkCounts() %v != %v", chunkCounts, []uint32{1, 3})
+	}
+	tags := storeIndex.GetBlockTags()
+	if len(tags) != 2 || tags[0] != 10001 || tags[1] != 10003 {
+		t.Errorf("TestStoreIndexBlocks() GetBlockTags() %v != %v", tags, []uint32{10001, 10003})
+	}
+	chunkSizes := storeIndex.GetChunkSizes()
+	if len(chunkSizes) != 4 || chunkSizes[0] != 10 || chunkSizes[3] != 30 {
+		t.Errorf("TestStoreIndexBlocks() GetChunkSizes() %v != %v", chunkSizes, []uint32{10, 10, 20, 30})
+	}
+}
+
+func TestCancelAPI(t *testing.T) {
+	cancelAPI := CreateAtomicCancelAPI()
+	defer cancelAPI.Dispose()
+	token, errno := cancelAPI.CreateToken()
+	if errno != 0 {
+		t.Errorf("TestCancelAPI() CreateToken() %d != %d", errno, 0)
+	}
+	if errno = cancelAPI.IsCancelled(token); errno != 0 {
+		t.Errorf("TestCancelAPI() IsCancelled() %d != %d", errno, 0)
+	}
+	if errno = cancelAPI.Cancel(token); errno != 0 {
+		t.Errorf("TestCancelAPI() Cancel() %d != %d", errno, 0)
+	}
+	if errno = cancelAPI.IsCancelled(token); errno != ECANCELED {
+		t.Errorf("TestCancelAPI() IsCancelled() %d != %d", errno, ECANCELED)
+	}
+	if errno = cancelAPI.DisposeToken(token); errno != 0 {
+		t.Errorf("TestCancelAPI() DisposeToken() %d != %d", errno, 0)
+	}
+}
+
+func TestCreateVersionIndexWithContext(t *testing.T) {
+	storageAPI := createFilledStorage("content")
+	defer storageAPI.Dispose()
+	hashAPI := CreateBlake3HashAPI()
+	defer hashAPI.Dispose()
+	chunkerAPI := CreateHPCDCChunkerAPI()
+	defer chunkerAPI.Dispose()
+	jobAPI := CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobAPI.Dispose()
+	fileInfos, errno := GetFilesRecursively(storageAPI, Longtail_PathFilterAPI{}, "content")
+	if errno != 0 {
+		t.Errorf("TestCreateVersionIndexWithContext() GetFilesRecursively() %d != %d", errno, 0)
+	}
+	defer fileInfos.Dispose()
+	tags := make([]uint32, fileInfos.GetFileCount())
+
+	versionIndex, err := CreateVersionIndexWithContext(context.Background(), storageAPI, hashAPI, chunkerAPI, jobAPI, nil, "content", fileInfos, tags, 32768)
+	if err != nil {
+		t.Errorf("TestCreateVersionIndexWithContext() CreateVersionIndexWithContext() %v != %v", err, nil)
+	}
+	if versionIndex.GetAssetCount() != fileInfos.GetFileCount() {
+		t.Errorf("TestCreateVersionIndexWithContext() GetAssetCount() %d != %d", versionIndex.GetAssetCount(), fileInfos.GetFileCount())
+	}
+	versionIndex.Dispose()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = CreateVersionIndexWithContext(ctx, storageAPI, hashAPI, chunkerAPI, jobAPI, nil, "content", fileInfos, tags, 32768)
+	if err != context.Canceled {
+		t.Errorf("TestCreateVersionIndexWithContext() CreateVersionIndexWithContext() %v != %v", err, context.Canceled)
+	}
+}
+
+// blockingBlockStore holds the completion of every put until release is closed so a test can act
+// while WriteContent is in flight, started is closed when the first block is put
+type blockingBlockStore struct {
+	*TestBlockStore
+	started     chan struct{}
+	release     chan struct{}
+	startedOnce sync.Once
+}
+
+func (b *blockingBlockStore) PutStoredBlock(
+	storedBlock Longtail_StoredBlock,
+	asyncCompleteAPI Longtail_AsyncPutStoredBlockAPI) int {
+	b.startedOnce.Do(func() { close(b.started) })
+	go func() {
+		<-b.release
+		asyncCompleteAPI.OnComplete(0)
+	}()
+	return 0
+}
+
+func TestWriteContentWithContextCancelInFlight(t *testing.T) {
+	storageAPI := createFilledStorage("content")
+	defer storageAPI.Dispose()
+	hashAPI := CreateBlake3HashAPI()
+	defer hashAPI.Dispose()
+	chunkerAPI := CreateHPCDCChunkerAPI()
+	defer chunkerAPI.Dispose()
+	jobAPI := CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobAPI.Dispose()
+	blockStore := &blockingBlockStore{
+		TestBlockStore: &TestBlockStore{blocks: make(map[uint64]Longtail_StoredBlock)},
+		started:        make(chan struct{}),
+		release:        make(chan struct{})}
+	blockStoreAPI := CreateBlockStoreAPI(blockStore)
+	defer blockStoreAPI.Dispose()
+
+	fileInfos, errno := GetFilesRecursively(storageAPI, Longtail_PathFilterAPI{}, "content")
+	if errno != 0 {
+		t.Errorf("TestWriteContentWithContextCancelInFlight() GetFilesRecursively() %d != %d", errno, 0)
+	}
+	defer fileInfos.Dispose()
+	tags := make([]uint32, fileInfos.GetFileCount())
+	versionIndex, errno := CreateVersionIndex(storageAPI, hashAPI, chunkerAPI, jobAPI, nil, "content", fileInfos, tags, 32768)
+	if errno != 0 {
+		t.Errorf("TestWriteContentWithContextCancelInFlight() CreateVersionIndex() %d != %d", errno, 0)
+	}
+	defer versionIndex.Dispose()
+	storeIndex, errno := CreateStoreIndexFromBlocks([]Longtail_BlockIndex{})
+	if errno != 0 {
+		t.Errorf("TestWriteContentWithContextCancelInFlight() CreateStoreIndexFromBlocks() %d != %d", errno, 0)
+	}
+	defer storeIndex.Dispose()
+	missingStoreIndex, errno := CreateMissingContent(hashAPI, storeIndex, versionIndex, 32768*2, 8)
+	if errno != 0 {
+		t.Errorf("TestWriteContentWithContextCancelInFlight() CreateMissingContent() %d != %d", errno, 0)
+	}
+	defer missingStoreIndex.Dispose()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- WriteContentWithContext(ctx, storageAPI, blockStoreAPI, jobAPI, nil, missingStoreIndex, versionIndex, "content")
+	}()
+
+	select {
+	case <-blockStore.started:
+	case <-time.After(10 * time.Second):
+		close(blockStore.release)
+		t.Fatalf("TestWriteContentWithContextCancelInFlight() no block was put")
+	}
+	// Every put succeeds once released so only the cancel token can make the call fail
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	close(blockStore.release)
+
+	err := <-result
+	if err != context.Canceled {
+		t.Errorf("TestWriteContentWithContextCancelInFlight() WriteContentWithContext() %v != %v", err, context.Canceled)
+	}
+}
+
+func TestHashBuffer(t *testing.T) {
+	hashAPI := CreateBlake3HashAPI()
+	defer hashAPI.Dispose()
+	hash1, errno := hashAPI.HashBuffer([]byte("the content of my_file"))
+	if errno != 0 {
+		t.Errorf("TestHashBuffer() HashBuffer() %d != %d", errno, 0)
+	}
+	hash2, _ := hashAPI.HashBuffer([]byte("the content of my_file"))
+	if hash1 != hash2 {
+		t.Errorf("TestHashBuffer() HashBuffer() %x != %x", hash1, hash2)
+	}
+	hash3, _ := hashAPI.HashBuffer([]byte("the content of my_file2"))
+	if hash1 == hash3 {
+		t.Errorf("TestHashBuffer() HashBuffer() %x == %x", hash1, hash3)
+	}
+}
+
 func TestFSBlockStore(t *testing.T) {
 	SetLogger(&testLogger{t: t})
 	defer SetLogger(nil)
@@ -433,6 +623,7 @@ type TestBlockStore struct {
 	lock          sync.Mutex
 	stats         [Longtail_BlockStoreAPI_StatU64_Count]uint64
 	didClose      bool
+	closeErr      error
 }
 
 func (b *TestBlockStore) PutStoredBlock(
@@ -548,8 +739,9 @@ func (b *TestBlockStore) Flush(asyncCompleteAPI Longtail_AsyncFlushAPI) int {
 	return 0
 }
 
-func (b *TestBlockStore) Close() {
+func (b *TestBlockStore) Close() error {
 	b.didClose = true
+	return b.closeErr
 }
 
 func TestBlockStoreProxy(t *testing.T) {
@@ -613,6 +805,34 @@ func TestBlockStoreProxy(t *testing.T) {
 	blockStoreProxy.Dispose()
 }
 
+func TestBlockStoreProxyClose(t *testing.T) {
+	SetLogger(&testLogger{t: t})
+	defer SetLogger(nil)
+	SetAssert(&testAssert{t: t})
+	defer SetAssert(nil)
+
+	blockStore := &TestBlockStore{blocks: make(map[uint64]Longtail_StoredBlock), closeErr: ErrEIO}
+	blockStoreProxy := CreateBlockStoreAPI(blockStore)
+	err := blockStoreProxy.Close()
+	if err != ErrEIO {
+		t.Errorf("TestBlockStoreProxyClose() Close() %v != %v", err, ErrEIO)
+	}
+	if !blockStore.didClose {
+		t.Errorf("TestBlockStoreProxyClose() didClose %t != %t", blockStore.didClose, true)
+	}
+
+	blockStore = &TestBlockStore{blocks: make(map[uint64]Longtail_StoredBlock)}
+	blockStoreProxy = CreateBlockStoreAPI(blockStore)
+	err = blockStoreProxy.Close()
+	if err != nil {
+		t.Errorf("TestBlockStoreProxyClose() Close() %v != %v", err, nil)
+	}
+	err = blockStoreProxy.Close()
+	if err != nil {
+		t.Errorf("TestBlockStoreProxyClose() second Close() %v != %v", err, nil)
+	}
+}
+
 type testPathFilter struct {
 }
 
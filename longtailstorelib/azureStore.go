@@ -0,0 +1,384 @@
+package longtailstorelib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+type azureBlobStore struct {
+	scheme        string
+	accountName   string
+	containerName string
+	prefix        string
+	containerURL  azblob.ContainerURL
+}
+
+type azureBlobClient struct {
+	store *azureBlobStore
+}
+
+type azureWriteCondition struct {
+	doesNotExist bool
+	eTag         azblob.ETag
+}
+
+type azureBlobObject struct {
+	client         *azureBlobClient
+	path           string
+	blobURL        azblob.BlockBlobURL
+	writeCondition *azureWriteCondition
+	contentType    string
+	metadata       map[string]string
+}
+
+// NewAzureBlobStore creates a BlobStore for an abfs:// or abfss:// URI
+//
+// The URI is in the form abfss://container@account.dfs.core.windows.net/prefix, abfs uses
+// http and abfss uses https. The account key is read from the AZURE_STORAGE_KEY environment
+// variable and a SAS token from AZURE_STORAGE_SAS_TOKEN, if neither is set anonymous access is used.
+//
+// The optional query parameter endpoint overrides the account service URL, for example
+// endpoint=http://127.0.0.1:10000/devstoreaccount1 when testing against Azurite.
+func NewAzureBlobStore(u *url.URL) (BlobStore, error) {
+	if u.Scheme != "abfs" && u.Scheme != "abfss" {
+		return nil, fmt.Errorf("invalid scheme '%s', expected 'abfs' or 'abfss'", u.Scheme)
+	}
+	containerName := u.User.Username()
+	if containerName == "" {
+		return nil, fmt.Errorf("missing container name in '%s'", u.String())
+	}
+	host := u.Hostname()
+	if host == "" {
+		return nil, fmt.Errorf("missing account name in '%s'", u.String())
+	}
+	accountName := strings.Split(host, ".")[0]
+
+	prefix := u.Path
+	if len(u.Path) > 0 {
+		prefix = u.Path[1:] // strip initial slash
+	}
+
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	serviceURL := u.Query().Get("endpoint")
+	if serviceURL == "" {
+		protocol := "https"
+		if u.Scheme == "abfs" {
+			protocol = "http"
+		}
+		serviceURL = fmt.Sprintf("%s://%s.blob.core.windows.net", protocol, accountName)
+	}
+	containerURLString := strings.TrimRight(serviceURL, "/") + "/" + containerName
+	if sasToken := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); sasToken != "" {
+		containerURLString += "?" + strings.TrimPrefix(sasToken, "?")
+	}
+	containerURL, err := url.Parse(containerURLString)
+	if err != nil {
+		return nil, errors.Wrap(err, containerURLString)
+	}
+
+	var credential azblob.Credential
+	if accountKey := os.Getenv("AZURE_STORAGE_KEY"); accountKey != "" {
+		credential, err = azblob.NewSharedKeyCredential(accountName, accountKey)
+		if err != nil {
+			return nil, errors.Wrap(err, accountName)
+		}
+	} else {
+		credential = azblob.NewAnonymousCredential()
+	}
+	// The remote store retries failed requests with its own policy, retries in the pipeline would multiply its attempts
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{Retry: azblob.RetryOptions{MaxTries: 1}})
+
+	s := &azureBlobStore{
+		scheme:        u.Scheme,
+		accountName:   accountName,
+		containerName: containerName,
+		prefix:        prefix,
+		containerURL:  azblob.NewContainerURL(*containerURL, pipeline)}
+	return s, nil
+}
+
+func (blobStore *azureBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
+	return &azureBlobClient{store: blobStore}, nil
+}
+
+func (blobStore *azureBlobStore) String() string {
+	return blobStore.scheme + "://" + blobStore.containerName + "@" + blobStore.accountName + "/" + blobStore.prefix
+}
+
+// IsRetryableError implements BlobErrorClassifier
+func (blobStore *azureBlobStore) IsRetryableError(err error) bool {
+	cause := errors.Cause(err)
+	if isAzureNotFound(cause) {
+		return false
+	}
+	if e, ok := cause.(azblob.StorageError); ok && e.Response() != nil {
+		return isRetryableHTTPStatus(e.Response().StatusCode)
+	}
+	return true
+}
+
+func (blobClient *azureBlobClient) NewObject(path string) (BlobObject, error) {
+	azurePath := blobClient.store.prefix + path
+	return &azureBlobObject{
+			client:         blobClient,
+			path:           azurePath,
+			blobURL:        blobClient.store.containerURL.NewBlockBlobURL(azurePath),
+			writeCondition: nil},
+		nil
+}
+
+func (blobClient *azureBlobClient) GetObjects(ctx context.Context) ([]BlobProperties, error) {
+	var items []BlobProperties
+	options := azblob.ListBlobsSegmentOptions{Prefix: blobClient.store.prefix}
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		response, err := blobClient.store.containerURL.ListBlobsFlatSegment(ctx, marker, options)
+		if err != nil {
+			return nil, errors.Wrap(err, blobClient.store.String())
+		}
+		for _, blob := range response.Segment.BlobItems {
+			items = append(items, getAzureBlobProperties(blob, len(blobClient.store.prefix)))
+		}
+		marker = response.NextMarker
+	}
+	return items, nil
+}
+
+type azureBlobObjectIterator struct {
+	ctx       context.Context
+	client    *azureBlobClient
+	prefix    string
+	delimiter string
+	marker    azblob.Marker
+	items     []BlobProperties
+}
+
+func (blobClient *azureBlobClient) ListObjects(ctx context.Context, prefix string, delimiter string) BlobObjectIterator {
+	return &azureBlobObjectIterator{ctx: ctx, client: blobClient, prefix: blobClient.store.prefix + prefix, delimiter: delimiter}
+}
+
+func getAzureBlobProperties(blob azblob.BlobItemInternal, prefixLength int) BlobProperties {
+	var size int64
+	if blob.Properties.ContentLength != nil {
+		size = *blob.Properties.ContentLength
+	}
+	return BlobProperties{Size: size, Name: blob.Name[prefixLength:]}
+}
+
+func (it *azureBlobObjectIterator) Next() (BlobProperties, error) {
+	ctx := it.ctx
+	containerURL := it.client.store.containerURL
+	prefixLength := len(it.client.store.prefix)
+	for len(it.items) == 0 {
+		if !it.marker.NotDone() {
+			return BlobProperties{}, ErrBlobIteratorDone
+		}
+		options := azblob.ListBlobsSegmentOptions{Prefix: it.prefix}
+		if it.delimiter == "" {
+			response, err := containerURL.ListBlobsFlatSegment(ctx, it.marker, options)
+			if err != nil {
+				return BlobProperties{}, errors.Wrap(err, it.client.store.String())
+			}
+			for _, blob := range response.Segment.BlobItems {
+				it.items = append(it.items, getAzureBlobProperties(blob, prefixLength))
+			}
+			it.marker = response.NextMarker
+		} else {
+			response, err := containerURL.ListBlobsHierarchySegment(ctx, it.marker, it.delimiter, options)
+			if err != nil {
+				return BlobProperties{}, errors.Wrap(err, it.client.store.String())
+			}
+			for _, blobPrefix := range response.Segment.BlobPrefixes {
+				it.items = append(it.items, BlobProperties{Name: blobPrefix.Name[prefixLength:], IsPrefix: true})
+			}
+			for _, blob := range response.Segment.BlobItems {
+				it.items = append(it.items, getAzureBlobProperties(blob, prefixLength))
+			}
+			it.marker = response.NextMarker
+		}
+	}
+	item := it.items[0]
+	it.items = it.items[1:]
+	return item, nil
+}
+
+func (blobClient *azureBlobClient) Close() {
+}
+
+func (blobClient *azureBlobClient) String() string {
+	return blobClient.store.String()
+}
+
+func isAzureNotFound(err error) bool {
+	if e, ok := err.(azblob.StorageError); ok {
+		return e.ServiceCode() == azblob.ServiceCodeBlobNotFound || (e.Response() != nil && e.Response().StatusCode == http.StatusNotFound)
+	}
+	return false
+}
+
+func isAzureConditionFailed(err error) bool {
+	if e, ok := err.(azblob.StorageError); ok {
+		switch e.ServiceCode() {
+		case azblob.ServiceCodeConditionNotMet, azblob.ServiceCodeBlobAlreadyExists:
+			return true
+		}
+		if e.Response() != nil {
+			switch e.Response().StatusCode {
+			case http.StatusPreconditionFailed, http.StatusConflict:
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (blobObject *azureBlobObject) Read(ctx context.Context) ([]byte, error) {
+	response, err := blobObject.blobURL.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.path)
+	}
+	body := response.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3})
+	data, err := ioutil.ReadAll(body)
+	err2 := body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.path)
+	} else if err2 != nil {
+		return nil, err2
+	}
+	return data, nil
+}
+
+func (blobObject *azureBlobObject) LockWriteVersion(ctx context.Context) (bool, error) {
+	properties, err := blobObject.blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if isAzureNotFound(err) {
+		blobObject.writeCondition = &azureWriteCondition{doesNotExist: true}
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, blobObject.path)
+	}
+
+	blobObject.writeCondition = &azureWriteCondition{eTag: properties.ETag()}
+	return true, nil
+}
+
+func (blobObject *azureBlobObject) Exists(ctx context.Context) (bool, error) {
+	_, err := blobObject.blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if isAzureNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, blobObject.path)
+	}
+	return true, nil
+}
+
+func (blobObject *azureBlobObject) accessConditions() azblob.BlobAccessConditions {
+	var conditions azblob.BlobAccessConditions
+	if blobObject.writeCondition != nil {
+		if blobObject.writeCondition.doesNotExist {
+			conditions.ModifiedAccessConditions.IfNoneMatch = azblob.ETagAny
+		} else {
+			conditions.ModifiedAccessConditions.IfMatch = blobObject.writeCondition.eTag
+		}
+	}
+	return conditions
+}
+
+func (blobObject *azureBlobObject) Write(ctx context.Context, data []byte) (bool, error) {
+	contentType := defaultBlobContentType
+	if blobObject.contentType != "" {
+		contentType = blobObject.contentType
+	}
+	_, err := blobObject.blobURL.Upload(
+		ctx,
+		bytes.NewReader(data),
+		azblob.BlobHTTPHeaders{ContentType: contentType},
+		azblob.Metadata(blobObject.metadata),
+		blobObject.accessConditions(),
+		azblob.DefaultAccessTier,
+		nil,
+		azblob.ClientProvidedKeyOptions{})
+	if isAzureConditionFailed(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, blobObject.path)
+	}
+	return true, nil
+}
+
+func (blobObject *azureBlobObject) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	return blobObject.NewRangeReader(ctx, 0, -1)
+}
+
+func (blobObject *azureBlobObject) NewRangeReader(ctx context.Context, offset int64, length int64) (io.ReadCloser, error) {
+	// A count of zero downloads to the end of the blob
+	if length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	count := int64(azblob.CountToEnd)
+	if length >= 0 {
+		count = length
+	}
+	response, err := blobObject.blobURL.Download(ctx, offset, count, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.path)
+	}
+	return response.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3}), nil
+}
+
+func (blobObject *azureBlobObject) NewWriter(ctx context.Context) (io.WriteCloser, error) {
+	// Block blob uploads with access conditions need a seekable body so we buffer the data
+	return newBufferedBlobWriter(ctx, blobObject), nil
+}
+
+func (blobObject *azureBlobObject) GetAttributes(ctx context.Context) (BlobObjectAttributes, error) {
+	properties, err := blobObject.blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if isAzureNotFound(err) {
+		return BlobObjectAttributes{}, errors.Wrap(longtaillib.ErrENOENT, blobObject.path)
+	}
+	if err != nil {
+		return BlobObjectAttributes{}, errors.Wrap(err, blobObject.path)
+	}
+	return BlobObjectAttributes{
+		Size:         properties.ContentLength(),
+		LastModified: properties.LastModified(),
+		Generation:   string(properties.ETag()),
+		ContentType:  properties.ContentType(),
+		Metadata:     map[string]string(properties.NewMetadata())}, nil
+}
+
+func (blobObject *azureBlobObject) SetWriteAttributes(contentType string, metadata map[string]string) {
+	blobObject.contentType = contentType
+	blobObject.metadata = metadata
+}
+
+func (blobObject *azureBlobObject) Delete(ctx context.Context) error {
+	var conditions azblob.BlobAccessConditions
+	if blobObject.writeCondition != nil && !blobObject.writeCondition.doesNotExist {
+		conditions.ModifiedAccessConditions.IfMatch = blobObject.writeCondition.eTag
+	}
+	_, err := blobObject.blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionInclude, conditions)
+	if isAzureNotFound(err) {
+		return nil
+	}
+	if isAzureConditionFailed(err) {
+		return fmt.Errorf("azureBlobObject: generation lock mismatch %s", blobObject.path)
+	}
+	if err != nil {
+		return errors.Wrap(err, blobObject.path)
+	}
+	return nil
+}
@@ -1,31 +1,227 @@
 package longtailstorelib
 
-import "context"
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrBlobWriteConditionFailed is returned when closing a writer from BlobObject.NewWriter if
+// the object was changed after LockWriteVersion, it corresponds to Write() returning false
+var ErrBlobWriteConditionFailed = errors.New("blob write condition failed")
+
+// ErrBlobChecksumMismatch is returned when the content of an object does not match the checksum recorded
+// when it was written, the data was corrupted in transfer or in storage and reading again may succeed
+var ErrBlobChecksumMismatch = errors.New("blob checksum mismatch")
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// newBlobChecksumMismatchError describes a mismatch between the expected and the actual checksum of an object
+func newBlobChecksumMismatchError(path string, algorithm string, expected []byte, actual []byte) error {
+	return errors.Wrapf(ErrBlobChecksumMismatch, "%s: %s %s != %s", path, algorithm, hex.EncodeToString(actual), hex.EncodeToString(expected))
+}
 
 // BlobObject
+//
+// All operations that access the store take a context, cancelling it or reaching its
+// deadline aborts the operation
 type BlobObject interface {
-	Exists() (bool, error)
-	LockWriteVersion() (bool, error)
-	Read() ([]byte, error)
-	Write(data []byte) (bool, error)
-	Delete() error
+	Exists(ctx context.Context) (bool, error)
+	LockWriteVersion(ctx context.Context) (bool, error)
+	Read(ctx context.Context) ([]byte, error)
+	Write(ctx context.Context, data []byte) (bool, error)
+	Delete(ctx context.Context) error
+
+	// NewReader opens a stream of the object content, the caller must close it
+	NewReader(ctx context.Context) (io.ReadCloser, error)
+	// NewRangeReader opens a stream of length bytes starting at offset, a negative length reads to the end of the object
+	NewRangeReader(ctx context.Context, offset int64, length int64) (io.ReadCloser, error)
+	// NewWriter opens a stream that replaces the object content when closed, the write condition
+	// from LockWriteVersion applies and Close returns ErrBlobWriteConditionFailed if it does not hold
+	NewWriter(ctx context.Context) (io.WriteCloser, error)
+
+	// GetAttributes reads the object attributes without downloading the content, if the
+	// object does not exist the returned error has longtaillib.ErrENOENT as cause
+	GetAttributes(ctx context.Context) (BlobObjectAttributes, error)
+	// SetWriteAttributes sets the content type and metadata for following calls to Write and NewWriter,
+	// an empty content type uses the default. Metadata keys should be lower case letters, digits and
+	// underscores to be valid on all backends
+	SetWriteAttributes(contentType string, metadata map[string]string)
+}
+
+// BlobObjectAttributes
+type BlobObjectAttributes struct {
+	Size         int64
+	LastModified time.Time
+	// Generation identifies the version of the object (generation number or ETag depending on backend)
+	Generation  string
+	ContentType string
+	Metadata    map[string]string
 }
 
+const defaultBlobContentType = "application/octet-stream"
+
 type BlobProperties struct {
 	Size int64
 	Name string
+	// IsPrefix is set for the common prefix entries returned by ListObjects when using a delimiter
+	IsPrefix bool
+}
+
+// ErrBlobIteratorDone is returned by BlobObjectIterator.Next when there are no more objects
+var ErrBlobIteratorDone = errors.New("no more blob objects")
+
+// BlobObjectIterator
+type BlobObjectIterator interface {
+	// Next returns the next object in the listing or ErrBlobIteratorDone at the end of the listing
+	Next() (BlobProperties, error)
 }
 
 // BlobClient
 type BlobClient interface {
 	NewObject(path string) (BlobObject, error)
-	GetObjects() ([]BlobProperties, error)
+	GetObjects(ctx context.Context) ([]BlobProperties, error)
+	// ListObjects iterates over the objects with names starting with prefix, the listing is fetched
+	// page by page as the iterator advances. If delimiter is not empty, objects with the delimiter in
+	// the name after the prefix are returned as a single entry with IsPrefix set, the name of the entry
+	// is the name up to and including the delimiter. The context applies to all pages of the listing
+	ListObjects(ctx context.Context, prefix string, delimiter string) BlobObjectIterator
 	String() string
 	Close()
 }
 
 // BlobStore
+//
+// The context passed to NewClient is only used to set up the client, each operation takes its own context
 type BlobStore interface {
 	NewClient(ctx context.Context) (BlobClient, error)
 	String() string
 }
+
+// bufferedBlobWriter collects the written data and stores it with BlobObject.Write when closed,
+// used by backends that can not stream uploads with a write condition
+type bufferedBlobWriter struct {
+	ctx    context.Context
+	object BlobObject
+	buffer bytes.Buffer
+}
+
+func newBufferedBlobWriter(ctx context.Context, object BlobObject) *bufferedBlobWriter {
+	return &bufferedBlobWriter{ctx: ctx, object: object}
+}
+
+func (w *bufferedBlobWriter) Write(p []byte) (int, error) {
+	return w.buffer.Write(p)
+}
+
+func (w *bufferedBlobWriter) Close() error {
+	ok, err := w.object.Write(w.ctx, w.buffer.Bytes())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrBlobWriteConditionFailed
+	}
+	return nil
+}
+
+// newBufferRangeReader returns a reader for a range of data, with the same range semantics as BlobObject.NewRangeReader
+func newBufferRangeReader(data []byte, offset int64, length int64) (io.ReadCloser, error) {
+	if offset < 0 || offset > int64(len(data)) {
+		return nil, errors.Errorf("range offset %d is outside object of size %d", offset, len(data))
+	}
+	end := int64(len(data))
+	if length >= 0 && offset+length < end {
+		end = offset + length
+	}
+	return ioutil.NopCloser(bytes.NewReader(data[offset:end])), nil
+}
+
+// writeWithWriter stores data using BlobObject.NewWriter and maps ErrBlobWriteConditionFailed to the Write() result
+func writeWithWriter(ctx context.Context, object BlobObject, data []byte) (bool, error) {
+	writer, err := object.NewWriter(ctx)
+	if err != nil {
+		return false, err
+	}
+	return writeToBlobWriter(writer, data)
+}
+
+// writeToBlobWriter writes data and closes writer, mapping ErrBlobWriteConditionFailed to the Write() result
+func writeToBlobWriter(writer io.WriteCloser, data []byte) (bool, error) {
+	_, err := writer.Write(data)
+	err2 := writer.Close()
+	if err != nil {
+		return false, err
+	}
+	if err2 == ErrBlobWriteConditionFailed {
+		return false, nil
+	}
+	if err2 != nil {
+		return false, err2
+	}
+	return true, nil
+}
+
+// getDelimitedName returns the name to list for an object given a listing delimiter, if the
+// object is rolled up into a common prefix the prefix is returned and isPrefix is true
+func getDelimitedName(name string, prefix string, delimiter string) (string, bool) {
+	if delimiter == "" {
+		return name, false
+	}
+	i := strings.Index(name[len(prefix):], delimiter)
+	if i == -1 {
+		return name, false
+	}
+	return name[:len(prefix)+i+len(delimiter)], true
+}
+
+// sliceBlobObjectIterator iterates over a listing that is already in memory
+type sliceBlobObjectIterator struct {
+	items []BlobProperties
+	err   error
+}
+
+func newSliceBlobObjectIterator(items []BlobProperties, err error) *sliceBlobObjectIterator {
+	return &sliceBlobObjectIterator{items: items, err: err}
+}
+
+func (it *sliceBlobObjectIterator) Next() (BlobProperties, error) {
+	if it.err != nil {
+		return BlobProperties{}, it.err
+	}
+	if len(it.items) == 0 {
+		return BlobProperties{}, ErrBlobIteratorDone
+	}
+	item := it.items[0]
+	it.items = it.items[1:]
+	return item, nil
+}
+
+// filterBlobProperties applies prefix and delimiter to a complete listing
+func filterBlobProperties(items []BlobProperties, prefix string, delimiter string) []BlobProperties {
+	result := make([]BlobProperties, 0, len(items))
+	seenPrefixes := make(map[string]bool)
+	for _, item := range items {
+		if !strings.HasPrefix(item.Name, prefix) {
+			continue
+		}
+		name, isPrefix := getDelimitedName(item.Name, prefix, delimiter)
+		if !isPrefix {
+			result = append(result, item)
+			continue
+		}
+		if seenPrefixes[name] {
+			continue
+		}
+		seenPrefixes[name] = true
+		result = append(result, BlobProperties{Name: name, IsPrefix: true})
+	}
+	return result
+}
@@ -0,0 +1,169 @@
+package longtailstorelib
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// BlobStoreOptions are passed to a BlobStoreFactory when creating a store for a URI
+type BlobStoreOptions struct {
+	// AccessType is how the store will be used, a factory can refuse access it does not support
+	AccessType AccessType
+}
+
+// BlobStoreFactory creates a BlobStore for a parsed URI
+type BlobStoreFactory func(u *url.URL, options BlobStoreOptions) (BlobStore, error)
+
+var (
+	blobStoreFactories      = make(map[string]BlobStoreFactory)
+	blobStoreFactoriesMutex sync.RWMutex
+)
+
+// RegisterBlobStoreScheme makes factory handle URIs with the scheme in ReadFromURI, WriteToURI
+// and CreateBlobStoreForURI. Registering a scheme that is already registered replaces the factory
+func RegisterBlobStoreScheme(scheme string, factory BlobStoreFactory) {
+	blobStoreFactoriesMutex.Lock()
+	defer blobStoreFactoriesMutex.Unlock()
+	blobStoreFactories[strings.ToLower(scheme)] = factory
+}
+
+// blobStoreDecorators are scheme prefixes that wrap the store of the rest of the scheme,
+// for example "encrypted+gs" is the store for "gs" wrapped by the "encrypted" decorator
+var blobStoreDecorators = make(map[string]BlobStoreFactory)
+
+// IsBlobStoreSchemeRegistered returns true if there is a factory for the scheme
+func IsBlobStoreSchemeRegistered(scheme string) bool {
+	scheme = strings.ToLower(scheme)
+	if i := strings.Index(scheme, "+"); i != -1 {
+		if _, exists := blobStoreDecorators[scheme[:i]]; !exists {
+			return false
+		}
+		return IsBlobStoreSchemeRegistered(scheme[i+1:])
+	}
+	blobStoreFactoriesMutex.RLock()
+	defer blobStoreFactoriesMutex.RUnlock()
+	_, exists := blobStoreFactories[scheme]
+	return exists
+}
+
+// CreateBlobStoreForURI creates a BlobStore using the factory registered for the URI scheme,
+// a URI without a registered scheme is treated as a local file system path
+func CreateBlobStoreForURI(uri string, options BlobStoreOptions) (BlobStore, error) {
+	blobStoreURL, err := url.Parse(uri)
+	if err == nil && IsBlobStoreSchemeRegistered(blobStoreURL.Scheme) {
+		return createBlobStoreForURL(blobStoreURL, options)
+	}
+
+	return NewFSBlobStore(uri)
+}
+
+// createBlobStoreForURL creates the store for a URL with a registered scheme, decorators get
+// the URL with their part of the scheme removed
+func createBlobStoreForURL(u *url.URL, options BlobStoreOptions) (BlobStore, error) {
+	if i := strings.Index(u.Scheme, "+"); i != -1 {
+		innerURL := *u
+		innerURL.Scheme = u.Scheme[i+1:]
+		return blobStoreDecorators[u.Scheme[:i]](&innerURL, options)
+	}
+	blobStoreFactoriesMutex.RLock()
+	factory := blobStoreFactories[u.Scheme]
+	blobStoreFactoriesMutex.RUnlock()
+	return factory(u, options)
+}
+
+// compositeURISeparator separates the URIs of the stores and the options in the URI of a composite
+// store, for example mirror:gs://bucket/store|fsblob:///S:/store|write-quorum=1
+const compositeURISeparator = "|"
+
+// compositeBlobStoreSchemes are the schemes whose URI is a list of URIs and options
+var compositeBlobStoreSchemes = map[string]bool{
+	"mirror": true,
+	"tiered": true,
+}
+
+// getCompositeURIElements returns the URIs of the stores and the options of a composite store URI
+func getCompositeURIElements(u *url.URL) ([]string, map[string]string) {
+	spec := u.Opaque
+	if u.RawQuery != "" {
+		// The query belongs to one of the URIs in the list
+		spec += "?" + u.RawQuery
+	}
+	uris := []string{}
+	options := make(map[string]string)
+	if spec == "" {
+		return uris, options
+	}
+	for _, element := range strings.Split(spec, compositeURISeparator) {
+		if isCompositeURIOption(element) {
+			i := strings.Index(element, "=")
+			options[element[:i]] = element[i+1:]
+			continue
+		}
+		uris = append(uris, element)
+	}
+	return uris, options
+}
+
+// isCompositeURIOption tells an option such as write-quorum=1 from a URI in a composite store URI
+func isCompositeURIOption(element string) bool {
+	i := strings.Index(element, "=")
+	if i <= 0 {
+		return false
+	}
+	for _, c := range element[:i] {
+		if (c < 'a' || c > 'z') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// splitCompositeURI splits each URI in a composite store URI into parent and name, the name is
+// expected to be the same for all of them
+func splitCompositeURI(scheme string, spec string) (string, string) {
+	elements := strings.Split(spec, compositeURISeparator)
+	name := ""
+	for i, element := range elements {
+		if isCompositeURIOption(element) {
+			continue
+		}
+		elements[i], name = splitURI(element)
+	}
+	return scheme + ":" + strings.Join(elements, compositeURISeparator), name
+}
+
+func init() {
+	blobStoreDecorators["encrypted"] = newEncryptedBlobStoreForURL
+
+	RegisterBlobStoreScheme("gs", func(u *url.URL, options BlobStoreOptions) (BlobStore, error) {
+		return NewGCSBlobStore(u)
+	})
+	RegisterBlobStoreScheme("s3", func(u *url.URL, options BlobStoreOptions) (BlobStore, error) {
+		return NewS3BlobStore(u)
+	})
+	azureFactory := func(u *url.URL, options BlobStoreOptions) (BlobStore, error) {
+		return NewAzureBlobStore(u)
+	}
+	RegisterBlobStoreScheme("abfs", azureFactory)
+	RegisterBlobStoreScheme("abfss", azureFactory)
+	httpFactory := func(u *url.URL, options BlobStoreOptions) (BlobStore, error) {
+		if options.AccessType != ReadOnly {
+			return nil, fmt.Errorf("http storage is read only, can not open %s for writing", u.String())
+		}
+		return NewHTTPBlobStore(u)
+	}
+	RegisterBlobStoreScheme("http", httpFactory)
+	RegisterBlobStoreScheme("https", httpFactory)
+	RegisterBlobStoreScheme("mem", func(u *url.URL, options BlobStoreOptions) (BlobStore, error) {
+		return NewMemBlobStore(u.Host + u.Path)
+	})
+	fsFactory := func(u *url.URL, options BlobStoreOptions) (BlobStore, error) {
+		return NewFSBlobStore(u.Path[1:])
+	}
+	RegisterBlobStoreScheme("file", fsFactory)
+	RegisterBlobStoreScheme("fsblob", fsFactory)
+	RegisterBlobStoreScheme("mirror", newMirroredBlobStoreForURL)
+	RegisterBlobStoreScheme("tiered", newTieredBlobStoreForURL)
+}
@@ -0,0 +1,71 @@
+package longtailstorelib
+
+import (
+	"context"
+	"net/url"
+	"testing"
+)
+
+func TestRegisterBlobStoreScheme(t *testing.T) {
+	var createdURL *url.URL
+	var createdOptions BlobStoreOptions
+	RegisterBlobStoreScheme("testscheme", func(u *url.URL, options BlobStoreOptions) (BlobStore, error) {
+		createdURL = u
+		createdOptions = options
+		return NewMemBlobStore("registry_test" + u.Path)
+	})
+	defer ReleaseMemBlobStore("registry_test")
+
+	if !IsBlobStoreSchemeRegistered("testscheme") {
+		t.Errorf("TestRegisterBlobStoreScheme() IsBlobStoreSchemeRegistered(\"testscheme\") %t != %t", false, true)
+	}
+	if IsBlobStoreSchemeRegistered("unknownscheme") {
+		t.Errorf("TestRegisterBlobStoreScheme() IsBlobStoreSchemeRegistered(\"unknownscheme\") %t != %t", true, false)
+	}
+
+	ctx := context.Background()
+	err := WriteToURI(ctx, "testscheme://host/the_path/file.txt", []byte("content"))
+	if err != nil {
+		t.Errorf("TestRegisterBlobStoreScheme() WriteToURI() %v != %v", err, nil)
+	}
+	if createdURL == nil || createdURL.Host != "host" || createdURL.Path != "/the_path" {
+		t.Errorf("TestRegisterBlobStoreScheme() factory url %v != %s", createdURL, "testscheme://host/the_path")
+	}
+	if createdOptions.AccessType != ReadWrite {
+		t.Errorf("TestRegisterBlobStoreScheme() factory options.AccessType %d != %d", createdOptions.AccessType, ReadWrite)
+	}
+
+	data, err := ReadFromURI(ctx, "testscheme://host/the_path/file.txt")
+	if err != nil {
+		t.Errorf("TestRegisterBlobStoreScheme() ReadFromURI() %v != %v", err, nil)
+	}
+	if string(data) != "content" {
+		t.Errorf("TestRegisterBlobStoreScheme() ReadFromURI() %s != %s", string(data), "content")
+	}
+	if createdOptions.AccessType != ReadOnly {
+		t.Errorf("TestRegisterBlobStoreScheme() factory options.AccessType %d != %d", createdOptions.AccessType, ReadOnly)
+	}
+
+	blobStore, err := CreateBlobStoreForURI("testscheme://host/the_path", BlobStoreOptions{AccessType: ReadOnly})
+	if err != nil {
+		t.Errorf("TestRegisterBlobStoreScheme() CreateBlobStoreForURI() %v != %v", err, nil)
+	}
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	obj, _ := client.NewObject("file.txt")
+	exists, _ := obj.Exists(ctx)
+	if !exists {
+		t.Errorf("TestRegisterBlobStoreScheme() obj.Exists() %t != %t", exists, true)
+	}
+}
+
+func TestHTTPSchemeIsReadOnly(t *testing.T) {
+	_, err := CreateBlobStoreForURI("https://cdn.example.com/store", BlobStoreOptions{AccessType: ReadWrite})
+	if err == nil {
+		t.Errorf("TestHTTPSchemeIsReadOnly() CreateBlobStoreForURI() err == nil")
+	}
+	_, err = CreateBlobStoreForURI("https://cdn.example.com/store", BlobStoreOptions{AccessType: ReadOnly})
+	if err != nil {
+		t.Errorf("TestHTTPSchemeIsReadOnly() CreateBlobStoreForURI() %v != %v", err, nil)
+	}
+}
@@ -3,143 +3,17 @@ package longtailstorelib
 import (
 	"context"
 	"fmt"
-	"sync"
+	"io/ioutil"
+	"sort"
 	"testing"
 
-	"cloud.google.com/go/storage"
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
 )
 
-type testBlob struct {
-	generation int
-	path       string
-	data       []byte
-}
-
-type testBlobStore struct {
-	blobs      map[string]*testBlob
-	blobsMutex sync.RWMutex
-	prefix     string
-}
-
-type testBlobClient struct {
-	store *testBlobStore
-}
-
-type testBlobObject struct {
-	client           *testBlobClient
-	path             string
-	lockedGeneration *int
-}
-
 // NewTestBlobStore ...
 func NewTestBlobStore(prefix string) (BlobStore, error) {
-	s := &testBlobStore{prefix: prefix, blobs: make(map[string]*testBlob)}
-	return s, nil
-}
-
-func (blobStore *testBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
-	return &testBlobClient{store: blobStore}, nil
-}
-
-func (blobStore *testBlobStore) String() string {
-	return "teststore"
-}
-
-func (blobClient *testBlobClient) NewObject(filepath string) (BlobObject, error) {
-	return &testBlobObject{client: blobClient, path: filepath}, nil
-}
-
-func (blobClient *testBlobClient) GetObjects() ([]BlobProperties, error) {
-	blobClient.store.blobsMutex.RLock()
-	defer blobClient.store.blobsMutex.RUnlock()
-	properties := make([]BlobProperties, len(blobClient.store.blobs))
-	i := 0
-	for key, blob := range blobClient.store.blobs {
-		properties[i] = BlobProperties{Name: key, Size: int64(len(blob.data))}
-		i++
-	}
-	return properties, nil
-}
-
-func (blobClient *testBlobClient) Close() {
-}
-
-func (blobClient *testBlobClient) String() string {
-	return "teststore"
-}
-
-func (blobObject *testBlobObject) Exists() (bool, error) {
-	blobObject.client.store.blobsMutex.RLock()
-	defer blobObject.client.store.blobsMutex.RUnlock()
-	_, exists := blobObject.client.store.blobs[blobObject.path]
-	return exists, nil
-}
-
-func (blobObject *testBlobObject) Read() ([]byte, error) {
-	blobObject.client.store.blobsMutex.RLock()
-	defer blobObject.client.store.blobsMutex.RUnlock()
-	blob, exists := blobObject.client.store.blobs[blobObject.path]
-	if !exists {
-		return nil, fmt.Errorf("testBlobObject object does not exist: %s", blobObject.path)
-	}
-	return blob.data, nil
-}
-
-func (blobObject *testBlobObject) LockWriteVersion() (bool, error) {
-	blobObject.client.store.blobsMutex.RLock()
-	defer blobObject.client.store.blobsMutex.RUnlock()
-	blob, exists := blobObject.client.store.blobs[blobObject.path]
-	blobObject.lockedGeneration = new(int)
-	if !exists {
-		*blobObject.lockedGeneration = -1
-		return false, nil
-	}
-	*blobObject.lockedGeneration = blob.generation
-	return true, nil
-}
-
-func (blobObject *testBlobObject) Write(data []byte) (bool, error) {
-	blobObject.client.store.blobsMutex.Lock()
-	defer blobObject.client.store.blobsMutex.Unlock()
-
-	blob, exists := blobObject.client.store.blobs[blobObject.path]
-
-	if blobObject.lockedGeneration != nil {
-		if exists {
-			if blob.generation != *blobObject.lockedGeneration {
-				return false, nil
-			}
-		} else if (*blobObject.lockedGeneration) != -1 {
-			return false, nil
-		}
-	}
-
-	if !exists {
-		blob = &testBlob{generation: 0, path: blobObject.path, data: data}
-		blobObject.client.store.blobs[blobObject.path] = blob
-		return true, nil
-	}
-
-	blob.data = data
-	blob.generation++
-	return true, nil
-}
-
-func (blobObject *testBlobObject) Delete() error {
-	blobObject.client.store.blobsMutex.Lock()
-	defer blobObject.client.store.blobsMutex.Unlock()
-
-	if blobObject.lockedGeneration != nil {
-		blob, exists := blobObject.client.store.blobs[blobObject.path]
-		if !exists {
-			return storage.ErrObjectNotExist
-		}
-		if blob.generation != *blobObject.lockedGeneration {
-			return fmt.Errorf("testBlobObject: generation lock mismatch %s", blobObject.path)
-		}
-	}
-	delete(blobObject.client.store.blobs, blobObject.path)
-	return nil
+	return NewMemBlobStore("/" + prefix)
 }
 
 func TestCreateStoreAndClient(t *testing.T) {
@@ -156,9 +30,10 @@ func TestCreateStoreAndClient(t *testing.T) {
 
 func TestListObjectsInEmptyStore(t *testing.T) {
 	blobStore, _ := NewTestBlobStore("the_path")
-	client, _ := blobStore.NewClient(context.Background())
+	ctx := context.Background()
+	client, _ := blobStore.NewClient(ctx)
 	defer client.Close()
-	objects, err := client.GetObjects()
+	objects, err := client.GetObjects(ctx)
 	if err != nil {
 		t.Errorf("TestListObjectsInEmptyStore() client.GetObjects()) %v != %v", err, nil)
 	}
@@ -166,9 +41,9 @@ func TestListObjectsInEmptyStore(t *testing.T) {
 		t.Errorf("TestListObjectsInEmptyStore() client.GetObjects()) %d != %d", len(objects), 0)
 	}
 	obj, _ := client.NewObject("should-not-exist")
-	data, err := obj.Read()
+	data, err := obj.Read(ctx)
 	if err == nil {
-		t.Errorf("TestListObjectsInEmptyStore() obj.Read()) %v != %v", fmt.Errorf("testBlobObject object does not exist: should-not-exist"), err)
+		t.Errorf("TestListObjectsInEmptyStore() obj.Read()) %v != %v", fmt.Errorf("memBlobObject object does not exist: the_path/should-not-exist"), err)
 	}
 	if data != nil {
 		t.Errorf("TestListObjectsInEmptyStore() obj.Read()) %v != %v", nil, data)
@@ -177,24 +52,25 @@ func TestListObjectsInEmptyStore(t *testing.T) {
 
 func TestSingleObjectStore(t *testing.T) {
 	blobStore, _ := NewTestBlobStore("the_path")
-	client, _ := blobStore.NewClient(context.Background())
+	ctx := context.Background()
+	client, _ := blobStore.NewClient(ctx)
 	defer client.Close()
 	obj, err := client.NewObject("my-fine-object.txt")
 	if err != nil {
 		t.Errorf("TestSingleObjectStore() client.NewObject(\"my-fine-object.txt\")) %v != %v", err, nil)
 	}
-	if exists, _ := obj.Exists(); exists {
+	if exists, _ := obj.Exists(ctx); exists {
 		t.Errorf("TestSingleObjectStore() obj.Exists()) %t != %t", exists, false)
 	}
 	testContent := "the content of the object"
-	ok, err := obj.Write([]byte(testContent))
+	ok, err := obj.Write(ctx, []byte(testContent))
 	if !ok {
 		t.Errorf("TestSingleObjectStore() obj.Write([]byte(testContent)) %t != %t", ok, true)
 	}
 	if err != nil {
 		t.Errorf("TestSingleObjectStore() obj.Write([]byte(testContent)) %v != %v", err, nil)
 	}
-	data, err := obj.Read()
+	data, err := obj.Read(ctx)
 	if err != nil {
 		t.Errorf("TestSingleObjectStore() obj.Read()) %v != %v", err, nil)
 	}
@@ -202,7 +78,7 @@ func TestSingleObjectStore(t *testing.T) {
 	if dataString != testContent {
 		t.Errorf("TestSingleObjectStore() string(data)) %s != %s", dataString, testContent)
 	}
-	err = obj.Delete()
+	err = obj.Delete(ctx)
 	if err != nil {
 		t.Errorf("TestSingleObjectStore() obj.Delete()) %v != %v", err, nil)
 	}
@@ -210,15 +86,16 @@ func TestSingleObjectStore(t *testing.T) {
 
 func TestListObjects(t *testing.T) {
 	blobStore, _ := NewTestBlobStore("the_path")
-	client, _ := blobStore.NewClient(context.Background())
+	ctx := context.Background()
+	client, _ := blobStore.NewClient(ctx)
 	defer client.Close()
 	obj, _ := client.NewObject("my-fine-object1.txt")
-	obj.Write([]byte("my-fine-object1.txt"))
+	obj.Write(ctx, []byte("my-fine-object1.txt"))
 	obj, _ = client.NewObject("my-fine-object2.txt")
-	obj.Write([]byte("my-fine-object2.txt"))
+	obj.Write(ctx, []byte("my-fine-object2.txt"))
 	obj, _ = client.NewObject("my-fine-object3.txt")
-	obj.Write([]byte("my-fine-object3.txt"))
-	objects, err := client.GetObjects()
+	obj.Write(ctx, []byte("my-fine-object3.txt"))
+	objects, err := client.GetObjects(ctx)
 	if err != nil {
 		t.Errorf("TestListObjects() client.GetObjects()) %v != %v", err, nil)
 	}
@@ -233,7 +110,7 @@ func TestListObjects(t *testing.T) {
 		if readObj == nil {
 			t.Errorf("TestListObjects() o.client.NewObject(o.Name)) %v == %v", readObj, nil)
 		}
-		data, err := readObj.Read()
+		data, err := readObj.Read(ctx)
 		if err != nil {
 			t.Errorf("TestListObjects() readObj.Read()) %v != %v", err, nil)
 		}
@@ -246,27 +123,28 @@ func TestListObjects(t *testing.T) {
 
 func TestGenerationWrite(t *testing.T) {
 	blobStore, _ := NewTestBlobStore("the_path")
-	client, _ := blobStore.NewClient(context.Background())
+	ctx := context.Background()
+	client, _ := blobStore.NewClient(ctx)
 	defer client.Close()
 	obj, _ := client.NewObject("my-fine-object.txt")
 	testContent1 := "the content of the object1"
 	testContent2 := "the content of the object2"
 	testContent3 := "the content of the object3"
-	exists, err := obj.LockWriteVersion()
+	exists, err := obj.LockWriteVersion(ctx)
 	if exists {
 		t.Errorf("TestGenerationWrite() obj.LockWriteVersion()) %t != %t", exists, false)
 	}
 	if err != nil {
 		t.Errorf("TestGenerationWrite() obj.LockWriteVersion()) %v != %v", err, nil)
 	}
-	ok, err := obj.Write([]byte(testContent1))
+	ok, err := obj.Write(ctx, []byte(testContent1))
 	if !ok {
 		t.Errorf("TestGenerationWrite() obj.Write([]byte(testContent1)) %t != %t", ok, true)
 	}
 	if err != nil {
 		t.Errorf("TestGenerationWrite() obj.Write([]byte(testContent1)) %v != %v", err, nil)
 	}
-	ok, err = obj.Write([]byte(testContent2))
+	ok, err = obj.Write(ctx, []byte(testContent2))
 	if ok {
 		t.Errorf("TestGenerationWrite() obj.Write([]byte(testContent2))) %t != %t", ok, false)
 	}
@@ -274,41 +152,276 @@ func TestGenerationWrite(t *testing.T) {
 		t.Errorf("TestGenerationWrite() obj.Write([]byte(testContent2))) %v != %v", err, nil)
 	}
 	obj2, _ := client.NewObject("my-fine-object.txt")
-	exists, err = obj.LockWriteVersion()
+	exists, err = obj.LockWriteVersion(ctx)
 	if !exists {
 		t.Errorf("TestGenerationWrite() obj.LockWriteVersion()) %t != %t", exists, true)
 	}
 	if err != nil {
 		t.Errorf("TestGenerationWrite() obj.LockWriteVersion()) %v != %v", err, nil)
 	}
-	exists, err = obj2.LockWriteVersion()
+	exists, err = obj2.LockWriteVersion(ctx)
 	if !exists {
 		t.Errorf("TestGenerationWrite() obj2.LockWriteVersion()) %t != %t", exists, true)
 	}
 	if err != nil {
 		t.Errorf("TestGenerationWrite() obj2.LockWriteVersion()) %v != %v", err, nil)
 	}
-	ok, err = obj.Write([]byte(testContent2))
+	ok, err = obj.Write(ctx, []byte(testContent2))
 	if !ok {
 		t.Errorf("TestGenerationWrite() obj.Write([]byte(testContent2))) %t != %t", ok, true)
 	}
 	if err != nil {
 		t.Errorf("TestGenerationWrite() obj.Write([]byte(testContent2))) %v != %v", err, nil)
 	}
-	ok, err = obj2.Write([]byte(testContent3))
+	ok, err = obj2.Write(ctx, []byte(testContent3))
 	if ok {
 		t.Errorf("TestGenerationWrite() obj2.Write([]byte(testContent3))) %t != %t", ok, false)
 	}
 	if err != nil {
 		t.Errorf("TestGenerationWrite() obj2.Write([]byte(testContent3))) %v != %v", err, nil)
 	}
-	err = obj.Delete()
+	err = obj.Delete(ctx)
 	if err == nil {
 		t.Errorf("TestGenerationWrite() obj.Delete()) %v == %v", err, nil)
 	}
-	obj.LockWriteVersion()
-	err = obj.Delete()
+	obj.LockWriteVersion(ctx)
+	err = obj.Delete(ctx)
 	if err != nil {
 		t.Errorf("TestGenerationWrite() obj.Delete()) %v != %v", err, nil)
 	}
 }
+
+func TestGenerationWriteRecreatedObject(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	ctx := context.Background()
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	obj, _ := client.NewObject("my-fine-object.txt")
+	obj2, _ := client.NewObject("my-fine-object.txt")
+	obj.Write(ctx, []byte("first"))
+
+	// A deleted and recreated object does not match a write version locked before the delete
+	obj2.LockWriteVersion(ctx)
+	obj.Delete(ctx)
+	obj.Write(ctx, []byte("second"))
+	ok, err := obj2.Write(ctx, []byte("third"))
+	if ok || err != nil {
+		t.Errorf("TestGenerationWriteRecreatedObject() obj2.Write([]byte(\"third\")) %t, %v != %t, %v", ok, err, false, nil)
+	}
+
+	obj.Delete(ctx)
+	_, err = obj.Read(ctx)
+	if errors.Cause(err) != longtaillib.ErrENOENT {
+		t.Errorf("TestGenerationWriteRecreatedObject() obj.Read() %v != %v", err, longtaillib.ErrENOENT)
+	}
+	err = obj.Delete(ctx)
+	if errors.Cause(err) != longtaillib.ErrENOENT {
+		t.Errorf("TestGenerationWriteRecreatedObject() obj.Delete() %v != %v", err, longtaillib.ErrENOENT)
+	}
+	obj2.LockWriteVersion(ctx)
+	err = obj2.Delete(ctx)
+	if errors.Cause(err) != longtaillib.ErrENOENT {
+		t.Errorf("TestGenerationWriteRecreatedObject() obj2.Delete() %v != %v", err, longtaillib.ErrENOENT)
+	}
+}
+
+func TestSharedNamedStore(t *testing.T) {
+	defer ReleaseMemBlobStore("shared-store")
+	blobStore1, _ := NewMemBlobStore("shared-store/the_path")
+	blobStore2, _ := NewMemBlobStore("shared-store/the_path")
+	otherPrefixStore, _ := NewMemBlobStore("shared-store/other_path")
+	privateStore, _ := NewMemBlobStore("/the_path")
+	ctx := context.Background()
+	client1, _ := blobStore1.NewClient(ctx)
+	defer client1.Close()
+	client2, _ := blobStore2.NewClient(ctx)
+	defer client2.Close()
+	otherPrefixClient, _ := otherPrefixStore.NewClient(ctx)
+	defer otherPrefixClient.Close()
+	privateClient, _ := privateStore.NewClient(ctx)
+	defer privateClient.Close()
+
+	obj1, _ := client1.NewObject("my-fine-object.txt")
+	obj1.LockWriteVersion(ctx)
+	obj2, _ := client2.NewObject("my-fine-object.txt")
+	obj2.LockWriteVersion(ctx)
+	ok, err := obj1.Write(ctx, []byte("client1"))
+	if !ok || err != nil {
+		t.Errorf("TestSharedNamedStore() obj1.Write() %t, %v != %t, %v", ok, err, true, nil)
+	}
+	ok, err = obj2.Write(ctx, []byte("client2"))
+	if ok || err != nil {
+		t.Errorf("TestSharedNamedStore() obj2.Write() %t, %v != %t, %v", ok, err, false, nil)
+	}
+	data, err := obj2.Read(ctx)
+	if err != nil {
+		t.Errorf("TestSharedNamedStore() obj2.Read() %v != %v", err, nil)
+	}
+	if string(data) != "client1" {
+		t.Errorf("TestSharedNamedStore() obj2.Read() %s != %s", string(data), "client1")
+	}
+	data[0] = 'C'
+	data, _ = obj1.Read(ctx)
+	if string(data) != "client1" {
+		t.Errorf("TestSharedNamedStore() obj1.Read() after changing read data %s != %s", string(data), "client1")
+	}
+
+	objects, _ := otherPrefixClient.GetObjects(ctx)
+	if len(objects) != 0 {
+		t.Errorf("TestSharedNamedStore() otherPrefixClient.GetObjects() %d != %d", len(objects), 0)
+	}
+	objects, _ = privateClient.GetObjects(ctx)
+	if len(objects) != 0 {
+		t.Errorf("TestSharedNamedStore() privateClient.GetObjects() %d != %d", len(objects), 0)
+	}
+	objects, _ = client2.GetObjects(ctx)
+	if len(objects) != 1 || objects[0].Name != "my-fine-object.txt" {
+		t.Errorf("TestSharedNamedStore() client2.GetObjects() %v != [my-fine-object.txt]", objects)
+	}
+}
+
+func TestStreamingReadWrite(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	ctx := context.Background()
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	obj, _ := client.NewObject("my-fine-object.txt")
+	writer, err := obj.NewWriter(ctx)
+	if err != nil {
+		t.Errorf("TestStreamingReadWrite() obj.NewWriter() %v != %v", err, nil)
+	}
+	writer.Write([]byte("0123"))
+	writer.Write([]byte("456789"))
+	err = writer.Close()
+	if err != nil {
+		t.Errorf("TestStreamingReadWrite() writer.Close() %v != %v", err, nil)
+	}
+	reader, err := obj.NewRangeReader(ctx, 2, 5)
+	if err != nil {
+		t.Errorf("TestStreamingReadWrite() obj.NewRangeReader(2, 5) %v != %v", err, nil)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if string(data) != "23456" {
+		t.Errorf("TestStreamingReadWrite() obj.NewRangeReader(2, 5) %s != %s", string(data), "23456")
+	}
+	reader, _ = obj.NewRangeReader(ctx, 8, 100)
+	data, _ = ioutil.ReadAll(reader)
+	reader.Close()
+	if string(data) != "89" {
+		t.Errorf("TestStreamingReadWrite() obj.NewRangeReader(8, 100) %s != %s", string(data), "89")
+	}
+	_, err = obj.NewRangeReader(ctx, 11, 1)
+	if err == nil {
+		t.Errorf("TestStreamingReadWrite() obj.NewRangeReader(11, 1) %v == %v", err, nil)
+	}
+
+	obj.LockWriteVersion(ctx)
+	obj2, _ := client.NewObject("my-fine-object.txt")
+	obj2.Write(ctx, []byte("changed"))
+	writer, _ = obj.NewWriter(ctx)
+	writer.Write([]byte("stale"))
+	err = writer.Close()
+	if err != ErrBlobWriteConditionFailed {
+		t.Errorf("TestStreamingReadWrite() writer.Close() %v != %v", err, ErrBlobWriteConditionFailed)
+	}
+}
+
+func TestObjectAttributes(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	ctx := context.Background()
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	obj, _ := client.NewObject("my-fine-object.txt")
+	_, err := obj.GetAttributes(ctx)
+	if errors.Cause(err) != longtaillib.ErrENOENT {
+		t.Errorf("TestObjectAttributes() obj.GetAttributes() %v != %v", errors.Cause(err), longtaillib.ErrENOENT)
+	}
+	obj.SetWriteAttributes("text/plain", map[string]string{"owner": "build_machine"})
+	obj.Write(ctx, []byte("the content"))
+	attributes, err := obj.GetAttributes(ctx)
+	if err != nil {
+		t.Errorf("TestObjectAttributes() obj.GetAttributes() %v != %v", err, nil)
+	}
+	if attributes.Size != 11 {
+		t.Errorf("TestObjectAttributes() attributes.Size %d != %d", attributes.Size, 11)
+	}
+	if attributes.ContentType != "text/plain" {
+		t.Errorf("TestObjectAttributes() attributes.ContentType %s != %s", attributes.ContentType, "text/plain")
+	}
+	if attributes.Metadata["owner"] != "build_machine" {
+		t.Errorf("TestObjectAttributes() attributes.Metadata[\"owner\"] %s != %s", attributes.Metadata["owner"], "build_machine")
+	}
+	obj.Write(ctx, []byte("the new content"))
+	newAttributes, _ := obj.GetAttributes(ctx)
+	if newAttributes.Generation == attributes.Generation {
+		t.Errorf("TestObjectAttributes() newAttributes.Generation %s == %s", newAttributes.Generation, attributes.Generation)
+	}
+}
+
+func listAllObjects(ctx context.Context, t *testing.T, client BlobClient, prefix string, delimiter string) []BlobProperties {
+	var items []BlobProperties
+	it := client.ListObjects(ctx, prefix, delimiter)
+	for {
+		item, err := it.Next()
+		if err == ErrBlobIteratorDone {
+			break
+		}
+		if err != nil {
+			t.Errorf("listAllObjects() it.Next() %v != %v", err, nil)
+			break
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items
+}
+
+func validateListing(ctx context.Context, t *testing.T, client BlobClient, prefix string, delimiter string, expected []BlobProperties) {
+	items := listAllObjects(ctx, t, client, prefix, delimiter)
+	if len(items) != len(expected) {
+		t.Errorf("validateListing() ListObjects(%q, %q) %v != %v", prefix, delimiter, items, expected)
+		return
+	}
+	for i := range expected {
+		if items[i] != expected[i] {
+			t.Errorf("validateListing() ListObjects(%q, %q) item %d %v != %v", prefix, delimiter, i, items[i], expected[i])
+		}
+	}
+}
+
+func writeListingTestObjects(ctx context.Context, client BlobClient) {
+	for _, name := range []string{"store.lsi", "chunks/0001/0x0001000000000000.lsb", "chunks/0001/0x0001000000000001.lsb", "chunks/0002/0x0002000000000000.lsb", "index/version.lvi"} {
+		obj, _ := client.NewObject(name)
+		obj.Write(ctx, []byte(name))
+	}
+}
+
+func validateListingTestObjects(ctx context.Context, t *testing.T, client BlobClient) {
+	validateListing(ctx, t, client, "", "/", []BlobProperties{
+		{Name: "chunks/", IsPrefix: true},
+		{Name: "index/", IsPrefix: true},
+		{Name: "store.lsi", Size: 9}})
+	validateListing(ctx, t, client, "chunks/", "/", []BlobProperties{
+		{Name: "chunks/0001/", IsPrefix: true},
+		{Name: "chunks/0002/", IsPrefix: true}})
+	validateListing(ctx, t, client, "chunks/0001/", "", []BlobProperties{
+		{Name: "chunks/0001/0x0001000000000000.lsb", Size: 34},
+		{Name: "chunks/0001/0x0001000000000001.lsb", Size: 34}})
+	validateListing(ctx, t, client, "chunks/000", "", []BlobProperties{
+		{Name: "chunks/0001/0x0001000000000000.lsb", Size: 34},
+		{Name: "chunks/0001/0x0001000000000001.lsb", Size: 34},
+		{Name: "chunks/0002/0x0002000000000000.lsb", Size: 34}})
+	validateListing(ctx, t, client, "index", "", []BlobProperties{
+		{Name: "index/version.lvi", Size: 17}})
+	validateListing(ctx, t, client, "missing/", "", []BlobProperties{})
+}
+
+func TestListObjectsWithPrefixAndDelimiter(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	ctx := context.Background()
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	writeListingTestObjects(ctx, client)
+	validateListingTestObjects(ctx, t, client)
+}
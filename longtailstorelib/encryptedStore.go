@@ -0,0 +1,331 @@
+package longtailstorelib
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// Encrypted objects are stored as magic, key id length (1 byte), key id, nonce and the AES-GCM ciphertext
+// with tag. The magic, key id and object path are authenticated as additional data so the header can not be
+// swapped and an encrypted object can not be copied to another path
+const (
+	encryptedBlobMagic       = "LTE1"
+	encryptedBlobNonceSize   = 12
+	encryptedBlobTagSize     = 16
+	encryptionKeyIDMetadata  = "longtail_encryption_key_id"
+	defaultEncryptionKeyEnv  = "LONGTAIL_ENCRYPTION_KEY"
+	encryptionKeyFileParam   = "key-file"
+	encryptionKeyEnvParam    = "key-env"
+	encryptionKeyIDParam     = "key-id"
+	maxEncryptionKeyIDLength = 255
+)
+
+type encryptedBlobStore struct {
+	blobStore BlobStore
+	keyID     string
+	aead      cipher.AEAD
+	header    []byte
+}
+
+type encryptedBlobClient struct {
+	store  *encryptedBlobStore
+	client BlobClient
+}
+
+type encryptedBlobObject struct {
+	store  *encryptedBlobStore
+	object BlobObject
+	path   string
+}
+
+type encryptedBlobObjectIterator struct {
+	store    *encryptedBlobStore
+	iterator BlobObjectIterator
+}
+
+// NewEncryptedBlobStore wraps blobStore so object content is encrypted with AES-GCM before it is
+// written and decrypted after it is read. The key must be 16, 24 or 32 bytes, keyID is stored
+// in each object so reading with the wrong key gives a clear error
+func NewEncryptedBlobStore(blobStore BlobStore, keyID string, key []byte) (BlobStore, error) {
+	if len(keyID) > maxEncryptionKeyIDLength {
+		return nil, errors.Wrapf(longtaillib.ErrEINVAL, "encryption key id `%s` is longer than %d characters", keyID, maxEncryptionKeyIDLength)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrapf(longtaillib.ErrEINVAL, "invalid encryption key: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "cipher.NewGCM() failed")
+	}
+	header := make([]byte, 0, len(encryptedBlobMagic)+1+len(keyID))
+	header = append(header, encryptedBlobMagic...)
+	header = append(header, byte(len(keyID)))
+	header = append(header, keyID...)
+	s := &encryptedBlobStore{blobStore: blobStore, keyID: keyID, aead: aead, header: header}
+	return s, nil
+}
+
+// GetEncryptionKeyID returns the key id used when no key id is given, derived from the key
+func GetEncryptionKeyID(key []byte) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:8])
+}
+
+// newEncryptedBlobStoreForURL creates the store for the URL without the "encrypted+" scheme prefix,
+// the key is read from the file in the key-file parameter or the environment variable in key-env
+func newEncryptedBlobStoreForURL(u *url.URL, options BlobStoreOptions) (BlobStore, error) {
+	query := u.Query()
+	var key []byte
+	var err error
+	if keyFile := query.Get(encryptionKeyFileParam); keyFile != "" {
+		keyData, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read encryption key from `%s`", keyFile)
+		}
+		key, err = parseEncryptionKey(keyData)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse encryption key in `%s`", keyFile)
+		}
+	} else {
+		keyEnv := query.Get(encryptionKeyEnvParam)
+		if keyEnv == "" {
+			keyEnv = defaultEncryptionKeyEnv
+		}
+		keyText := os.Getenv(keyEnv)
+		if keyText == "" {
+			return nil, errors.Wrapf(longtaillib.ErrEINVAL, "no encryption key for `%s`, set %s or use the %s parameter", u.String(), keyEnv, encryptionKeyFileParam)
+		}
+		key, err = parseEncryptionKey([]byte(keyText))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse encryption key in %s", keyEnv)
+		}
+	}
+	keyID := query.Get(encryptionKeyIDParam)
+	if keyID == "" {
+		keyID = GetEncryptionKeyID(key)
+	}
+
+	query.Del(encryptionKeyFileParam)
+	query.Del(encryptionKeyEnvParam)
+	query.Del(encryptionKeyIDParam)
+	innerURL := *u
+	innerURL.RawQuery = query.Encode()
+	blobStore, err := createBlobStoreForURL(&innerURL, options)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptedBlobStore(blobStore, keyID, key)
+}
+
+// parseEncryptionKey accepts a hex or base64 encoded key, or the raw key bytes
+func parseEncryptionKey(data []byte) ([]byte, error) {
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && isValidEncryptionKeyLength(len(key)) {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && isValidEncryptionKeyLength(len(key)) {
+		return key, nil
+	}
+	if isValidEncryptionKeyLength(len(data)) {
+		return data, nil
+	}
+	return nil, errors.Wrap(longtaillib.ErrEINVAL, "encryption key must be 16, 24 or 32 bytes, hex or base64 encoded")
+}
+
+func isValidEncryptionKeyLength(length int) bool {
+	return length == 16 || length == 24 || length == 32
+}
+
+// overhead is the number of bytes an encrypted object is larger than its content
+func (s *encryptedBlobStore) overhead() int64 {
+	return int64(len(s.header) + encryptedBlobNonceSize + encryptedBlobTagSize)
+}
+
+func (s *encryptedBlobStore) plainSize(size int64) int64 {
+	if size < s.overhead() {
+		return size
+	}
+	return size - s.overhead()
+}
+
+// additionalData is the header followed by the path of the object
+func additionalData(header []byte, path string) []byte {
+	result := make([]byte, 0, len(header)+len(path))
+	result = append(result, header...)
+	return append(result, path...)
+}
+
+func (s *encryptedBlobStore) encrypt(path string, data []byte) ([]byte, error) {
+	result := make([]byte, len(s.header)+encryptedBlobNonceSize, len(s.header)+encryptedBlobNonceSize+len(data)+encryptedBlobTagSize)
+	copy(result, s.header)
+	nonce := result[len(s.header):]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "failed to generate encryption nonce")
+	}
+	return s.aead.Seal(result, nonce, data, additionalData(s.header, path)), nil
+}
+
+func (s *encryptedBlobStore) decrypt(path string, data []byte) ([]byte, error) {
+	if len(data) < len(encryptedBlobMagic)+1 || string(data[:len(encryptedBlobMagic)]) != encryptedBlobMagic {
+		return nil, errors.Wrapf(longtaillib.ErrEACCES, "`%s` is not encrypted", path)
+	}
+	headerSize := len(encryptedBlobMagic) + 1 + int(data[len(encryptedBlobMagic)])
+	if len(data) < headerSize+encryptedBlobNonceSize+encryptedBlobTagSize {
+		return nil, errors.Wrapf(longtaillib.ErrEACCES, "encrypted object `%s` is truncated", path)
+	}
+	header := data[:headerSize]
+	keyID := string(header[len(encryptedBlobMagic)+1:])
+	if keyID != s.keyID {
+		return nil, errors.Wrapf(longtaillib.ErrEACCES, "`%s` is encrypted with key `%s`, not `%s`", path, keyID, s.keyID)
+	}
+	nonce := data[headerSize : headerSize+encryptedBlobNonceSize]
+	plain, err := s.aead.Open(nil, nonce, data[headerSize+encryptedBlobNonceSize:], additionalData(header, path))
+	if err != nil {
+		return nil, errors.Wrapf(longtaillib.ErrEACCES, "failed to decrypt `%s` with key `%s`: %v", path, s.keyID, err)
+	}
+	return plain, nil
+}
+
+func (s *encryptedBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
+	client, err := s.blobStore.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedBlobClient{store: s, client: client}, nil
+}
+
+func (s *encryptedBlobStore) String() string {
+	return "encrypted+" + s.blobStore.String()
+}
+
+// IsRetryableError forwards to the classification of the wrapped store, decryption errors are never retried
+func (s *encryptedBlobStore) IsRetryableError(err error) bool {
+	if classifier, ok := s.blobStore.(BlobErrorClassifier); ok {
+		return classifier.IsRetryableError(err)
+	}
+	return true
+}
+
+func (blobClient *encryptedBlobClient) NewObject(path string) (BlobObject, error) {
+	object, err := blobClient.client.NewObject(path)
+	if err != nil {
+		return nil, err
+	}
+	object.SetWriteAttributes("", map[string]string{encryptionKeyIDMetadata: blobClient.store.keyID})
+	return &encryptedBlobObject{store: blobClient.store, object: object, path: path}, nil
+}
+
+func (blobClient *encryptedBlobClient) GetObjects(ctx context.Context) ([]BlobProperties, error) {
+	items, err := blobClient.client.GetObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range items {
+		items[i].Size = blobClient.store.plainSize(items[i].Size)
+	}
+	return items, nil
+}
+
+func (blobClient *encryptedBlobClient) ListObjects(ctx context.Context, prefix string, delimiter string) BlobObjectIterator {
+	return &encryptedBlobObjectIterator{store: blobClient.store, iterator: blobClient.client.ListObjects(ctx, prefix, delimiter)}
+}
+
+func (blobClient *encryptedBlobClient) Close() {
+	blobClient.client.Close()
+}
+
+func (blobClient *encryptedBlobClient) String() string {
+	return "encrypted+" + blobClient.client.String()
+}
+
+func (it *encryptedBlobObjectIterator) Next() (BlobProperties, error) {
+	item, err := it.iterator.Next()
+	if err != nil {
+		return item, err
+	}
+	if !item.IsPrefix {
+		item.Size = it.store.plainSize(item.Size)
+	}
+	return item, nil
+}
+
+func (blobObject *encryptedBlobObject) Exists(ctx context.Context) (bool, error) {
+	return blobObject.object.Exists(ctx)
+}
+
+func (blobObject *encryptedBlobObject) LockWriteVersion(ctx context.Context) (bool, error) {
+	return blobObject.object.LockWriteVersion(ctx)
+}
+
+func (blobObject *encryptedBlobObject) Read(ctx context.Context) ([]byte, error) {
+	data, err := blobObject.object.Read(ctx)
+	if err != nil || data == nil {
+		return data, err
+	}
+	return blobObject.store.decrypt(blobObject.path, data)
+}
+
+func (blobObject *encryptedBlobObject) Write(ctx context.Context, data []byte) (bool, error) {
+	encrypted, err := blobObject.store.encrypt(blobObject.path, data)
+	if err != nil {
+		return false, err
+	}
+	return blobObject.object.Write(ctx, encrypted)
+}
+
+func (blobObject *encryptedBlobObject) Delete(ctx context.Context) error {
+	return blobObject.object.Delete(ctx)
+}
+
+// NewReader decrypts the whole object before returning the reader, the tag can only be checked on the full content
+func (blobObject *encryptedBlobObject) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	return blobObject.NewRangeReader(ctx, 0, -1)
+}
+
+func (blobObject *encryptedBlobObject) NewRangeReader(ctx context.Context, offset int64, length int64) (io.ReadCloser, error) {
+	data, err := blobObject.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	return newBufferRangeReader(data, offset, length)
+}
+
+func (blobObject *encryptedBlobObject) NewWriter(ctx context.Context) (io.WriteCloser, error) {
+	return newBufferedBlobWriter(ctx, blobObject), nil
+}
+
+func (blobObject *encryptedBlobObject) GetAttributes(ctx context.Context) (BlobObjectAttributes, error) {
+	attributes, err := blobObject.object.GetAttributes(ctx)
+	if err != nil {
+		return attributes, err
+	}
+	attributes.Size = blobObject.store.plainSize(attributes.Size)
+	return attributes, nil
+}
+
+func (blobObject *encryptedBlobObject) SetWriteAttributes(contentType string, metadata map[string]string) {
+	encryptedMetadata := make(map[string]string, len(metadata)+1)
+	for k, v := range metadata {
+		encryptedMetadata[k] = v
+	}
+	encryptedMetadata[encryptionKeyIDMetadata] = blobObject.store.keyID
+	blobObject.object.SetWriteAttributes(contentType, encryptedMetadata)
+}
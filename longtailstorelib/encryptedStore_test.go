@@ -0,0 +1,162 @@
+package longtailstorelib
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+var testEncryptionKey = []byte("0123456789abcdef0123456789abcdef")
+
+func newTestEncryptedBlobStore(t *testing.T, name string, key []byte) (BlobStore, BlobStore) {
+	memStore, err := NewMemBlobStore(name)
+	if err != nil {
+		t.Fatalf("newTestEncryptedBlobStore() NewMemBlobStore() %v != %v", err, nil)
+	}
+	blobStore, err := NewEncryptedBlobStore(memStore, GetEncryptionKeyID(key), key)
+	if err != nil {
+		t.Fatalf("newTestEncryptedBlobStore() NewEncryptedBlobStore() %v != %v", err, nil)
+	}
+	return blobStore, memStore
+}
+
+func TestEncryptedBlobStoreRoundtrip(t *testing.T) {
+	ctx := context.Background()
+	blobStore, memStore := newTestEncryptedBlobStore(t, "encrypted_roundtrip", testEncryptionKey)
+	defer ReleaseMemBlobStore("encrypted_roundtrip")
+
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	obj, _ := client.NewObject("chunks/0000/0000000000000000.lsb")
+	content := []byte("the content of the block that should not be readable in the store")
+	ok, err := obj.Write(ctx, content)
+	if !ok || err != nil {
+		t.Errorf("TestEncryptedBlobStoreRoundtrip() obj.Write() %t, %v != %t, %v", ok, err, true, nil)
+	}
+	data, err := obj.Read(ctx)
+	if err != nil {
+		t.Errorf("TestEncryptedBlobStoreRoundtrip() obj.Read() %v != %v", err, nil)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("TestEncryptedBlobStoreRoundtrip() obj.Read() %s != %s", string(data), string(content))
+	}
+
+	memClient, _ := memStore.NewClient(ctx)
+	defer memClient.Close()
+	memObj, _ := memClient.NewObject("chunks/0000/0000000000000000.lsb")
+	stored, _ := memObj.Read(ctx)
+	if bytes.Contains(stored, content) {
+		t.Errorf("TestEncryptedBlobStoreRoundtrip() stored data contains plain text")
+	}
+
+	attributes, err := obj.GetAttributes(ctx)
+	if err != nil {
+		t.Errorf("TestEncryptedBlobStoreRoundtrip() obj.GetAttributes() %v != %v", err, nil)
+	}
+	if attributes.Size != int64(len(content)) {
+		t.Errorf("TestEncryptedBlobStoreRoundtrip() attributes.Size %d != %d", attributes.Size, len(content))
+	}
+	if attributes.Metadata[encryptionKeyIDMetadata] != GetEncryptionKeyID(testEncryptionKey) {
+		t.Errorf("TestEncryptedBlobStoreRoundtrip() attributes.Metadata[%s] %s != %s", encryptionKeyIDMetadata, attributes.Metadata[encryptionKeyIDMetadata], GetEncryptionKeyID(testEncryptionKey))
+	}
+	objects, _ := client.GetObjects(ctx)
+	if len(objects) != 1 || objects[0].Size != int64(len(content)) {
+		t.Errorf("TestEncryptedBlobStoreRoundtrip() client.GetObjects() %v", objects)
+	}
+
+	reader, err := obj.NewRangeReader(ctx, 4, 7)
+	if err != nil {
+		t.Errorf("TestEncryptedBlobStoreRoundtrip() obj.NewRangeReader() %v != %v", err, nil)
+	}
+	rangeData, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if string(rangeData) != "content" {
+		t.Errorf("TestEncryptedBlobStoreRoundtrip() obj.NewRangeReader() %s != %s", string(rangeData), "content")
+	}
+}
+
+func TestEncryptedBlobStoreWrongKey(t *testing.T) {
+	ctx := context.Background()
+	blobStore, memStore := newTestEncryptedBlobStore(t, "encrypted_wrong_key", testEncryptionKey)
+	defer ReleaseMemBlobStore("encrypted_wrong_key")
+
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	obj, _ := client.NewObject("store.lsi")
+	obj.Write(ctx, []byte("index"))
+
+	otherKey := []byte("fedcba9876543210fedcba9876543210")
+	otherStore, _ := NewEncryptedBlobStore(memStore, GetEncryptionKeyID(otherKey), otherKey)
+	otherClient, _ := otherStore.NewClient(ctx)
+	defer otherClient.Close()
+	otherObj, _ := otherClient.NewObject("store.lsi")
+	_, err := otherObj.Read(ctx)
+	if errors.Cause(err) != longtaillib.ErrEACCES {
+		t.Errorf("TestEncryptedBlobStoreWrongKey() otherObj.Read() %v != %v", err, longtaillib.ErrEACCES)
+	}
+
+	sameIDStore, _ := NewEncryptedBlobStore(memStore, GetEncryptionKeyID(testEncryptionKey), otherKey)
+	sameIDClient, _ := sameIDStore.NewClient(ctx)
+	defer sameIDClient.Close()
+	sameIDObj, _ := sameIDClient.NewObject("store.lsi")
+	_, err = sameIDObj.Read(ctx)
+	if errors.Cause(err) != longtaillib.ErrEACCES {
+		t.Errorf("TestEncryptedBlobStoreWrongKey() sameIDObj.Read() %v != %v", err, longtaillib.ErrEACCES)
+	}
+}
+
+func TestEncryptedBlobStoreMovedObject(t *testing.T) {
+	ctx := context.Background()
+	blobStore, memStore := newTestEncryptedBlobStore(t, "encrypted_moved_object", testEncryptionKey)
+	defer ReleaseMemBlobStore("encrypted_moved_object")
+
+	writeTestObject(ctx, blobStore, "store-deltas/0001.lsi", []byte("index"))
+	encrypted, _ := readTestObject(ctx, memStore, "store-deltas/0001.lsi")
+	writeTestObject(ctx, memStore, "store.lsi", encrypted)
+
+	_, err := readTestObject(ctx, blobStore, "store.lsi")
+	if errors.Cause(err) != longtaillib.ErrEACCES {
+		t.Errorf("TestEncryptedBlobStoreMovedObject() Read() %v != %v", err, longtaillib.ErrEACCES)
+	}
+	data, err := readTestObject(ctx, blobStore, "store-deltas/0001.lsi")
+	if err != nil || string(data) != "index" {
+		t.Errorf("TestEncryptedBlobStoreMovedObject() Read() %s, %v != %s, %v", string(data), err, "index", nil)
+	}
+}
+
+func TestEncryptedBlobStoreURI(t *testing.T) {
+	ctx := context.Background()
+	os.Setenv("LONGTAIL_TEST_ENCRYPTION_KEY", hex.EncodeToString(testEncryptionKey))
+	defer os.Unsetenv("LONGTAIL_TEST_ENCRYPTION_KEY")
+	defer ReleaseMemBlobStore("encrypted_uri")
+
+	if !IsBlobStoreSchemeRegistered("encrypted+mem") {
+		t.Errorf("TestEncryptedBlobStoreURI() IsBlobStoreSchemeRegistered(\"encrypted+mem\") %t != %t", false, true)
+	}
+	if IsBlobStoreSchemeRegistered("encrypted+unknownscheme") {
+		t.Errorf("TestEncryptedBlobStoreURI() IsBlobStoreSchemeRegistered(\"encrypted+unknownscheme\") %t != %t", true, false)
+	}
+
+	uri := "encrypted+mem://encrypted_uri/version.lvi?key-env=LONGTAIL_TEST_ENCRYPTION_KEY"
+	err := WriteToURI(ctx, uri, []byte("version index"))
+	if err != nil {
+		t.Errorf("TestEncryptedBlobStoreURI() WriteToURI() %v != %v", err, nil)
+	}
+	data, err := ReadFromURI(ctx, uri)
+	if err != nil {
+		t.Errorf("TestEncryptedBlobStoreURI() ReadFromURI() %v != %v", err, nil)
+	}
+	if string(data) != "version index" {
+		t.Errorf("TestEncryptedBlobStoreURI() ReadFromURI() %s != %s", string(data), "version index")
+	}
+	data, _ = ReadFromURI(ctx, "mem://encrypted_uri/version.lvi")
+	if string(data) == "version index" {
+		t.Errorf("TestEncryptedBlobStoreURI() ReadFromURI() of unencrypted store returned plain text")
+	}
+}
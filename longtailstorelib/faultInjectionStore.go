@@ -0,0 +1,373 @@
+package longtailstorelib
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// ErrFaultInjected is the cause of the errors injected by the store created by NewFaultInjectionBlobStore,
+// the error is classified as retryable
+var ErrFaultInjected = errors.New("injected blob store fault")
+
+// FaultInjectionOptions configures the faults injected by NewFaultInjectionBlobStore, each rate is
+// the probability in the range 0 to 1 that an operation fails in that way
+type FaultInjectionOptions struct {
+	// Seed for the random source, the same seed gives the same faults for the same sequence of operations
+	Seed int64
+	// ExistsErrorRate applies to Exists, LockWriteVersion and GetAttributes
+	ExistsErrorRate float64
+	// ReadErrorRate applies to Read, NewReader and NewRangeReader
+	ReadErrorRate float64
+	// WriteErrorRate applies to Write, Delete and closing writers, a failed write does not change the object
+	WriteErrorRate float64
+	// WriteConflictRate makes a write after LockWriteVersion return false as if another writer changed the object
+	WriteConflictRate float64
+	// CorruptionRate flips a random byte in the data returned by a successful read
+	CorruptionRate float64
+	// ListErrorRate makes GetObjects fail and ListObjects fail after returning part of the listing
+	ListErrorRate float64
+	// PartialListRate makes GetObjects and ListObjects silently return only part of the listing
+	PartialListRate float64
+	// Latency is added to every operation that reaches the wrapped store
+	Latency time.Duration
+}
+
+// FaultInjectionStats counts the faults injected by a store created by NewFaultInjectionBlobStore
+type FaultInjectionStats struct {
+	ExistsErrors   uint64
+	ReadErrors     uint64
+	WriteErrors    uint64
+	WriteConflicts uint64
+	Corruptions    uint64
+	ListErrors     uint64
+	PartialLists   uint64
+}
+
+// FaultInjectionStatsProvider is implemented by the store created by NewFaultInjectionBlobStore
+type FaultInjectionStatsProvider interface {
+	GetFaultInjectionStats() FaultInjectionStats
+}
+
+type faultInjectionBlobStore struct {
+	blobStore BlobStore
+	options   FaultInjectionOptions
+	randMutex sync.Mutex
+	random    *rand.Rand
+	stats     FaultInjectionStats
+}
+
+type faultInjectionBlobClient struct {
+	store  *faultInjectionBlobStore
+	client BlobClient
+}
+
+type faultInjectionBlobObject struct {
+	store  *faultInjectionBlobStore
+	object BlobObject
+	path   string
+	locked bool
+}
+
+// NewFaultInjectionBlobStore wraps blobStore so its operations fail, conflict, return corrupted data
+// or partial listings at the rates given in faults. It is intended for testing how callers handle
+// an unreliable store
+func NewFaultInjectionBlobStore(blobStore BlobStore, faults FaultInjectionOptions) (BlobStore, error) {
+	rates := []float64{
+		faults.ExistsErrorRate,
+		faults.ReadErrorRate,
+		faults.WriteErrorRate,
+		faults.WriteConflictRate,
+		faults.CorruptionRate,
+		faults.ListErrorRate,
+		faults.PartialListRate}
+	for _, rate := range rates {
+		if rate < 0 || rate > 1 {
+			return nil, errors.Wrapf(longtaillib.ErrEINVAL, "fault injection rate %f must be between 0 and 1", rate)
+		}
+	}
+	if faults.Latency < 0 {
+		return nil, errors.Wrapf(longtaillib.ErrEINVAL, "invalid fault injection latency %v", faults.Latency)
+	}
+	s := &faultInjectionBlobStore{
+		blobStore: blobStore,
+		options:   faults,
+		random:    rand.New(rand.NewSource(faults.Seed))}
+	return s, nil
+}
+
+// inject returns true with the probability rate and counts the fault in counter
+func (s *faultInjectionBlobStore) inject(rate float64, counter *uint64) bool {
+	if rate <= 0 {
+		return false
+	}
+	s.randMutex.Lock()
+	hit := s.random.Float64() < rate
+	s.randMutex.Unlock()
+	if hit {
+		atomic.AddUint64(counter, 1)
+	}
+	return hit
+}
+
+func (s *faultInjectionBlobStore) randomIndex(n int) int {
+	s.randMutex.Lock()
+	defer s.randMutex.Unlock()
+	return s.random.Intn(n)
+}
+
+// delay waits for the configured latency
+func (s *faultInjectionBlobStore) delay(ctx context.Context) error {
+	if s.options.Latency == 0 {
+		return ctx.Err()
+	}
+	return sleepWithContext(ctx, s.options.Latency)
+}
+
+// corrupt returns a copy of data with one byte flipped if a corruption is injected
+func (s *faultInjectionBlobStore) corrupt(data []byte) []byte {
+	if len(data) == 0 || !s.inject(s.options.CorruptionRate, &s.stats.Corruptions) {
+		return data
+	}
+	corrupted := make([]byte, len(data))
+	copy(corrupted, data)
+	corrupted[s.randomIndex(len(data))] ^= 0xff
+	return corrupted
+}
+
+// truncateListing drops the tail of a listing if a partial listing is injected
+func (s *faultInjectionBlobStore) truncateListing(items []BlobProperties) []BlobProperties {
+	if len(items) == 0 || !s.inject(s.options.PartialListRate, &s.stats.PartialLists) {
+		return items
+	}
+	return items[:s.randomIndex(len(items))]
+}
+
+func (s *faultInjectionBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
+	client, err := s.blobStore.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &faultInjectionBlobClient{store: s, client: client}, nil
+}
+
+func (s *faultInjectionBlobStore) String() string {
+	return s.blobStore.String()
+}
+
+// IsRetryableError treats injected faults as retryable and forwards other errors to the wrapped store
+func (s *faultInjectionBlobStore) IsRetryableError(err error) bool {
+	if errors.Cause(err) == ErrFaultInjected {
+		return true
+	}
+	if classifier, ok := s.blobStore.(BlobErrorClassifier); ok {
+		return classifier.IsRetryableError(err)
+	}
+	return true
+}
+
+// GetFaultInjectionStats implements FaultInjectionStatsProvider
+func (s *faultInjectionBlobStore) GetFaultInjectionStats() FaultInjectionStats {
+	return FaultInjectionStats{
+		ExistsErrors:   atomic.LoadUint64(&s.stats.ExistsErrors),
+		ReadErrors:     atomic.LoadUint64(&s.stats.ReadErrors),
+		WriteErrors:    atomic.LoadUint64(&s.stats.WriteErrors),
+		WriteConflicts: atomic.LoadUint64(&s.stats.WriteConflicts),
+		Corruptions:    atomic.LoadUint64(&s.stats.Corruptions),
+		ListErrors:     atomic.LoadUint64(&s.stats.ListErrors),
+		PartialLists:   atomic.LoadUint64(&s.stats.PartialLists)}
+}
+
+func (blobClient *faultInjectionBlobClient) NewObject(path string) (BlobObject, error) {
+	object, err := blobClient.client.NewObject(path)
+	if err != nil {
+		return nil, err
+	}
+	return &faultInjectionBlobObject{store: blobClient.store, object: object, path: path}, nil
+}
+
+func (blobClient *faultInjectionBlobClient) GetObjects(ctx context.Context) ([]BlobProperties, error) {
+	s := blobClient.store
+	if err := s.delay(ctx); err != nil {
+		return nil, err
+	}
+	if s.inject(s.options.ListErrorRate, &s.stats.ListErrors) {
+		return nil, errors.Wrapf(ErrFaultInjected, "faultInjectionBlobClient: injected listing error in %s", s.String())
+	}
+	items, err := blobClient.client.GetObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.truncateListing(items), nil
+}
+
+// ListObjects reads the complete listing from the wrapped store before returning the first object,
+// an injected listing error is returned after a random part of the listing
+func (blobClient *faultInjectionBlobClient) ListObjects(ctx context.Context, prefix string, delimiter string) BlobObjectIterator {
+	s := blobClient.store
+	if err := s.delay(ctx); err != nil {
+		return newSliceBlobObjectIterator(nil, err)
+	}
+	items, err := readBlobObjectIterator(blobClient.client.ListObjects(ctx, prefix, delimiter))
+	if err != nil {
+		return newSliceBlobObjectIterator(nil, err)
+	}
+	if s.inject(s.options.ListErrorRate, &s.stats.ListErrors) {
+		partialCount := 0
+		if len(items) > 0 {
+			partialCount = s.randomIndex(len(items))
+		}
+		return &faultInjectionBlobObjectIterator{
+			items: items[:partialCount],
+			err:   errors.Wrapf(ErrFaultInjected, "faultInjectionBlobClient: injected listing error in %s", s.String())}
+	}
+	return newSliceBlobObjectIterator(s.truncateListing(items), nil)
+}
+
+func (blobClient *faultInjectionBlobClient) Close() {
+	blobClient.client.Close()
+}
+
+func (blobClient *faultInjectionBlobClient) String() string {
+	return blobClient.client.String()
+}
+
+// faultInjectionBlobObjectIterator returns items and then fails with err
+type faultInjectionBlobObjectIterator struct {
+	items []BlobProperties
+	err   error
+}
+
+func (it *faultInjectionBlobObjectIterator) Next() (BlobProperties, error) {
+	if len(it.items) == 0 {
+		return BlobProperties{}, it.err
+	}
+	item := it.items[0]
+	it.items = it.items[1:]
+	return item, nil
+}
+
+func (blobObject *faultInjectionBlobObject) injectedError(operation string) error {
+	return errors.Wrapf(ErrFaultInjected, "faultInjectionBlobObject: injected %s error for %s", operation, blobObject.path)
+}
+
+func (blobObject *faultInjectionBlobObject) Exists(ctx context.Context) (bool, error) {
+	s := blobObject.store
+	if err := s.delay(ctx); err != nil {
+		return false, err
+	}
+	if s.inject(s.options.ExistsErrorRate, &s.stats.ExistsErrors) {
+		return false, blobObject.injectedError("exists")
+	}
+	return blobObject.object.Exists(ctx)
+}
+
+func (blobObject *faultInjectionBlobObject) LockWriteVersion(ctx context.Context) (bool, error) {
+	s := blobObject.store
+	if err := s.delay(ctx); err != nil {
+		return false, err
+	}
+	if s.inject(s.options.ExistsErrorRate, &s.stats.ExistsErrors) {
+		return false, blobObject.injectedError("lock")
+	}
+	exists, err := blobObject.object.LockWriteVersion(ctx)
+	if err != nil {
+		return false, err
+	}
+	blobObject.locked = true
+	return exists, nil
+}
+
+func (blobObject *faultInjectionBlobObject) Read(ctx context.Context) ([]byte, error) {
+	s := blobObject.store
+	if err := s.delay(ctx); err != nil {
+		return nil, err
+	}
+	if s.inject(s.options.ReadErrorRate, &s.stats.ReadErrors) {
+		return nil, blobObject.injectedError("read")
+	}
+	data, err := blobObject.object.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.corrupt(data), nil
+}
+
+// Write fails or reports a conflict before the data reaches the wrapped store, a conflict is only
+// injected after LockWriteVersion as unconditional writes can not conflict
+func (blobObject *faultInjectionBlobObject) Write(ctx context.Context, data []byte) (bool, error) {
+	s := blobObject.store
+	if err := s.delay(ctx); err != nil {
+		return false, err
+	}
+	if s.inject(s.options.WriteErrorRate, &s.stats.WriteErrors) {
+		return false, blobObject.injectedError("write")
+	}
+	if blobObject.locked && s.inject(s.options.WriteConflictRate, &s.stats.WriteConflicts) {
+		return false, nil
+	}
+	return blobObject.object.Write(ctx, data)
+}
+
+func (blobObject *faultInjectionBlobObject) Delete(ctx context.Context) error {
+	s := blobObject.store
+	if err := s.delay(ctx); err != nil {
+		return err
+	}
+	if s.inject(s.options.WriteErrorRate, &s.stats.WriteErrors) {
+		return blobObject.injectedError("delete")
+	}
+	return blobObject.object.Delete(ctx)
+}
+
+func (blobObject *faultInjectionBlobObject) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	return blobObject.NewRangeReader(ctx, 0, -1)
+}
+
+// NewRangeReader reads the range from the wrapped store up front so corruption can be injected
+func (blobObject *faultInjectionBlobObject) NewRangeReader(ctx context.Context, offset int64, length int64) (io.ReadCloser, error) {
+	s := blobObject.store
+	if err := s.delay(ctx); err != nil {
+		return nil, err
+	}
+	if s.inject(s.options.ReadErrorRate, &s.stats.ReadErrors) {
+		return nil, blobObject.injectedError("read")
+	}
+	reader, err := blobObject.object.NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return newBufferRangeReader(s.corrupt(data), 0, -1)
+}
+
+// NewWriter buffers the written data and writes it with Write when closed so write faults are injected
+func (blobObject *faultInjectionBlobObject) NewWriter(ctx context.Context) (io.WriteCloser, error) {
+	return newBufferedBlobWriter(ctx, blobObject), nil
+}
+
+func (blobObject *faultInjectionBlobObject) GetAttributes(ctx context.Context) (BlobObjectAttributes, error) {
+	s := blobObject.store
+	if err := s.delay(ctx); err != nil {
+		return BlobObjectAttributes{}, err
+	}
+	if s.inject(s.options.ExistsErrorRate, &s.stats.ExistsErrors) {
+		return BlobObjectAttributes{}, blobObject.injectedError("attributes")
+	}
+	return blobObject.object.GetAttributes(ctx)
+}
+
+func (blobObject *faultInjectionBlobObject) SetWriteAttributes(contentType string, metadata map[string]string) {
+	blobObject.object.SetWriteAttributes(contentType, metadata)
+}
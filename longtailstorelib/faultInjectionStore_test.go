@@ -0,0 +1,203 @@
+package longtailstorelib
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestFaultInjectionBlobStoreErrors(t *testing.T) {
+	ctx := context.Background()
+	memStore, _ := NewMemBlobStore("fault_errors")
+	defer ReleaseMemBlobStore("fault_errors")
+	writeTestObject(ctx, memStore, "store.lsi", []byte("index"))
+
+	blobStore, err := NewFaultInjectionBlobStore(memStore, FaultInjectionOptions{ExistsErrorRate: 1, ReadErrorRate: 1, WriteErrorRate: 1})
+	if err != nil {
+		t.Errorf("TestFaultInjectionBlobStoreErrors() NewFaultInjectionBlobStore() %v != %v", err, nil)
+	}
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	object, _ := client.NewObject("store.lsi")
+	_, err = object.Exists(ctx)
+	if errors.Cause(err) != ErrFaultInjected {
+		t.Errorf("TestFaultInjectionBlobStoreErrors() object.Exists() %v != %v", err, ErrFaultInjected)
+	}
+	_, err = object.Read(ctx)
+	if errors.Cause(err) != ErrFaultInjected {
+		t.Errorf("TestFaultInjectionBlobStoreErrors() object.Read() %v != %v", err, ErrFaultInjected)
+	}
+	_, err = object.NewReader(ctx)
+	if errors.Cause(err) != ErrFaultInjected {
+		t.Errorf("TestFaultInjectionBlobStoreErrors() object.NewReader() %v != %v", err, ErrFaultInjected)
+	}
+	_, err = object.Write(ctx, []byte("new index"))
+	if errors.Cause(err) != ErrFaultInjected {
+		t.Errorf("TestFaultInjectionBlobStoreErrors() object.Write() %v != %v", err, ErrFaultInjected)
+	}
+	writer, _ := object.NewWriter(ctx)
+	writer.Write([]byte("new index"))
+	err = writer.Close()
+	if errors.Cause(err) != ErrFaultInjected {
+		t.Errorf("TestFaultInjectionBlobStoreErrors() writer.Close() %v != %v", err, ErrFaultInjected)
+	}
+	if !blobStore.(BlobErrorClassifier).IsRetryableError(err) {
+		t.Errorf("TestFaultInjectionBlobStoreErrors() IsRetryableError() %t != %t", false, true)
+	}
+
+	// Failed writes must not reach the wrapped store
+	data, _ := readTestObject(ctx, memStore, "store.lsi")
+	if string(data) != "index" {
+		t.Errorf("TestFaultInjectionBlobStoreErrors() Read() %s != %s", string(data), "index")
+	}
+	stats := blobStore.(FaultInjectionStatsProvider).GetFaultInjectionStats()
+	if stats.ExistsErrors != 1 || stats.ReadErrors != 2 || stats.WriteErrors != 2 {
+		t.Errorf("TestFaultInjectionBlobStoreErrors() GetFaultInjectionStats() %v", stats)
+	}
+
+	_, err = NewFaultInjectionBlobStore(memStore, FaultInjectionOptions{ReadErrorRate: 1.5})
+	if err == nil {
+		t.Errorf("TestFaultInjectionBlobStoreErrors() NewFaultInjectionBlobStore() err == nil")
+	}
+}
+
+func TestFaultInjectionBlobStoreConflict(t *testing.T) {
+	ctx := context.Background()
+	memStore, _ := NewMemBlobStore("fault_conflict")
+	defer ReleaseMemBlobStore("fault_conflict")
+	blobStore, _ := NewFaultInjectionBlobStore(memStore, FaultInjectionOptions{WriteConflictRate: 1})
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	object, _ := client.NewObject("store.lsi")
+
+	// Writes without a write condition can not conflict
+	ok, err := object.Write(ctx, []byte("index"))
+	if !ok || err != nil {
+		t.Errorf("TestFaultInjectionBlobStoreConflict() object.Write() %t, %v != %t, %v", ok, err, true, nil)
+	}
+	object.LockWriteVersion(ctx)
+	ok, err = object.Write(ctx, []byte("merged index"))
+	if ok || err != nil {
+		t.Errorf("TestFaultInjectionBlobStoreConflict() object.Write() %t, %v != %t, %v", ok, err, false, nil)
+	}
+	writer, _ := object.NewWriter(ctx)
+	writer.Write([]byte("merged index"))
+	err = writer.Close()
+	if err != ErrBlobWriteConditionFailed {
+		t.Errorf("TestFaultInjectionBlobStoreConflict() writer.Close() %v != %v", err, ErrBlobWriteConditionFailed)
+	}
+	data, _ := readTestObject(ctx, memStore, "store.lsi")
+	if string(data) != "index" {
+		t.Errorf("TestFaultInjectionBlobStoreConflict() Read() %s != %s", string(data), "index")
+	}
+}
+
+func TestFaultInjectionBlobStoreCorruption(t *testing.T) {
+	ctx := context.Background()
+	memStore, _ := NewMemBlobStore("fault_corruption")
+	defer ReleaseMemBlobStore("fault_corruption")
+	writeTestObject(ctx, memStore, "store.lsi", []byte("index"))
+	blobStore, _ := NewFaultInjectionBlobStore(memStore, FaultInjectionOptions{CorruptionRate: 1})
+
+	data, err := readTestObject(ctx, blobStore, "store.lsi")
+	if err != nil || len(data) != 5 || string(data) == "index" {
+		t.Errorf("TestFaultInjectionBlobStoreCorruption() Read() %q, %v", string(data), err)
+	}
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	object, _ := client.NewObject("store.lsi")
+	reader, _ := object.NewRangeReader(ctx, 1, 3)
+	data, _ = ioutil.ReadAll(reader)
+	reader.Close()
+	if len(data) != 3 || string(data) == "nde" {
+		t.Errorf("TestFaultInjectionBlobStoreCorruption() object.NewRangeReader() %q", string(data))
+	}
+	data, _ = readTestObject(ctx, memStore, "store.lsi")
+	if string(data) != "index" {
+		t.Errorf("TestFaultInjectionBlobStoreCorruption() Read() from wrapped store %s != %s", string(data), "index")
+	}
+}
+
+func TestFaultInjectionBlobStoreListing(t *testing.T) {
+	ctx := context.Background()
+	memStore, _ := NewMemBlobStore("fault_listing")
+	defer ReleaseMemBlobStore("fault_listing")
+	for i := 0; i < 10; i++ {
+		writeTestObject(ctx, memStore, fmt.Sprintf("chunks/%04d.lsb", i), []byte("block"))
+	}
+
+	blobStore, _ := NewFaultInjectionBlobStore(memStore, FaultInjectionOptions{PartialListRate: 1})
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	items, err := readBlobObjectIterator(client.ListObjects(ctx, "chunks/", ""))
+	if err != nil || len(items) >= 10 {
+		t.Errorf("TestFaultInjectionBlobStoreListing() client.ListObjects() %d, %v, expected partial listing", len(items), err)
+	}
+
+	blobStore, _ = NewFaultInjectionBlobStore(memStore, FaultInjectionOptions{ListErrorRate: 1})
+	client, _ = blobStore.NewClient(ctx)
+	defer client.Close()
+	_, err = readBlobObjectIterator(client.ListObjects(ctx, "chunks/", ""))
+	if errors.Cause(err) != ErrFaultInjected {
+		t.Errorf("TestFaultInjectionBlobStoreListing() client.ListObjects() %v != %v", err, ErrFaultInjected)
+	}
+	_, err = client.GetObjects(ctx)
+	if errors.Cause(err) != ErrFaultInjected {
+		t.Errorf("TestFaultInjectionBlobStoreListing() client.GetObjects() %v != %v", err, ErrFaultInjected)
+	}
+}
+
+func TestFaultInjectionBlobStoreSeed(t *testing.T) {
+	ctx := context.Background()
+	memStore, _ := NewMemBlobStore("fault_seed")
+	defer ReleaseMemBlobStore("fault_seed")
+	writeTestObject(ctx, memStore, "store.lsi", []byte("index"))
+
+	readFailures := func() []bool {
+		blobStore, _ := NewFaultInjectionBlobStore(memStore, FaultInjectionOptions{Seed: 4711, ReadErrorRate: 0.5})
+		failures := make([]bool, 32)
+		for i := range failures {
+			_, err := readTestObject(ctx, blobStore, "store.lsi")
+			failures[i] = err != nil
+		}
+		return failures
+	}
+	first := readFailures()
+	second := readFailures()
+	failureCount := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("TestFaultInjectionBlobStoreSeed() read %d failed %t != %t", i, first[i], second[i])
+		}
+		if first[i] {
+			failureCount++
+		}
+	}
+	if failureCount == 0 || failureCount == len(first) {
+		t.Errorf("TestFaultInjectionBlobStoreSeed() %d of %d reads failed", failureCount, len(first))
+	}
+}
+
+func TestFaultInjectionBlobStoreLatency(t *testing.T) {
+	ctx := context.Background()
+	memStore, _ := NewMemBlobStore("fault_latency")
+	defer ReleaseMemBlobStore("fault_latency")
+	blobStore, _ := NewFaultInjectionBlobStore(memStore, FaultInjectionOptions{Latency: 50 * time.Millisecond})
+
+	startTime := time.Now()
+	writeTestObject(ctx, blobStore, "store.lsi", []byte("index"))
+	if elapsed := time.Since(startTime); elapsed < 50*time.Millisecond {
+		t.Errorf("TestFaultInjectionBlobStoreLatency() Write() took %v < %v", elapsed, 50*time.Millisecond)
+	}
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err := readTestObject(cancelCtx, blobStore, "store.lsi")
+	if err != context.Canceled {
+		t.Errorf("TestFaultInjectionBlobStoreLatency() Read() %v != %v", err, context.Canceled)
+	}
+}
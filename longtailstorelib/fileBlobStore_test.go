@@ -1,8 +1,17 @@
 package longtailstorelib
 
 import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
@@ -14,7 +23,8 @@ func TestFSBlobStore(t *testing.T) {
 	if err != nil {
 		t.Errorf("NewFSBlobStore() err == %q", err)
 	}
-	client, err := blobStore.NewClient(context.Background())
+	ctx := context.Background()
+	client, err := blobStore.NewClient(ctx)
 	if err != nil {
 		t.Errorf("blobStore.NewClient() err == %q", err)
 	}
@@ -22,7 +32,7 @@ func TestFSBlobStore(t *testing.T) {
 	if err != nil {
 		t.Errorf("client.NewObject() err == %q", err)
 	}
-	ok, err := object.Write([]byte("apa"))
+	ok, err := object.Write(ctx, []byte("apa"))
 	if !ok {
 		t.Errorf("object.Write() ok != true")
 	}
@@ -30,3 +40,496 @@ func TestFSBlobStore(t *testing.T) {
 		t.Errorf("object.Write() err == %q", err)
 	}
 }
+
+func TestFSBlobStoreListObjects(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "fsblobstore")
+	if err != nil {
+		t.Errorf("ioutil.TempDir() err == %q", err)
+	}
+	defer os.RemoveAll(storePath)
+
+	blobStore, _ := NewFSBlobStore(storePath)
+	ctx := context.Background()
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+
+	objects, err := client.GetObjects(ctx)
+	if err != nil {
+		t.Errorf("client.GetObjects() err == %q", err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("TestFSBlobStoreListObjects() len(objects) %d != %d", len(objects), 0)
+	}
+
+	blockObject, _ := client.NewObject("chunks/0000/0x0000000000000001.lsb")
+	blockObject.Write(ctx, []byte("block"))
+	indexObject, _ := client.NewObject("store.lsi")
+	indexObject.LockWriteVersion(ctx)
+	indexObject.Write(ctx, []byte("index!"))
+
+	objects, err = client.GetObjects(ctx)
+	if err != nil {
+		t.Errorf("client.GetObjects() err == %q", err)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	expected := []BlobProperties{
+		{Name: "chunks/0000/0x0000000000000001.lsb", Size: 5},
+		{Name: "store.lsi", Size: 6}}
+	if len(objects) != len(expected) {
+		t.Errorf("TestFSBlobStoreListObjects() len(objects) %d != %d", len(objects), len(expected))
+	}
+	for i := range expected {
+		if objects[i] != expected[i] {
+			t.Errorf("TestFSBlobStoreListObjects() objects[%d] %v != %v", i, objects[i], expected[i])
+		}
+	}
+}
+
+func TestFSBlobStoreInternalFileNames(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "fsblobstore")
+	if err != nil {
+		t.Errorf("ioutil.TempDir() err == %q", err)
+	}
+	defer os.RemoveAll(storePath)
+
+	blobStore, _ := NewFSBlobStore(storePath)
+	ctx := context.Background()
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+
+	// Objects named like the internal files of the store are regular objects
+	names := []string{"index/version" + fsLockSuffix, "index/version" + fsMetaSuffix, "index/version" + fsTempSuffix}
+	for _, name := range names {
+		object, _ := client.NewObject(name)
+		object.LockWriteVersion(ctx)
+		object.Write(ctx, []byte(name))
+	}
+	objects, err := client.GetObjects(ctx)
+	if err != nil || len(objects) != len(names) {
+		t.Errorf("TestFSBlobStoreInternalFileNames() client.GetObjects() %d, %v != %d, %v", len(objects), err, len(names), nil)
+	}
+	items, err := readBlobObjectIterator(client.ListObjects(ctx, "", ""))
+	if err != nil || len(items) != len(names) {
+		t.Errorf("TestFSBlobStoreInternalFileNames() client.ListObjects() %d, %v != %d, %v", len(items), err, len(names), nil)
+	}
+
+	missing, _ := client.NewObject("index/missing.lvi")
+	_, err = missing.Read(ctx)
+	if errors.Cause(err) != longtaillib.ErrENOENT {
+		t.Errorf("TestFSBlobStoreInternalFileNames() missing.Read() %v != %v", err, longtaillib.ErrENOENT)
+	}
+	_, err = missing.NewReader(ctx)
+	if errors.Cause(err) != longtaillib.ErrENOENT {
+		t.Errorf("TestFSBlobStoreInternalFileNames() missing.NewReader() %v != %v", err, longtaillib.ErrENOENT)
+	}
+	err = missing.Delete(ctx)
+	if errors.Cause(err) != longtaillib.ErrENOENT {
+		t.Errorf("TestFSBlobStoreInternalFileNames() missing.Delete() %v != %v", err, longtaillib.ErrENOENT)
+	}
+}
+
+func TestFSBlobStoreGenerationWrite(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "fsblobstore")
+	if err != nil {
+		t.Errorf("ioutil.TempDir() err == %q", err)
+	}
+	defer os.RemoveAll(storePath)
+
+	blobStore, _ := NewFSBlobStore(storePath)
+	ctx := context.Background()
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+
+	object1, _ := client.NewObject("store.lsi")
+	object2, _ := client.NewObject("store.lsi")
+
+	exists, err := object1.LockWriteVersion(ctx)
+	if err != nil || exists {
+		t.Errorf("object1.LockWriteVersion() %t, %q != false, nil", exists, err)
+	}
+	exists, err = object2.LockWriteVersion(ctx)
+	if err != nil || exists {
+		t.Errorf("object2.LockWriteVersion() %t, %q != false, nil", exists, err)
+	}
+	ok, err := object1.Write(ctx, []byte("first"))
+	if !ok || err != nil {
+		t.Errorf("object1.Write() %t, %q != true, nil", ok, err)
+	}
+	ok, err = object2.Write(ctx, []byte("second"))
+	if ok || err != nil {
+		t.Errorf("object2.Write() %t, %q != false, nil", ok, err)
+	}
+	exists, err = object2.LockWriteVersion(ctx)
+	if err != nil || !exists {
+		t.Errorf("object2.LockWriteVersion() %t, %q != true, nil", exists, err)
+	}
+	ok, err = object2.Write(ctx, []byte("second"))
+	if !ok || err != nil {
+		t.Errorf("object2.Write() %t, %q != true, nil", ok, err)
+	}
+	data, err := object1.Read(ctx)
+	if err != nil {
+		t.Errorf("object1.Read() err == %q", err)
+	}
+	if string(data) != "second" {
+		t.Errorf("TestFSBlobStoreGenerationWrite() object1.Read() %s != %s", string(data), "second")
+	}
+	err = object1.Delete(ctx)
+	if err == nil {
+		t.Errorf("object1.Delete() err == nil with stale generation")
+	}
+	err = object2.Delete(ctx)
+	if err != nil {
+		t.Errorf("object2.Delete() err == %q", err)
+	}
+}
+
+func TestFSBlobStoreStreaming(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "fsblobstore")
+	if err != nil {
+		t.Errorf("ioutil.TempDir() err == %q", err)
+	}
+	defer os.RemoveAll(storePath)
+
+	blobStore, _ := NewFSBlobStore(storePath)
+	ctx := context.Background()
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+
+	object, _ := client.NewObject("index/version.lvi")
+	writer, err := object.NewWriter(ctx)
+	if err != nil {
+		t.Errorf("object.NewWriter() err == %q", err)
+	}
+	writer.Write([]byte("0123"))
+	writer.Write([]byte("456789"))
+	err = writer.Close()
+	if err != nil {
+		t.Errorf("writer.Close() err == %q", err)
+	}
+
+	reader, err := object.NewReader(ctx)
+	if err != nil {
+		t.Errorf("object.NewReader() err == %q", err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if string(data) != "0123456789" {
+		t.Errorf("TestFSBlobStoreStreaming() NewReader() %s != %s", string(data), "0123456789")
+	}
+
+	reader, err = object.NewRangeReader(ctx, 3, 4)
+	if err != nil {
+		t.Errorf("object.NewRangeReader() err == %q", err)
+	}
+	data, _ = ioutil.ReadAll(reader)
+	reader.Close()
+	if string(data) != "3456" {
+		t.Errorf("TestFSBlobStoreStreaming() NewRangeReader(3, 4) %s != %s", string(data), "3456")
+	}
+
+	reader, err = object.NewRangeReader(ctx, 7, -1)
+	if err != nil {
+		t.Errorf("object.NewRangeReader() err == %q", err)
+	}
+	data, _ = ioutil.ReadAll(reader)
+	reader.Close()
+	if string(data) != "789" {
+		t.Errorf("TestFSBlobStoreStreaming() NewRangeReader(7, -1) %s != %s", string(data), "789")
+	}
+
+	object.LockWriteVersion(ctx)
+	other, _ := client.NewObject("index/version.lvi")
+	other.Write(ctx, []byte("changed"))
+	writer, _ = object.NewWriter(ctx)
+	writer.Write([]byte("stale"))
+	err = writer.Close()
+	if err != ErrBlobWriteConditionFailed {
+		t.Errorf("writer.Close() err %v != %v", err, ErrBlobWriteConditionFailed)
+	}
+}
+
+func TestFSBlobStoreAttributes(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "fsblobstore")
+	if err != nil {
+		t.Errorf("ioutil.TempDir() err == %q", err)
+	}
+	defer os.RemoveAll(storePath)
+
+	blobStore, _ := NewFSBlobStore(storePath)
+	ctx := context.Background()
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+
+	object, _ := client.NewObject("chunks/0000/0x0000000000000001.lsb")
+	object.SetWriteAttributes("", map[string]string{"longtail_chunk_count": "3"})
+	object.Write(ctx, []byte("block"))
+	attributes, err := object.GetAttributes(ctx)
+	if err != nil {
+		t.Errorf("object.GetAttributes() err == %q", err)
+	}
+	if attributes.Size != 5 {
+		t.Errorf("TestFSBlobStoreAttributes() attributes.Size %d != %d", attributes.Size, 5)
+	}
+	if attributes.ContentType != "application/octet-stream" {
+		t.Errorf("TestFSBlobStoreAttributes() attributes.ContentType %s != %s", attributes.ContentType, "application/octet-stream")
+	}
+	if attributes.Metadata["longtail_chunk_count"] != "3" {
+		t.Errorf("TestFSBlobStoreAttributes() attributes.Metadata %v", attributes.Metadata)
+	}
+	objects, _ := client.GetObjects(ctx)
+	if len(objects) != 1 {
+		t.Errorf("TestFSBlobStoreAttributes() len(objects) %d != %d", len(objects), 1)
+	}
+	object.Delete(ctx)
+	_, err = os.Stat(filepath.Join(storePath, fsInternalFolder, "chunks/0000/0x0000000000000001.lsb"+fsMetaSuffix))
+	if !os.IsNotExist(err) {
+		t.Errorf("TestFSBlobStoreAttributes() metadata file not removed with object")
+	}
+}
+
+func TestFSBlobStoreChecksum(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "fsblobstore")
+	if err != nil {
+		t.Errorf("ioutil.TempDir() err == %q", err)
+	}
+	defer os.RemoveAll(storePath)
+
+	blobStore, _ := NewFSBlobStore(storePath)
+	ctx := context.Background()
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+
+	object, _ := client.NewObject("chunks/0000/0x0000000000000001.lsb")
+	object.Write(ctx, []byte("block content"))
+	data, err := object.Read(ctx)
+	if err != nil {
+		t.Errorf("TestFSBlobStoreChecksum() object.Read() %v != %v", err, nil)
+	}
+	if string(data) != "block content" {
+		t.Errorf("TestFSBlobStoreChecksum() object.Read() %s != %s", string(data), "block content")
+	}
+
+	blockPath := filepath.Join(storePath, "chunks/0000/0x0000000000000001.lsb")
+	err = ioutil.WriteFile(blockPath, []byte("block c0ntent"), 0644)
+	if err != nil {
+		t.Errorf("ioutil.WriteFile() err == %q", err)
+	}
+	_, err = object.Read(ctx)
+	if errors.Cause(err) != ErrBlobChecksumMismatch {
+		t.Errorf("TestFSBlobStoreChecksum() object.Read() %v != %v", err, ErrBlobChecksumMismatch)
+	}
+	reader, _ := object.NewReader(ctx)
+	_, err = ioutil.ReadAll(reader)
+	reader.Close()
+	if errors.Cause(err) != ErrBlobChecksumMismatch {
+		t.Errorf("TestFSBlobStoreChecksum() ioutil.ReadAll(object.NewReader()) %v != %v", err, ErrBlobChecksumMismatch)
+	}
+
+	// Objects written without checksums, for example by the native file system store, are not verified
+	os.Remove(filepath.Join(storePath, fsInternalFolder, "chunks/0000/0x0000000000000001.lsb"+fsMetaSuffix))
+	data, err = object.Read(ctx)
+	if err != nil {
+		t.Errorf("TestFSBlobStoreChecksum() object.Read() %v != %v", err, nil)
+	}
+	if string(data) != "block c0ntent" {
+		t.Errorf("TestFSBlobStoreChecksum() object.Read() %s != %s", string(data), "block c0ntent")
+	}
+}
+
+func TestFSBlobStoreInterruptedWrite(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "fsblobstore")
+	if err != nil {
+		t.Errorf("ioutil.TempDir() err == %q", err)
+	}
+	defer os.RemoveAll(storePath)
+
+	blobStore, _ := NewFSBlobStore(storePath)
+	ctx := context.Background()
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	object, _ := client.NewObject("store.lsi")
+	object.Write(ctx, []byte("first"))
+
+	// A writer that stops after writing the meta leaves both the previous and the new checksums
+	secondWriter, _ := object.NewWriter(ctx)
+	secondWriter.Write([]byte("second"))
+	fsWriter := secondWriter.(*fsBlobWriter)
+	fsWriter.tempFile.Close()
+	os.Remove(fsWriter.tempFile.Name())
+	previousMeta, _ := object.(*fsBlobObject).readMeta()
+	object.(*fsBlobObject).writeMeta(fsObjectMeta{
+		fsChecksums: fsChecksums{
+			CRC32C: hex.EncodeToString(fsWriter.crc32c.Sum(nil)),
+			MD5:    hex.EncodeToString(fsWriter.md5.Sum(nil))},
+		Previous: &previousMeta.fsChecksums})
+	data, err := object.Read(ctx)
+	if err != nil || string(data) != "first" {
+		t.Errorf("TestFSBlobStoreInterruptedWrite() object.Read() %s, %v != %s, %v", string(data), err, "first", nil)
+	}
+
+	// A writer that stops after renaming the content in place
+	ioutil.WriteFile(filepath.Join(storePath, "store.lsi"), []byte("second"), 0644)
+	data, err = object.Read(ctx)
+	if err != nil || string(data) != "second" {
+		t.Errorf("TestFSBlobStoreInterruptedWrite() object.Read() %s, %v != %s, %v", string(data), err, "second", nil)
+	}
+}
+
+func TestFSBlobStoreStaleLock(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "fsblobstore")
+	if err != nil {
+		t.Errorf("ioutil.TempDir() err == %q", err)
+	}
+	defer os.RemoveAll(storePath)
+
+	blobStore, _ := NewFSBlobStore(storePath)
+	ctx := context.Background()
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	object1, _ := client.NewObject("store.lsi")
+	object2, _ := client.NewObject("store.lsi")
+
+	lockPath := filepath.Join(storePath, fsInternalFolder, "store.lsi"+fsLockSuffix)
+	os.MkdirAll(filepath.Dir(lockPath), os.ModePerm)
+	ioutil.WriteFile(lockPath, []byte("crashed writer"), 0644)
+	staleTime := time.Now().Add(-2 * fsLockStaleTimeout)
+	os.Chtimes(lockPath, staleTime, staleTime)
+
+	locked, err := object1.(*fsBlobObject).tryLock()
+	if !locked || err != nil {
+		t.Errorf("TestFSBlobStoreStaleLock() object1.tryLock() %t, %v != %t, %v", locked, err, true, nil)
+	}
+	locked, err = object2.(*fsBlobObject).tryLock()
+	if locked || err != nil {
+		t.Errorf("TestFSBlobStoreStaleLock() object2.tryLock() %t, %v != %t, %v", locked, err, false, nil)
+	}
+
+	// A writer whose lock was replaced by another writer does not commit
+	ioutil.WriteFile(lockPath, []byte("other writer"), 0644)
+	if object1.(*fsBlobObject).holdsLock() {
+		t.Errorf("TestFSBlobStoreStaleLock() object1.holdsLock() %t != %t", true, false)
+	}
+	object1.(*fsBlobObject).unlock()
+	data, _ := ioutil.ReadFile(lockPath)
+	if string(data) != "other writer" {
+		t.Errorf("TestFSBlobStoreStaleLock() lock %s != %s", string(data), "other writer")
+	}
+	files, _ := ioutil.ReadDir(storePath)
+	if len(files) != 1 {
+		t.Errorf("TestFSBlobStoreStaleLock() len(files) %d != %d", len(files), 1)
+	}
+}
+
+func TestFSBlobStoreSameTimeWrite(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "fsblobstore")
+	if err != nil {
+		t.Errorf("ioutil.TempDir() err == %q", err)
+	}
+	defer os.RemoveAll(storePath)
+
+	blobStore, _ := NewFSBlobStore(storePath)
+	ctx := context.Background()
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	object1, _ := client.NewObject("store.lsi")
+	object2, _ := client.NewObject("store.lsi")
+	object1.Write(ctx, []byte("first"))
+	info, _ := os.Stat(filepath.Join(storePath, "store.lsi"))
+
+	// A same size rewrite within the time resolution of the file system is told apart by the generation
+	object1.LockWriteVersion(ctx)
+	object2.LockWriteVersion(ctx)
+	ok, err := object1.Write(ctx, []byte("other"))
+	if !ok || err != nil {
+		t.Errorf("TestFSBlobStoreSameTimeWrite() object1.Write() %t, %v != %t, %v", ok, err, true, nil)
+	}
+	os.Chtimes(filepath.Join(storePath, "store.lsi"), info.ModTime(), info.ModTime())
+	ok, err = object2.Write(ctx, []byte("third"))
+	if ok || err != nil {
+		t.Errorf("TestFSBlobStoreSameTimeWrite() object2.Write() %t, %v != %t, %v", ok, err, false, nil)
+	}
+	data, _ := object2.Read(ctx)
+	if string(data) != "other" {
+		t.Errorf("TestFSBlobStoreSameTimeWrite() object2.Read() %s != %s", string(data), "other")
+	}
+}
+
+func TestFSBlobStoreConcurrentMetaWrites(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "fsblobstore")
+	if err != nil {
+		t.Errorf("ioutil.TempDir() err == %q", err)
+	}
+	defer os.RemoveAll(storePath)
+
+	blobStore, _ := NewFSBlobStore(storePath)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, _ := blobStore.NewClient(ctx)
+			defer client.Close()
+			object, _ := client.NewObject("chunks/0000/0x0000000000000001.lsb")
+			for j := 0; j < 16; j++ {
+				ok, err := object.Write(ctx, []byte("block content"))
+				if !ok || err != nil {
+					t.Errorf("TestFSBlobStoreConcurrentMetaWrites() object.Write() %t, %v != %t, %v", ok, err, true, nil)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	names := []string{}
+	for _, folder := range []string{"chunks/0000", fsInternalFolder + "/chunks/0000"} {
+		files, _ := ioutil.ReadDir(filepath.Join(storePath, folder))
+		for _, file := range files {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "0x0000000000000001.lsb" || names[1] != "0x0000000000000001.lsb"+fsMetaSuffix {
+		t.Errorf("TestFSBlobStoreConcurrentMetaWrites() files %v != [%s %s]", names, "0x0000000000000001.lsb", "0x0000000000000001.lsb"+fsMetaSuffix)
+	}
+}
+
+func TestFSBlobStoreListObjectsWithPrefixAndDelimiter(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "fsblobstore")
+	if err != nil {
+		t.Errorf("ioutil.TempDir() err == %q", err)
+	}
+	defer os.RemoveAll(storePath)
+
+	blobStore, _ := NewFSBlobStore(storePath)
+	ctx := context.Background()
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	writeListingTestObjects(ctx, client)
+	validateListingTestObjects(ctx, t, client)
+}
+
+func TestFSBlobStoreListObjectsCancelled(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "fsblobstore")
+	if err != nil {
+		t.Errorf("ioutil.TempDir() err == %q", err)
+	}
+	defer os.RemoveAll(storePath)
+
+	blobStore, _ := NewFSBlobStore(storePath)
+	ctx, cancel := context.WithCancel(context.Background())
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	writeListingTestObjects(ctx, client)
+	cancel()
+	_, err = client.ListObjects(ctx, "", "").Next()
+	if err != context.Canceled {
+		t.Errorf("client.ListObjects().Next() %v != %v", err, context.Canceled)
+	}
+	_, err = client.GetObjects(ctx)
+	if errors.Cause(err) != context.Canceled {
+		t.Errorf("client.GetObjects() %v != %v", err, context.Canceled)
+	}
+}
@@ -1,11 +1,38 @@
 package longtailstorelib
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Lock, meta and temporary files are kept below this folder in the store root, at the same
+	// relative path as the object, so they never hide or shadow an object. Objects can not be
+	// stored below this folder
+	fsInternalFolder = ".fsblob"
+	fsLockSuffix     = ".lock"
+	fsTempSuffix     = ".tmp"
+	// Content type, metadata and checksums are stored in the meta file of the object
+	fsMetaSuffix = ".meta"
+	// A lock file older than this is considered abandoned by a crashed writer
+	fsLockStaleTimeout = 30 * time.Second
 )
 
 type fsBlobStore struct {
@@ -16,9 +43,43 @@ type fsBlobClient struct {
 	store *fsBlobStore
 }
 
+// fsWriteCondition identifies a version of an object, the modification time alone can not tell
+// versions apart on file systems with a coarse time resolution so the generation from the meta is included
+type fsWriteCondition struct {
+	exists     bool
+	generation int64
+	modTime    time.Time
+	size       int64
+}
+
 type fsBlobObject struct {
 	client *fsBlobClient
 	path   string
+	// internalPath is the path of the object below fsInternalFolder, the lock, meta and
+	// temporary files of the object use it with their suffix
+	internalPath   string
+	writeCondition *fsWriteCondition
+	// lockToken is written to the lock file so we can tell if we still hold the lock
+	lockToken   string
+	contentType string
+	metadata    map[string]string
+}
+
+// fsChecksums are the checksums of the content of an object, empty checksums match any content
+type fsChecksums struct {
+	CRC32C string `json:"crc32c,omitempty"`
+	MD5    string `json:"md5,omitempty"`
+}
+
+type fsObjectMeta struct {
+	ContentType string            `json:"content_type"`
+	Metadata    map[string]string `json:"metadata"`
+	fsChecksums
+	// Previous is set while the content is replaced, the meta is written before the content is renamed
+	// in place so a reader may see either the previous or the new content
+	Previous *fsChecksums `json:"previous,omitempty"`
+	// Generation is increased by each write, it is odd while the content is replaced
+	Generation int64 `json:"generation,omitempty"`
 }
 
 // NewFSBlobStore ...
@@ -35,13 +96,139 @@ func (blobStore *fsBlobStore) String() string {
 	return "fsstore"
 }
 
+// IsRetryableError implements BlobErrorClassifier
+func (blobStore *fsBlobStore) IsRetryableError(err error) bool {
+	cause := errors.Cause(err)
+	return !os.IsNotExist(cause) && !os.IsPermission(cause)
+}
+
 func (blobClient *fsBlobClient) NewObject(filepath string) (BlobObject, error) {
 	fsPath := path.Join(blobClient.store.prefix, filepath)
-	return &fsBlobObject{client: blobClient, path: fsPath}, nil
+	internalPath := path.Join(blobClient.store.prefix, fsInternalFolder, filepath)
+	return &fsBlobObject{client: blobClient, path: fsPath, internalPath: internalPath}, nil
+}
+
+func (blobClient *fsBlobClient) GetObjects(ctx context.Context) ([]BlobProperties, error) {
+	items := make([]BlobProperties, 0)
+	root := filepath.Clean(blobClient.store.prefix)
+	err := filepath.Walk(root, func(itemPath string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if itemPath == filepath.Join(root, fsInternalFolder) {
+				return filepath.SkipDir
+			}
+			// Walking a large network share can take a long time so we check for cancellation per folder
+			return ctx.Err()
+		}
+		itemName, err := filepath.Rel(root, itemPath)
+		if err != nil {
+			return err
+		}
+		items = append(items, BlobProperties{Size: info.Size(), Name: filepath.ToSlash(itemName)})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, blobClient.store.prefix)
+	}
+	return items, nil
+}
+
+// fsBlobObjectIterator walks the folder tree one folder at a time as the iterator advances
+type fsBlobObjectIterator struct {
+	ctx          context.Context
+	root         string
+	prefix       string
+	delimiter    string
+	folders      []string
+	items        []BlobProperties
+	seenPrefixes map[string]bool
+}
+
+func (blobClient *fsBlobClient) ListObjects(ctx context.Context, prefix string, delimiter string) BlobObjectIterator {
+	return &fsBlobObjectIterator{
+		ctx:          ctx,
+		root:         filepath.Clean(blobClient.store.prefix),
+		prefix:       prefix,
+		delimiter:    delimiter,
+		folders:      []string{""},
+		seenPrefixes: make(map[string]bool)}
 }
 
-func (blobClient *fsBlobClient) GetObjects() ([]BlobProperties, error) {
-	return make([]BlobProperties, 0), nil
+func (it *fsBlobObjectIterator) addItem(item BlobProperties) {
+	name, isPrefix := getDelimitedName(item.Name, it.prefix, it.delimiter)
+	if !isPrefix {
+		it.items = append(it.items, item)
+		return
+	}
+	if it.seenPrefixes[name] {
+		return
+	}
+	it.seenPrefixes[name] = true
+	it.items = append(it.items, BlobProperties{Name: name, IsPrefix: true})
+}
+
+func (it *fsBlobObjectIterator) readFolder(folder string) error {
+	entries, err := ioutil.ReadDir(filepath.Join(it.root, filepath.FromSlash(folder)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, it.root)
+	}
+	var subFolders []string
+	for _, entry := range entries {
+		name := folder + entry.Name()
+		if entry.IsDir() {
+			if name == fsInternalFolder {
+				continue
+			}
+			name += "/"
+			if !strings.HasPrefix(it.prefix, name) {
+				if !strings.HasPrefix(name, it.prefix) {
+					continue
+				}
+				if it.delimiter == "/" {
+					// Everything below the folder rolls up into the folder name, no need to look inside it
+					it.addItem(BlobProperties{Name: name})
+					continue
+				}
+			}
+			subFolders = append(subFolders, name)
+			continue
+		}
+		if !strings.HasPrefix(name, it.prefix) {
+			continue
+		}
+		it.addItem(BlobProperties{Size: entry.Size(), Name: name})
+	}
+	// Visit the sub folders in order before the remaining folders
+	it.folders = append(subFolders, it.folders...)
+	return nil
+}
+
+func (it *fsBlobObjectIterator) Next() (BlobProperties, error) {
+	for len(it.items) == 0 {
+		if len(it.folders) == 0 {
+			return BlobProperties{}, ErrBlobIteratorDone
+		}
+		if err := it.ctx.Err(); err != nil {
+			return BlobProperties{}, err
+		}
+		folder := it.folders[0]
+		it.folders = it.folders[1:]
+		err := it.readFolder(folder)
+		if err != nil {
+			return BlobProperties{}, err
+		}
+	}
+	item := it.items[0]
+	it.items = it.items[1:]
+	return item, nil
 }
 
 func (blobClient *fsBlobClient) Close() {
@@ -51,7 +238,7 @@ func (blobClient *fsBlobClient) String() string {
 	return "fsstore"
 }
 
-func (blobObject *fsBlobObject) Exists() (bool, error) {
+func (blobObject *fsBlobObject) Exists(ctx context.Context) (bool, error) {
 	_, err := os.Stat(blobObject.path)
 	if os.IsNotExist(err) {
 		return false, nil
@@ -62,30 +249,484 @@ func (blobObject *fsBlobObject) Exists() (bool, error) {
 	return true, nil
 }
 
-func (blobObject *fsBlobObject) Read() ([]byte, error) {
+// Read verifies the content against the checksums recorded when the object was written, objects
+// written without checksums are not verified
+func (blobObject *fsBlobObject) Read(ctx context.Context) ([]byte, error) {
+	meta, err := blobObject.readMeta()
+	if err != nil {
+		return nil, err
+	}
 	data, err := ioutil.ReadFile(blobObject.path)
+	if os.IsNotExist(err) {
+		return nil, errors.Wrap(longtaillib.ErrENOENT, blobObject.path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	crc32cHash := crc32.New(crc32cTable)
+	crc32cHash.Write(data)
+	md5Sum := md5.Sum(data)
+	err = blobObject.verifyContent(meta, crc32cHash.Sum(nil), md5Sum[:])
 	if err != nil {
 		return nil, err
 	}
 	return data, nil
 }
 
-func (blobObject *fsBlobObject) LockWriteVersion() (bool, error) {
-	return blobObject.Exists()
+// verifyContent checks the checksums of content read after meta was read, if the content was
+// replaced in between it is checked again against the meta of the new content
+func (blobObject *fsBlobObject) verifyContent(meta fsObjectMeta, crc32cSum []byte, md5Sum []byte) error {
+	err := meta.verifyChecksums(blobObject.path, crc32cSum, md5Sum)
+	if errors.Cause(err) != ErrBlobChecksumMismatch {
+		return err
+	}
+	meta, metaErr := blobObject.readMeta()
+	if metaErr != nil {
+		return err
+	}
+	return meta.verifyChecksums(blobObject.path, crc32cSum, md5Sum)
 }
 
-func (blobObject *fsBlobObject) Write(data []byte) (bool, error) {
-	err := os.MkdirAll(filepath.Dir(blobObject.path), os.ModePerm)
+func (blobObject *fsBlobObject) currentVersion() (*fsWriteCondition, error) {
+	info, err := os.Stat(blobObject.path)
+	if os.IsNotExist(err) {
+		return &fsWriteCondition{exists: false}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta, err := blobObject.readMeta()
+	if err != nil {
+		return nil, err
+	}
+	return &fsWriteCondition{exists: true, generation: meta.Generation, modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+func (blobObject *fsBlobObject) LockWriteVersion(ctx context.Context) (bool, error) {
+	writeCondition, err := blobObject.currentVersion()
 	if err != nil {
 		return false, err
 	}
-	err = ioutil.WriteFile(blobObject.path, data, 0644)
+	blobObject.writeCondition = writeCondition
+	return writeCondition.exists, nil
+}
+
+// tryLock creates the lock file for the object, it returns false if another writer holds the lock
+func (blobObject *fsBlobObject) tryLock() (bool, error) {
+	lockPath := blobObject.internalPath + fsLockSuffix
+	err := os.MkdirAll(filepath.Dir(lockPath), os.ModePerm)
 	if err != nil {
 		return false, err
 	}
-	return true, err
+	tokenBytes := make([]byte, 8)
+	if _, err = rand.Read(tokenBytes); err != nil {
+		return false, err
+	}
+	token := fmt.Sprintf("%d-%s", os.Getpid(), hex.EncodeToString(tokenBytes))
+	for {
+		lockFile, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = lockFile.WriteString(token)
+			lockFile.Close()
+			if err != nil {
+				os.Remove(lockPath)
+				return false, err
+			}
+			blobObject.lockToken = token
+			return true, nil
+		}
+		if !os.IsExist(err) {
+			return false, err
+		}
+		info, err := os.Stat(lockPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if time.Since(info.ModTime()) < fsLockStaleTimeout {
+			return false, nil
+		}
+		// Take over the stale lock by moving it away, only one writer can move it. If another writer
+		// replaced the stale lock before we moved it we put it back, the other writer checks that it
+		// still holds the lock before it commits
+		stalePath := lockPath + "." + token + fsTempSuffix
+		err = os.Rename(lockPath, stalePath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		info, err = os.Stat(stalePath)
+		if err == nil && time.Since(info.ModTime()) < fsLockStaleTimeout {
+			os.Link(stalePath, lockPath)
+			os.Remove(stalePath)
+			return false, nil
+		}
+		os.Remove(stalePath)
+	}
+}
+
+// holdsLock tells if the lock file is still the one created by tryLock
+func (blobObject *fsBlobObject) holdsLock() bool {
+	token, err := ioutil.ReadFile(blobObject.internalPath + fsLockSuffix)
+	return err == nil && string(token) == blobObject.lockToken
+}
+
+func (blobObject *fsBlobObject) unlock() {
+	if blobObject.holdsLock() {
+		os.Remove(blobObject.internalPath + fsLockSuffix)
+	}
+	blobObject.lockToken = ""
+}
+
+func (blobObject *fsBlobObject) matchesWriteCondition() (bool, error) {
+	if blobObject.writeCondition == nil {
+		return true, nil
+	}
+	current, err := blobObject.currentVersion()
+	if err != nil {
+		return false, err
+	}
+	if current.exists != blobObject.writeCondition.exists {
+		return false, nil
+	}
+	if !current.exists {
+		return true, nil
+	}
+	return current.generation == blobObject.writeCondition.generation &&
+		current.size == blobObject.writeCondition.size &&
+		current.modTime.Equal(blobObject.writeCondition.modTime), nil
+}
+
+func (blobObject *fsBlobObject) Write(ctx context.Context, data []byte) (bool, error) {
+	return writeWithWriter(ctx, blobObject, data)
+}
+
+// fsVerifyingReader checks the checksums of the object when the reader reaches the end of the content
+type fsVerifyingReader struct {
+	object *fsBlobObject
+	file   *os.File
+	meta   fsObjectMeta
+	crc32c hash.Hash32
+	md5    hash.Hash
+}
+
+// NewReader verifies the content like Read, the checksum mismatch is returned instead of io.EOF
+func (blobObject *fsBlobObject) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	meta, err := blobObject.readMeta()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(blobObject.path)
+	if os.IsNotExist(err) {
+		return nil, errors.Wrap(longtaillib.ErrENOENT, blobObject.path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &fsVerifyingReader{object: blobObject, file: file, meta: meta, crc32c: crc32.New(crc32cTable), md5: md5.New()}, nil
+}
+
+func (r *fsVerifyingReader) Read(p []byte) (int, error) {
+	n, err := r.file.Read(p)
+	r.crc32c.Write(p[:n])
+	r.md5.Write(p[:n])
+	if err == io.EOF {
+		if verifyErr := r.object.verifyContent(r.meta, r.crc32c.Sum(nil), r.md5.Sum(nil)); verifyErr != nil {
+			return n, verifyErr
+		}
+	}
+	return n, err
+}
+
+func (r *fsVerifyingReader) Close() error {
+	return r.file.Close()
+}
+
+type fsRangeReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (r *fsRangeReader) Close() error {
+	return r.file.Close()
+}
+
+// NewRangeReader does not verify the content, the checksums are of the whole object
+func (blobObject *fsBlobObject) NewRangeReader(ctx context.Context, offset int64, length int64) (io.ReadCloser, error) {
+	file, err := os.Open(blobObject.path)
+	if os.IsNotExist(err) {
+		return nil, errors.Wrap(longtaillib.ErrENOENT, blobObject.path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return file, nil
+	}
+	return &fsRangeReader{Reader: io.LimitReader(file, length), file: file}, nil
 }
 
-func (blobObject *fsBlobObject) Delete() error {
-	return os.Remove(blobObject.path)
+// fsBlobWriter writes to a temporary file which is renamed in place when closed
+// so readers never see a partially written object
+type fsBlobWriter struct {
+	object   *fsBlobObject
+	tempFile *os.File
+	crc32c   hash.Hash32
+	md5      hash.Hash
+}
+
+func (blobObject *fsBlobObject) NewWriter(ctx context.Context) (io.WriteCloser, error) {
+	err := os.MkdirAll(filepath.Dir(blobObject.path), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(blobObject.internalPath), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(blobObject.internalPath), filepath.Base(blobObject.internalPath)+".*"+fsTempSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &fsBlobWriter{object: blobObject, tempFile: tempFile, crc32c: crc32.New(crc32cTable), md5: md5.New()}, nil
+}
+
+func (w *fsBlobWriter) Write(p []byte) (int, error) {
+	n, err := w.tempFile.Write(p)
+	w.crc32c.Write(p[:n])
+	w.md5.Write(p[:n])
+	return n, err
+}
+
+func (w *fsBlobWriter) Close() error {
+	tempPath := w.tempFile.Name()
+	err := w.tempFile.Close()
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	err = os.Chmod(tempPath, 0644)
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	blobObject := w.object
+	if blobObject.writeCondition != nil {
+		locked, err := blobObject.tryLock()
+		if err != nil {
+			os.Remove(tempPath)
+			return err
+		}
+		if !locked {
+			os.Remove(tempPath)
+			return ErrBlobWriteConditionFailed
+		}
+		defer blobObject.unlock()
+		ok, err := blobObject.matchesWriteCondition()
+		if err != nil {
+			os.Remove(tempPath)
+			return err
+		}
+		if !ok || !blobObject.holdsLock() {
+			os.Remove(tempPath)
+			return ErrBlobWriteConditionFailed
+		}
+	}
+
+	// The meta with the new checksums is in place before the content so a reader never sees content
+	// without its checksums, until the content is renamed in place the previous checksums are kept.
+	// The pending meta has its own generation so a version seen while the content is replaced never
+	// matches the version after the write
+	previousMeta, err := blobObject.readMeta()
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	meta := fsObjectMeta{
+		ContentType: blobObject.contentType,
+		Metadata:    blobObject.metadata,
+		fsChecksums: fsChecksums{
+			CRC32C: hex.EncodeToString(w.crc32c.Sum(nil)),
+			MD5:    hex.EncodeToString(w.md5.Sum(nil))},
+		Generation: previousMeta.Generation - previousMeta.Generation%2 + 2}
+	pendingMeta := meta
+	pendingMeta.Generation = meta.Generation - 1
+	if _, statErr := os.Stat(blobObject.path); statErr == nil {
+		pendingMeta.Previous = &previousMeta.fsChecksums
+	}
+	err = blobObject.writeMeta(pendingMeta)
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	err = os.Rename(tempPath, blobObject.path)
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	// The object is in place and verifies with the pending meta, a failure to write the final meta
+	// only leaves the previous checksums accepted and the generation odd so it is not an error
+	blobObject.writeMeta(meta)
+	if blobObject.writeCondition != nil {
+		// We hold the lock so the new version is the one we just wrote
+		if current, err := blobObject.currentVersion(); err == nil {
+			blobObject.writeCondition = current
+		}
+	}
+	return nil
+}
+
+// writeMeta replaces the meta of the object through a temporary file so readers see either the old or the new meta
+func (blobObject *fsBlobObject) writeMeta(meta fsObjectMeta) error {
+	metaPath := blobObject.internalPath + fsMetaSuffix
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(metaPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(metaPath), filepath.Base(metaPath)+".*"+fsTempSuffix)
+	if err != nil {
+		return err
+	}
+	tempMetaPath := tempFile.Name()
+	_, err = tempFile.Write(metaData)
+	if err2 := tempFile.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Chmod(tempMetaPath, 0644)
+	}
+	if err != nil {
+		os.Remove(tempMetaPath)
+		return err
+	}
+	err = os.Rename(tempMetaPath, metaPath)
+	if err != nil {
+		os.Remove(tempMetaPath)
+		return err
+	}
+	return nil
+}
+
+func (blobObject *fsBlobObject) GetAttributes(ctx context.Context) (BlobObjectAttributes, error) {
+	info, err := os.Stat(blobObject.path)
+	if os.IsNotExist(err) {
+		return BlobObjectAttributes{}, errors.Wrap(longtaillib.ErrENOENT, blobObject.path)
+	}
+	if err != nil {
+		return BlobObjectAttributes{}, err
+	}
+	meta, err := blobObject.readMeta()
+	if err != nil {
+		return BlobObjectAttributes{}, err
+	}
+	if meta.ContentType == "" {
+		meta.ContentType = defaultBlobContentType
+	}
+	if meta.Metadata == nil {
+		meta.Metadata = map[string]string{}
+	}
+	return BlobObjectAttributes{
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+		Generation:   fmt.Sprintf("%d-%d-%d", meta.Generation, info.ModTime().UnixNano(), info.Size()),
+		ContentType:  meta.ContentType,
+		Metadata:     meta.Metadata}, nil
+}
+
+// readMeta returns empty attributes if the object has no meta file
+func (blobObject *fsBlobObject) readMeta() (fsObjectMeta, error) {
+	meta := fsObjectMeta{}
+	metaData, err := ioutil.ReadFile(blobObject.internalPath + fsMetaSuffix)
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(metaData, &meta)
+	if err != nil {
+		return meta, errors.Wrap(err, blobObject.internalPath+fsMetaSuffix)
+	}
+	return meta, nil
+}
+
+// verifyChecksums accepts content that matches the checksums of the object, or the previous checksums
+// while the content is replaced
+func (meta *fsObjectMeta) verifyChecksums(path string, crc32cSum []byte, md5Sum []byte) error {
+	err := meta.fsChecksums.verify(path, crc32cSum, md5Sum)
+	if err != nil && meta.Previous != nil && meta.Previous.verify(path, crc32cSum, md5Sum) == nil {
+		return nil
+	}
+	return err
+}
+
+func (checksums *fsChecksums) verify(path string, crc32cSum []byte, md5Sum []byte) error {
+	if checksums.CRC32C != "" {
+		expected, _ := hex.DecodeString(checksums.CRC32C)
+		if !bytes.Equal(crc32cSum, expected) {
+			return newBlobChecksumMismatchError(path, "crc32c", expected, crc32cSum)
+		}
+	}
+	if checksums.MD5 != "" {
+		expected, _ := hex.DecodeString(checksums.MD5)
+		if !bytes.Equal(md5Sum, expected) {
+			return newBlobChecksumMismatchError(path, "md5", expected, md5Sum)
+		}
+	}
+	return nil
+}
+
+func (blobObject *fsBlobObject) SetWriteAttributes(contentType string, metadata map[string]string) {
+	blobObject.contentType = contentType
+	blobObject.metadata = metadata
+}
+
+func (blobObject *fsBlobObject) Delete(ctx context.Context) error {
+	if blobObject.writeCondition != nil {
+		locked, err := blobObject.tryLock()
+		if err != nil {
+			return err
+		}
+		if !locked {
+			return fmt.Errorf("fsBlobObject: %s is locked by another writer", blobObject.path)
+		}
+		defer blobObject.unlock()
+		ok, err := blobObject.matchesWriteCondition()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("fsBlobObject: generation lock mismatch %s", blobObject.path)
+		}
+		if !blobObject.holdsLock() {
+			return fmt.Errorf("fsBlobObject: %s is locked by another writer", blobObject.path)
+		}
+	}
+	err := os.Remove(blobObject.path)
+	if os.IsNotExist(err) {
+		return errors.Wrap(longtaillib.ErrENOENT, blobObject.path)
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Remove(blobObject.internalPath + fsMetaSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
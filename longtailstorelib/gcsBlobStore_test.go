@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net/url"
+	"os"
 	"sort"
 	"strings"
 	"sync"
@@ -13,19 +14,65 @@ import (
 	"golang.org/x/net/context"
 )
 
-func TestGCSBlobStore(t *testing.T) {
-	// This test uses hardcoded paths in gcs and is disabled
-	t.Skip()
-
-	u, err := url.Parse("gs://longtail-storage/test-storage/store")
+// newTestGCSBlobStore creates the store for the URI in LONGTAIL_GCS_TEST_URI and skips the test if it
+// is not set. To test against a local fake-gcs-server started with -scheme http use
+// gs://longtail-storage/test-storage/store?endpoint=http://127.0.0.1:4443/storage/v1/
+func newTestGCSBlobStore(t *testing.T) BlobStore {
+	uri := os.Getenv("LONGTAIL_GCS_TEST_URI")
+	if uri == "" {
+		t.Skip("LONGTAIL_GCS_TEST_URI is not set")
+	}
+	u, err := url.Parse(uri)
 	if err != nil {
-		t.Errorf("url.Parse() err == %q", err)
+		t.Fatalf("url.Parse() err == %q", err)
 	}
 	blobStore, err := NewGCSBlobStore(u)
+	if err != nil {
+		t.Fatalf("NewGCSBlobStore() err == %q", err)
+	}
+	return blobStore
+}
+
+func TestGCSBlobStoreURI(t *testing.T) {
+	u, _ := url.Parse("gs://longtail-storage/test-storage/store?endpoint=http://127.0.0.1:4443/storage/v1/")
+	blobStore, err := NewGCSBlobStore(u)
 	if err != nil {
 		t.Errorf("NewGCSBlobStore() err == %q", err)
 	}
-	client, err := blobStore.NewClient(context.Background())
+	if blobStore.String() != "gs://longtail-storage/test-storage/store/" {
+		t.Errorf("TestGCSBlobStoreURI() String() %s != %s", blobStore.String(), "gs://longtail-storage/test-storage/store/")
+	}
+	if !blobStore.(*gcsBlobStore).anonymous {
+		t.Errorf("TestGCSBlobStoreURI() anonymous %t != %t for http endpoint", false, true)
+	}
+
+	u, _ = url.Parse("gs://longtail-storage/store?credentials-file=key.json&impersonate=longtail@project.iam.gserviceaccount.com")
+	blobStore, err = NewGCSBlobStore(u)
+	if err != nil {
+		t.Errorf("NewGCSBlobStore() err == %q", err)
+	}
+	if blobStore.(*gcsBlobStore).credentialsFile != "key.json" || blobStore.(*gcsBlobStore).impersonate != "longtail@project.iam.gserviceaccount.com" {
+		t.Errorf("TestGCSBlobStoreURI() credentials %s, %s", blobStore.(*gcsBlobStore).credentialsFile, blobStore.(*gcsBlobStore).impersonate)
+	}
+
+	for _, invalid := range []string{
+		"gs://longtail-storage/store?anonymous=maybe",
+		"gs://longtail-storage/store?anonymous=true&credentials-file=key.json",
+		"gs://longtail-storage/store?endpoint=http://127.0.0.1:4443/storage/v1/&impersonate=longtail@project.iam.gserviceaccount.com",
+		"gs://longtail-storage/store?endpoint=localhost",
+		"s3://longtail-storage/store"} {
+		u, _ = url.Parse(invalid)
+		_, err = NewGCSBlobStore(u)
+		if err == nil {
+			t.Errorf("NewGCSBlobStore() err == nil for %s", invalid)
+		}
+	}
+}
+
+func TestGCSBlobStore(t *testing.T) {
+	blobStore := newTestGCSBlobStore(t)
+	ctx := context.Background()
+	client, err := blobStore.NewClient(ctx)
 	if err != nil {
 		t.Errorf("blobStore.NewClient() err == %q", err)
 	}
@@ -33,7 +80,7 @@ func TestGCSBlobStore(t *testing.T) {
 	if err != nil {
 		t.Errorf("client.NewObject() err == %q", err)
 	}
-	ok, err := object.Write([]byte("apa"))
+	ok, err := object.Write(ctx, []byte("apa"))
 	if !ok {
 		t.Errorf("object.Write() ok != true")
 	}
@@ -43,18 +90,9 @@ func TestGCSBlobStore(t *testing.T) {
 }
 
 func TestGCSBlobStoreVersioning(t *testing.T) {
-	// This test uses hardcoded paths in gcs and is disabled
-	t.Skip()
-
-	u, err := url.Parse("gs://longtail-storage/test-storage/store")
-	if err != nil {
-		t.Errorf("url.Parse() err == %q", err)
-	}
-	blobStore, err := NewGCSBlobStore(u)
-	if err != nil {
-		t.Errorf("NewGCSBlobStore() err == %q", err)
-	}
-	client, err := blobStore.NewClient(context.Background())
+	blobStore := newTestGCSBlobStore(t)
+	ctx := context.Background()
+	client, err := blobStore.NewClient(ctx)
 	if err != nil {
 		t.Errorf("blobStore.NewClient() err == %q", err)
 	}
@@ -62,54 +100,55 @@ func TestGCSBlobStoreVersioning(t *testing.T) {
 	if err != nil {
 		t.Errorf("client.NewObject() err == %q", err)
 	}
-	err = object.Delete()
-	exists, err := object.LockWriteVersion()
+	err = object.Delete(ctx)
+	exists, err := object.LockWriteVersion(ctx)
 	if err != nil {
 		t.Errorf("object.LockWriteVersion() err == %q", err)
 	}
 	if exists {
 		t.Errorf("object.LockWriteVersion() exists != false")
 	}
-	ok, err := object.Write([]byte("apa"))
+	ok, err := object.Write(ctx, []byte("apa"))
 	if !ok {
 		t.Errorf("object.Write() ok != true")
 	}
 	if err != nil {
 		t.Errorf("object.Write() err == %q", err)
 	}
-	ok, err = object.Write([]byte("skapa"))
+	ok, err = object.Write(ctx, []byte("skapa"))
 	if ok {
 		t.Errorf("object.Write() ok != false")
 	}
 	if err != nil {
 		t.Errorf("object.Write() err == %q", err)
 	}
-	exists, err = object.LockWriteVersion()
+	exists, err = object.LockWriteVersion(ctx)
 	if err != nil {
 		t.Errorf("object.LockWriteVersion() err == %q", err)
 	}
 	if !exists {
 		t.Errorf("object.LockWriteVersion() exists == false")
 	}
-	ok, err = object.Write([]byte("skapa"))
+	ok, err = object.Write(ctx, []byte("skapa"))
 	if !ok {
 		t.Errorf("object.Write() ok == false")
 	}
 	if err != nil {
 		t.Errorf("object.Write() err == %q", err)
 	}
-	_, err = object.Read()
+	_, err = object.Read(ctx)
 	if err != nil {
 		t.Errorf("object.Read() err == %q", err)
 	}
-	err = object.Delete()
+	err = object.Delete(ctx)
 	if err != nil {
 		t.Errorf("object.Delete() err == %q", err)
 	}
 }
 
 func writeANumberWithRetry(number int, blobStore BlobStore) error {
-	client, err := blobStore.NewClient(context.Background())
+	ctx := context.Background()
+	client, err := blobStore.NewClient(ctx)
 	if err != nil {
 		return err
 	}
@@ -119,13 +158,13 @@ func writeANumberWithRetry(number int, blobStore BlobStore) error {
 		return err
 	}
 	for {
-		exists, err := object.LockWriteVersion()
+		exists, err := object.LockWriteVersion(ctx)
 		if err != nil {
 			return err
 		}
 		var sliceData []string
 		if exists {
-			data, err := object.Read()
+			data, err := object.Read(ctx)
 			if err != nil {
 				return err
 			}
@@ -136,7 +175,7 @@ func writeANumberWithRetry(number int, blobStore BlobStore) error {
 		sort.Strings(sliceData)
 		newData := strings.Join(sliceData, "\n")
 
-		ok, err := object.Write([]byte(newData))
+		ok, err := object.Write(ctx, []byte(newData))
 		if err != nil {
 			return err
 		}
@@ -149,17 +188,7 @@ func writeANumberWithRetry(number int, blobStore BlobStore) error {
 }
 
 func TestGCSBlobStoreVersioningStressTest(t *testing.T) {
-	// This test uses hardcoded paths in gcs and is disabled
-	t.Skip()
-
-	u, err := url.Parse("gs://longtail-storage/test-storage/store")
-	if err != nil {
-		t.Errorf("url.Parse() err == %q", err)
-	}
-	blobStore, err := NewGCSBlobStore(u)
-	if err != nil {
-		t.Errorf("NewGCSBlobStore() err == %q", err)
-	}
+	blobStore := newTestGCSBlobStore(t)
 
 	var wg sync.WaitGroup
 
@@ -177,7 +206,8 @@ func TestGCSBlobStoreVersioningStressTest(t *testing.T) {
 		wg.Wait()
 	}
 
-	client, err := blobStore.NewClient(context.Background())
+	ctx := context.Background()
+	client, err := blobStore.NewClient(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -186,7 +216,7 @@ func TestGCSBlobStoreVersioningStressTest(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	data, err := object.Read()
+	data, err := object.Read(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
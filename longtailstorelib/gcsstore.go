@@ -2,43 +2,68 @@ package longtailstorelib
 
 import (
 	"context"
+	"crypto/md5"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
 	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
 	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iamcredentials/v1"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
 type gcsBlobStore struct {
-	bucketName string
-	prefix     string
+	bucketName      string
+	prefix          string
+	credentialsFile string
+	impersonate     string
+	anonymous       bool
+	endpoint        string
 }
 
 type gcsBlobClient struct {
 	client *storage.Client
-	ctx    context.Context
 	store  *gcsBlobStore
 	bucket *storage.BucketHandle
 }
 
 type gcsBlobObject struct {
 	objHandle      *storage.ObjectHandle
-	ctx            context.Context
 	path           string
 	writeCondition *storage.Conditions
 	client         *gcsBlobClient
+	contentType    string
+	metadata       map[string]string
 }
 
 const (
 	// If the meta generation changes between our lock and write/close we get a gcs error with code 412
 	writeConditionFailed = 412
 	rateLimitExceeded    = 429
+	// An upload that does not match the CRC32C or MD5 sent with it is rejected with code 400
+	badRequest = 400
 )
 
-// NewGCSBlobStore ...
+// NewGCSBlobStore creates a BlobStore for a gs://bucket/prefix URI
+//
+// Without query parameters the application default credentials are used, for example from
+// gcloud auth application-default login. The following optional query parameters are supported:
+//
+//	credentials-file - service account JSON key file
+//	impersonate      - service account email to impersonate, the caller needs the Service Account Token Creator role
+//	anonymous        - set to true to access a public bucket without credentials
+//	endpoint         - custom JSON API endpoint, for example http://127.0.0.1:4443/storage/v1/ for fake-gcs-server,
+//	                   a plain http endpoint is treated as a local emulator and accessed anonymously
 func NewGCSBlobStore(u *url.URL) (BlobStore, error) {
 	if u.Scheme != "gs" {
 		return nil, fmt.Errorf("invalid scheme '%s', expected 'gs'", u.Scheme)
@@ -52,39 +77,148 @@ func NewGCSBlobStore(u *url.URL) (BlobStore, error) {
 		prefix += "/"
 	}
 
-	s := &gcsBlobStore{bucketName: u.Host, prefix: prefix}
+	query := u.Query()
+	s := &gcsBlobStore{
+		bucketName:      u.Host,
+		prefix:          prefix,
+		credentialsFile: query.Get("credentials-file"),
+		impersonate:     query.Get("impersonate"),
+		endpoint:        query.Get("endpoint")}
+	if anonymous := query.Get("anonymous"); anonymous != "" {
+		var err error
+		s.anonymous, err = strconv.ParseBool(anonymous)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid anonymous value '%s'", anonymous)
+		}
+	}
+	if s.endpoint != "" {
+		endpointURL, err := url.Parse(s.endpoint)
+		if err != nil || endpointURL.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint '%s'", s.endpoint)
+		}
+		if endpointURL.Scheme == "http" {
+			s.anonymous = true
+		}
+	}
+	if s.anonymous && (s.credentialsFile != "" || s.impersonate != "") {
+		return nil, fmt.Errorf("anonymous access can not be combined with credentials in '%s'", u.String())
+	}
 	return s, nil
 }
 
+// getClientOptions returns the storage client options for the authentication and endpoint of the store
+func (blobStore *gcsBlobStore) getClientOptions(ctx context.Context) ([]option.ClientOption, error) {
+	opts := []option.ClientOption{}
+	if blobStore.credentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(blobStore.credentialsFile))
+	}
+	if blobStore.impersonate != "" {
+		tokenSource, err := newGCSImpersonatedTokenSource(ctx, blobStore.impersonate, opts)
+		if err != nil {
+			return nil, err
+		}
+		opts = []option.ClientOption{option.WithTokenSource(tokenSource)}
+	}
+	if blobStore.anonymous {
+		opts = append(opts, option.WithoutAuthentication())
+	}
+	if blobStore.endpoint != "" {
+		opts = append(opts, option.WithEndpoint(blobStore.endpoint))
+		endpointURL, _ := url.Parse(blobStore.endpoint)
+		if endpointURL.Scheme == "http" {
+			// The storage client always reads object content over https, an emulator only listens on http
+			opts = append(opts, option.WithHTTPClient(&http.Client{Transport: &gcsEmulatorTransport{host: endpointURL.Host}}))
+		}
+	}
+	return opts, nil
+}
+
+// gcsEmulatorTransport sends the https requests for host over http
+type gcsEmulatorTransport struct {
+	host string
+}
+
+func (t *gcsEmulatorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" && req.URL.Host == t.host {
+		req = req.Clone(req.Context())
+		req.URL.Scheme = "http"
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// gcsImpersonatedTokenSource creates access tokens for a service account using the credentials of the caller
+type gcsImpersonatedTokenSource struct {
+	service *iamcredentials.Service
+	name    string
+}
+
+func newGCSImpersonatedTokenSource(ctx context.Context, serviceAccount string, opts []option.ClientOption) (oauth2.TokenSource, error) {
+	service, err := iamcredentials.NewService(ctx, opts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create credentials service to impersonate %s", serviceAccount)
+	}
+	return oauth2.ReuseTokenSource(nil, &gcsImpersonatedTokenSource{service: service, name: "projects/-/serviceAccounts/" + serviceAccount}), nil
+}
+
+// Token implements oauth2.TokenSource, it is called when the current token has expired which can be
+// long after the client was created so it does not use the context of NewClient
+func (ts *gcsImpersonatedTokenSource) Token() (*oauth2.Token, error) {
+	request := &iamcredentials.GenerateAccessTokenRequest{Scope: []string{storage.ScopeFullControl}}
+	response, err := ts.service.Projects.ServiceAccounts.GenerateAccessToken(ts.name, request).Do()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to impersonate %s", ts.name)
+	}
+	expiry, err := time.Parse(time.RFC3339, response.ExpireTime)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid token expiry time '%s'", response.ExpireTime)
+	}
+	return &oauth2.Token{AccessToken: response.AccessToken, TokenType: "Bearer", Expiry: expiry}, nil
+}
+
 func (blobStore *gcsBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
-	client, err := storage.NewClient(ctx)
+	opts, err := blobStore.getClientOptions(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, blobStore.bucketName)
+	}
+	client, err := storage.NewClient(ctx, opts...)
 	if err != nil {
 		return nil, errors.Wrap(err, blobStore.bucketName)
 	}
 
 	bucket := client.Bucket(blobStore.bucketName)
-	return &gcsBlobClient{client: client, ctx: ctx, store: blobStore, bucket: bucket}, nil
+	return &gcsBlobClient{client: client, store: blobStore, bucket: bucket}, nil
 }
 
 func (blobStore *gcsBlobStore) String() string {
 	return "gs://" + blobStore.bucketName + "/" + blobStore.prefix
 }
 
+// IsRetryableError implements BlobErrorClassifier
+func (blobStore *gcsBlobStore) IsRetryableError(err error) bool {
+	cause := errors.Cause(err)
+	if cause == storage.ErrObjectNotExist || cause == storage.ErrBucketNotExist {
+		return false
+	}
+	if e, ok := cause.(*googleapi.Error); ok {
+		return isRetryableHTTPStatus(e.Code)
+	}
+	return true
+}
+
 func (blobClient *gcsBlobClient) NewObject(path string) (BlobObject, error) {
 	gcsPath := blobClient.store.prefix + path
 	objHandle := blobClient.bucket.Object(gcsPath)
 	return &gcsBlobObject{
 			objHandle:      objHandle,
-			ctx:            blobClient.ctx,
 			path:           gcsPath,
 			writeCondition: nil,
 			client:         blobClient},
 		nil
 }
 
-func (blobClient *gcsBlobClient) GetObjects() ([]BlobProperties, error) {
+func (blobClient *gcsBlobClient) GetObjects(ctx context.Context) ([]BlobProperties, error) {
 	var items []BlobProperties
-	it := blobClient.bucket.Objects(blobClient.ctx, &storage.Query{
+	it := blobClient.bucket.Objects(ctx, &storage.Query{
 		Prefix: blobClient.store.prefix,
 	})
 
@@ -102,6 +236,33 @@ func (blobClient *gcsBlobClient) GetObjects() ([]BlobProperties, error) {
 	return items, nil
 }
 
+type gcsBlobObjectIterator struct {
+	it     *storage.ObjectIterator
+	prefix string
+}
+
+func (blobClient *gcsBlobClient) ListObjects(ctx context.Context, prefix string, delimiter string) BlobObjectIterator {
+	it := blobClient.bucket.Objects(ctx, &storage.Query{
+		Prefix:    blobClient.store.prefix + prefix,
+		Delimiter: delimiter,
+	})
+	return &gcsBlobObjectIterator{it: it, prefix: blobClient.store.prefix}
+}
+
+func (it *gcsBlobObjectIterator) Next() (BlobProperties, error) {
+	attrs, err := it.it.Next()
+	if err == iterator.Done {
+		return BlobProperties{}, ErrBlobIteratorDone
+	}
+	if err != nil {
+		return BlobProperties{}, err
+	}
+	if attrs.Prefix != "" {
+		return BlobProperties{Name: attrs.Prefix[len(it.prefix):], IsPrefix: true}, nil
+	}
+	return BlobProperties{Size: attrs.Size, Name: attrs.Name[len(it.prefix):]}, nil
+}
+
 func (blobClient *gcsBlobClient) Close() {
 	blobClient.client.Close()
 }
@@ -110,23 +271,38 @@ func (blobClient *gcsBlobClient) String() string {
 	return blobClient.store.String()
 }
 
-func (blobObject *gcsBlobObject) Read() ([]byte, error) {
-	reader, err := blobObject.objHandle.NewReader(blobObject.ctx)
+// Read verifies the content against the CRC32C of the object generation it reads
+func (blobObject *gcsBlobObject) Read(ctx context.Context) ([]byte, error) {
+	objAttrs, err := blobObject.objHandle.Attrs(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, blobObject.path)
 	}
-	data, err := ioutil.ReadAll(reader)
-	err2 := reader.Close()
-	if err != nil {
-		return nil, errors.Wrap(err, blobObject.path)
-	} else if err2 != nil {
-		return nil, err2
+	data := []byte{}
+	if objAttrs.Size > 0 {
+		// A ranged read of the whole object is not checked by the storage reader, we check it below
+		reader, err := blobObject.objHandle.Generation(objAttrs.Generation).NewRangeReader(ctx, 0, objAttrs.Size)
+		if err != nil {
+			return nil, errors.Wrap(err, blobObject.path)
+		}
+		data, err = ioutil.ReadAll(reader)
+		err2 := reader.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, blobObject.path)
+		} else if err2 != nil {
+			return nil, err2
+		}
+	}
+	if objAttrs.ContentEncoding != "gzip" {
+		// Objects stored gzip encoded are decompressed on download and the CRC32C is of the compressed content
+		if crc := crc32.Checksum(data, crc32cTable); crc != objAttrs.CRC32C {
+			return nil, errors.Wrapf(ErrBlobChecksumMismatch, "%s: crc32c %08x != %08x", blobObject.path, crc, objAttrs.CRC32C)
+		}
 	}
 	return data, nil
 }
 
-func (blobObject *gcsBlobObject) LockWriteVersion() (bool, error) {
-	objAttrs, err := blobObject.objHandle.Attrs(blobObject.ctx)
+func (blobObject *gcsBlobObject) LockWriteVersion(ctx context.Context) (bool, error) {
+	objAttrs, err := blobObject.objHandle.Attrs(ctx)
 	if err == storage.ErrObjectNotExist {
 		blobObject.writeCondition = &storage.Conditions{DoesNotExist: true}
 		return false, nil
@@ -138,8 +314,8 @@ func (blobObject *gcsBlobObject) LockWriteVersion() (bool, error) {
 	return true, nil
 }
 
-func (blobObject *gcsBlobObject) Exists() (bool, error) {
-	_, err := blobObject.objHandle.Attrs(blobObject.ctx)
+func (blobObject *gcsBlobObject) Exists(ctx context.Context) (bool, error) {
+	_, err := blobObject.objHandle.Attrs(ctx)
 	if err == storage.ErrObjectNotExist {
 		return false, nil
 	}
@@ -149,37 +325,110 @@ func (blobObject *gcsBlobObject) Exists() (bool, error) {
 	return true, nil
 }
 
-func (blobObject *gcsBlobObject) Write(data []byte) (bool, error) {
+// Write sends the CRC32C and MD5 of data so the upload is rejected if it is corrupted on the way
+func (blobObject *gcsBlobObject) Write(ctx context.Context, data []byte) (bool, error) {
+	w := blobObject.newGCSBlobWriter(ctx)
+	w.writer.CRC32C = crc32.Checksum(data, crc32cTable)
+	w.writer.SendCRC32C = true
+	md5Sum := md5.Sum(data)
+	w.writer.MD5 = md5Sum[:]
+	w.sentChecksums = true
+	return writeToBlobWriter(w, data)
+}
+
+func (blobObject *gcsBlobObject) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	reader, err := blobObject.objHandle.NewReader(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.path)
+	}
+	return reader, nil
+}
+
+func (blobObject *gcsBlobObject) NewRangeReader(ctx context.Context, offset int64, length int64) (io.ReadCloser, error) {
+	if length < 0 {
+		length = -1
+	}
+	reader, err := blobObject.objHandle.NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.path)
+	}
+	return reader, nil
+}
+
+type gcsBlobWriter struct {
+	writer *storage.Writer
+	path   string
+	// sentChecksums is set when the upload carries the checksums of the content, the request is
+	// otherwise the same as any other write so a bad request means the content did not match them
+	sentChecksums bool
+}
+
+func (blobObject *gcsBlobObject) NewWriter(ctx context.Context) (io.WriteCloser, error) {
+	return blobObject.newGCSBlobWriter(ctx), nil
+}
+
+func (blobObject *gcsBlobObject) newGCSBlobWriter(ctx context.Context) *gcsBlobWriter {
 	var writer *storage.Writer
 	if blobObject.writeCondition == nil {
-		writer = blobObject.objHandle.NewWriter(blobObject.ctx)
+		writer = blobObject.objHandle.NewWriter(ctx)
 	} else {
-		writer = blobObject.objHandle.If(*blobObject.writeCondition).NewWriter(blobObject.ctx)
+		writer = blobObject.objHandle.If(*blobObject.writeCondition).NewWriter(ctx)
+	}
+	writer.ContentType = defaultBlobContentType
+	if blobObject.contentType != "" {
+		writer.ContentType = blobObject.contentType
 	}
+	writer.Metadata = blobObject.metadata
+	return &gcsBlobWriter{writer: writer, path: blobObject.path}
+}
 
-	_, err := writer.Write(data)
-	err2 := writer.Close()
+func (w *gcsBlobWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
 	if err != nil {
-		return false, errors.Wrap(err, blobObject.path)
+		return n, errors.Wrap(err, w.path)
 	}
-	if e, ok := err2.(*googleapi.Error); ok {
+	return n, nil
+}
+
+func (w *gcsBlobWriter) Close() error {
+	err := w.writer.Close()
+	if e, ok := err.(*googleapi.Error); ok {
 		if e.Code == writeConditionFailed || e.Code == rateLimitExceeded {
-			return false, nil
+			return ErrBlobWriteConditionFailed
+		}
+		if e.Code == badRequest && w.sentChecksums {
+			return errors.Wrapf(ErrBlobChecksumMismatch, "%s: %v", w.path, e)
 		}
-		return false, err2
-	} else if err2 != nil {
-		return false, err2
+		return err
+	} else if err != nil {
+		return err
 	}
+	return nil
+}
 
-	_, err = blobObject.objHandle.Update(blobObject.ctx, storage.ObjectAttrsToUpdate{ContentType: "application/octet-stream"})
+func (blobObject *gcsBlobObject) GetAttributes(ctx context.Context) (BlobObjectAttributes, error) {
+	objAttrs, err := blobObject.objHandle.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return BlobObjectAttributes{}, errors.Wrap(longtaillib.ErrENOENT, blobObject.path)
+	}
 	if err != nil {
-		return true, err
+		return BlobObjectAttributes{}, errors.Wrap(err, blobObject.path)
 	}
-	return true, nil
+	return BlobObjectAttributes{
+		Size:         objAttrs.Size,
+		LastModified: objAttrs.Updated,
+		Generation:   strconv.FormatInt(objAttrs.Generation, 10),
+		ContentType:  objAttrs.ContentType,
+		Metadata:     objAttrs.Metadata}, nil
+}
+
+func (blobObject *gcsBlobObject) SetWriteAttributes(contentType string, metadata map[string]string) {
+	blobObject.contentType = contentType
+	blobObject.metadata = metadata
 }
 
-func (blobObject *gcsBlobObject) Delete() error {
-	_, err := blobObject.objHandle.Attrs(blobObject.ctx)
+func (blobObject *gcsBlobObject) Delete(ctx context.Context) error {
+	_, err := blobObject.objHandle.Attrs(ctx)
 	if err == storage.ErrObjectNotExist {
 		return nil
 	}
@@ -187,9 +436,9 @@ func (blobObject *gcsBlobObject) Delete() error {
 		return err
 	}
 	if blobObject.writeCondition == nil {
-		err = blobObject.objHandle.Delete(blobObject.ctx)
+		err = blobObject.objHandle.Delete(ctx)
 	} else {
-		err = blobObject.objHandle.If(*blobObject.writeCondition).Delete(blobObject.ctx)
+		err = blobObject.objHandle.If(*blobObject.writeCondition).Delete(ctx)
 	}
 	return err
 }
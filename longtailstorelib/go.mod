@@ -4,9 +4,12 @@ go 1.13
 
 require (
 	cloud.google.com/go/storage v1.7.0
+	github.com/Azure/azure-storage-blob-go v0.13.0
 	github.com/DanEngelbrecht/golongtail/longtaillib v0.0.0-00010101000000-000000000000
+	github.com/aws/aws-sdk-go v1.35.35
 	github.com/pkg/errors v0.9.1
-	golang.org/x/net v0.0.0-20200501053045-e0ff5e5a1de5
+	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b
+	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	google.golang.org/api v0.22.0
 )
 
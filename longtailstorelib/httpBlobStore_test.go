@@ -0,0 +1,116 @@
+package longtailstorelib
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func newTestHTTPServer() *httptest.Server {
+	content := map[string][]byte{
+		"/store/store.lsi":      []byte("store-index"),
+		"/store/index/test.lvi": []byte("version-index"),
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		data, exists := content[r.URL.Path]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	}))
+}
+
+func TestHTTPBlobStore(t *testing.T) {
+	server := newTestHTTPServer()
+	defer server.Close()
+
+	u, err := url.Parse(server.URL + "/store?token=secret")
+	if err != nil {
+		t.Errorf("url.Parse() err == %q", err)
+	}
+	blobStore, err := NewHTTPBlobStore(u)
+	if err != nil {
+		t.Errorf("NewHTTPBlobStore() err == %q", err)
+	}
+	ctx := context.Background()
+	client, err := blobStore.NewClient(ctx)
+	if err != nil {
+		t.Errorf("blobStore.NewClient() err == %q", err)
+	}
+	defer client.Close()
+
+	object, _ := client.NewObject("store.lsi")
+	exists, err := object.Exists(ctx)
+	if err != nil {
+		t.Errorf("object.Exists() err == %q", err)
+	}
+	if !exists {
+		t.Errorf("object.Exists() exists != true")
+	}
+	data, err := object.Read(ctx)
+	if err != nil {
+		t.Errorf("object.Read() err == %q", err)
+	}
+	if string(data) != "store-index" {
+		t.Errorf("TestHTTPBlobStore() object.Read() %s != %s", string(data), "store-index")
+	}
+	reader, err := object.NewRangeReader(ctx, 3, 0)
+	if err != nil {
+		t.Errorf("object.NewRangeReader() err == %q", err)
+	} else {
+		rangeData, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		if len(rangeData) != 0 {
+			t.Errorf("TestHTTPBlobStore() object.NewRangeReader() %d != %d", len(rangeData), 0)
+		}
+	}
+	ok, err := object.Write(ctx, []byte("apa"))
+	if ok || err == nil {
+		t.Errorf("object.Write() on read only store succeeded")
+	}
+	_, err = object.LockWriteVersion(ctx)
+	if err == nil {
+		t.Errorf("object.LockWriteVersion() on read only store succeeded")
+	}
+
+	missingObject, _ := client.NewObject("chunks/0000/0x0000000000000000.lsb")
+	exists, err = missingObject.Exists(ctx)
+	if err != nil {
+		t.Errorf("missingObject.Exists() err == %q", err)
+	}
+	if exists {
+		t.Errorf("missingObject.Exists() exists != false")
+	}
+	_, err = missingObject.Read(ctx)
+	if err == nil {
+		t.Errorf("missingObject.Read() err == nil")
+	}
+}
+
+func TestHTTPReadFromURI(t *testing.T) {
+	server := newTestHTTPServer()
+	defer server.Close()
+
+	data, err := ReadFromURI(context.Background(), server.URL + "/store/index/test.lvi?token=secret")
+	if err != nil {
+		t.Errorf("ReadFromURI() err == %q", err)
+	}
+	if string(data) != "version-index" {
+		t.Errorf("TestHTTPReadFromURI() ReadFromURI() %s != %s", string(data), "version-index")
+	}
+	err = WriteToURI(context.Background(), server.URL+"/store/index/test.lvi?token=secret", []byte("apa"))
+	if err == nil {
+		t.Errorf("WriteToURI() err == nil")
+	}
+}
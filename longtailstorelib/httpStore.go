@@ -0,0 +1,234 @@
+package longtailstorelib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+type httpBlobStore struct {
+	baseURL    url.URL
+	prefix     string
+	httpClient *http.Client
+}
+
+type httpBlobClient struct {
+	store *httpBlobStore
+}
+
+type httpBlobObject struct {
+	client    *httpBlobClient
+	path      string
+	objectURL string
+}
+
+// NewHTTPBlobStore creates a read only BlobStore for an http:// or https:// URI
+//
+// Objects are fetched with plain GET requests relative to the URI, any query string
+// in the URI (such as a CDN access token) is passed along with each request. The store
+// can not be listed or written to so it is only usable with a ReadOnly remote block store
+func NewHTTPBlobStore(u *url.URL) (BlobStore, error) {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid scheme '%s', expected 'http' or 'https'", u.Scheme)
+	}
+	prefix := u.Path
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if prefix == "" {
+		prefix = "/"
+	}
+
+	s := &httpBlobStore{
+		baseURL:    *u,
+		prefix:     prefix,
+		httpClient: &http.Client{}}
+	return s, nil
+}
+
+func (blobStore *httpBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
+	return &httpBlobClient{store: blobStore}, nil
+}
+
+func (blobStore *httpBlobStore) String() string {
+	return blobStore.baseURL.Scheme + "://" + blobStore.baseURL.Host + blobStore.prefix
+}
+
+// IsRetryableError implements BlobErrorClassifier
+func (blobStore *httpBlobStore) IsRetryableError(err error) bool {
+	if e, ok := errors.Cause(err).(*httpStatusError); ok {
+		return isRetryableHTTPStatus(e.statusCode)
+	}
+	return true
+}
+
+// httpStatusError is returned when the server answers with an unexpected status
+type httpStatusError struct {
+	method     string
+	url        string
+	status     string
+	statusCode int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("httpBlobObject: %s %s failed with status %s", e.method, e.url, e.status)
+}
+
+func (blobClient *httpBlobClient) NewObject(path string) (BlobObject, error) {
+	objectURL := blobClient.store.baseURL
+	objectURL.Path = blobClient.store.prefix + path
+	objectURL.RawPath = ""
+	return &httpBlobObject{
+			client:    blobClient,
+			path:      path,
+			objectURL: objectURL.String()},
+		nil
+}
+
+func (blobClient *httpBlobClient) GetObjects(ctx context.Context) ([]BlobProperties, error) {
+	return nil, errors.Wrapf(longtaillib.ErrEINVAL, "httpBlobClient: listing objects is not supported in %s", blobClient.store.String())
+}
+
+func (blobClient *httpBlobClient) ListObjects(ctx context.Context, prefix string, delimiter string) BlobObjectIterator {
+	_, err := blobClient.GetObjects(ctx)
+	return newSliceBlobObjectIterator(nil, err)
+}
+
+func (blobClient *httpBlobClient) Close() {
+}
+
+func (blobClient *httpBlobClient) String() string {
+	return blobClient.store.String()
+}
+
+func (blobObject *httpBlobObject) do(ctx context.Context, method string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, blobObject.objectURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.objectURL)
+	}
+	resp, err := blobObject.client.store.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.objectURL)
+	}
+	return resp, nil
+}
+
+func (blobObject *httpBlobObject) Read(ctx context.Context) ([]byte, error) {
+	resp, err := blobObject.do(ctx, http.MethodGet)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errors.Wrap(longtaillib.ErrENOENT, blobObject.objectURL)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{method: http.MethodGet, url: blobObject.objectURL, status: resp.Status, statusCode: resp.StatusCode}
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.objectURL)
+	}
+	return data, nil
+}
+
+func (blobObject *httpBlobObject) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	return blobObject.NewRangeReader(ctx, 0, -1)
+}
+
+func (blobObject *httpBlobObject) NewRangeReader(ctx context.Context, offset int64, length int64) (io.ReadCloser, error) {
+	// An empty range can not be expressed as a range request
+	if length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, blobObject.objectURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.objectURL)
+	}
+	expectedStatus := http.StatusOK
+	if length >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+		expectedStatus = http.StatusPartialContent
+	} else if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		expectedStatus = http.StatusPartialContent
+	}
+	resp, err := blobObject.client.store.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.objectURL)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errors.Wrap(longtaillib.ErrENOENT, blobObject.objectURL)
+	}
+	if resp.StatusCode != expectedStatus {
+		resp.Body.Close()
+		return nil, &httpStatusError{method: http.MethodGet, url: blobObject.objectURL, status: resp.Status, statusCode: resp.StatusCode}
+	}
+	return resp.Body, nil
+}
+
+func (blobObject *httpBlobObject) NewWriter(ctx context.Context) (io.WriteCloser, error) {
+	return nil, errors.Wrapf(longtaillib.ErrEROFS, "httpBlobObject: %s is read only", blobObject.objectURL)
+}
+
+func (blobObject *httpBlobObject) LockWriteVersion(ctx context.Context) (bool, error) {
+	return false, errors.Wrapf(longtaillib.ErrEROFS, "httpBlobObject: %s is read only", blobObject.objectURL)
+}
+
+func (blobObject *httpBlobObject) Exists(ctx context.Context) (bool, error) {
+	resp, err := blobObject.do(ctx, http.MethodHead)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, &httpStatusError{method: http.MethodHead, url: blobObject.objectURL, status: resp.Status, statusCode: resp.StatusCode}
+	}
+	return true, nil
+}
+
+func (blobObject *httpBlobObject) GetAttributes(ctx context.Context) (BlobObjectAttributes, error) {
+	resp, err := blobObject.do(ctx, http.MethodHead)
+	if err != nil {
+		return BlobObjectAttributes{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return BlobObjectAttributes{}, errors.Wrap(longtaillib.ErrENOENT, blobObject.objectURL)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return BlobObjectAttributes{}, &httpStatusError{method: http.MethodHead, url: blobObject.objectURL, status: resp.Status, statusCode: resp.StatusCode}
+	}
+	attributes := BlobObjectAttributes{
+		Size:        resp.ContentLength,
+		Generation:  resp.Header.Get("ETag"),
+		ContentType: resp.Header.Get("Content-Type"),
+		Metadata:    map[string]string{}}
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		attributes.LastModified = lastModified
+	}
+	return attributes, nil
+}
+
+func (blobObject *httpBlobObject) SetWriteAttributes(contentType string, metadata map[string]string) {
+}
+
+func (blobObject *httpBlobObject) Write(ctx context.Context, data []byte) (bool, error) {
+	return false, errors.Wrapf(longtaillib.ErrEROFS, "httpBlobObject: %s is read only", blobObject.objectURL)
+}
+
+func (blobObject *httpBlobObject) Delete(ctx context.Context) error {
+	return errors.Wrapf(longtaillib.ErrEROFS, "httpBlobObject: %s is read only", blobObject.objectURL)
+}
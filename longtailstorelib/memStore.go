@@ -0,0 +1,269 @@
+package longtailstorelib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+type memBlob struct {
+	generation   int
+	data         []byte
+	lastModified time.Time
+	contentType  string
+	metadata     map[string]string
+}
+
+type memBlobData struct {
+	blobs map[string]*memBlob
+	// lastGeneration is increased by every write in the store so a deleted and recreated
+	// object never gets a generation it had before
+	lastGeneration int
+	blobsMutex     sync.RWMutex
+}
+
+type memBlobStore struct {
+	name   string
+	prefix string
+	data   *memBlobData
+}
+
+type memBlobClient struct {
+	store *memBlobStore
+}
+
+type memBlobObject struct {
+	client           *memBlobClient
+	path             string
+	lockedGeneration *int
+	contentType      string
+	metadata         map[string]string
+}
+
+var (
+	namedMemBlobStores      = make(map[string]*memBlobData)
+	namedMemBlobStoresMutex sync.Mutex
+)
+
+// NewMemBlobStore creates an in-memory BlobStore
+//
+// The name is in the form "name" or "name/prefix". All stores created with the same
+// name in a process share the same objects so multiple clients can work against the
+// same store concurrently. An empty name creates a private store.
+func NewMemBlobStore(name string) (BlobStore, error) {
+	prefix := ""
+	if i := strings.Index(name, "/"); i != -1 {
+		prefix = strings.Trim(name[i+1:], "/")
+		name = name[:i]
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var data *memBlobData
+	if name == "" {
+		data = &memBlobData{blobs: make(map[string]*memBlob)}
+	} else {
+		namedMemBlobStoresMutex.Lock()
+		data = namedMemBlobStores[name]
+		if data == nil {
+			data = &memBlobData{blobs: make(map[string]*memBlob)}
+			namedMemBlobStores[name] = data
+		}
+		namedMemBlobStoresMutex.Unlock()
+	}
+	s := &memBlobStore{name: name, prefix: prefix, data: data}
+	return s, nil
+}
+
+// ReleaseMemBlobStore drops the objects of the named in-memory store, stores that are
+// already open keep their objects but the next NewMemBlobStore with the name starts empty
+func ReleaseMemBlobStore(name string) {
+	namedMemBlobStoresMutex.Lock()
+	delete(namedMemBlobStores, name)
+	namedMemBlobStoresMutex.Unlock()
+}
+
+func (blobStore *memBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
+	return &memBlobClient{store: blobStore}, nil
+}
+
+func (blobStore *memBlobStore) String() string {
+	return "mem://" + blobStore.name + "/" + blobStore.prefix
+}
+
+func (blobClient *memBlobClient) NewObject(path string) (BlobObject, error) {
+	return &memBlobObject{client: blobClient, path: blobClient.store.prefix + path}, nil
+}
+
+func (blobClient *memBlobClient) GetObjects(ctx context.Context) ([]BlobProperties, error) {
+	data := blobClient.store.data
+	data.blobsMutex.RLock()
+	defer data.blobsMutex.RUnlock()
+	properties := make([]BlobProperties, 0, len(data.blobs))
+	for key, blob := range data.blobs {
+		if !strings.HasPrefix(key, blobClient.store.prefix) {
+			continue
+		}
+		properties = append(properties, BlobProperties{Name: key[len(blobClient.store.prefix):], Size: int64(len(blob.data))})
+	}
+	return properties, nil
+}
+
+func (blobClient *memBlobClient) ListObjects(ctx context.Context, prefix string, delimiter string) BlobObjectIterator {
+	items, err := blobClient.GetObjects(ctx)
+	if err != nil {
+		return newSliceBlobObjectIterator(nil, err)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return newSliceBlobObjectIterator(filterBlobProperties(items, prefix, delimiter), nil)
+}
+
+func (blobClient *memBlobClient) Close() {
+}
+
+func (blobClient *memBlobClient) String() string {
+	return blobClient.store.String()
+}
+
+func (blobObject *memBlobObject) Exists(ctx context.Context) (bool, error) {
+	data := blobObject.client.store.data
+	data.blobsMutex.RLock()
+	defer data.blobsMutex.RUnlock()
+	_, exists := data.blobs[blobObject.path]
+	return exists, nil
+}
+
+func (blobObject *memBlobObject) Read(ctx context.Context) ([]byte, error) {
+	data := blobObject.client.store.data
+	data.blobsMutex.RLock()
+	defer data.blobsMutex.RUnlock()
+	blob, exists := data.blobs[blobObject.path]
+	if !exists {
+		return nil, errors.Wrap(longtaillib.ErrENOENT, blobObject.path)
+	}
+	// Return a copy so the caller can not change the content seen by other clients of the store
+	return append([]byte(nil), blob.data...), nil
+}
+
+func (blobObject *memBlobObject) LockWriteVersion(ctx context.Context) (bool, error) {
+	data := blobObject.client.store.data
+	data.blobsMutex.RLock()
+	defer data.blobsMutex.RUnlock()
+	blob, exists := data.blobs[blobObject.path]
+	blobObject.lockedGeneration = new(int)
+	if !exists {
+		*blobObject.lockedGeneration = -1
+		return false, nil
+	}
+	*blobObject.lockedGeneration = blob.generation
+	return true, nil
+}
+
+func (blobObject *memBlobObject) Write(ctx context.Context, data []byte) (bool, error) {
+	storeData := blobObject.client.store.data
+	storeData.blobsMutex.Lock()
+	defer storeData.blobsMutex.Unlock()
+
+	blob, exists := storeData.blobs[blobObject.path]
+
+	if blobObject.lockedGeneration != nil {
+		if exists {
+			if blob.generation != *blobObject.lockedGeneration {
+				return false, nil
+			}
+		} else if (*blobObject.lockedGeneration) != -1 {
+			return false, nil
+		}
+	}
+
+	contentType := defaultBlobContentType
+	if blobObject.contentType != "" {
+		contentType = blobObject.contentType
+	}
+	metadata := make(map[string]string, len(blobObject.metadata))
+	for key, value := range blobObject.metadata {
+		metadata[key] = value
+	}
+
+	// Keep our own copy so the caller can reuse its buffer
+	dataCopy := append([]byte(nil), data...)
+	if !exists {
+		blob = &memBlob{}
+		storeData.blobs[blobObject.path] = blob
+	}
+	storeData.lastGeneration++
+	blob.generation = storeData.lastGeneration
+	blob.data = dataCopy
+	blob.lastModified = time.Now()
+	blob.contentType = contentType
+	blob.metadata = metadata
+	return true, nil
+}
+
+func (blobObject *memBlobObject) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	return blobObject.NewRangeReader(ctx, 0, -1)
+}
+
+func (blobObject *memBlobObject) NewRangeReader(ctx context.Context, offset int64, length int64) (io.ReadCloser, error) {
+	data, err := blobObject.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newBufferRangeReader(data, offset, length)
+}
+
+func (blobObject *memBlobObject) NewWriter(ctx context.Context) (io.WriteCloser, error) {
+	return newBufferedBlobWriter(ctx, blobObject), nil
+}
+
+func (blobObject *memBlobObject) GetAttributes(ctx context.Context) (BlobObjectAttributes, error) {
+	data := blobObject.client.store.data
+	data.blobsMutex.RLock()
+	defer data.blobsMutex.RUnlock()
+	blob, exists := data.blobs[blobObject.path]
+	if !exists {
+		return BlobObjectAttributes{}, errors.Wrap(longtaillib.ErrENOENT, blobObject.path)
+	}
+	metadata := make(map[string]string, len(blob.metadata))
+	for key, value := range blob.metadata {
+		metadata[key] = value
+	}
+	return BlobObjectAttributes{
+		Size:         int64(len(blob.data)),
+		LastModified: blob.lastModified,
+		Generation:   strconv.Itoa(blob.generation),
+		ContentType:  blob.contentType,
+		Metadata:     metadata}, nil
+}
+
+func (blobObject *memBlobObject) SetWriteAttributes(contentType string, metadata map[string]string) {
+	blobObject.contentType = contentType
+	blobObject.metadata = metadata
+}
+
+func (blobObject *memBlobObject) Delete(ctx context.Context) error {
+	data := blobObject.client.store.data
+	data.blobsMutex.Lock()
+	defer data.blobsMutex.Unlock()
+
+	blob, exists := data.blobs[blobObject.path]
+	if !exists {
+		return errors.Wrap(longtaillib.ErrENOENT, blobObject.path)
+	}
+	if blobObject.lockedGeneration != nil {
+		if blob.generation != *blobObject.lockedGeneration {
+			return fmt.Errorf("memBlobObject: generation lock mismatch %s", blobObject.path)
+		}
+	}
+	delete(data.blobs, blobObject.path)
+	return nil
+}
@@ -0,0 +1,467 @@
+package longtailstorelib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+const mirrorWriteQuorumOption = "write-quorum"
+
+type mirroredBlobStore struct {
+	blobStores  []BlobStore
+	writeQuorum int
+}
+
+type mirroredBlobClient struct {
+	store   *mirroredBlobStore
+	clients []BlobClient
+}
+
+type mirroredBlobObject struct {
+	client  *mirroredBlobClient
+	path    string
+	objects []BlobObject
+	// lockErrors holds the error from LockWriteVersion for each store, a store that could not
+	// be locked is not written to as an unconditional write could overwrite another writer
+	lockErrors []error
+	// lockExists tells which stores had the object when it was locked
+	lockExists []bool
+}
+
+// ErrMirrorDiverged is returned when reading an object to update it and the mirrored stores have
+// different content for it that can not be merged
+var ErrMirrorDiverged = errors.New("mirrored stores have diverged")
+
+// NewMirroredBlobStore creates a store that writes to all of blobStores and reads from the first
+// one that succeeds. Writes succeed if at least writeQuorum stores were written, a write condition
+// set by LockWriteVersion failing in any store makes Write return false so the caller reads and
+// merges again. Reading after LockWriteVersion merges the content of all locked stores so a write
+// that reached only some of the stores is not lost.
+//
+// The merge can not tell a block that was removed from a store index in some of the stores from a
+// block that was added to the others, so prune, repack and scrub use the stores with a write quorum
+// of all stores, see requireAllMirrors
+func NewMirroredBlobStore(blobStores []BlobStore, writeQuorum int) (BlobStore, error) {
+	if len(blobStores) == 0 {
+		return nil, errors.Wrap(longtaillib.ErrEINVAL, "mirrored store needs at least one store")
+	}
+	if writeQuorum < 1 || writeQuorum > len(blobStores) {
+		return nil, errors.Wrapf(longtaillib.ErrEINVAL, "write quorum %d must be between 1 and %d", writeQuorum, len(blobStores))
+	}
+	s := &mirroredBlobStore{blobStores: blobStores, writeQuorum: writeQuorum}
+	return s, nil
+}
+
+// newMirroredBlobStoreForURL creates a store for mirror:<uri>|<uri>[|write-quorum=<n>], each
+// uri is created with CreateBlobStoreForURI and the write quorum defaults to all stores
+func newMirroredBlobStoreForURL(u *url.URL, options BlobStoreOptions) (BlobStore, error) {
+	uris, uriOptions := getCompositeURIElements(u)
+	if len(uris) == 0 {
+		return nil, errors.Wrapf(longtaillib.ErrEINVAL, "invalid mirror uri `%s`, expected mirror:<uri>%s<uri>", u.String(), compositeURISeparator)
+	}
+	writeQuorum := len(uris)
+	for name, value := range uriOptions {
+		if name != mirrorWriteQuorumOption {
+			return nil, errors.Wrapf(longtaillib.ErrEINVAL, "unknown option `%s` in `%s`", name, u.String())
+		}
+		quorum, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.Wrapf(longtaillib.ErrEINVAL, "invalid write quorum in `%s`", u.String())
+		}
+		writeQuorum = quorum
+	}
+	blobStores := make([]BlobStore, 0, len(uris))
+	for _, uri := range uris {
+		blobStore, err := CreateBlobStoreForURI(uri, options)
+		if err != nil {
+			return nil, err
+		}
+		blobStores = append(blobStores, blobStore)
+	}
+	return NewMirroredBlobStore(blobStores, writeQuorum)
+}
+
+// requireAllMirrors returns blobStore with a write quorum of all stores if it is a mirrored store.
+// Writes that remove blocks from the store index, and the deletes of the store index deltas and
+// blocks that follow, must reach every store or merging with a store that missed them brings the
+// blocks back to the store index
+func requireAllMirrors(blobStore BlobStore) BlobStore {
+	s, ok := blobStore.(*mirroredBlobStore)
+	if !ok || s.writeQuorum == len(s.blobStores) {
+		return blobStore
+	}
+	return &mirroredBlobStore{blobStores: s.blobStores, writeQuorum: len(s.blobStores)}
+}
+
+func (s *mirroredBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
+	clients := make([]BlobClient, 0, len(s.blobStores))
+	for _, blobStore := range s.blobStores {
+		client, err := blobStore.NewClient(ctx)
+		if err != nil {
+			for _, c := range clients {
+				c.Close()
+			}
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return &mirroredBlobClient{store: s, clients: clients}, nil
+}
+
+func (s *mirroredBlobStore) String() string {
+	names := make([]string, len(s.blobStores))
+	for i, blobStore := range s.blobStores {
+		names[i] = blobStore.String()
+	}
+	return "mirror:" + strings.Join(names, compositeURISeparator)
+}
+
+// IsRetryableError is true if any of the mirrored stores considers the error retryable
+func (s *mirroredBlobStore) IsRetryableError(err error) bool {
+	for _, blobStore := range s.blobStores {
+		classifier, ok := blobStore.(BlobErrorClassifier)
+		if !ok || classifier.IsRetryableError(err) {
+			return true
+		}
+	}
+	return false
+}
+
+func (blobClient *mirroredBlobClient) NewObject(path string) (BlobObject, error) {
+	objects := make([]BlobObject, len(blobClient.clients))
+	for i, client := range blobClient.clients {
+		object, err := client.NewObject(path)
+		if err != nil {
+			return nil, err
+		}
+		objects[i] = object
+	}
+	return &mirroredBlobObject{client: blobClient, path: path, objects: objects}, nil
+}
+
+// GetObjects lists the union of the objects in the stores that can be listed
+func (blobClient *mirroredBlobClient) GetObjects(ctx context.Context) ([]BlobProperties, error) {
+	return getObjectsUnion(blobClient.clients, func(client BlobClient) ([]BlobProperties, error) {
+		return client.GetObjects(ctx)
+	})
+}
+
+// ListObjects lists the union of the objects in the stores that can be listed, the listings are
+// merged so all pages are fetched before the first object is returned
+func (blobClient *mirroredBlobClient) ListObjects(ctx context.Context, prefix string, delimiter string) BlobObjectIterator {
+	items, err := getObjectsUnion(blobClient.clients, func(client BlobClient) ([]BlobProperties, error) {
+		return readBlobObjectIterator(client.ListObjects(ctx, prefix, delimiter))
+	})
+	if err != nil {
+		return newSliceBlobObjectIterator(nil, err)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return newSliceBlobObjectIterator(items, nil)
+}
+
+// getObjectsUnion merges the listings of the clients, it fails only if no client could be listed
+func getObjectsUnion(clients []BlobClient, list func(client BlobClient) ([]BlobProperties, error)) ([]BlobProperties, error) {
+	var firstErr error
+	listedCount := 0
+	seen := make(map[string]bool)
+	result := []BlobProperties{}
+	for _, client := range clients {
+		items, err := list(client)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		listedCount++
+		for _, item := range items {
+			if !seen[item.Name] {
+				seen[item.Name] = true
+				result = append(result, item)
+			}
+		}
+	}
+	if listedCount == 0 {
+		return nil, firstErr
+	}
+	return result, nil
+}
+
+func readBlobObjectIterator(it BlobObjectIterator) ([]BlobProperties, error) {
+	items := []BlobProperties{}
+	for {
+		item, err := it.Next()
+		if err == ErrBlobIteratorDone {
+			return items, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+}
+
+func (blobClient *mirroredBlobClient) Close() {
+	for _, client := range blobClient.clients {
+		client.Close()
+	}
+}
+
+func (blobClient *mirroredBlobClient) String() string {
+	return blobClient.store.String()
+}
+
+// Exists is true if the object exists in any store that could be reached
+func (blobObject *mirroredBlobObject) Exists(ctx context.Context) (bool, error) {
+	var firstErr error
+	checkedCount := 0
+	for _, object := range blobObject.objects {
+		exists, err := object.Exists(ctx)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if exists {
+			return true, nil
+		}
+		checkedCount++
+	}
+	if checkedCount == 0 {
+		return false, firstErr
+	}
+	return false, nil
+}
+
+// LockWriteVersion locks the object in all stores, it returns true if the object exists in any of
+// them so the caller merges with the existing content before writing
+func (blobObject *mirroredBlobObject) LockWriteVersion(ctx context.Context) (bool, error) {
+	blobObject.lockErrors = make([]error, len(blobObject.objects))
+	blobObject.lockExists = make([]bool, len(blobObject.objects))
+	anyExists := false
+	lockedCount := 0
+	for i, object := range blobObject.objects {
+		exists, err := object.LockWriteVersion(ctx)
+		if err != nil {
+			blobObject.lockErrors[i] = err
+			continue
+		}
+		blobObject.lockExists[i] = exists
+		anyExists = anyExists || exists
+		lockedCount++
+	}
+	if lockedCount < blobObject.client.store.writeQuorum {
+		return false, blobObject.quorumError("lock", lockedCount, blobObject.lockErrors)
+	}
+	return anyExists, nil
+}
+
+func (blobObject *mirroredBlobObject) quorumError(operation string, successCount int, errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return errors.Wrapf(err, "mirroredBlobObject: could %s %s in %d of %d stores, write quorum is %d", operation, blobObject.path, successCount, len(blobObject.objects), blobObject.client.store.writeQuorum)
+		}
+	}
+	return fmt.Errorf("mirroredBlobObject: could %s %s in %d of %d stores, write quorum is %d", operation, blobObject.path, successCount, len(blobObject.objects), blobObject.client.store.writeQuorum)
+}
+
+// Read returns the content from the first store that can read the object. After LockWriteVersion
+// it reads the object from every locked store that has it, see readLocked
+func (blobObject *mirroredBlobObject) Read(ctx context.Context) ([]byte, error) {
+	if blobObject.lockErrors != nil {
+		return blobObject.readLocked(ctx)
+	}
+	var firstErr error
+	for _, object := range blobObject.objects {
+		data, err := object.Read(ctx)
+		if err == nil {
+			return data, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// readLocked reads the object from the locked stores that have it. A Write that reached only
+// some of the stores leaves them with different content, store indexes are then merged so the
+// following Write has the blocks of all of them. Other content that differs gives ErrMirrorDiverged
+func (blobObject *mirroredBlobObject) readLocked(ctx context.Context) ([]byte, error) {
+	contents := [][]byte{}
+	for i, object := range blobObject.objects {
+		if blobObject.lockErrors[i] != nil || !blobObject.lockExists[i] {
+			continue
+		}
+		// Not reading a locked store could make the following Write overwrite its content
+		data, err := object.Read(ctx)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, data)
+	}
+	if len(contents) == 0 {
+		return nil, errors.Wrapf(longtaillib.ErrENOENT, "mirroredBlobObject: %s does not exist", blobObject.path)
+	}
+	for _, data := range contents[1:] {
+		if !bytes.Equal(data, contents[0]) {
+			return mergeMirroredStoreIndexes(blobObject.path, contents)
+		}
+	}
+	return contents[0], nil
+}
+
+// mergeMirroredStoreIndexes merges the different versions of a store index read from the mirrored stores
+func mergeMirroredStoreIndexes(path string, contents [][]byte) ([]byte, error) {
+	var mergedStoreIndex longtaillib.Longtail_StoreIndex
+	defer mergedStoreIndex.Dispose()
+	for _, data := range contents {
+		storeIndex, errno := longtaillib.ReadStoreIndexFromBuffer(data)
+		if errno != 0 {
+			return nil, errors.Wrapf(ErrMirrorDiverged, "mirroredBlobObject: %s differs between the stores", path)
+		}
+		if !mergedStoreIndex.IsValid() {
+			mergedStoreIndex = storeIndex
+			continue
+		}
+		err := mergeIntoStoreIndex(&mergedStoreIndex, storeIndex)
+		storeIndex.Dispose()
+		if err != nil {
+			return nil, err
+		}
+	}
+	blob, errno := longtaillib.WriteStoreIndexToBuffer(mergedStoreIndex)
+	if errno != 0 {
+		return nil, errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "longtaillib.WriteStoreIndexToBuffer() failed")
+	}
+	return blob, nil
+}
+
+// Write writes to all stores in parallel. If the write condition fails in any store Write returns
+// false even if other stores were written, the caller then reads again, which merges the content of
+// all stores, and writes the result to all of them
+func (blobObject *mirroredBlobObject) Write(ctx context.Context, data []byte) (bool, error) {
+	errs := make([]error, len(blobObject.objects))
+	oks := make([]bool, len(blobObject.objects))
+	wg := sync.WaitGroup{}
+	for i, object := range blobObject.objects {
+		if blobObject.lockErrors != nil && blobObject.lockErrors[i] != nil {
+			errs[i] = blobObject.lockErrors[i]
+			continue
+		}
+		wg.Add(1)
+		go func(i int, object BlobObject) {
+			oks[i], errs[i] = object.Write(ctx, data)
+			wg.Done()
+		}(i, object)
+	}
+	wg.Wait()
+
+	successCount := 0
+	conflictCount := 0
+	for i := range blobObject.objects {
+		if errs[i] != nil {
+			continue
+		}
+		if !oks[i] {
+			conflictCount++
+			continue
+		}
+		successCount++
+	}
+	if conflictCount > 0 {
+		return false, nil
+	}
+	if successCount < blobObject.client.store.writeQuorum {
+		return false, blobObject.quorumError("write", successCount, errs)
+	}
+	return true, nil
+}
+
+// Delete removes the object from all stores, a store that does not have the object counts as deleted.
+// If no store had the object the error is longtaillib.ErrENOENT
+func (blobObject *mirroredBlobObject) Delete(ctx context.Context) error {
+	errs := make([]error, len(blobObject.objects))
+	successCount := 0
+	missingCount := 0
+	for i, object := range blobObject.objects {
+		errs[i] = object.Delete(ctx)
+		if errors.Cause(errs[i]) == longtaillib.ErrENOENT {
+			errs[i] = nil
+			missingCount++
+		}
+		if errs[i] == nil {
+			successCount++
+		}
+	}
+	if missingCount == len(blobObject.objects) {
+		return errors.Wrapf(longtaillib.ErrENOENT, "mirroredBlobObject: %s does not exist", blobObject.path)
+	}
+	if successCount < blobObject.client.store.writeQuorum {
+		return blobObject.quorumError("delete", successCount, errs)
+	}
+	return nil
+}
+
+func (blobObject *mirroredBlobObject) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	var firstErr error
+	for _, object := range blobObject.objects {
+		reader, err := object.NewReader(ctx)
+		if err == nil {
+			return reader, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+func (blobObject *mirroredBlobObject) NewRangeReader(ctx context.Context, offset int64, length int64) (io.ReadCloser, error) {
+	var firstErr error
+	for _, object := range blobObject.objects {
+		reader, err := object.NewRangeReader(ctx, offset, length)
+		if err == nil {
+			return reader, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+func (blobObject *mirroredBlobObject) NewWriter(ctx context.Context) (io.WriteCloser, error) {
+	return newBufferedBlobWriter(ctx, blobObject), nil
+}
+
+func (blobObject *mirroredBlobObject) GetAttributes(ctx context.Context) (BlobObjectAttributes, error) {
+	var firstErr error
+	for _, object := range blobObject.objects {
+		attributes, err := object.GetAttributes(ctx)
+		if err == nil {
+			return attributes, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return BlobObjectAttributes{}, firstErr
+}
+
+func (blobObject *mirroredBlobObject) SetWriteAttributes(contentType string, metadata map[string]string) {
+	for _, object := range blobObject.objects {
+		object.SetWriteAttributes(contentType, metadata)
+	}
+}
@@ -0,0 +1,240 @@
+package longtailstorelib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+func newTestMirroredBlobStore(t *testing.T, writeQuorum int) (BlobStore, BlobStore, BlobStore) {
+	primary, _ := NewMemBlobStore("mirror_primary")
+	secondary, _ := NewMemBlobStore("mirror_secondary")
+	blobStore, err := NewMirroredBlobStore([]BlobStore{primary, secondary}, writeQuorum)
+	if err != nil {
+		t.Fatalf("newTestMirroredBlobStore() NewMirroredBlobStore() %v != %v", err, nil)
+	}
+	return blobStore, primary, secondary
+}
+
+func readTestObject(ctx context.Context, blobStore BlobStore, path string) ([]byte, error) {
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	object, _ := client.NewObject(path)
+	return object.Read(ctx)
+}
+
+func writeTestObject(ctx context.Context, blobStore BlobStore, path string, data []byte) (bool, error) {
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	object, _ := client.NewObject(path)
+	return object.Write(ctx, data)
+}
+
+func TestMirroredBlobStoreWriteAndRead(t *testing.T) {
+	ctx := context.Background()
+	blobStore, primary, secondary := newTestMirroredBlobStore(t, 2)
+	defer ReleaseMemBlobStore("mirror_primary")
+	defer ReleaseMemBlobStore("mirror_secondary")
+
+	ok, err := writeTestObject(ctx, blobStore, "chunks/0000/0000000000000000.lsb", []byte("block"))
+	if !ok || err != nil {
+		t.Errorf("TestMirroredBlobStoreWriteAndRead() Write() %t, %v != %t, %v", ok, err, true, nil)
+	}
+	for _, s := range []BlobStore{primary, secondary} {
+		data, err := readTestObject(ctx, s, "chunks/0000/0000000000000000.lsb")
+		if err != nil || string(data) != "block" {
+			t.Errorf("TestMirroredBlobStoreWriteAndRead() Read() from %s %s, %v != %s, %v", s.String(), string(data), err, "block", nil)
+		}
+	}
+
+	// An object missing in the primary store is read from the secondary store
+	writeTestObject(ctx, secondary, "chunks/0001/0001000000000000.lsb", []byte("secondary only"))
+	data, err := readTestObject(ctx, blobStore, "chunks/0001/0001000000000000.lsb")
+	if err != nil || string(data) != "secondary only" {
+		t.Errorf("TestMirroredBlobStoreWriteAndRead() Read() %s, %v != %s, %v", string(data), err, "secondary only", nil)
+	}
+
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	objects, err := client.GetObjects(ctx)
+	if err != nil || len(objects) != 2 {
+		t.Errorf("TestMirroredBlobStoreWriteAndRead() client.GetObjects() %d, %v != %d, %v", len(objects), err, 2, nil)
+	}
+	listed := listAllObjects(ctx, t, client, "chunks/", "/")
+	if len(listed) != 2 {
+		t.Errorf("TestMirroredBlobStoreWriteAndRead() client.ListObjects() %v", listed)
+	}
+	object, _ := client.NewObject("chunks/0001/0001000000000000.lsb")
+	exists, err := object.Exists(ctx)
+	if !exists || err != nil {
+		t.Errorf("TestMirroredBlobStoreWriteAndRead() object.Exists() %t, %v != %t, %v", exists, err, true, nil)
+	}
+	reader, err := object.NewRangeReader(ctx, 0, 9)
+	if err != nil {
+		t.Errorf("TestMirroredBlobStoreWriteAndRead() object.NewRangeReader() %v != %v", err, nil)
+	}
+	data, _ = ioutil.ReadAll(reader)
+	reader.Close()
+	if string(data) != "secondary" {
+		t.Errorf("TestMirroredBlobStoreWriteAndRead() object.NewRangeReader() %s != %s", string(data), "secondary")
+	}
+}
+
+func TestMirroredBlobStoreLockWriteVersion(t *testing.T) {
+	ctx := context.Background()
+	blobStore, _, secondary := newTestMirroredBlobStore(t, 2)
+	defer ReleaseMemBlobStore("mirror_primary")
+	defer ReleaseMemBlobStore("mirror_secondary")
+
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	object, _ := client.NewObject("store.lsi")
+	exists, err := object.LockWriteVersion(ctx)
+	if exists || err != nil {
+		t.Errorf("TestMirroredBlobStoreLockWriteVersion() object.LockWriteVersion() %t, %v != %t, %v", exists, err, false, nil)
+	}
+	ok, err := object.Write(ctx, []byte("first"))
+	if !ok || err != nil {
+		t.Errorf("TestMirroredBlobStoreLockWriteVersion() object.Write() %t, %v != %t, %v", ok, err, true, nil)
+	}
+
+	exists, _ = object.LockWriteVersion(ctx)
+	if !exists {
+		t.Errorf("TestMirroredBlobStoreLockWriteVersion() object.LockWriteVersion() %t != %t", exists, true)
+	}
+	// Another writer updates the secondary store only, the write must fail so the index is merged again
+	writeTestObject(ctx, secondary, "store.lsi", []byte("other writer"))
+	ok, err = object.Write(ctx, []byte("second"))
+	if ok || err != nil {
+		t.Errorf("TestMirroredBlobStoreLockWriteVersion() object.Write() %t, %v != %t, %v", ok, err, false, nil)
+	}
+
+	object.LockWriteVersion(ctx)
+	ok, err = object.Write(ctx, []byte("merged"))
+	if !ok || err != nil {
+		t.Errorf("TestMirroredBlobStoreLockWriteVersion() object.Write() %t, %v != %t, %v", ok, err, true, nil)
+	}
+	data, _ := readTestObject(ctx, secondary, "store.lsi")
+	if string(data) != "merged" {
+		t.Errorf("TestMirroredBlobStoreLockWriteVersion() Read() %s != %s", string(data), "merged")
+	}
+}
+
+func TestMirroredBlobStoreLockedReadMerges(t *testing.T) {
+	ctx := context.Background()
+	blobStore, primary, secondary := newTestMirroredBlobStore(t, 2)
+	defer ReleaseMemBlobStore("mirror_primary")
+	defer ReleaseMemBlobStore("mirror_secondary")
+
+	// The stores have diverged, each has a block the other does not have
+	blockHashes := []uint64{}
+	for i, store := range []BlobStore{primary, secondary} {
+		storedBlock, _ := generateStoredBlock(t, uint8(i))
+		blockIndex := storedBlock.GetBlockIndex()
+		blockHashes = append(blockHashes, blockIndex.GetBlockHash())
+		storeIndex, _ := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{blockIndex})
+		blob, _ := longtaillib.WriteStoreIndexToBuffer(storeIndex)
+		storeIndex.Dispose()
+		storedBlock.Dispose()
+		writeTestObject(ctx, store, "store.lsi", blob)
+	}
+
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	object, _ := client.NewObject("store.lsi")
+	object.LockWriteVersion(ctx)
+	blob, err := object.Read(ctx)
+	if err != nil {
+		t.Errorf("TestMirroredBlobStoreLockedReadMerges() object.Read() %v != %v", err, nil)
+	}
+	storeIndex, errno := longtaillib.ReadStoreIndexFromBuffer(blob)
+	if errno != 0 || storeIndex.GetBlockCount() != 2 {
+		t.Errorf("TestMirroredBlobStoreLockedReadMerges() ReadStoreIndexFromBuffer() %d, %d != %d, %d", storeIndex.GetBlockCount(), errno, 2, 0)
+	}
+	storeIndex.Dispose()
+	ok, err := object.Write(ctx, blob)
+	if !ok || err != nil {
+		t.Errorf("TestMirroredBlobStoreLockedReadMerges() object.Write() %t, %v != %t, %v", ok, err, true, nil)
+	}
+	primaryData, _ := readTestObject(ctx, primary, "store.lsi")
+	secondaryData, _ := readTestObject(ctx, secondary, "store.lsi")
+	if string(primaryData) != string(secondaryData) {
+		t.Errorf("TestMirroredBlobStoreLockedReadMerges() the stores still differ")
+	}
+
+	// Content that is not a store index can not be merged
+	writeTestObject(ctx, primary, "other", []byte("first"))
+	writeTestObject(ctx, secondary, "other", []byte("second"))
+	object, _ = client.NewObject("other")
+	object.LockWriteVersion(ctx)
+	_, err = object.Read(ctx)
+	if errors.Cause(err) != ErrMirrorDiverged {
+		t.Errorf("TestMirroredBlobStoreLockedReadMerges() object.Read() %v != %v", err, ErrMirrorDiverged)
+	}
+}
+
+func TestMirroredBlobStoreWriteQuorum(t *testing.T) {
+	ctx := context.Background()
+	// A file system store rooted at a file can not create any objects
+	brokenFile, err := ioutil.TempFile("", "mirror_broken")
+	if err != nil {
+		t.Errorf("ioutil.TempFile() err == %q", err)
+	}
+	brokenFile.Close()
+	defer os.Remove(brokenFile.Name())
+	broken, _ := NewFSBlobStore(brokenFile.Name())
+	working, _ := NewMemBlobStore("mirror_quorum")
+	defer ReleaseMemBlobStore("mirror_quorum")
+
+	blobStore, _ := NewMirroredBlobStore([]BlobStore{broken, working}, 1)
+	ok, err := writeTestObject(ctx, blobStore, "chunks/0000/0000000000000000.lsb", []byte("block"))
+	if !ok || err != nil {
+		t.Errorf("TestMirroredBlobStoreWriteQuorum() Write() %t, %v != %t, %v", ok, err, true, nil)
+	}
+	data, err := readTestObject(ctx, blobStore, "chunks/0000/0000000000000000.lsb")
+	if err != nil || string(data) != "block" {
+		t.Errorf("TestMirroredBlobStoreWriteQuorum() Read() %s, %v != %s, %v", string(data), err, "block", nil)
+	}
+
+	blobStore, _ = NewMirroredBlobStore([]BlobStore{broken, working}, 2)
+	ok, err = writeTestObject(ctx, blobStore, "chunks/0000/0000000000000000.lsb", []byte("block"))
+	if ok || err == nil {
+		t.Errorf("TestMirroredBlobStoreWriteQuorum() Write() %t, %v, expected error", ok, err)
+	}
+
+	_, err = NewMirroredBlobStore([]BlobStore{broken, working}, 3)
+	if err == nil {
+		t.Errorf("TestMirroredBlobStoreWriteQuorum() NewMirroredBlobStore() err == nil")
+	}
+}
+
+func TestMirroredBlobStoreURI(t *testing.T) {
+	ctx := context.Background()
+	defer ReleaseMemBlobStore("mirror_uri_a")
+	defer ReleaseMemBlobStore("mirror_uri_b")
+
+	blobStore, err := CreateBlobStoreForURI("mirror:mem://mirror_uri_a|mem://mirror_uri_b|write-quorum=1", BlobStoreOptions{AccessType: ReadWrite})
+	if err != nil {
+		t.Errorf("TestMirroredBlobStoreURI() CreateBlobStoreForURI() %v != %v", err, nil)
+	}
+	if blobStore.(*mirroredBlobStore).writeQuorum != 1 {
+		t.Errorf("TestMirroredBlobStoreURI() writeQuorum %d != %d", blobStore.(*mirroredBlobStore).writeQuorum, 1)
+	}
+	writeTestObject(ctx, blobStore, "store.lsi", []byte("index"))
+	for _, name := range []string{"mirror_uri_a", "mirror_uri_b"} {
+		memStore, _ := NewMemBlobStore(name)
+		data, err := readTestObject(ctx, memStore, "store.lsi")
+		if err != nil || string(data) != "index" {
+			t.Errorf("TestMirroredBlobStoreURI() Read() from %s %s, %v != %s, %v", name, string(data), err, "index", nil)
+		}
+	}
+
+	_, err = CreateBlobStoreForURI("mirror:mem://mirror_uri_a|write-quorum=x", BlobStoreOptions{AccessType: ReadWrite})
+	if err == nil {
+		t.Errorf("TestMirroredBlobStoreURI() CreateBlobStoreForURI() err == nil")
+	}
+}
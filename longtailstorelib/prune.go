@@ -0,0 +1,468 @@
+package longtailstorelib
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// PruneOptions controls PruneStore
+type PruneOptions struct {
+	// DryRun reports what would be pruned without changing the store
+	DryRun bool
+	// GracePeriod keeps unreferenced blocks that were written more recently than this, they may
+	// belong to an upload that has not written its version index yet. Zero uses DefaultPruneGracePeriod,
+	// use NoPruneGracePeriod to prune blocks regardless of when they were written
+	GracePeriod time.Duration
+	// WorkerCount is the number of blocks deleted in parallel
+	WorkerCount int
+	RetryPolicy RetryPolicy
+}
+
+const (
+	// DefaultPruneGracePeriod is the grace period used when PruneOptions.GracePeriod is zero
+	DefaultPruneGracePeriod = 24 * time.Hour
+	// NoPruneGracePeriod makes PruneStore prune recently written blocks too
+	NoPruneGracePeriod = time.Duration(-1)
+)
+
+// PruneResult tells what PruneStore found in the store and what it removed
+type PruneResult struct {
+	// BlockCount is the number of blocks in the store
+	BlockCount int
+	// ReferencedBlockCount is the number of blocks needed by the retained versions
+	ReferencedBlockCount int
+	// RecentBlockCount is the number of unreferenced blocks kept because they are within the grace period
+	RecentBlockCount int
+	// PrunedBlockCount and PrunedByteCount are the unreferenced blocks that were removed, or
+	// would be removed in a dry run
+	PrunedBlockCount int
+	PrunedByteCount  int64
+}
+
+// ListVersionIndexURIs returns the URIs of all version indexes (.lvi) under prefixURI
+func ListVersionIndexURIs(ctx context.Context, prefixURI string) ([]string, error) {
+	if i := strings.Index(prefixURI, ":"); i != -1 && compositeBlobStoreSchemes[strings.ToLower(prefixURI[:i])] {
+		return nil, errors.Wrapf(longtaillib.ErrEINVAL, "ListVersionIndexURIs: listing is not supported for %s", prefixURI)
+	}
+	blobStore, err := CreateBlobStoreForURI(prefixURI, BlobStoreOptions{AccessType: ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	client, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	items, err := readBlobObjectIterator(client.ListObjects(ctx, "", ""))
+	if err != nil {
+		return nil, errors.Wrapf(err, "ListVersionIndexURIs: failed listing %s", prefixURI)
+	}
+	// Query parameters configure the store so the object name goes before them
+	base, query := prefixURI, ""
+	if strings.Contains(base, "://") {
+		if q := strings.Index(base, "?"); q != -1 {
+			base, query = base[:q], base[q:]
+		}
+	}
+	base = strings.TrimRight(base, "/\\")
+	uris := []string{}
+	for _, item := range items {
+		if strings.HasSuffix(item.Name, ".lvi") {
+			uris = append(uris, base+"/"+item.Name+query)
+		}
+	}
+	sort.Strings(uris)
+	return uris, nil
+}
+
+// parseBlockPath returns the hash of the block stored at key, ok is false if key is not a block path
+func parseBlockPath(key string) (uint64, bool) {
+	name := key[strings.LastIndex(key, "/")+1:]
+	if !strings.HasPrefix(name, "0x") || !strings.HasSuffix(name, ".lsb") {
+		return 0, false
+	}
+	blockHash, err := strconv.ParseUint(name[2:len(name)-4], 16, 64)
+	if err != nil || GetBlockPath("chunks", blockHash) != key {
+		return 0, false
+	}
+	return blockHash, true
+}
+
+// readRequiredChunkHashes returns the union of the chunks used by the version indexes
+func readRequiredChunkHashes(ctx context.Context, versionIndexURIs []string) ([]uint64, error) {
+	chunkHashSet := map[uint64]bool{}
+	for _, uri := range versionIndexURIs {
+		vbuffer, err := ReadFromURI(ctx, uri)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed reading version index %s", uri)
+		}
+		versionIndex, errno := longtaillib.ReadVersionIndexFromBuffer(vbuffer)
+		if errno != 0 {
+			return nil, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "longtaillib.ReadVersionIndexFromBuffer() failed for %s", uri)
+		}
+		for _, chunkHash := range versionIndex.GetChunkHashes() {
+			chunkHashSet[chunkHash] = true
+		}
+		versionIndex.Dispose()
+	}
+	chunkHashes := make([]uint64, 0, len(chunkHashSet))
+	for chunkHash := range chunkHashSet {
+		chunkHashes = append(chunkHashes, chunkHash)
+	}
+	return chunkHashes, nil
+}
+
+// listStoreBlocks returns the blocks in the store by block hash
+func listStoreBlocks(ctx context.Context, s *remoteStore, client BlobClient) (map[uint64]BlobProperties, error) {
+	var blocks map[uint64]BlobProperties
+	_, err := s.retryPolicy.run(ctx, s.isRetryableError, "list blocks in store "+s.String(), func() error {
+		items, err := readBlobObjectIterator(client.ListObjects(ctx, "chunks/", ""))
+		if err != nil {
+			return err
+		}
+		blocks = make(map[uint64]BlobProperties, len(items))
+		for _, item := range items {
+			if blockHash, ok := parseBlockPath(item.Name); ok {
+				blocks[blockHash] = item
+			}
+		}
+		return nil
+	})
+	return blocks, err
+}
+
+// readRecentBlockIndexes reads the block indexes of the blocks that are younger than gracePeriod, the
+// other blocks in keys are returned as old
+func readRecentBlockIndexes(
+	ctx context.Context,
+	s *remoteStore,
+	client BlobClient,
+	keys []string,
+	gracePeriod time.Duration) ([]longtaillib.Longtail_BlockIndex, []string, error) {
+	blockIndexes := []longtaillib.Longtail_BlockIndex{}
+	oldKeys := []string{}
+	disposeBlockIndexes := func() {
+		for _, blockIndex := range blockIndexes {
+			blockIndex.Dispose()
+		}
+	}
+	for _, key := range keys {
+		objHandle, err := client.NewObject(key)
+		if err != nil {
+			disposeBlockIndexes()
+			return nil, nil, err
+		}
+		var attributes BlobObjectAttributes
+		_, err = s.retryPolicy.run(ctx, s.isRetryableError, "get attributes of "+key+" in store "+s.String(), func() error {
+			attributes, err = objHandle.GetAttributes(ctx)
+			return err
+		})
+		if errors.Cause(err) == longtaillib.ErrENOENT {
+			continue
+		}
+		if err != nil {
+			disposeBlockIndexes()
+			return nil, nil, errors.Wrapf(err, "failed getting attributes of %s", key)
+		}
+		if time.Since(attributes.LastModified) >= gracePeriod {
+			oldKeys = append(oldKeys, key)
+			continue
+		}
+		blobData, _, err := readBlobWithRetry(ctx, s, client, key)
+		if errors.Cause(err) == longtaillib.ErrENOENT {
+			continue
+		}
+		if err != nil {
+			disposeBlockIndexes()
+			return nil, nil, errors.Wrapf(err, "failed reading %s", key)
+		}
+		blockIndex, errno := longtaillib.ReadBlockIndexFromBuffer(blobData)
+		if errno != 0 {
+			// Not a valid block, it is left as is
+			log.Printf("Block %s is not a valid block, skipping it\n", key)
+			continue
+		}
+		blockIndexes = append(blockIndexes, blockIndex)
+	}
+	return blockIndexes, oldKeys, nil
+}
+
+// createPrunedStoreIndex returns the store index for the blocks that stay in the store, the blocks in
+// storeIndex used by the required chunks and the recently written blocks
+func createPrunedStoreIndex(
+	storeIndex longtaillib.Longtail_StoreIndex,
+	requiredChunkHashes []uint64,
+	recentBlockIndexes []longtaillib.Longtail_BlockIndex) (longtaillib.Longtail_StoreIndex, error) {
+	prunedStoreIndex, errno := longtaillib.GetExistingStoreIndex(storeIndex, requiredChunkHashes, 0)
+	if errno != 0 {
+		return longtaillib.Longtail_StoreIndex{}, errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "longtaillib.GetExistingStoreIndex() failed")
+	}
+	// A retained version with chunks that are not in the store index is already broken or was
+	// uploaded to blocks we do not know of, pruning could remove the blocks it needs
+	foundChunkHashes := map[uint64]bool{}
+	for _, chunkHash := range prunedStoreIndex.GetChunkHashes() {
+		foundChunkHashes[chunkHash] = true
+	}
+	missingCount := 0
+	for _, chunkHash := range requiredChunkHashes {
+		if !foundChunkHashes[chunkHash] {
+			missingCount++
+		}
+	}
+	if missingCount > 0 {
+		prunedStoreIndex.Dispose()
+		return longtaillib.Longtail_StoreIndex{}, errors.Wrapf(longtaillib.ErrENOENT, "%d chunks used by the retained versions are not in the store index", missingCount)
+	}
+	if len(recentBlockIndexes) == 0 {
+		return prunedStoreIndex, nil
+	}
+	recentStoreIndex, errno := longtaillib.CreateStoreIndexFromBlocks(recentBlockIndexes)
+	if errno != 0 {
+		prunedStoreIndex.Dispose()
+		return longtaillib.Longtail_StoreIndex{}, errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "longtaillib.CreateStoreIndexFromBlocks() failed")
+	}
+	err := mergeIntoStoreIndex(&prunedStoreIndex, recentStoreIndex)
+	recentStoreIndex.Dispose()
+	if err != nil {
+		prunedStoreIndex.Dispose()
+		return longtaillib.Longtail_StoreIndex{}, err
+	}
+	return prunedStoreIndex, nil
+}
+
+// deleteBlobs deletes the objects in keys using workerCount clients, it tries all of them and returns
+// the number of deleted objects and the first error
+func deleteBlobs(ctx context.Context, s *remoteStore, keys []string, workerCount int) (int, error) {
+	if workerCount < 1 {
+		workerCount = 1
+	}
+	keyChan := make(chan string, len(keys))
+	for _, key := range keys {
+		keyChan <- key
+	}
+	close(keyChan)
+
+	var mutex sync.Mutex
+	var firstErr error
+	deletedCount := 0
+	var wg sync.WaitGroup
+	wg.Add(workerCount)
+	for w := 0; w < workerCount; w++ {
+		go func() {
+			defer wg.Done()
+			client, err := s.blobStore.NewClient(ctx)
+			if err != nil {
+				mutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mutex.Unlock()
+				return
+			}
+			defer client.Close()
+			for key := range keyChan {
+				objHandle, err := client.NewObject(key)
+				if err == nil {
+					_, err = s.retryPolicy.run(ctx, s.isRetryableError, "delete "+key+" in store "+s.String(), func() error {
+						return objHandle.Delete(ctx)
+					})
+				}
+				mutex.Lock()
+				if err == nil || errors.Cause(err) == longtaillib.ErrENOENT {
+					deletedCount++
+				} else if firstErr == nil {
+					firstErr = errors.Wrapf(err, "failed deleting %s", key)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return deletedCount, firstErr
+}
+
+// deleteMergedStoreIndexDeltas deletes the store index deltas that were merged into a newly written
+// base store index. A delta that is left would add the blocks removed from the base store index back,
+// so no block may be deleted unless this succeeds
+func deleteMergedStoreIndexDeltas(ctx context.Context, s *remoteStore, deltaKeys []string, workerCount int) error {
+	deletedCount, err := deleteBlobs(ctx, s, deltaKeys, workerCount)
+	if err != nil {
+		return errors.Wrapf(err, "deleted %d of %d merged store index deltas", deletedCount, len(deltaKeys))
+	}
+	return nil
+}
+
+// excludeIndexedBlockKeys returns the block keys in keys that the store index, with the deltas listed now,
+// does not have. A compaction or upload that read the store before it was rewritten may have
+// added blocks that were removed back to it, those blocks must stay
+func excludeIndexedBlockKeys(ctx context.Context, s *remoteStore, client BlobClient, keys []string) ([]string, error) {
+	storeIndex, err := readStoreStoreIndex(ctx, s, client)
+	if err != nil {
+		return nil, err
+	}
+	defer storeIndex.Dispose()
+	indexedBlocks := map[uint64]bool{}
+	for _, blockHash := range storeIndex.GetBlockHashes() {
+		indexedBlocks[blockHash] = true
+	}
+	unindexedKeys := []string{}
+	for _, key := range keys {
+		blockHash, ok := parseBlockPath(key)
+		if ok && indexedBlocks[blockHash] {
+			log.Printf("Block %s is back in the store index, keeping it\n", key)
+			continue
+		}
+		unindexedKeys = append(unindexedKeys, key)
+	}
+	return unindexedKeys, nil
+}
+
+// PruneStore removes the blocks in blobStore that are not used by the versions in versionIndexURIs and
+// writes a store index with the remaining blocks. Blocks written within options.GracePeriod are kept as
+// they may belong to an upload in progress.
+//
+// The store index is replaced with a conditional write and PruneStore fails with ErrStoreIndexContention
+// if it was changed while pruning. An upload that started before the pruned store index was written can
+// still reuse a block that is pruned, so prune when no uploads are running or use a grace period that
+// covers them
+func PruneStore(ctx context.Context, blobStore BlobStore, versionIndexURIs []string, options PruneOptions) (PruneResult, error) {
+	requiredChunkHashes, err := readRequiredChunkHashes(ctx, versionIndexURIs)
+	if err != nil {
+		return PruneResult{}, errors.Wrap(err, "PruneStore")
+	}
+	return pruneStoreBlocks(ctx, blobStore, requiredChunkHashes, options)
+}
+
+// pruneStoreBlocks removes the blocks that are not needed for requiredChunkHashes, see PruneStore
+func pruneStoreBlocks(ctx context.Context, blobStore BlobStore, requiredChunkHashes []uint64, options PruneOptions) (PruneResult, error) {
+	result := PruneResult{}
+	blobStore = requireAllMirrors(blobStore)
+	client, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return result, errors.Wrap(err, blobStore.String())
+	}
+	defer client.Close()
+	s := newMaintenanceRemoteStore(blobStore, client, options.WorkerCount, options.RetryPolicy)
+
+	objHandle, err := client.NewObject(storeIndexKey)
+	if err != nil {
+		return result, errors.Wrapf(err, "PruneStore: client.NewObject(%s) failed", storeIndexKey)
+	}
+	exists, err := objHandle.LockWriteVersion(ctx)
+	if err != nil {
+		return result, errors.Wrapf(err, "PruneStore: objHandle.LockWriteVersion(%s) failed", storeIndexKey)
+	}
+	if !exists {
+		return result, errors.Wrapf(longtaillib.ErrENOENT, "PruneStore: %s has no store index", s.String())
+	}
+	deltaKeys, err := listStoreIndexDeltas(ctx, s, client)
+	if err != nil {
+		return result, errors.Wrap(err, "PruneStore")
+	}
+	storeIndex, err := readStoreIndexObject(ctx, s, client, storeIndexKey)
+	if err != nil {
+		return result, errors.Wrap(err, "PruneStore")
+	}
+	defer storeIndex.Dispose()
+	_, err = readStoreIndexDeltas(ctx, s, client, &storeIndex, deltaKeys)
+	if err != nil {
+		return result, errors.Wrap(err, "PruneStore")
+	}
+
+	referencedStoreIndex, err := createPrunedStoreIndex(storeIndex, requiredChunkHashes, nil)
+	if err != nil {
+		return result, errors.Wrap(err, "PruneStore")
+	}
+	referencedBlocks := map[uint64]bool{}
+	for _, blockHash := range referencedStoreIndex.GetBlockHashes() {
+		referencedBlocks[blockHash] = true
+	}
+	referencedStoreIndex.Dispose()
+
+	blocks, err := listStoreBlocks(ctx, s, client)
+	if err != nil {
+		return result, errors.Wrap(err, "PruneStore")
+	}
+	unreferencedKeys := []string{}
+	for blockHash, block := range blocks {
+		if referencedBlocks[blockHash] {
+			result.ReferencedBlockCount++
+			continue
+		}
+		unreferencedKeys = append(unreferencedKeys, block.Name)
+	}
+	result.BlockCount = len(blocks)
+
+	gracePeriod := options.GracePeriod
+	if gracePeriod == 0 {
+		gracePeriod = DefaultPruneGracePeriod
+	} else if gracePeriod < 0 {
+		gracePeriod = 0
+	}
+	recentBlockIndexes, prunedKeys, err := readRecentBlockIndexes(ctx, s, client, unreferencedKeys, gracePeriod)
+	if err != nil {
+		return result, errors.Wrap(err, "PruneStore")
+	}
+	defer func() {
+		for _, blockIndex := range recentBlockIndexes {
+			blockIndex.Dispose()
+		}
+	}()
+	result.RecentBlockCount = len(recentBlockIndexes)
+	for _, key := range prunedKeys {
+		blockHash, _ := parseBlockPath(key)
+		result.PrunedBlockCount++
+		result.PrunedByteCount += blocks[blockHash].Size
+	}
+	if options.DryRun || len(prunedKeys) == 0 {
+		return result, nil
+	}
+
+	prunedStoreIndex, err := createPrunedStoreIndex(storeIndex, requiredChunkHashes, recentBlockIndexes)
+	if err != nil {
+		return result, errors.Wrap(err, "PruneStore")
+	}
+	blob, errno := longtaillib.WriteStoreIndexToBuffer(prunedStoreIndex)
+	prunedStoreIndex.Dispose()
+	if errno != 0 {
+		return result, errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "PruneStore: longtaillib.WriteStoreIndexToBuffer() failed")
+	}
+	// The store index must stop listing the blocks before they are deleted
+	ok, err := objHandle.Write(ctx, blob)
+	if err != nil {
+		return result, errors.Wrapf(err, "PruneStore: objHandle.Write(%s) failed", storeIndexKey)
+	}
+	if !ok {
+		return result, errors.Wrapf(ErrStoreIndexContention, "PruneStore: %s was changed while pruning, nothing was pruned", storeIndexKey)
+	}
+	err = deleteMergedStoreIndexDeltas(ctx, s, deltaKeys, options.WorkerCount)
+	if err != nil {
+		return result, errors.Wrap(err, "PruneStore: no blocks were deleted")
+	}
+	prunedKeys, err = excludeIndexedBlockKeys(ctx, s, client, prunedKeys)
+	if err != nil {
+		return result, errors.Wrap(err, "PruneStore: no blocks were deleted")
+	}
+	result.PrunedBlockCount = 0
+	result.PrunedByteCount = 0
+	for _, key := range prunedKeys {
+		blockHash, _ := parseBlockPath(key)
+		result.PrunedBlockCount++
+		result.PrunedByteCount += blocks[blockHash].Size
+	}
+
+	deletedCount, err := deleteBlobs(ctx, s, prunedKeys, options.WorkerCount)
+	if err != nil {
+		return result, errors.Wrapf(err, "PruneStore: deleted %d of %d unreferenced blocks", deletedCount, len(prunedKeys))
+	}
+	log.Printf("Pruned %d blocks (%d bytes) in %s\n", result.PrunedBlockCount, result.PrunedByteCount, s.String())
+	return result, nil
+}
@@ -0,0 +1,212 @@
+package longtailstorelib
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+func TestParseBlockPath(t *testing.T) {
+	blockHash, ok := parseBlockPath(GetBlockPath("chunks", 0xdeadbeef500177aa))
+	if !ok || blockHash != 0xdeadbeef500177aa {
+		t.Errorf("TestParseBlockPath() parseBlockPath() %x, %t != %x, %t", blockHash, ok, uint64(0xdeadbeef500177aa), true)
+	}
+	for _, key := range []string{"chunks/dead/0xdeadbeef500177aa.lsi", "chunks/beef/0xdeadbeef500177aa.lsb", "chunks/dead/deadbeef500177aa.lsb", "store.lsi"} {
+		if _, ok := parseBlockPath(key); ok {
+			t.Errorf("TestParseBlockPath() parseBlockPath(%s) %t != %t", key, ok, false)
+		}
+	}
+}
+
+func TestListVersionIndexURIs(t *testing.T) {
+	ctx := context.Background()
+	memStore, _ := NewMemBlobStore("prune_versions")
+	defer ReleaseMemBlobStore("prune_versions")
+	writeTestObject(ctx, memStore, "a.lvi", []byte("version"))
+	writeTestObject(ctx, memStore, "release/b.lvi", []byte("version"))
+	writeTestObject(ctx, memStore, "release/b.lsi", []byte("store index"))
+
+	uris, err := ListVersionIndexURIs(ctx, "mem://prune_versions/")
+	if err != nil {
+		t.Errorf("TestListVersionIndexURIs() ListVersionIndexURIs() %v != %v", err, nil)
+	}
+	if len(uris) != 2 || uris[0] != "mem://prune_versions/a.lvi" || uris[1] != "mem://prune_versions/release/b.lvi" {
+		t.Errorf("TestListVersionIndexURIs() ListVersionIndexURIs() %v", uris)
+	}
+	data, err := ReadFromURI(ctx, uris[1])
+	if err != nil || string(data) != "version" {
+		t.Errorf("TestListVersionIndexURIs() ReadFromURI(%s) %q, %v != %q, %v", uris[1], string(data), err, "version", nil)
+	}
+}
+
+func TestPruneStore(t *testing.T) {
+	ctx := context.Background()
+	memStore, _ := NewMemBlobStore("prune")
+	defer ReleaseMemBlobStore("prune")
+	client, _ := memStore.NewClient(ctx)
+	defer client.Close()
+	s := newMaintenanceRemoteStore(memStore, client, 2, DefaultRetryPolicy())
+
+	blockIndexes := []longtaillib.Longtail_BlockIndex{}
+	for _, seed := range []uint8{1, 10, 20} {
+		storedBlock, _ := generateStoredBlock(t, seed)
+		storeBlock(client, storedBlock, 0, "")
+		blockIndex := storedBlock.GetBlockIndex()
+		blockIndexCopy, _ := blockIndex.Copy()
+		blockIndexes = append(blockIndexes, blockIndexCopy)
+		storedBlock.Dispose()
+	}
+	// The last block is only in a store index delta
+	storeIndex, _ := longtaillib.CreateStoreIndexFromBlocks(blockIndexes[:2])
+	storeIndexBlob, _ := longtaillib.WriteStoreIndexToBuffer(storeIndex)
+	storeIndex.Dispose()
+	writeTestObject(ctx, memStore, "store.lsi", storeIndexBlob)
+	deltaStoreIndex, _ := longtaillib.CreateStoreIndexFromBlocks(blockIndexes[2:])
+	writeStoreIndexDelta(ctx, s, client, deltaStoreIndex)
+	deltaStoreIndex.Dispose()
+	for _, blockIndex := range blockIndexes {
+		blockIndex.Dispose()
+	}
+
+	// Chunks of the block from seed 10
+	requiredChunkHashes := []uint64{11, 12}
+
+	result, err := pruneStoreBlocks(ctx, memStore, requiredChunkHashes, PruneOptions{DryRun: true, GracePeriod: NoPruneGracePeriod})
+	if err != nil {
+		t.Errorf("TestPruneStore() pruneStoreBlocks() %v != %v", err, nil)
+	}
+	if result.BlockCount != 3 || result.ReferencedBlockCount != 1 || result.RecentBlockCount != 0 || result.PrunedBlockCount != 2 || result.PrunedByteCount == 0 {
+		t.Errorf("TestPruneStore() pruneStoreBlocks() dry run %+v", result)
+	}
+	data, _ := readTestObject(ctx, memStore, "store.lsi")
+	if string(data) != string(storeIndexBlob) {
+		t.Errorf("TestPruneStore() store.lsi was changed by a dry run")
+	}
+
+	result, err = pruneStoreBlocks(ctx, memStore, requiredChunkHashes, PruneOptions{GracePeriod: time.Hour})
+	if err != nil || result.RecentBlockCount != 2 || result.PrunedBlockCount != 0 {
+		t.Errorf("TestPruneStore() pruneStoreBlocks() grace period %+v, %v", result, err)
+	}
+	if blocks, _ := listStoreBlocks(ctx, s, client); len(blocks) != 3 {
+		t.Errorf("TestPruneStore() len(blocks) %d != %d", len(blocks), 3)
+	}
+
+	// A store index that does not cover the retained versions is not pruned
+	_, err = pruneStoreBlocks(ctx, memStore, []uint64{11, 12, 4711}, PruneOptions{GracePeriod: NoPruneGracePeriod})
+	if errors.Cause(err) != longtaillib.ErrENOENT {
+		t.Errorf("TestPruneStore() pruneStoreBlocks() %v != %v", err, longtaillib.ErrENOENT)
+	}
+
+	result, err = pruneStoreBlocks(ctx, memStore, requiredChunkHashes, PruneOptions{GracePeriod: NoPruneGracePeriod, WorkerCount: 2})
+	if err != nil || result.PrunedBlockCount != 2 {
+		t.Errorf("TestPruneStore() pruneStoreBlocks() %+v, %v", result, err)
+	}
+	if blocks, _ := listStoreBlocks(ctx, s, client); len(blocks) != 1 {
+		t.Errorf("TestPruneStore() len(blocks) %d != %d", len(blocks), 1)
+	}
+	if deltaKeys, _ := listStoreIndexDeltas(ctx, s, client); len(deltaKeys) != 0 {
+		t.Errorf("TestPruneStore() len(deltaKeys) %d != %d", len(deltaKeys), 0)
+	}
+	storeIndex, err = readStoreStoreIndex(ctx, s, client)
+	if err != nil || storeIndex.GetBlockCount() != 1 {
+		t.Errorf("TestPruneStore() readStoreStoreIndex() %d, %v != %d, %v", storeIndex.GetBlockCount(), err, 1, nil)
+	}
+	storeIndex.Dispose()
+}
+
+func TestPruneStoreMirrorFailing(t *testing.T) {
+	ctx := context.Background()
+	primary, _ := NewMemBlobStore("prune_mirror_primary")
+	defer ReleaseMemBlobStore("prune_mirror_primary")
+	secondary, _ := NewMemBlobStore("prune_mirror_secondary")
+	defer ReleaseMemBlobStore("prune_mirror_secondary")
+	blobStore, _ := NewMirroredBlobStore([]BlobStore{primary, secondary}, 1)
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	s := newMaintenanceRemoteStore(blobStore, client, 1, DefaultRetryPolicy())
+
+	blockIndexes := []longtaillib.Longtail_BlockIndex{}
+	for _, seed := range []uint8{1, 10, 20} {
+		storedBlock, _ := generateStoredBlock(t, seed)
+		storeBlock(client, storedBlock, 0, "")
+		blockIndex := storedBlock.GetBlockIndex()
+		blockIndexCopy, _ := blockIndex.Copy()
+		blockIndexes = append(blockIndexes, blockIndexCopy)
+		storedBlock.Dispose()
+	}
+	storeIndex, _ := longtaillib.CreateStoreIndexFromBlocks(blockIndexes)
+	storeIndexBlob, _ := longtaillib.WriteStoreIndexToBuffer(storeIndex)
+	storeIndex.Dispose()
+	for _, blockIndex := range blockIndexes {
+		blockIndex.Dispose()
+	}
+	writeTestObject(ctx, blobStore, "store.lsi", storeIndexBlob)
+
+	// Chunks of the block from seed 10
+	requiredChunkHashes := []uint64{11, 12}
+
+	// Pruning while a mirror fails writes does not delete any blocks, even if the write quorum of the store is met
+	failingSecondary, _ := NewFaultInjectionBlobStore(secondary, FaultInjectionOptions{WriteErrorRate: 1})
+	failingStore, _ := NewMirroredBlobStore([]BlobStore{primary, failingSecondary}, 1)
+	_, err := pruneStoreBlocks(ctx, failingStore, requiredChunkHashes, PruneOptions{GracePeriod: NoPruneGracePeriod})
+	if err == nil {
+		t.Errorf("TestPruneStoreMirrorFailing() pruneStoreBlocks() err == nil")
+	}
+	for _, store := range []BlobStore{primary, secondary} {
+		storeClient, _ := store.NewClient(ctx)
+		blocks, _ := listStoreBlocks(ctx, s, storeClient)
+		storeClient.Close()
+		if len(blocks) != 3 {
+			t.Errorf("TestPruneStoreMirrorFailing() len(blocks) in %s %d != %d", store.String(), len(blocks), 3)
+		}
+	}
+
+	result, err := pruneStoreBlocks(ctx, blobStore, requiredChunkHashes, PruneOptions{GracePeriod: NoPruneGracePeriod})
+	if err != nil || result.PrunedBlockCount != 2 {
+		t.Errorf("TestPruneStoreMirrorFailing() pruneStoreBlocks() %+v, %v", result, err)
+	}
+
+	// Merging the store indexes of the mirrors does not bring the pruned blocks back
+	object, _ := client.NewObject("store.lsi")
+	object.LockWriteVersion(ctx)
+	blob, err := object.Read(ctx)
+	if err != nil {
+		t.Errorf("TestPruneStoreMirrorFailing() object.Read() %v != %v", err, nil)
+	}
+	storeIndex, errno := longtaillib.ReadStoreIndexFromBuffer(blob)
+	if errno != 0 || storeIndex.GetBlockCount() != 1 {
+		t.Errorf("TestPruneStoreMirrorFailing() ReadStoreIndexFromBuffer() %d, %d != %d, %d", storeIndex.GetBlockCount(), errno, 1, 0)
+	}
+	storeIndex.Dispose()
+}
+
+func TestExcludeIndexedBlockKeys(t *testing.T) {
+	ctx := context.Background()
+	memStore, _ := NewMemBlobStore("exclude_indexed")
+	defer ReleaseMemBlobStore("exclude_indexed")
+	client, _ := memStore.NewClient(ctx)
+	defer client.Close()
+	s := newMaintenanceRemoteStore(memStore, client, 1, DefaultRetryPolicy())
+
+	storedBlock, _ := generateStoredBlock(t, 7)
+	blockIndex := storedBlock.GetBlockIndex()
+	blockHash := blockIndex.GetBlockHash()
+	storeIndex, _ := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{})
+	storeIndexBlob, _ := longtaillib.WriteStoreIndexToBuffer(storeIndex)
+	storeIndex.Dispose()
+	writeTestObject(ctx, memStore, "store.lsi", storeIndexBlob)
+	// A delta written after the base store index was rewritten lists the block again
+	deltaStoreIndex, _ := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{blockIndex})
+	writeStoreIndexDelta(ctx, s, client, deltaStoreIndex)
+	deltaStoreIndex.Dispose()
+	storedBlock.Dispose()
+
+	keys := []string{GetBlockPath("chunks", blockHash), GetBlockPath("chunks", blockHash+1)}
+	unindexedKeys, err := excludeIndexedBlockKeys(ctx, s, client, keys)
+	if err != nil || len(unindexedKeys) != 1 || unindexedKeys[0] != keys[1] {
+		t.Errorf("TestExcludeIndexedBlockKeys() excludeIndexedBlockKeys() %v, %v != %v, %v", unindexedKeys, err, keys[1:], nil)
+	}
+}
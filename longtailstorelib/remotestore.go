@@ -2,10 +2,12 @@ package longtailstorelib
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"log"
-	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -15,27 +17,18 @@ import (
 	"github.com/pkg/errors"
 )
 
-func createBlobStoreForURI(uri string) (BlobStore, error) {
-	blobStoreURL, err := url.Parse(uri)
-	if err == nil {
-		switch blobStoreURL.Scheme {
-		case "gs":
-			return NewGCSBlobStore(blobStoreURL)
-		case "s3":
-			return NewS3BlobStore(blobStoreURL)
-		case "abfs":
-			return nil, fmt.Errorf("azure Gen1 storage not yet implemented")
-		case "abfss":
-			return nil, fmt.Errorf("azure Gen2 storage not yet implemented")
-		case "file":
-			return NewFSBlobStore(blobStoreURL.Path[1:])
+func splitURI(uri string) (string, string) {
+	if i := strings.Index(uri, ":"); i != -1 && compositeBlobStoreSchemes[strings.ToLower(uri[:i])] {
+		return splitCompositeURI(uri[:i], uri[i+1:])
+	}
+	// Query parameters configure the store (endpoint, region etc) so they stay with the parent
+	query := ""
+	if strings.Contains(uri, "://") {
+		if q := strings.Index(uri, "?"); q != -1 {
+			query = uri[q:]
+			uri = uri[:q]
 		}
 	}
-
-	return NewFSBlobStore(uri)
-}
-
-func splitURI(uri string) (string, string) {
 	i := strings.LastIndex(uri, "/")
 	if i == -1 {
 		i = strings.LastIndex(uri, "\\")
@@ -43,17 +36,17 @@ func splitURI(uri string) (string, string) {
 	if i == -1 {
 		return "", uri
 	}
-	return uri[:i], uri[i+1:]
+	return uri[:i] + query, uri[i+1:]
 }
 
 // ReadFromURI ...
-func ReadFromURI(uri string) ([]byte, error) {
+func ReadFromURI(ctx context.Context, uri string) ([]byte, error) {
 	uriParent, uriName := splitURI(uri)
-	blobStore, err := createBlobStoreForURI(uriParent)
+	blobStore, err := CreateBlobStoreForURI(uriParent, BlobStoreOptions{AccessType: ReadOnly})
 	if err != nil {
 		return nil, err
 	}
-	client, err := blobStore.NewClient(context.Background())
+	client, err := blobStore.NewClient(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -62,21 +55,21 @@ func ReadFromURI(uri string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	vbuffer, err := object.Read()
+	vbuffer, err := object.Read(ctx)
 	if err != nil {
 		return nil, err
 	}
 	return vbuffer, nil
 }
 
-// ReadFromURI ...
-func WriteToURI(uri string, data []byte) error {
+// WriteToURI ...
+func WriteToURI(ctx context.Context, uri string, data []byte) error {
 	uriParent, uriName := splitURI(uri)
-	blobStore, err := createBlobStoreForURI(uriParent)
+	blobStore, err := CreateBlobStoreForURI(uriParent, BlobStoreOptions{AccessType: ReadWrite})
 	if err != nil {
 		return err
 	}
-	client, err := blobStore.NewClient(context.Background())
+	client, err := blobStore.NewClient(ctx)
 	if err != nil {
 		return err
 	}
@@ -85,7 +78,7 @@ func WriteToURI(uri string, data []byte) error {
 	if err != nil {
 		return err
 	}
-	_, err = object.Write(data)
+	_, err = object.Write(ctx, data)
 	if err != nil {
 		return err
 	}
@@ -162,6 +155,15 @@ type remoteStore struct {
 	fetchedBlocksSync sync.Mutex
 	prefetchBlocks    map[uint64]*pendingPrefetchedBlock
 
+	retryPolicy      RetryPolicy
+	isRetryableError func(err error) bool
+
+	// storeIndexUpdatePolicy retries store index updates that lost the race against another writer
+	storeIndexUpdatePolicy RetryPolicy
+
+	// storeIndexDeltaCompactionCount is the number of store index deltas that makes a writer compact them
+	storeIndexDeltaCompactionCount int
+
 	stats longtaillib.BlockStoreStats
 }
 
@@ -170,47 +172,57 @@ func (s *remoteStore) String() string {
 	return s.defaultClient.String()
 }
 
+// countChecksumMismatch counts block reads and writes that failed with ErrBlobChecksumMismatch in
+// the ChecksumMismatch_RetryCount stat so corrupted transfers can be told from other failures, it returns err
+func (s *remoteStore) countChecksumMismatch(err error) error {
+	if errors.Cause(err) == ErrBlobChecksumMismatch {
+		atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_ChecksumMismatch_RetryCount], 1)
+	}
+	return err
+}
+
 func readBlobWithRetry(
 	ctx context.Context,
 	s *remoteStore,
 	client BlobClient,
 	key string) ([]byte, int, error) {
-	retryCount := 0
 	objHandle, err := client.NewObject(key)
 	if err != nil {
-		return nil, retryCount, err
+		return nil, 0, err
 	}
-	exists, err := objHandle.Exists()
+	var blobData []byte
+	retryCount, err := s.retryPolicy.run(ctx, s.isRetryableError, "getBlob "+key+" in store "+s.String(), func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		exists, err := objHandle.Exists(ctx)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return longtaillib.ErrENOENT
+		}
+		blobData, err = objHandle.Read(ctx)
+		return s.countChecksumMismatch(err)
+	})
 	if err != nil {
 		return nil, retryCount, err
 	}
-	if !exists {
-		return nil, retryCount, longtaillib.ErrENOENT
-	}
-	blobData, err := objHandle.Read()
-	if err != nil {
-		log.Printf("Retrying getBlob %s in store %s\n", key, s.String())
-		retryCount++
-		blobData, err = objHandle.Read()
-	}
-	if err != nil {
-		log.Printf("Retrying 500 ms delayed getBlob %s in store %s\n", key, s.String())
-		time.Sleep(500 * time.Millisecond)
-		retryCount++
-		blobData, err = objHandle.Read()
-	}
-	if err != nil {
-		log.Printf("Retrying 2 s delayed getBlob %s in store %s\n", key, s.String())
-		time.Sleep(2 * time.Second)
-		retryCount++
-		blobData, err = objHandle.Read()
-	}
+	return blobData, retryCount, nil
+}
 
-	if err != nil {
-		return nil, retryCount, err
-	}
+const (
+	// BlockMetadataHashIdentifier is the object metadata key for the hash identifier of a stored block
+	BlockMetadataHashIdentifier = "longtail_hash_identifier"
+	// BlockMetadataChunkCount is the object metadata key for the number of chunks in a stored block
+	BlockMetadataChunkCount = "longtail_chunk_count"
+)
 
-	return blobData, retryCount, nil
+func getStoredBlockMetadata(blockIndex longtaillib.Longtail_BlockIndex) map[string]string {
+	return map[string]string{
+		BlockMetadataHashIdentifier: strconv.FormatUint(uint64(blockIndex.GetHashIdentifier()), 10),
+		BlockMetadataChunkCount:     strconv.FormatUint(uint64(blockIndex.GetChunkCount()), 10),
+	}
 }
 
 func putStoredBlock(
@@ -221,6 +233,10 @@ func putStoredBlock(
 	storedBlock longtaillib.Longtail_StoredBlock) error {
 
 	atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Count], 1)
+	if err := ctx.Err(); err != nil {
+		atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_FailCount], 1)
+		return err
+	}
 
 	blockIndex := storedBlock.GetBlockIndex()
 	blockHash := blockIndex.GetBlockHash()
@@ -229,34 +245,38 @@ func putStoredBlock(
 	if err != nil {
 		return err
 	}
-	if exists, err := objHandle.Exists(); err == nil && !exists {
+	var exists bool
+	retryCount, err := s.retryPolicy.run(ctx, s.isRetryableError, "putBlob "+key+" in store "+s.String(), func() error {
+		exists, err = objHandle.Exists(ctx)
+		return err
+	})
+	atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_RetryCount], uint64(retryCount))
+	if err != nil {
+		atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_FailCount], 1)
+		return err
+	}
+	if !exists {
 		blob, errno := longtaillib.WriteStoredBlockToBuffer(storedBlock)
 		if errno != 0 {
 			return longtaillib.ErrnoToError(errno, longtaillib.ErrEIO)
 		}
 
-		ok, err := objHandle.Write(blob)
-		if err != nil || !ok {
-			log.Printf("Retrying putBlob %s in store %s\n", key, s.String())
-			atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_RetryCount], 1)
-			ok, err = objHandle.Write(blob)
-		}
-		if err != nil || !ok {
-			log.Printf("Retrying 500 ms delayed putBlob %s in store %s\n", key, s.String())
-			time.Sleep(500 * time.Millisecond)
-			atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_RetryCount], 1)
-			ok, err = objHandle.Write(blob)
-		}
-		if err != nil || !ok {
-			log.Printf("Retrying 2 s delayed putBlob %s in store %s\n", key, s.String())
-			time.Sleep(2 * time.Second)
-			atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_RetryCount], 1)
-			ok, err = objHandle.Write(blob)
-		}
-
-		if err != nil || !ok {
+		objHandle.SetWriteAttributes("", getStoredBlockMetadata(blockIndex))
+		retryCount, err := s.retryPolicy.run(ctx, s.isRetryableError, "putBlob "+key+" in store "+s.String(), func() error {
+			ok, err := objHandle.Write(ctx, blob)
+			if err != nil {
+				return s.countChecksumMismatch(err)
+			}
+			if !ok {
+				// There is no write condition on blocks so a rejected write is unexpected, retry it
+				return ErrBlobWriteConditionFailed
+			}
+			return nil
+		})
+		atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_RetryCount], uint64(retryCount))
+		if err != nil {
 			atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_FailCount], 1)
-			return longtaillib.ErrnoToError(errno, longtaillib.ErrEIO)
+			return errors.Wrapf(err, "putStoredBlock: failed writing %s to %s", key, s.String())
 		}
 
 		atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Byte_Count], (uint64)(len(blob)))
@@ -377,9 +397,6 @@ func prefetchBlock(
 	s.fetchedBlocksSync.Unlock()
 
 	storedBlock, getErr := getStoredBlock(ctx, s, client, prefetchMsg.blockHash)
-	if getErr != nil {
-		return
-	}
 
 	s.fetchedBlocksSync.Lock()
 
@@ -390,6 +407,15 @@ func prefetchBlock(
 		return
 	}
 	completeCallbacks := prefetchedBlock.completeCallbacks
+	if getErr != nil {
+		// Fail anyone waiting for the block and forget the prefetch so a later get tries again
+		delete(s.prefetchBlocks, prefetchMsg.blockHash)
+		s.fetchedBlocksSync.Unlock()
+		for _, c := range completeCallbacks {
+			c.OnComplete(longtaillib.Longtail_StoredBlock{}, longtaillib.ErrorToErrno(getErr, longtaillib.EIO))
+		}
+		return
+	}
 	if len(completeCallbacks) == 0 {
 		// Nobody is actively waiting for the block
 		blockSize := int64(storedBlock.GetBlockSize())
@@ -400,12 +426,8 @@ func prefetchBlock(
 	}
 	s.prefetchBlocks[prefetchMsg.blockHash] = nil
 	s.fetchedBlocksSync.Unlock()
-	for i := 1; i < len(completeCallbacks)-1; i++ {
+	for i := 1; i < len(completeCallbacks); i++ {
 		c := completeCallbacks[i]
-		if getErr != nil {
-			c.OnComplete(longtaillib.Longtail_StoredBlock{}, longtaillib.ErrorToErrno(getErr, longtaillib.EIO))
-			continue
-		}
 		buf, errno := longtaillib.WriteStoredBlockToBuffer(storedBlock)
 		if errno != 0 {
 			c.OnComplete(longtaillib.Longtail_StoredBlock{}, errno)
@@ -418,7 +440,7 @@ func prefetchBlock(
 		}
 		c.OnComplete(blockCopy, 0)
 	}
-	completeCallbacks[0].OnComplete(storedBlock, longtaillib.ErrorToErrno(getErr, longtaillib.EIO))
+	completeCallbacks[0].OnComplete(storedBlock, 0)
 }
 
 func flushPrefetch(
@@ -457,6 +479,31 @@ L:
 	s.fetchedBlocksSync.Unlock()
 }
 
+// remoteWorkerReplyErrorState completes all requests with errno until the store is closed so
+// callers of a worker that can not reach the blob store do not wait forever
+func remoteWorkerReplyErrorState(
+	putBlockMessages <-chan putBlockMessage,
+	getBlockMessages <-chan getBlockMessage,
+	prefetchBlockMessages <-chan prefetchBlockMessage,
+	flushMessages <-chan int,
+	flushReplyMessages chan<- int,
+	errno int) {
+	for {
+		select {
+		case putMsg, more := <-putBlockMessages:
+			if !more {
+				return
+			}
+			putMsg.asyncCompleteAPI.OnComplete(errno)
+		case getMsg := <-getBlockMessages:
+			getMsg.asyncCompleteAPI.OnComplete(longtaillib.Longtail_StoredBlock{}, errno)
+		case <-prefetchBlockMessages:
+		case <-flushMessages:
+			flushReplyMessages <- errno
+		}
+	}
+}
+
 func remoteWorker(
 	ctx context.Context,
 	s *remoteStore,
@@ -469,7 +516,9 @@ func remoteWorker(
 	accessType AccessType) error {
 	client, err := s.blobStore.NewClient(ctx)
 	if err != nil {
-		return errors.Wrap(err, s.blobStore.String())
+		err = errors.Wrap(err, s.blobStore.String())
+		remoteWorkerReplyErrorState(putBlockMessages, getBlockMessages, prefetchBlockChan, flushMessages, flushReplyMessages, longtaillib.ErrorToErrno(err, longtaillib.EIO))
+		return err
 	}
 	defer client.Close()
 	run := true
@@ -547,12 +596,12 @@ func tryUpdateRemoteStoreIndex(
 	updatedStoreIndex longtaillib.Longtail_StoreIndex,
 	objHandle BlobObject) (bool, longtaillib.Longtail_StoreIndex, error) {
 
-	exists, err := objHandle.LockWriteVersion()
+	exists, err := objHandle.LockWriteVersion(ctx)
 	if err != nil {
 		return false, longtaillib.Longtail_StoreIndex{}, err
 	}
 	if exists {
-		blob, err := objHandle.Read()
+		blob, err := objHandle.Read(ctx)
 		if err != nil {
 			return false, longtaillib.Longtail_StoreIndex{}, errors.Wrapf(err, "updateRemoteStoreIndex: objHandle.Read() failed")
 		}
@@ -574,7 +623,7 @@ func tryUpdateRemoteStoreIndex(
 			return false, longtaillib.Longtail_StoreIndex{}, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "updateRemoteStoreIndex: longtaillib.WriteStoreIndexToBuffer() kfailed")
 		}
 
-		ok, err := objHandle.Write(storeBlob)
+		ok, err := objHandle.Write(ctx, storeBlob)
 		if err != nil {
 			newStoreIndex.Dispose()
 			return false, longtaillib.Longtail_StoreIndex{}, errors.Wrapf(err, "updateRemoteStoreIndex: objHandle.Write() failed")
@@ -590,145 +639,223 @@ func tryUpdateRemoteStoreIndex(
 		return false, longtaillib.Longtail_StoreIndex{}, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "updateRemoteStoreIndex: WriteStoreIndexToBuffer() failed")
 	}
 
-	ok, err := objHandle.Write(storeBlob)
+	ok, err := objHandle.Write(ctx, storeBlob)
 	if err != nil {
 		return false, longtaillib.Longtail_StoreIndex{}, errors.Wrapf(err, "updateRemoteStoreIndex: objHandle.Write() failed")
 	}
 	return ok, longtaillib.Longtail_StoreIndex{}, nil
 }
 
+// ErrStoreIndexContention is returned when the store index could not be updated because other
+// writers kept changing it until the update policy ran out of attempts or time
+var ErrStoreIndexContention = errors.New("store index update contention")
+
+// storeIndexUpdateAttempts is how many times a store index update is tried while other writers change it
+const storeIndexUpdateAttempts = 16
+
+// storeIndexUpdateMinJitter spreads out the retries of writers that lost the same race
+const storeIndexUpdateMinJitter = 0.5
+
+// getStoreIndexUpdatePolicy derives the policy for retrying store index updates that lost the race against
+// another writer from the policy for failed operations, failed operations are not retried by it
+func getStoreIndexUpdatePolicy(retryPolicy RetryPolicy) RetryPolicy {
+	policy := retryPolicy
+	policy.MaxAttempts = storeIndexUpdateAttempts
+	if policy.Jitter < storeIndexUpdateMinJitter {
+		policy.Jitter = storeIndexUpdateMinJitter
+	}
+	policy.IsRetryable = isStoreIndexContention
+	return policy
+}
+
+func isStoreIndexContention(err error) bool {
+	return err == ErrStoreIndexContention
+}
+
 func updateRemoteStoreIndex(
 	ctx context.Context,
+	s *remoteStore,
 	blobClient BlobClient,
 	updatedStoreIndex longtaillib.Longtail_StoreIndex) (longtaillib.Longtail_StoreIndex, error) {
 
-	key := "store.lsi"
+	atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_UpdateStoreIndex_Count], 1)
+	key := storeIndexKey
 	objHandle, err := blobClient.NewObject(key)
 	if err != nil {
+		atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_UpdateStoreIndex_FailCount], 1)
 		return longtaillib.Longtail_StoreIndex{}, errors.Wrapf(err, "updateRemoteStoreIndex: blobClient.NewObject(%s) failed", key)
 	}
-	for {
-		ok, newStoreIndex, err := tryUpdateRemoteStoreIndex(
+	var newStoreIndex longtaillib.Longtail_StoreIndex
+	retryCount, err := s.storeIndexUpdatePolicy.run(ctx, s.storeIndexUpdatePolicy.IsRetryable, "updating store index "+key+" in store "+s.String(), func() error {
+		ok, storeIndex, err := tryUpdateRemoteStoreIndex(
 			ctx,
 			updatedStoreIndex,
 			objHandle)
-		if ok {
-			return newStoreIndex, nil
-		}
 		if err != nil {
-			return longtaillib.Longtail_StoreIndex{}, errors.Wrapf(err, "updateRemoteStoreIndex: tryUpdateRemoteStoreIndex(%s) failed", key)
+			return err
 		}
-		log.Printf("Retrying updating remote store index %s\n", key)
+		if !ok {
+			return ErrStoreIndexContention
+		}
+		newStoreIndex = storeIndex
+		return nil
+	})
+	atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_UpdateStoreIndex_RetryCount], uint64(retryCount))
+	if err == nil {
+		return newStoreIndex, nil
 	}
-	return longtaillib.Longtail_StoreIndex{}, nil
+	atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_UpdateStoreIndex_FailCount], 1)
+	if ctx.Err() != nil {
+		return longtaillib.Longtail_StoreIndex{}, errors.Wrapf(ctx.Err(), "updateRemoteStoreIndex: updating %s was cancelled", key)
+	}
+	if err == ErrStoreIndexContention {
+		return longtaillib.Longtail_StoreIndex{}, errors.Wrapf(err, "updateRemoteStoreIndex: %s kept changing, gave up after %d attempts", key, retryCount+1)
+	}
+	return longtaillib.Longtail_StoreIndex{}, errors.Wrapf(err, "updateRemoteStoreIndex: tryUpdateRemoteStoreIndex(%s) failed", key)
 }
 
+// storeIndexBlockBatchSize is the number of scanned block indexes we collect before merging them into the store index
+const storeIndexBlockBatchSize = 1024
+
 func getStoreIndexFromBlocks(
 	ctx context.Context,
 	s *remoteStore,
 	blobClient BlobClient,
-	blockKeys []string) (longtaillib.Longtail_StoreIndex, error) {
+	blockKeys <-chan string) (longtaillib.Longtail_StoreIndex, error) {
 
 	storeIndex, errno := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{})
 	if errno != 0 {
 		return longtaillib.Longtail_StoreIndex{}, longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM)
 	}
 
-	batchCount := s.workerCount
-	batchStart := 0
-
-	if batchCount > len(blockKeys) {
-		batchCount = len(blockKeys)
-	}
-	clients := make([]BlobClient, batchCount)
-	for c := 0; c < batchCount; c++ {
+	clients := make([]BlobClient, s.workerCount)
+	for c := 0; c < s.workerCount; c++ {
 		client, err := s.blobStore.NewClient(ctx)
 		if err != nil {
+			for _, client := range clients[:c] {
+				client.Close()
+			}
 			storeIndex.Dispose()
+			// Let the producer of the block keys run to completion
+			go func() {
+				for range blockKeys {
+				}
+			}()
 			return longtaillib.Longtail_StoreIndex{}, err
 		}
 		clients[c] = client
 	}
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
 
-	var wg sync.WaitGroup
+	blockIndexes := make(chan longtaillib.Longtail_BlockIndex, s.workerCount)
+
+	// A block that can not be read would be missing from the index, so the scan fails instead
+	var readErrMutex sync.Mutex
+	var readErr error
 
-	for batchStart < len(blockKeys) {
-		batchLength := batchCount
-		if batchStart+batchLength > len(blockKeys) {
-			batchLength = len(blockKeys) - batchStart
-		}
-		batchBlockIndexes := make([]longtaillib.Longtail_BlockIndex, batchLength)
-		wg.Add(batchLength)
-		for batchPos := 0; batchPos < batchLength; batchPos++ {
-			i := batchStart + batchPos
-			blockKey := blockKeys[i]
-			go func(client BlobClient, batchPos int, blockKey string) {
+	var wg sync.WaitGroup
+	wg.Add(s.workerCount)
+	for c := 0; c < s.workerCount; c++ {
+		go func(client BlobClient) {
+			defer wg.Done()
+			for blockKey := range blockKeys {
 				storedBlockData, _, err := readBlobWithRetry(
 					ctx,
 					s,
 					client,
 					blockKey)
 
+				if errors.Cause(err) == longtaillib.ErrENOENT {
+					// Deleted since it was listed
+					continue
+				}
 				if err != nil {
-					wg.Done()
-					return
+					readErrMutex.Lock()
+					if readErr == nil {
+						readErr = errors.Wrapf(err, "getStoreIndexFromBlocks: failed reading %s", blockKey)
+					}
+					readErrMutex.Unlock()
+					continue
 				}
 
 				blockIndex, errno := longtaillib.ReadBlockIndexFromBuffer(storedBlockData)
 				if errno != 0 {
-					wg.Done()
-					return
+					log.Printf("Block %s is not a valid block, skipping it\n", blockKey)
+					continue
 				}
 
 				blockPath := GetBlockPath("chunks", blockIndex.GetBlockHash())
-				if blockPath == blockKey {
-					batchBlockIndexes[batchPos] = blockIndex
-				} else {
+				if blockPath != blockKey {
 					log.Printf("Block %s name does not match content hash, expected name %s\n", blockKey, blockPath)
+					blockIndex.Dispose()
+					continue
 				}
-
-				wg.Done()
-			}(clients[batchPos], batchPos, blockKey)
-		}
-		wg.Wait()
-		writeIndex := 0
-		for i, blockIndex := range batchBlockIndexes {
-			if !blockIndex.IsValid() {
-				continue
-			}
-			if i > writeIndex {
-				batchBlockIndexes[writeIndex] = blockIndex
+				blockIndexes <- blockIndex
 			}
-			writeIndex++
-		}
-		batchBlockIndexes = batchBlockIndexes[:writeIndex]
+		}(clients[c])
+	}
+	go func() {
+		wg.Wait()
+		close(blockIndexes)
+	}()
+
+	var err error
+	scannedCount := 0
+	batchBlockIndexes := make([]longtaillib.Longtail_BlockIndex, 0, storeIndexBlockBatchSize)
+	mergeBatch := func() error {
 		batchStoreIndex, errno := longtaillib.CreateStoreIndexFromBlocks(batchBlockIndexes)
 		for _, blockIndex := range batchBlockIndexes {
 			blockIndex.Dispose()
 		}
+		batchBlockIndexes = batchBlockIndexes[:0]
 		if errno != 0 {
-			batchStoreIndex.Dispose()
-			storeIndex.Dispose()
-			return longtaillib.Longtail_StoreIndex{}, longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM)
+			return longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM)
 		}
 		newStoreIndex, errno := longtaillib.MergeStoreIndex(storeIndex, batchStoreIndex)
+		batchStoreIndex.Dispose()
 		if errno != 0 {
-			batchStoreIndex.Dispose()
-			storeIndex.Dispose()
-			return longtaillib.Longtail_StoreIndex{}, longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM)
+			return longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM)
 		}
-		batchStoreIndex.Dispose()
 		storeIndex.Dispose()
 		storeIndex = newStoreIndex
-		//		blockIndexes = append(blockIndexes, batchBlockIndexes[:writeIndex]...)
-		batchStart += batchLength
-		log.Printf("Scanned %d/%d blocks in %s\n", batchStart, len(blockKeys), blobClient.String())
+		log.Printf("Scanned %d blocks in %s\n", scannedCount, blobClient.String())
+		return nil
 	}
 
-	for c := 0; c < batchCount; c++ {
-		clients[c].Close()
+	// Keep draining the scanned blocks after an error so the workers can finish
+	for blockIndex := range blockIndexes {
+		if err != nil {
+			blockIndex.Dispose()
+			continue
+		}
+		batchBlockIndexes = append(batchBlockIndexes, blockIndex)
+		scannedCount++
+		if len(batchBlockIndexes) == storeIndexBlockBatchSize {
+			err = mergeBatch()
+		}
+	}
+	if err == nil {
+		// All workers are done once blockIndexes is closed
+		err = readErr
+	}
+	if err == nil {
+		// A cancelled scan would give an incomplete index which must not be saved as the store index
+		err = ctx.Err()
+	}
+	if err == nil && len(batchBlockIndexes) > 0 {
+		err = mergeBatch()
+	}
+	if err != nil {
+		for _, blockIndex := range batchBlockIndexes {
+			blockIndex.Dispose()
+		}
+		storeIndex.Dispose()
+		return longtaillib.Longtail_StoreIndex{}, err
 	}
-
 	return storeIndex, nil
 }
 
@@ -737,56 +864,95 @@ func buildStoreIndexFromStoreBlocks(
 	s *remoteStore,
 	blobClient BlobClient) (longtaillib.Longtail_StoreIndex, error) {
 
-	var items []string
-	blobs, err := blobClient.GetObjects()
+	blockKeys := make(chan string, s.workerCount*4)
+	var listErr error
+	go func() {
+		defer close(blockKeys)
+		it := blobClient.ListObjects(ctx, "chunks/", "")
+		for {
+			blob, err := it.Next()
+			if err == ErrBlobIteratorDone {
+				return
+			}
+			if err != nil {
+				listErr = err
+				return
+			}
+			if blob.Size == 0 {
+				continue
+			}
+			if strings.HasSuffix(blob.Name, ".lsb") {
+				select {
+				case blockKeys <- blob.Name:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	storeIndex, err := getStoreIndexFromBlocks(ctx, s, blobClient, blockKeys)
 	if err != nil {
 		return longtaillib.Longtail_StoreIndex{}, err
 	}
-
-	for _, blob := range blobs {
-		if blob.Size == 0 {
-			continue
-		}
-		if strings.HasSuffix(blob.Name, ".lsb") {
-			items = append(items, blob.Name)
-		}
+	// blockKeys is closed once the listing goroutine is done so listErr is safe to read
+	if listErr != nil {
+		storeIndex.Dispose()
+		return longtaillib.Longtail_StoreIndex{}, listErr
 	}
-
-	return getStoreIndexFromBlocks(ctx, s, blobClient, items)
+	return storeIndex, nil
 }
 
+// storeIndexWorkerReplyErrorState completes all requests to a failed store index worker with the errno
+// of err until the store is closed
 func storeIndexWorkerReplyErrorState(
+	err error,
+	preflightGetMessages <-chan preflightGetMessage,
 	blockIndexMessages <-chan blockIndexMessage,
 	getExistingContentMessages <-chan getExistingContentMessage,
 	flushMessages <-chan int,
 	flushReplyMessages chan<- int) {
+	errno := longtaillib.ErrorToErrno(err, longtaillib.EIO)
 	for {
 		select {
 		case <-flushMessages:
-			flushReplyMessages <- 0
-		case _, more := <-blockIndexMessages:
+			flushReplyMessages <- errno
+		case preflightGetMsg := <-preflightGetMessages:
+			preflightGetMsg.asyncCompleteAPI.OnComplete([]uint64{}, errno)
+		case blockIndexMsg, more := <-blockIndexMessages:
 			if !more {
 				return
 			}
+			blockIndexMsg.blockIndex.Dispose()
 		case getExistingContentMessage := <-getExistingContentMessages:
-			getExistingContentMessage.asyncCompleteAPI.OnComplete(longtaillib.Longtail_StoreIndex{}, longtaillib.EINVAL)
+			getExistingContentMessage.asyncCompleteAPI.OnComplete(longtaillib.Longtail_StoreIndex{}, errno)
 		}
 	}
 }
 
-func readStoreStoreIndex(
+const (
+	// storeIndexKey is the base store index, together with the store index deltas it lists all blocks in the store
+	storeIndexKey = "store.lsi"
+	// storeIndexDeltaPrefix is where each writer saves the blocks it added as a store index delta of its own,
+	// deltas have unique names so writers do not contend for storeIndexKey
+	storeIndexDeltaPrefix = "store-deltas/"
+	// defaultStoreIndexDeltaCompactionCount makes a writer merge its delta into the base store index on every
+	// flush, clients that do not know about deltas only read the base store index
+	defaultStoreIndexDeltaCompactionCount = 1
+	// storeIndexReadAttempts is how many times the store index is read if a delta is compacted away while reading it
+	storeIndexReadAttempts = 8
+)
+
+// readStoreIndexObject reads and parses the store index in key
+func readStoreIndexObject(
 	ctx context.Context,
 	s *remoteStore,
-	client BlobClient) (longtaillib.Longtail_StoreIndex, error) {
-
-	key := "store.lsi"
+	client BlobClient,
+	key string) (longtaillib.Longtail_StoreIndex, error) {
 	blobData, _, err := readBlobWithRetry(ctx, s, client, key)
 	if err != nil {
 		return longtaillib.Longtail_StoreIndex{}, err
 	}
-	if blobData == nil {
-		return longtaillib.Longtail_StoreIndex{}, nil
-	}
 	storeIndex, errno := longtaillib.ReadStoreIndexFromBuffer(blobData)
 	if errno != 0 {
 		return longtaillib.Longtail_StoreIndex{}, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "contentIndexWorker: longtaillib.ReadStoreIndexFromBuffer() for %s", key)
@@ -794,6 +960,289 @@ func readStoreStoreIndex(
 	return storeIndex, nil
 }
 
+// mergeIntoStoreIndex merges other into storeIndex, storeIndex is replaced by the merged index
+func mergeIntoStoreIndex(storeIndex *longtaillib.Longtail_StoreIndex, other longtaillib.Longtail_StoreIndex) error {
+	mergedStoreIndex, errno := longtaillib.MergeStoreIndex(*storeIndex, other)
+	if errno != 0 {
+		return errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "longtaillib.MergeStoreIndex() failed")
+	}
+	storeIndex.Dispose()
+	*storeIndex = mergedStoreIndex
+	return nil
+}
+
+// listStoreIndexDeltas returns the keys of all store index deltas
+func listStoreIndexDeltas(
+	ctx context.Context,
+	s *remoteStore,
+	client BlobClient) ([]string, error) {
+	var keys []string
+	_, err := s.retryPolicy.run(ctx, s.isRetryableError, "list store index deltas in store "+s.String(), func() error {
+		items, err := readBlobObjectIterator(client.ListObjects(ctx, storeIndexDeltaPrefix, ""))
+		if err != nil {
+			return err
+		}
+		keys = keys[:0]
+		for _, item := range items {
+			if strings.HasSuffix(item.Name, ".lsi") {
+				keys = append(keys, item.Name)
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// readStoreIndexDeltas merges the store index deltas in keys into storeIndex, a delta that no longer
+// exists has been compacted into the base store index and is skipped, missingCount tells how many
+func readStoreIndexDeltas(
+	ctx context.Context,
+	s *remoteStore,
+	client BlobClient,
+	storeIndex *longtaillib.Longtail_StoreIndex,
+	keys []string) (int, error) {
+	missingCount := 0
+	for _, key := range keys {
+		deltaStoreIndex, err := readStoreIndexObject(ctx, s, client, key)
+		if errors.Cause(err) == longtaillib.ErrENOENT {
+			missingCount++
+			continue
+		}
+		if err != nil {
+			return missingCount, err
+		}
+		err = mergeIntoStoreIndex(storeIndex, deltaStoreIndex)
+		deltaStoreIndex.Dispose()
+		if err != nil {
+			return missingCount, err
+		}
+	}
+	return missingCount, nil
+}
+
+// readStoreStoreIndex reads the base store index and merges all store index deltas into it. A store
+// without a base store index gives ErrENOENT so the index is rebuilt from the blocks
+func readStoreStoreIndex(
+	ctx context.Context,
+	s *remoteStore,
+	client BlobClient) (longtaillib.Longtail_StoreIndex, error) {
+
+	for attempt := 1; ; attempt++ {
+		// The deltas are listed before the base is read, see below
+		deltaKeys, err := listStoreIndexDeltas(ctx, s, client)
+		if err != nil {
+			return longtaillib.Longtail_StoreIndex{}, err
+		}
+		storeIndex, err := readStoreIndexObject(ctx, s, client, storeIndexKey)
+		if err != nil {
+			return longtaillib.Longtail_StoreIndex{}, err
+		}
+		missingCount, err := readStoreIndexDeltas(ctx, s, client, &storeIndex, deltaKeys)
+		if err != nil {
+			storeIndex.Dispose()
+			return longtaillib.Longtail_StoreIndex{}, err
+		}
+		if missingCount == 0 || attempt == storeIndexReadAttempts {
+			// The blocks of a delta compacted before the base was read are in the base, a delta
+			// compacted after that makes us read again
+			return storeIndex, nil
+		}
+		storeIndex.Dispose()
+		log.Printf("Store index deltas in %s were compacted while reading, reading the store index again\n", s.String())
+	}
+}
+
+// newStoreIndexDeltaKey returns a unique key for a store index delta, the time first so the deltas
+// list in the order they were written
+func newStoreIndexDeltaKey() (string, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%016x-%s.lsi", storeIndexDeltaPrefix, time.Now().UnixNano(), hex.EncodeToString(id)), nil
+}
+
+// writeStoreIndexDelta saves the blocks added by this writer as a new store index delta
+func writeStoreIndexDelta(
+	ctx context.Context,
+	s *remoteStore,
+	client BlobClient,
+	deltaStoreIndex longtaillib.Longtail_StoreIndex) error {
+	key, err := newStoreIndexDeltaKey()
+	if err != nil {
+		return errors.Wrap(err, "writeStoreIndexDelta: newStoreIndexDeltaKey() failed")
+	}
+	blob, errno := longtaillib.WriteStoreIndexToBuffer(deltaStoreIndex)
+	if errno != 0 {
+		return errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "writeStoreIndexDelta: longtaillib.WriteStoreIndexToBuffer() failed")
+	}
+	objHandle, err := client.NewObject(key)
+	if err != nil {
+		return errors.Wrapf(err, "writeStoreIndexDelta: client.NewObject(%s) failed", key)
+	}
+	_, err = s.retryPolicy.run(ctx, s.isRetryableError, "write store index delta "+key+" in store "+s.String(), func() error {
+		ok, err := objHandle.Write(ctx, blob)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// There is no write condition on deltas so a rejected write is unexpected, retry it
+			return ErrBlobWriteConditionFailed
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "writeStoreIndexDelta: failed writing %s to %s", key, s.String())
+	}
+	return nil
+}
+
+// tryCompactStoreIndexDeltas merges the deltas in deltaKeys into the base store index with a
+// conditional write, it returns false if another writer changed the base store index
+func tryCompactStoreIndexDeltas(
+	ctx context.Context,
+	s *remoteStore,
+	client BlobClient,
+	objHandle BlobObject,
+	deltaKeys []string) (bool, error) {
+	exists, err := objHandle.LockWriteVersion(ctx)
+	if err != nil {
+		return false, err
+	}
+	var storeIndex longtaillib.Longtail_StoreIndex
+	if exists {
+		storeIndex, err = readStoreIndexObject(ctx, s, client, storeIndexKey)
+		if err != nil {
+			return false, err
+		}
+	} else {
+		var errno int
+		storeIndex, errno = longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{})
+		if errno != 0 {
+			return false, errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "longtaillib.CreateStoreIndexFromBlocks() failed")
+		}
+	}
+	defer storeIndex.Dispose()
+	// A missing delta was compacted by another writer which also changed the base so the write below fails
+	_, err = readStoreIndexDeltas(ctx, s, client, &storeIndex, deltaKeys)
+	if err != nil {
+		return false, err
+	}
+	blob, errno := longtaillib.WriteStoreIndexToBuffer(storeIndex)
+	if errno != 0 {
+		return false, errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "longtaillib.WriteStoreIndexToBuffer() failed")
+	}
+	return objHandle.Write(ctx, blob)
+}
+
+// compactStoreIndexDeltas merges the store index deltas into the base store index and deletes them once
+// there are at least s.storeIndexDeltaCompactionCount of them. Deltas written while compacting are left
+// for the next compaction
+func compactStoreIndexDeltas(
+	ctx context.Context,
+	s *remoteStore,
+	client BlobClient) error {
+	deltaKeys, err := listStoreIndexDeltas(ctx, s, client)
+	if err != nil {
+		return err
+	}
+	if len(deltaKeys) == 0 || len(deltaKeys) < s.storeIndexDeltaCompactionCount {
+		return nil
+	}
+	objHandle, err := client.NewObject(storeIndexKey)
+	if err != nil {
+		return errors.Wrapf(err, "compactStoreIndexDeltas: client.NewObject(%s) failed", storeIndexKey)
+	}
+	_, err = s.storeIndexUpdatePolicy.run(ctx, s.storeIndexUpdatePolicy.IsRetryable, "compacting store index deltas in store "+s.String(), func() error {
+		ok, err := tryCompactStoreIndexDeltas(ctx, s, client, objHandle, deltaKeys)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrStoreIndexContention
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "compactStoreIndexDeltas: failed compacting %d deltas in %s", len(deltaKeys), s.String())
+	}
+	for _, key := range deltaKeys {
+		deltaHandle, err := client.NewObject(key)
+		if err == nil {
+			err = deltaHandle.Delete(ctx)
+		}
+		if err != nil && errors.Cause(err) != longtaillib.ErrENOENT {
+			// The delta is already in the base store index, merging it again does no harm
+			log.Printf("Failed to delete compacted store index delta %s: %v\n", key, err)
+		}
+	}
+	if s.storeIndexDeltaCompactionCount > 1 {
+		log.Printf("Compacted %d store index deltas in %s\n", len(deltaKeys), s.String())
+	}
+	return nil
+}
+
+// addBlocksToStoreIndex merges the added blocks into storeIndex, if it has been read, and into
+// deltaStoreIndex which holds the blocks that are not yet saved to the store. The block indexes are disposed
+func addBlocksToStoreIndex(
+	storeIndex longtaillib.Longtail_StoreIndex,
+	deltaStoreIndex longtaillib.Longtail_StoreIndex,
+	addedBlockIndexes []longtaillib.Longtail_BlockIndex) (longtaillib.Longtail_StoreIndex, longtaillib.Longtail_StoreIndex, error) {
+	defer func() {
+		for _, blockIndex := range addedBlockIndexes {
+			blockIndex.Dispose()
+		}
+	}()
+	if len(addedBlockIndexes) == 0 {
+		return storeIndex, deltaStoreIndex, nil
+	}
+	updatedDeltaStoreIndex, err := updateStoreIndex(deltaStoreIndex, addedBlockIndexes)
+	if err != nil {
+		return storeIndex, deltaStoreIndex, err
+	}
+	deltaStoreIndex.Dispose()
+	if !storeIndex.IsValid() {
+		return storeIndex, updatedDeltaStoreIndex, nil
+	}
+	updatedStoreIndex, err := updateStoreIndex(storeIndex, addedBlockIndexes)
+	if err != nil {
+		return storeIndex, updatedDeltaStoreIndex, err
+	}
+	storeIndex.Dispose()
+	return updatedStoreIndex, updatedDeltaStoreIndex, nil
+}
+
+// saveStoreIndexChanges writes the complete store index if saveStoreIndex is set, otherwise the blocks in
+// deltaStoreIndex as a store index delta followed by a compaction if there are enough deltas, by default
+// every delta is compacted right away. It returns
+// the merged store index if the complete store index was written
+func saveStoreIndexChanges(
+	ctx context.Context,
+	s *remoteStore,
+	client BlobClient,
+	storeIndex longtaillib.Longtail_StoreIndex,
+	deltaStoreIndex longtaillib.Longtail_StoreIndex,
+	saveStoreIndex bool) (longtaillib.Longtail_StoreIndex, error) {
+	if saveStoreIndex && storeIndex.IsValid() {
+		// The store index holds the blocks of the delta as well
+		return updateRemoteStoreIndex(ctx, s, client, storeIndex)
+	}
+	if !deltaStoreIndex.IsValid() || deltaStoreIndex.GetBlockCount() == 0 {
+		return longtaillib.Longtail_StoreIndex{}, nil
+	}
+	err := writeStoreIndexDelta(ctx, s, client, deltaStoreIndex)
+	if err != nil {
+		return longtaillib.Longtail_StoreIndex{}, err
+	}
+	err = compactStoreIndexDeltas(ctx, s, client)
+	if err != nil {
+		// The delta is saved, compaction is retried by the next writer
+		log.Printf("WARNING: %v\n", err)
+	}
+	return longtaillib.Longtail_StoreIndex{}, nil
+}
+
 func onPreflighMessage(
 	s *remoteStore,
 	storeIndex longtaillib.Longtail_StoreIndex,
@@ -845,72 +1294,70 @@ func getStoreIndex(
 	client BlobClient,
 	accessType AccessType,
 	storeIndex longtaillib.Longtail_StoreIndex,
-	saveStoreIndex bool,
-	addedBlockIndexes []longtaillib.Longtail_BlockIndex) (longtaillib.Longtail_StoreIndex, bool, error) {
+	deltaStoreIndex longtaillib.Longtail_StoreIndex,
+	saveStoreIndex bool) (longtaillib.Longtail_StoreIndex, bool, error) {
 	var err error
 	var errno int
-	if !storeIndex.IsValid() {
-		if accessType == Init {
-			saveStoreIndex = true
-		} else {
-			if accessType == ReadOnly && len(optionalStoreIndexPath) > 0 {
-				sbuffer, err := ReadFromURI(optionalStoreIndexPath)
-				if err == nil {
-					storeIndex, errno = longtaillib.ReadStoreIndexFromBuffer(sbuffer)
-					if errno != 0 {
-						log.Printf("Failed parsing local store index from %s: %d\n", optionalStoreIndexPath, errno)
-					}
-				} else {
-					log.Printf("Failed reading local store index: %v\n", err)
+	if storeIndex.IsValid() {
+		return storeIndex, saveStoreIndex, nil
+	}
+	if accessType == Init {
+		saveStoreIndex = true
+	} else {
+		if accessType == ReadOnly && len(optionalStoreIndexPath) > 0 {
+			sbuffer, err := ReadFromURI(ctx, optionalStoreIndexPath)
+			if err == nil {
+				storeIndex, errno = longtaillib.ReadStoreIndexFromBuffer(sbuffer)
+				if errno != 0 {
+					log.Printf("Failed parsing local store index from %s: %d\n", optionalStoreIndexPath, errno)
 				}
+			} else {
+				log.Printf("Failed reading local store index: %v\n", err)
 			}
-			if !storeIndex.IsValid() {
-				storeIndex, err = readStoreStoreIndex(ctx, s, client)
-				if err != nil {
-					log.Printf("contentIndexWorker: readStoreStoreIndex() failed with %v", err)
-				}
+		}
+		if !storeIndex.IsValid() {
+			storeIndex, err = readStoreStoreIndex(ctx, s, client)
+			if err != nil {
+				log.Printf("contentIndexWorker: readStoreStoreIndex() failed with %v", err)
 			}
 		}
+	}
 
-		if !storeIndex.IsValid() {
-			if accessType == ReadOnly {
-				storeIndex, errno = longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{})
-				if errno != 0 {
-					return longtaillib.Longtail_StoreIndex{}, false, errors.Wrapf(longtaillib.ErrnoToError(longtaillib.EACCES, longtaillib.ErrEACCES), "contentIndexWorker: CreateStoreIndexFromBlocks() failed")
-				}
-			} else {
-				storeIndex, err = buildStoreIndexFromStoreBlocks(
-					ctx,
-					s,
-					client)
+	if !storeIndex.IsValid() {
+		if accessType == ReadOnly {
+			storeIndex, errno = longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{})
+			if errno != 0 {
+				return longtaillib.Longtail_StoreIndex{}, false, errors.Wrapf(longtaillib.ErrnoToError(longtaillib.EACCES, longtaillib.ErrEACCES), "contentIndexWorker: CreateStoreIndexFromBlocks() failed")
+			}
+		} else {
+			storeIndex, err = buildStoreIndexFromStoreBlocks(
+				ctx,
+				s,
+				client)
 
-				if err != nil {
-					return longtaillib.Longtail_StoreIndex{}, false, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "contentIndexWorker: buildStoreIndexFromStoreBlocks() failed")
-				}
-				log.Printf("Rebuilt remote index with %d blocks\n", len(storeIndex.GetBlockHashes()))
-				newStoreIndex, err := updateRemoteStoreIndex(ctx, client, storeIndex)
-				if err != nil {
-					log.Printf("Failed to update store index in store %s\n", s.String())
-					saveStoreIndex = true
-				}
-				if newStoreIndex.IsValid() {
-					storeIndex.Dispose()
-					storeIndex = newStoreIndex
-				}
+			if err != nil {
+				return longtaillib.Longtail_StoreIndex{}, false, errors.Wrap(err, "contentIndexWorker: buildStoreIndexFromStoreBlocks() failed")
+			}
+			log.Printf("Rebuilt remote index with %d blocks\n", len(storeIndex.GetBlockHashes()))
+			newStoreIndex, err := updateRemoteStoreIndex(ctx, s, client, storeIndex)
+			if err != nil {
+				log.Printf("Failed to update store index in store %s\n", s.String())
+				saveStoreIndex = true
+			}
+			if newStoreIndex.IsValid() {
+				storeIndex.Dispose()
+				storeIndex = newStoreIndex
 			}
 		}
 	}
 
-	if len(addedBlockIndexes) > 0 {
-		updatedStoreIndex, err := updateStoreIndex(storeIndex, addedBlockIndexes)
+	if deltaStoreIndex.IsValid() {
+		// Blocks added by us that are not yet saved to the store
+		err = mergeIntoStoreIndex(&storeIndex, deltaStoreIndex)
 		if err != nil {
-			log.Printf("WARNING: Failed to update store index with added blocks %v", err)
-			return longtaillib.Longtail_StoreIndex{}, false, err
+			storeIndex.Dispose()
+			return longtaillib.Longtail_StoreIndex{}, false, errors.Wrap(err, "contentIndexWorker: mergeIntoStoreIndex() failed")
 		}
-		storeIndex.Dispose()
-		storeIndex = updatedStoreIndex
-		saveStoreIndex = true
-		addedBlockIndexes = nil
 	}
 	return storeIndex, saveStoreIndex, nil
 }
@@ -929,21 +1376,65 @@ func contentIndexWorker(
 
 	client, err := s.blobStore.NewClient(ctx)
 	if err != nil {
-		storeIndexWorkerReplyErrorState(blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
-		return errors.Wrap(err, s.blobStore.String())
+		err = errors.Wrap(err, s.blobStore.String())
+		storeIndexWorkerReplyErrorState(err, preflightGetMessages, blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
+		return err
 	}
 	defer client.Close()
 
 	saveStoreIndex := false
 
 	storeIndex := longtaillib.Longtail_StoreIndex{}
+	// Blocks added by us that are not yet saved to the store
+	deltaStoreIndex := longtaillib.Longtail_StoreIndex{}
 
 	var addedBlockIndexes []longtaillib.Longtail_BlockIndex
-	defer func(addedBlockIndexes []longtaillib.Longtail_BlockIndex) {
+	defer func() {
 		for _, blockIndex := range addedBlockIndexes {
 			blockIndex.Dispose()
 		}
-	}(addedBlockIndexes)
+		deltaStoreIndex.Dispose()
+	}()
+
+	loadStoreIndex := func() error {
+		var err error
+		storeIndex, saveStoreIndex, err = getStoreIndex(
+			ctx,
+			s,
+			optionalStoreIndexPath,
+			client,
+			accessType,
+			storeIndex,
+			deltaStoreIndex,
+			saveStoreIndex)
+		if err != nil {
+			return err
+		}
+		storeIndex, deltaStoreIndex, err = addBlocksToStoreIndex(storeIndex, deltaStoreIndex, addedBlockIndexes)
+		addedBlockIndexes = nil
+		return err
+	}
+
+	saveChanges := func() error {
+		var err error
+		storeIndex, deltaStoreIndex, err = addBlocksToStoreIndex(storeIndex, deltaStoreIndex, addedBlockIndexes)
+		addedBlockIndexes = nil
+		if err != nil {
+			return err
+		}
+		newStoreIndex, err := saveStoreIndexChanges(ctx, s, client, storeIndex, deltaStoreIndex, saveStoreIndex)
+		if err != nil {
+			return err
+		}
+		if newStoreIndex.IsValid() {
+			storeIndex.Dispose()
+			storeIndex = newStoreIndex
+		}
+		deltaStoreIndex.Dispose()
+		deltaStoreIndex = longtaillib.Longtail_StoreIndex{}
+		saveStoreIndex = false
+		return nil
+	}
 
 	run := true
 	for run {
@@ -951,19 +1442,11 @@ func contentIndexWorker(
 		select {
 		case preflightGetMsg := <-preflightGetMessages:
 			received++
-			storeIndex, saveStoreIndex, err = getStoreIndex(
-				ctx,
-				s,
-				optionalStoreIndexPath,
-				client,
-				accessType,
-				storeIndex,
-				saveStoreIndex,
-				addedBlockIndexes)
+			err = loadStoreIndex()
 			if err != nil {
 				storeIndex.Dispose()
 				preflightGetMsg.asyncCompleteAPI.OnComplete([]uint64{}, longtaillib.ErrorToErrno(err, longtaillib.EIO))
-				storeIndexWorkerReplyErrorState(blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
+				storeIndexWorkerReplyErrorState(err, preflightGetMessages, blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
 				return err
 			}
 			onPreflighMessage(s, storeIndex, preflightGetMsg, prefetchBlockMessages)
@@ -976,19 +1459,11 @@ func contentIndexWorker(
 			}
 		case getExistingContentMessage := <-getExistingContentMessages:
 			received++
-			storeIndex, saveStoreIndex, err = getStoreIndex(
-				ctx,
-				s,
-				optionalStoreIndexPath,
-				client,
-				accessType,
-				storeIndex,
-				saveStoreIndex,
-				addedBlockIndexes)
+			err = loadStoreIndex()
 			if err != nil {
 				storeIndex.Dispose()
 				getExistingContentMessage.asyncCompleteAPI.OnComplete(longtaillib.Longtail_StoreIndex{}, longtaillib.ErrorToErrno(err, longtaillib.EIO))
-				storeIndexWorkerReplyErrorState(blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
+				storeIndexWorkerReplyErrorState(err, preflightGetMessages, blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
 				return err
 			}
 			onGetExistingContentMessage(s, storeIndex, getExistingContentMessage)
@@ -1001,44 +1476,20 @@ func contentIndexWorker(
 
 		select {
 		case <-flushMessages:
-			if len(addedBlockIndexes) > 0 && accessType != ReadOnly {
-				updatedStoreIndex, err := updateStoreIndex(storeIndex, addedBlockIndexes)
-				if err != nil {
-					flushReplyMessages <- longtaillib.ErrorToErrno(err, longtaillib.ENOMEM)
-					continue
-				}
-				storeIndex.Dispose()
-				storeIndex = updatedStoreIndex
-				addedBlockIndexes = nil
-				saveStoreIndex = true
-			}
-			if saveStoreIndex {
-				newStoreIndex, err := updateRemoteStoreIndex(ctx, client, storeIndex)
+			if accessType != ReadOnly {
+				err = saveChanges()
 				if err != nil {
 					flushReplyMessages <- longtaillib.ErrorToErrno(err, longtaillib.ENOMEM)
 					continue
 				}
-				if newStoreIndex.IsValid() {
-					storeIndex.Dispose()
-					storeIndex = newStoreIndex
-				}
-				saveStoreIndex = false
 			}
 			flushReplyMessages <- 0
 		case preflightGetMsg := <-preflightGetMessages:
-			storeIndex, saveStoreIndex, err = getStoreIndex(
-				ctx,
-				s,
-				optionalStoreIndexPath,
-				client,
-				accessType,
-				storeIndex,
-				saveStoreIndex,
-				addedBlockIndexes)
+			err = loadStoreIndex()
 			if err != nil {
 				storeIndex.Dispose()
 				preflightGetMsg.asyncCompleteAPI.OnComplete([]uint64{}, longtaillib.ErrorToErrno(err, longtaillib.EIO))
-				storeIndexWorkerReplyErrorState(blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
+				storeIndexWorkerReplyErrorState(err, preflightGetMessages, blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
 				return err
 			}
 			onPreflighMessage(s, storeIndex, preflightGetMsg, prefetchBlockMessages)
@@ -1049,60 +1500,70 @@ func contentIndexWorker(
 				run = false
 			}
 		case getExistingContentMessage := <-getExistingContentMessages:
-			storeIndex, saveStoreIndex, err = getStoreIndex(
-				ctx,
-				s,
-				optionalStoreIndexPath,
-				client,
-				accessType,
-				storeIndex,
-				saveStoreIndex,
-				addedBlockIndexes)
+			err = loadStoreIndex()
 			if err != nil {
 				storeIndex.Dispose()
 				getExistingContentMessage.asyncCompleteAPI.OnComplete(longtaillib.Longtail_StoreIndex{}, longtaillib.ErrorToErrno(err, longtaillib.EIO))
-				storeIndexWorkerReplyErrorState(blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
+				storeIndexWorkerReplyErrorState(err, preflightGetMessages, blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
 				return err
 			}
 			onGetExistingContentMessage(s, storeIndex, getExistingContentMessage)
 		}
 	}
 
+	defer storeIndex.Dispose()
 	if accessType == ReadOnly {
-		storeIndex.Dispose()
 		return nil
 	}
 
-	if len(addedBlockIndexes) > 0 {
-		updatedStoreIndex, err := updateStoreIndex(storeIndex, addedBlockIndexes)
-		if err != nil {
-			return errors.Wrapf(err, "WARNING: Failed to update store index with added blocks")
-		}
-		storeIndex.Dispose()
-		storeIndex = updatedStoreIndex
-		saveStoreIndex = true
-		addedBlockIndexes = nil
-	}
-
-	if saveStoreIndex {
-		newIndex, err := updateRemoteStoreIndex(ctx, client, storeIndex)
-		storeIndex.Dispose()
-		if err != nil {
-			return err
-		}
-		newIndex.Dispose()
+	err = saveChanges()
+	if err != nil {
+		return errors.Wrapf(err, "contentIndexWorker: failed to save store index changes")
 	}
 	return nil
 }
 
+// newMaintenanceRemoteStore returns a remote store without workers, for operations that work directly on the
+// blocks and store index of a store. The caller owns client
+func newMaintenanceRemoteStore(blobStore BlobStore, client BlobClient, workerCount int, retryPolicy RetryPolicy) *remoteStore {
+	s := &remoteStore{
+		blobStore:     blobStore,
+		defaultClient: client,
+		workerCount:   workerCount,
+		retryPolicy:   retryPolicy.withDefaults()}
+	s.isRetryableError = s.retryPolicy.getRetryClassifier(blobStore)
+	s.storeIndexUpdatePolicy = getStoreIndexUpdatePolicy(s.retryPolicy)
+	s.storeIndexDeltaCompactionCount = defaultStoreIndexDeltaCompactionCount
+	return s
+}
+
 // NewRemoteBlockStore ...
+//
+// All requests to the blob store made by the block store use ctx, cancelling it fails any
+// outstanding and following requests
 func NewRemoteBlockStore(
+	ctx context.Context,
 	jobAPI longtaillib.Longtail_JobAPI,
 	blobStore BlobStore,
 	optionalStoreIndexPath string,
 	workerCount int,
-	accessType AccessType) (longtaillib.BlockStoreAPI, error) {
-	ctx := context.Background()
+	accessType AccessType,
+	retryPolicy RetryPolicy) (longtaillib.BlockStoreAPI, error) {
+	return NewRemoteBlockStoreWithStoreIndexDeltas(ctx, jobAPI, blobStore, optionalStoreIndexPath, workerCount, accessType, retryPolicy, defaultStoreIndexDeltaCompactionCount)
+}
+
+// NewRemoteBlockStoreWithStoreIndexDeltas is NewRemoteBlockStore that leaves the added blocks in store index
+// deltas until there are storeIndexDeltaLimit of them. Clients that do not read the deltas do not see
+// the blocks until they are compacted into store.lsi, a storeIndexDeltaLimit of 1 compacts on every flush
+func NewRemoteBlockStoreWithStoreIndexDeltas(
+	ctx context.Context,
+	jobAPI longtaillib.Longtail_JobAPI,
+	blobStore BlobStore,
+	optionalStoreIndexPath string,
+	workerCount int,
+	accessType AccessType,
+	retryPolicy RetryPolicy,
+	storeIndexDeltaLimit int) (longtaillib.BlockStoreAPI, error) {
 	defaultClient, err := blobStore.NewClient(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, blobStore.String())
@@ -1111,7 +1572,14 @@ func NewRemoteBlockStore(
 	s := &remoteStore{
 		jobAPI:        jobAPI,
 		blobStore:     blobStore,
-		defaultClient: defaultClient}
+		defaultClient: defaultClient,
+		retryPolicy:   retryPolicy.withDefaults()}
+	s.isRetryableError = s.retryPolicy.getRetryClassifier(blobStore)
+	s.storeIndexUpdatePolicy = getStoreIndexUpdatePolicy(s.retryPolicy)
+	s.storeIndexDeltaCompactionCount = storeIndexDeltaLimit
+	if s.storeIndexDeltaCompactionCount < 1 {
+		s.storeIndexDeltaCompactionCount = defaultStoreIndexDeltaCompactionCount
+	}
 
 	s.workerCount = workerCount
 	s.putBlockChan = make(chan putBlockMessage, s.workerCount*8)
@@ -1210,20 +1678,27 @@ func (s *remoteStore) Flush(asyncCompleteAPI longtaillib.Longtail_AsyncFlushAPI)
 	return 0
 }
 
-// Close ...
-func (s *remoteStore) Close() {
+// Close stops the workers and saves any store index changes, it returns the first error
+// from the workers, such as a failure to save the store index
+func (s *remoteStore) Close() error {
+	var firstErr error
 	close(s.putBlockChan)
 	for i := 0; i < s.workerCount; i++ {
 		err := <-s.workerErrorChan
-		if err != nil {
-			log.Fatal(err)
+		if err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
 	close(s.blockIndexChan)
 	err := <-s.workerErrorChan
-	if err != nil {
-		log.Fatal(err)
+	if err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	if checksumRetryCount := atomic.LoadUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_ChecksumMismatch_RetryCount]); checksumRetryCount > 0 {
+		log.Printf("Checksum mismatch in %d transfers with store %s\n", checksumRetryCount, s.String())
 	}
 
 	s.defaultClient.Close()
+	return firstErr
 }
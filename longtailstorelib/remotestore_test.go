@@ -4,9 +4,12 @@ import (
 	"context"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
 )
 
 func TestCreateRemoteBlobStore(t *testing.T) {
@@ -14,11 +17,13 @@ func TestCreateRemoteBlobStore(t *testing.T) {
 	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
 	defer jobs.Dispose()
 	remoteStore, err := NewRemoteBlockStore(
+		context.Background(),
 		jobs,
 		blobStore,
 		"",
 		runtime.NumCPU(),
-		ReadOnly)
+		ReadOnly,
+		DefaultRetryPolicy())
 	if err != nil {
 		t.Errorf("TestCreateRemoveBlobStore() NewRemoteBlockStore()) %v != %v", err, nil)
 	}
@@ -77,11 +82,13 @@ func TestEmptyGetExistingContent(t *testing.T) {
 	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
 	defer jobs.Dispose()
 	remoteStore, err := NewRemoteBlockStore(
+		context.Background(),
 		jobs,
 		blobStore,
 		"",
 		runtime.NumCPU(),
-		ReadOnly)
+		ReadOnly,
+		DefaultRetryPolicy())
 	if err != nil {
 		t.Errorf("TestCreateRemoveBlobStore() NewRemoteBlockStore()) %v != %v", err, nil)
 	}
@@ -179,11 +186,13 @@ func TestPutGetStoredBlock(t *testing.T) {
 	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
 	defer jobs.Dispose()
 	remoteStore, err := NewRemoteBlockStore(
+		context.Background(),
 		jobs,
 		blobStore,
 		"",
 		runtime.NumCPU(),
-		ReadWrite)
+		ReadWrite,
+		DefaultRetryPolicy())
 	if err != nil {
 		t.Errorf("TestPutGetStoredBlock() NewRemoteBlockStore()) %v != %v", err, nil)
 	}
@@ -206,17 +215,65 @@ func TestPutGetStoredBlock(t *testing.T) {
 
 	validateBlockFromSeed(t, 0, storedBlockCopy)
 
+	ctx := context.Background()
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	blockObject, _ := client.NewObject(GetBlockPath("chunks", blockHash))
+	attributes, err := blockObject.GetAttributes(ctx)
+	if err != nil {
+		t.Errorf("TestPutGetStoredBlock() blockObject.GetAttributes() %v != %v", err, nil)
+	}
+	if attributes.Metadata[BlockMetadataHashIdentifier] != "997" {
+		t.Errorf("TestPutGetStoredBlock() attributes.Metadata[BlockMetadataHashIdentifier] %s != %s", attributes.Metadata[BlockMetadataHashIdentifier], "997")
+	}
+	if attributes.Metadata[BlockMetadataChunkCount] != "3" {
+		t.Errorf("TestPutGetStoredBlock() attributes.Metadata[BlockMetadataChunkCount] %s != %s", attributes.Metadata[BlockMetadataChunkCount], "3")
+	}
+
 	defer storeAPI.Dispose()
 }
 
-type flushCompletionAPI struct {
-	wg  sync.WaitGroup
-	err int
-}
+func TestGetStoredBlockCancelled(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStore(
+		context.Background(),
+		jobs,
+		blobStore,
+		"",
+		runtime.NumCPU(),
+		ReadWrite,
+		DefaultRetryPolicy())
+	if err != nil {
+		t.Errorf("TestGetStoredBlockCancelled() NewRemoteBlockStore()) %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	blockHash, errno := storeBlockFromSeed(t, storeAPI, 0)
+	if errno != 0 {
+		t.Errorf("TestGetStoredBlockCancelled() storeBlock(t, storeAPI, 0) %d != %d", errno, 0)
+	}
+	storeAPI.Dispose()
 
-func (a *flushCompletionAPI) OnComplete(err int) {
-	a.err = err
-	a.wg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	remoteStore, err = NewRemoteBlockStore(
+		ctx,
+		jobs,
+		blobStore,
+		"",
+		runtime.NumCPU(),
+		ReadOnly,
+		DefaultRetryPolicy())
+	if err != nil {
+		t.Errorf("TestGetStoredBlockCancelled() NewRemoteBlockStore()) %v != %v", err, nil)
+	}
+	storeAPI = longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+	_, errno = fetchBlockFromStore(t, storeAPI, blockHash)
+	if errno == 0 {
+		t.Errorf("TestGetStoredBlockCancelled() fetchBlockFromStore(t, storeAPI, 0) %d == %d", errno, 0)
+	}
 }
 
 func TestGetExistingContent(t *testing.T) {
@@ -224,11 +281,13 @@ func TestGetExistingContent(t *testing.T) {
 	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
 	defer jobs.Dispose()
 	remoteStore, err := NewRemoteBlockStore(
+		context.Background(),
 		jobs,
 		blobStore,
 		"",
 		runtime.NumCPU(),
-		ReadWrite)
+		ReadWrite,
+		DefaultRetryPolicy())
 	if err != nil {
 		t.Errorf("TestPutGetStoredBlock() NewRemoteBlockStore()) %v != %v", err, nil)
 	}
@@ -287,11 +346,13 @@ func TestRestoreStore(t *testing.T) {
 	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
 	defer jobs.Dispose()
 	remoteStore, err := NewRemoteBlockStore(
+		context.Background(),
 		jobs,
 		blobStore,
 		"",
 		runtime.NumCPU(),
-		ReadWrite)
+		ReadWrite,
+		DefaultRetryPolicy())
 	if err != nil {
 		t.Errorf("TestPutGetStoredBlock() NewRemoteBlockStore()) %v != %v", err, nil)
 	}
@@ -313,11 +374,13 @@ func TestRestoreStore(t *testing.T) {
 	storeAPI.Dispose()
 
 	remoteStore, err = NewRemoteBlockStore(
+		context.Background(),
 		jobs,
 		blobStore,
 		"",
 		runtime.NumCPU(),
-		ReadWrite)
+		ReadWrite,
+		DefaultRetryPolicy())
 	if err != nil {
 		t.Errorf("TestPutGetStoredBlock() NewRemoteBlockStore()) %v != %v", err, nil)
 	}
@@ -361,11 +424,13 @@ func TestRestoreStore(t *testing.T) {
 	storeAPI.Dispose()
 
 	remoteStore, err = NewRemoteBlockStore(
+		context.Background(),
 		jobs,
 		blobStore,
 		"",
 		runtime.NumCPU(),
-		ReadWrite)
+		ReadWrite,
+		DefaultRetryPolicy())
 	if err != nil {
 		t.Errorf("TestRestoreStore() NewRemoteBlockStore()) %v != %v", err, nil)
 	}
@@ -419,6 +484,7 @@ func createStoredBlock(chunkCount uint32, hashIdentifier uint32) (longtaillib.Lo
 }
 
 func storeBlock(blobClient BlobClient, storedBlock longtaillib.Longtail_StoredBlock, blockHashOffset uint64, parentPath string) uint64 {
+	ctx := context.Background()
 	bytes, _ := longtaillib.WriteStoredBlockToBuffer(storedBlock)
 	blockIndex := storedBlock.GetBlockIndex()
 	storedBlockHash := blockIndex.GetBlockHash() + blockHashOffset
@@ -427,7 +493,7 @@ func storeBlock(blobClient BlobClient, storedBlock longtaillib.Longtail_StoredBl
 		path = parentPath + "/" + path
 	}
 	blobObject, _ := blobClient.NewObject(path)
-	blobObject.Write(bytes)
+	blobObject.Write(ctx, bytes)
 	return storedBlockHash
 }
 
@@ -453,11 +519,13 @@ func TestBlockScanning(t *testing.T) {
 	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
 	defer jobs.Dispose()
 	remoteStore, err := NewRemoteBlockStore(
+		context.Background(),
 		jobs,
 		blobStore,
 		"",
 		runtime.NumCPU(),
-		Init)
+		Init,
+		DefaultRetryPolicy())
 	if err != nil {
 		t.Errorf("TestPutGetStoredBlock() NewRemoteBlockStore()) %v != %v", err, nil)
 	}
@@ -503,3 +571,516 @@ func TestBlockScanning(t *testing.T) {
 		t.Errorf("TestBlockScanning() getExistingContent(t, storeAPI, chunks, 0) %d!= %d", len(existingContent.GetChunkHashes()), len(goodBlockInCorrectPathIndex.GetChunkHashes()))
 	}
 }
+
+// newFaultInjectionRemoteStore creates a remoteStore without workers on top of a memory store with
+// injected faults so the block and index functions can be called directly
+func newFaultInjectionRemoteStore(t *testing.T, name string, faults FaultInjectionOptions) (*remoteStore, BlobStore) {
+	memStore, _ := NewMemBlobStore(name)
+	blobStore, err := NewFaultInjectionBlobStore(memStore, faults)
+	if err != nil {
+		t.Fatalf("newFaultInjectionRemoteStore() NewFaultInjectionBlobStore() %v != %v", err, nil)
+	}
+	client, _ := blobStore.NewClient(context.Background())
+	s := &remoteStore{
+		blobStore:      blobStore,
+		defaultClient:  client,
+		workerCount:    2,
+		prefetchBlocks: map[uint64]*pendingPrefetchedBlock{},
+		retryPolicy: RetryPolicy{
+			MaxAttempts:       32,
+			InitialBackoff:    time.Millisecond,
+			MaxBackoff:        5 * time.Millisecond,
+			BackoffMultiplier: 2.0}}
+	s.isRetryableError = s.retryPolicy.getRetryClassifier(blobStore)
+	s.storeIndexUpdatePolicy = getStoreIndexUpdatePolicy(s.retryPolicy)
+	s.storeIndexDeltaCompactionCount = defaultStoreIndexDeltaCompactionCount
+	return s, memStore
+}
+
+func getInjectedFaults(s *remoteStore) FaultInjectionStats {
+	return s.blobStore.(FaultInjectionStatsProvider).GetFaultInjectionStats()
+}
+
+func TestPutStoredBlockWithFaults(t *testing.T) {
+	ctx := context.Background()
+	s, memStore := newFaultInjectionRemoteStore(t, "fault_put", FaultInjectionOptions{Seed: 2, ExistsErrorRate: 0.3, WriteErrorRate: 0.5})
+	defer ReleaseMemBlobStore("fault_put")
+	defer s.defaultClient.Close()
+
+	storedBlock, _ := generateStoredBlock(t, 1)
+	defer storedBlock.Dispose()
+	blockIndexMessages := make(chan blockIndexMessage, 1)
+	err := putStoredBlock(ctx, s, s.defaultClient, blockIndexMessages, storedBlock)
+	if err != nil {
+		t.Errorf("TestPutStoredBlockWithFaults() putStoredBlock() %v != %v", err, nil)
+	}
+	if len(blockIndexMessages) != 1 {
+		t.Errorf("TestPutStoredBlockWithFaults() len(blockIndexMessages) %d != %d", len(blockIndexMessages), 1)
+	} else {
+		msg := <-blockIndexMessages
+		msg.blockIndex.Dispose()
+	}
+	faults := getInjectedFaults(s)
+	retryCount := s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_RetryCount]
+	if retryCount != faults.ExistsErrors+faults.WriteErrors {
+		t.Errorf("TestPutStoredBlockWithFaults() PutStoredBlock_RetryCount %d != %d", retryCount, faults.ExistsErrors+faults.WriteErrors)
+	}
+
+	data, err := readTestObject(ctx, memStore, GetBlockPath("chunks", uint64(1)+21412151))
+	if err != nil {
+		t.Errorf("TestPutStoredBlockWithFaults() Read() %v != %v", err, nil)
+	}
+	storedBlockCopy, errno := longtaillib.ReadStoredBlockFromBuffer(data)
+	if errno != 0 {
+		t.Errorf("TestPutStoredBlockWithFaults() longtaillib.ReadStoredBlockFromBuffer() %d != %d", errno, 0)
+	}
+	validateBlockFromSeed(t, 1, storedBlockCopy)
+	storedBlockCopy.Dispose()
+}
+
+func TestPutStoredBlockFailing(t *testing.T) {
+	ctx := context.Background()
+	s, memStore := newFaultInjectionRemoteStore(t, "fault_put_failing", FaultInjectionOptions{WriteErrorRate: 1})
+	defer ReleaseMemBlobStore("fault_put_failing")
+	defer s.defaultClient.Close()
+
+	storedBlock, _ := generateStoredBlock(t, 2)
+	defer storedBlock.Dispose()
+	blockIndexMessages := make(chan blockIndexMessage, 1)
+	err := putStoredBlock(ctx, s, s.defaultClient, blockIndexMessages, storedBlock)
+	if errors.Cause(err) != ErrFaultInjected {
+		t.Errorf("TestPutStoredBlockFailing() putStoredBlock() %v != %v", err, ErrFaultInjected)
+	}
+	if len(blockIndexMessages) != 0 {
+		t.Errorf("TestPutStoredBlockFailing() len(blockIndexMessages) %d != %d", len(blockIndexMessages), 0)
+	}
+	if failCount := s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_FailCount]; failCount != 1 {
+		t.Errorf("TestPutStoredBlockFailing() PutStoredBlock_FailCount %d != %d", failCount, 1)
+	}
+	if faults := getInjectedFaults(s); faults.WriteErrors != uint64(s.retryPolicy.MaxAttempts) {
+		t.Errorf("TestPutStoredBlockFailing() faults.WriteErrors %d != %d", faults.WriteErrors, s.retryPolicy.MaxAttempts)
+	}
+	_, err = readTestObject(ctx, memStore, GetBlockPath("chunks", uint64(2)+21412151))
+	if errors.Cause(err) != longtaillib.ErrENOENT {
+		t.Errorf("TestPutStoredBlockFailing() Read() %v != %v", err, longtaillib.ErrENOENT)
+	}
+}
+
+func TestFetchBlockWithFaults(t *testing.T) {
+	ctx := context.Background()
+	s, memStore := newFaultInjectionRemoteStore(t, "fault_fetch", FaultInjectionOptions{Seed: 2, ExistsErrorRate: 0.3, ReadErrorRate: 0.5})
+	defer ReleaseMemBlobStore("fault_fetch")
+	defer s.defaultClient.Close()
+	memClient, _ := memStore.NewClient(ctx)
+	defer memClient.Close()
+	storedBlock, _ := generateStoredBlock(t, 3)
+	blockHash := storeBlock(memClient, storedBlock, 0, "")
+	storedBlock.Dispose()
+
+	g := &getStoredBlockCompletionAPI{}
+	g.wg.Add(1)
+	fetchBlock(ctx, s, s.defaultClient, getBlockMessage{blockHash: blockHash, asyncCompleteAPI: longtaillib.CreateAsyncGetStoredBlockAPI(g)})
+	g.wg.Wait()
+	if g.err != 0 {
+		t.Errorf("TestFetchBlockWithFaults() fetchBlock() %d != %d", g.err, 0)
+	}
+	validateBlockFromSeed(t, 3, g.storedBlock)
+	g.storedBlock.Dispose()
+	faults := getInjectedFaults(s)
+	retryCount := s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_RetryCount]
+	if retryCount != faults.ExistsErrors+faults.ReadErrors {
+		t.Errorf("TestFetchBlockWithFaults() GetStoredBlock_RetryCount %d != %d", retryCount, faults.ExistsErrors+faults.ReadErrors)
+	}
+	if s.prefetchBlocks[blockHash] != nil {
+		t.Errorf("TestFetchBlockWithFaults() s.prefetchBlocks[blockHash] is still pending")
+	}
+
+	// A fetch that fails after all retries completes with an error
+	s, memStore = newFaultInjectionRemoteStore(t, "fault_fetch", FaultInjectionOptions{ReadErrorRate: 1})
+	defer s.defaultClient.Close()
+	g = &getStoredBlockCompletionAPI{}
+	g.wg.Add(1)
+	fetchBlock(ctx, s, s.defaultClient, getBlockMessage{blockHash: blockHash, asyncCompleteAPI: longtaillib.CreateAsyncGetStoredBlockAPI(g)})
+	g.wg.Wait()
+	if g.err != longtaillib.EIO {
+		t.Errorf("TestFetchBlockWithFaults() fetchBlock() %d != %d", g.err, longtaillib.EIO)
+	}
+	if failCount := s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_FailCount]; failCount != 1 {
+		t.Errorf("TestFetchBlockWithFaults() GetStoredBlock_FailCount %d != %d", failCount, 1)
+	}
+
+	// A corrupted block is either rejected or has the requested hash, the fetch must complete either way
+	s, _ = newFaultInjectionRemoteStore(t, "fault_fetch", FaultInjectionOptions{Seed: 4, CorruptionRate: 1})
+	defer s.defaultClient.Close()
+	g = &getStoredBlockCompletionAPI{}
+	g.wg.Add(1)
+	fetchBlock(ctx, s, s.defaultClient, getBlockMessage{blockHash: blockHash, asyncCompleteAPI: longtaillib.CreateAsyncGetStoredBlockAPI(g)})
+	g.wg.Wait()
+	if g.err == 0 {
+		blockIndex := g.storedBlock.GetBlockIndex()
+		if blockIndex.GetBlockHash() != blockHash {
+			t.Errorf("TestFetchBlockWithFaults() blockIndex.GetBlockHash() %d != %d", blockIndex.GetBlockHash(), blockHash)
+		}
+		g.storedBlock.Dispose()
+	}
+}
+
+func TestPrefetchBlockWithFaults(t *testing.T) {
+	ctx := context.Background()
+	s, memStore := newFaultInjectionRemoteStore(t, "fault_prefetch", FaultInjectionOptions{ReadErrorRate: 1})
+	defer ReleaseMemBlobStore("fault_prefetch")
+	defer s.defaultClient.Close()
+	memClient, _ := memStore.NewClient(ctx)
+	defer memClient.Close()
+	storedBlock, _ := generateStoredBlock(t, 4)
+	blockHash := storeBlock(memClient, storedBlock, 0, "")
+	storedBlock.Dispose()
+
+	// A failed prefetch is forgotten so a later get does not wait for it
+	prefetchBlock(ctx, s, s.defaultClient, prefetchBlockMessage{blockHash: blockHash})
+	if _, exists := s.prefetchBlocks[blockHash]; exists {
+		t.Errorf("TestPrefetchBlockWithFaults() failed prefetch is still in s.prefetchBlocks")
+	}
+	g := &getStoredBlockCompletionAPI{}
+	g.wg.Add(1)
+	fetchBlock(ctx, s, s.defaultClient, getBlockMessage{blockHash: blockHash, asyncCompleteAPI: longtaillib.CreateAsyncGetStoredBlockAPI(g)})
+	g.wg.Wait()
+	if g.err != longtaillib.EIO {
+		t.Errorf("TestPrefetchBlockWithFaults() fetchBlock() %d != %d", g.err, longtaillib.EIO)
+	}
+
+	for _, readErrorRate := range []float64{0, 1} {
+		// The latency keeps the prefetch in flight while the gets are queued on it
+		s, _ := newFaultInjectionRemoteStore(t, "fault_prefetch", FaultInjectionOptions{ReadErrorRate: readErrorRate, Latency: 200 * time.Millisecond})
+		defer s.defaultClient.Close()
+		s.retryPolicy.MaxAttempts = 1
+		prefetchDone := make(chan bool)
+		go func() {
+			prefetchBlock(ctx, s, s.defaultClient, prefetchBlockMessage{blockHash: blockHash})
+			prefetchDone <- true
+		}()
+		time.Sleep(50 * time.Millisecond)
+		waiting := []*getStoredBlockCompletionAPI{{}, {}}
+		for _, g := range waiting {
+			g.wg.Add(1)
+			fetchBlock(ctx, s, s.defaultClient, getBlockMessage{blockHash: blockHash, asyncCompleteAPI: longtaillib.CreateAsyncGetStoredBlockAPI(g)})
+		}
+		<-prefetchDone
+		for i, g := range waiting {
+			g.wg.Wait()
+			if readErrorRate == 0 {
+				if g.err != 0 {
+					t.Errorf("TestPrefetchBlockWithFaults() waiting fetch %d %d != %d", i, g.err, 0)
+					continue
+				}
+				validateBlockFromSeed(t, 4, g.storedBlock)
+				g.storedBlock.Dispose()
+			} else if g.err != longtaillib.EIO {
+				t.Errorf("TestPrefetchBlockWithFaults() waiting fetch %d %d != %d", i, g.err, longtaillib.EIO)
+			}
+		}
+	}
+}
+
+func TestUpdateRemoteStoreIndexWithFaults(t *testing.T) {
+	ctx := context.Background()
+	s, memStore := newFaultInjectionRemoteStore(t, "fault_index", FaultInjectionOptions{Seed: 2, WriteConflictRate: 0.7})
+	defer ReleaseMemBlobStore("fault_index")
+	defer s.defaultClient.Close()
+
+	otherBlock, _ := generateStoredBlock(t, 5)
+	defer otherBlock.Dispose()
+	otherStoreIndex, _ := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{otherBlock.GetBlockIndex()})
+	otherStoreIndexBlob, _ := longtaillib.WriteStoreIndexToBuffer(otherStoreIndex)
+	otherStoreIndex.Dispose()
+	writeTestObject(ctx, memStore, "store.lsi", otherStoreIndexBlob)
+
+	addedBlock, _ := generateStoredBlock(t, 6)
+	defer addedBlock.Dispose()
+	addedStoreIndex, _ := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{addedBlock.GetBlockIndex()})
+	defer addedStoreIndex.Dispose()
+
+	newStoreIndex, err := updateRemoteStoreIndex(ctx, s, s.defaultClient, addedStoreIndex)
+	if err != nil {
+		t.Errorf("TestUpdateRemoteStoreIndexWithFaults() updateRemoteStoreIndex() %v != %v", err, nil)
+	}
+	newStoreIndex.Dispose()
+	if faults := getInjectedFaults(s); faults.WriteConflicts == 0 {
+		t.Errorf("TestUpdateRemoteStoreIndexWithFaults() no write conflicts were injected")
+	}
+	data, _ := readTestObject(ctx, memStore, "store.lsi")
+	storeIndex, errno := longtaillib.ReadStoreIndexFromBuffer(data)
+	if errno != 0 {
+		t.Errorf("TestUpdateRemoteStoreIndexWithFaults() longtaillib.ReadStoreIndexFromBuffer() %d != %d", errno, 0)
+	}
+	defer storeIndex.Dispose()
+	if len(storeIndex.GetBlockHashes()) != 2 {
+		t.Errorf("TestUpdateRemoteStoreIndexWithFaults() len(storeIndex.GetBlockHashes()) %d != %d", len(storeIndex.GetBlockHashes()), 2)
+	}
+
+	// Failing to lock the index is not retried
+	s, _ = newFaultInjectionRemoteStore(t, "fault_index", FaultInjectionOptions{ExistsErrorRate: 1})
+	defer s.defaultClient.Close()
+	_, err = updateRemoteStoreIndex(ctx, s, s.defaultClient, addedStoreIndex)
+	if errors.Cause(err) != ErrFaultInjected {
+		t.Errorf("TestUpdateRemoteStoreIndexWithFaults() updateRemoteStoreIndex() %v != %v", err, ErrFaultInjected)
+	}
+
+	// Losing every race gives up after the attempts of the update policy
+	s, _ = newFaultInjectionRemoteStore(t, "fault_index", FaultInjectionOptions{WriteConflictRate: 1})
+	defer s.defaultClient.Close()
+	_, err = updateRemoteStoreIndex(ctx, s, s.defaultClient, addedStoreIndex)
+	if errors.Cause(err) != ErrStoreIndexContention {
+		t.Errorf("TestUpdateRemoteStoreIndexWithFaults() updateRemoteStoreIndex() %v != %v", err, ErrStoreIndexContention)
+	}
+	if faults := getInjectedFaults(s); faults.WriteConflicts != storeIndexUpdateAttempts {
+		t.Errorf("TestUpdateRemoteStoreIndexWithFaults() faults.WriteConflicts %d != %d", faults.WriteConflicts, storeIndexUpdateAttempts)
+	}
+	if retryCount := s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_UpdateStoreIndex_RetryCount]; retryCount != storeIndexUpdateAttempts-1 {
+		t.Errorf("TestUpdateRemoteStoreIndexWithFaults() UpdateStoreIndex_RetryCount %d != %d", retryCount, storeIndexUpdateAttempts-1)
+	}
+	if failCount := s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_UpdateStoreIndex_FailCount]; failCount != 1 {
+		t.Errorf("TestUpdateRemoteStoreIndexWithFaults() UpdateStoreIndex_FailCount %d != %d", failCount, 1)
+	}
+
+	// A cancelled update stops retrying
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = updateRemoteStoreIndex(cancelCtx, s, s.defaultClient, addedStoreIndex)
+	if errors.Cause(err) != context.Canceled {
+		t.Errorf("TestUpdateRemoteStoreIndexWithFaults() updateRemoteStoreIndex() %v != %v", err, context.Canceled)
+	}
+	if faults := getInjectedFaults(s); faults.WriteConflicts != storeIndexUpdateAttempts {
+		t.Errorf("TestUpdateRemoteStoreIndexWithFaults() faults.WriteConflicts %d != %d", faults.WriteConflicts, storeIndexUpdateAttempts)
+	}
+}
+
+func TestRemoteStoreChecksumMismatchStats(t *testing.T) {
+	s, _ := newFaultInjectionRemoteStore(t, "checksum_stats", FaultInjectionOptions{})
+	defer s.defaultClient.Close()
+
+	s.countChecksumMismatch(errors.Wrap(ErrBlobChecksumMismatch, "chunks/0000/0000000000000000.lsb"))
+	s.countChecksumMismatch(errors.Wrap(ErrFaultInjected, "chunks/0000/0000000000000000.lsb"))
+	stats, errno := s.GetStats()
+	if errno != 0 {
+		t.Errorf("TestRemoteStoreChecksumMismatchStats() GetStats() %d != %d", errno, 0)
+	}
+	if retryCount := stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_ChecksumMismatch_RetryCount]; retryCount != 1 {
+		t.Errorf("TestRemoteStoreChecksumMismatchStats() ChecksumMismatch_RetryCount %d != %d", retryCount, 1)
+	}
+}
+
+func TestBuildStoreIndexWithFaults(t *testing.T) {
+	ctx := context.Background()
+	s, memStore := newFaultInjectionRemoteStore(t, "fault_scan", FaultInjectionOptions{Seed: 7, ExistsErrorRate: 0.2, ReadErrorRate: 0.3})
+	defer ReleaseMemBlobStore("fault_scan")
+	defer s.defaultClient.Close()
+	memClient, _ := memStore.NewClient(ctx)
+	defer memClient.Close()
+	for seed := uint8(7); seed < 10; seed++ {
+		storedBlock, _ := generateStoredBlock(t, seed)
+		storeBlock(memClient, storedBlock, 0, "")
+		storedBlock.Dispose()
+	}
+
+	storeIndex, err := buildStoreIndexFromStoreBlocks(ctx, s, s.defaultClient)
+	if err != nil {
+		t.Errorf("TestBuildStoreIndexWithFaults() buildStoreIndexFromStoreBlocks() %v != %v", err, nil)
+	}
+	if len(storeIndex.GetBlockHashes()) != 3 {
+		t.Errorf("TestBuildStoreIndexWithFaults() len(storeIndex.GetBlockHashes()) %d != %d", len(storeIndex.GetBlockHashes()), 3)
+	}
+	storeIndex.Dispose()
+
+	// Blocks that can not be read must fail the scan rather than be left out of the index
+	for _, faults := range []FaultInjectionOptions{{ReadErrorRate: 1}, {ListErrorRate: 1}} {
+		s, _ := newFaultInjectionRemoteStore(t, "fault_scan", faults)
+		defer s.defaultClient.Close()
+		_, err := buildStoreIndexFromStoreBlocks(ctx, s, s.defaultClient)
+		if errors.Cause(err) != ErrFaultInjected {
+			t.Errorf("TestBuildStoreIndexWithFaults() buildStoreIndexFromStoreBlocks() %v != %v", err, ErrFaultInjected)
+		}
+	}
+}
+
+func TestStoreIndexDeltas(t *testing.T) {
+	ctx := context.Background()
+	s, memStore := newFaultInjectionRemoteStore(t, "store_index_deltas", FaultInjectionOptions{})
+	defer ReleaseMemBlobStore("store_index_deltas")
+	defer s.defaultClient.Close()
+
+	// addBlocksToStoreIndex takes ownership of the block indexes
+	addBlock := func(seed uint8) longtaillib.Longtail_StoreIndex {
+		addedBlock, _ := generateStoredBlock(t, seed)
+		defer addedBlock.Dispose()
+		blockIndex := addedBlock.GetBlockIndex()
+		blockIndexCopy, err := blockIndex.Copy()
+		if err != nil {
+			t.Fatalf("TestStoreIndexDeltas() blockIndex.Copy() %v != %v", err, nil)
+		}
+		storeIndex, deltaStoreIndex, err := addBlocksToStoreIndex(longtaillib.Longtail_StoreIndex{}, longtaillib.Longtail_StoreIndex{}, []longtaillib.Longtail_BlockIndex{blockIndexCopy})
+		if err != nil || storeIndex.IsValid() {
+			t.Errorf("TestStoreIndexDeltas() addBlocksToStoreIndex() %t, %v != %t, %v", storeIndex.IsValid(), err, false, nil)
+		}
+		return deltaStoreIndex
+	}
+
+	_, err := readStoreStoreIndex(ctx, s, s.defaultClient)
+	if errors.Cause(err) != longtaillib.ErrENOENT {
+		t.Errorf("TestStoreIndexDeltas() readStoreStoreIndex() %v != %v", err, longtaillib.ErrENOENT)
+	}
+
+	baseBlock, _ := generateStoredBlock(t, 11)
+	defer baseBlock.Dispose()
+	baseStoreIndex, _ := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{baseBlock.GetBlockIndex()})
+	baseStoreIndexBlob, _ := longtaillib.WriteStoreIndexToBuffer(baseStoreIndex)
+	baseStoreIndex.Dispose()
+	writeTestObject(ctx, memStore, "store.lsi", baseStoreIndexBlob)
+
+	// Each writer adds its blocks as a separate delta
+	s.storeIndexDeltaCompactionCount = 3
+	for seed := uint8(12); seed < 14; seed++ {
+		deltaStoreIndex := addBlock(seed)
+		newStoreIndex, err := saveStoreIndexChanges(ctx, s, s.defaultClient, longtaillib.Longtail_StoreIndex{}, deltaStoreIndex, false)
+		deltaStoreIndex.Dispose()
+		if err != nil || newStoreIndex.IsValid() {
+			t.Errorf("TestStoreIndexDeltas() saveStoreIndexChanges() %t, %v != %t, %v", newStoreIndex.IsValid(), err, false, nil)
+		}
+	}
+	deltaKeys, _ := listStoreIndexDeltas(ctx, s, s.defaultClient)
+	if len(deltaKeys) != 2 {
+		t.Errorf("TestStoreIndexDeltas() len(deltaKeys) %d != %d", len(deltaKeys), 2)
+	}
+	data, _ := readTestObject(ctx, memStore, "store.lsi")
+	if string(data) != string(baseStoreIndexBlob) {
+		t.Errorf("TestStoreIndexDeltas() store.lsi was changed when writing deltas")
+	}
+	storeIndex, err := readStoreStoreIndex(ctx, s, s.defaultClient)
+	if err != nil {
+		t.Errorf("TestStoreIndexDeltas() readStoreStoreIndex() %v != %v", err, nil)
+	}
+	if storeIndex.GetBlockCount() != 3 {
+		t.Errorf("TestStoreIndexDeltas() storeIndex.GetBlockCount() %d != %d", storeIndex.GetBlockCount(), 3)
+	}
+	storeIndex.Dispose()
+
+	// Reaching the compaction count merges the deltas into store.lsi
+	deltaStoreIndex := addBlock(14)
+	_, err = saveStoreIndexChanges(ctx, s, s.defaultClient, longtaillib.Longtail_StoreIndex{}, deltaStoreIndex, false)
+	deltaStoreIndex.Dispose()
+	if err != nil {
+		t.Errorf("TestStoreIndexDeltas() saveStoreIndexChanges() %v != %v", err, nil)
+	}
+	deltaKeys, _ = listStoreIndexDeltas(ctx, s, s.defaultClient)
+	if len(deltaKeys) != 0 {
+		t.Errorf("TestStoreIndexDeltas() len(deltaKeys) %d != %d", len(deltaKeys), 0)
+	}
+
+	// A store with only store.lsi is read as before
+	data, _ = readTestObject(ctx, memStore, "store.lsi")
+	storeIndex, errno := longtaillib.ReadStoreIndexFromBuffer(data)
+	if errno != 0 {
+		t.Errorf("TestStoreIndexDeltas() longtaillib.ReadStoreIndexFromBuffer() %d != %d", errno, 0)
+	}
+	if storeIndex.GetBlockCount() != 4 {
+		t.Errorf("TestStoreIndexDeltas() storeIndex.GetBlockCount() %d != %d", storeIndex.GetBlockCount(), 4)
+	}
+	storeIndex.Dispose()
+	storeIndex, err = readStoreStoreIndex(ctx, s, s.defaultClient)
+	if err != nil || storeIndex.GetBlockCount() != 4 {
+		t.Errorf("TestStoreIndexDeltas() readStoreStoreIndex() %d, %v != %d, %v", storeIndex.GetBlockCount(), err, 4, nil)
+	}
+	storeIndex.Dispose()
+
+	// By default every delta is compacted so clients that only read store.lsi see the added blocks
+	s.storeIndexDeltaCompactionCount = defaultStoreIndexDeltaCompactionCount
+	deltaStoreIndex = addBlock(15)
+	_, err = saveStoreIndexChanges(ctx, s, s.defaultClient, longtaillib.Longtail_StoreIndex{}, deltaStoreIndex, false)
+	deltaStoreIndex.Dispose()
+	if err != nil {
+		t.Errorf("TestStoreIndexDeltas() saveStoreIndexChanges() %v != %v", err, nil)
+	}
+	deltaKeys, _ = listStoreIndexDeltas(ctx, s, s.defaultClient)
+	if len(deltaKeys) != 0 {
+		t.Errorf("TestStoreIndexDeltas() len(deltaKeys) %d != %d", len(deltaKeys), 0)
+	}
+	data, _ = readTestObject(ctx, memStore, "store.lsi")
+	storeIndex, errno = longtaillib.ReadStoreIndexFromBuffer(data)
+	if errno != 0 || storeIndex.GetBlockCount() != 5 {
+		t.Errorf("TestStoreIndexDeltas() longtaillib.ReadStoreIndexFromBuffer() %d, %d != %d, %d", storeIndex.GetBlockCount(), errno, 5, 0)
+	}
+	storeIndex.Dispose()
+}
+
+func TestCloseFailedStoreIndexSave(t *testing.T) {
+	memStore, _ := NewMemBlobStore("close_failed_save")
+	defer ReleaseMemBlobStore("close_failed_save")
+	blobStore, _ := NewFaultInjectionBlobStore(memStore, FaultInjectionOptions{})
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStore(context.Background(), jobs, blobStore, "", 2, ReadWrite, RetryPolicy{MaxAttempts: 1})
+	if err != nil {
+		t.Errorf("TestCloseFailedStoreIndexSave() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+	_, errno := storeBlockFromSeed(t, storeAPI, 0)
+	if errno != 0 {
+		t.Errorf("TestCloseFailedStoreIndexSave() storeBlockFromSeed() %d != %d", errno, 0)
+	}
+
+	// The added block is saved to the store index when the store is closed
+	blobStore.(*faultInjectionBlobStore).options.WriteErrorRate = 1
+	err = storeAPI.Close()
+	if errors.Cause(err) != ErrFaultInjected {
+		t.Errorf("TestCloseFailedStoreIndexSave() Close() %v != %v", err, ErrFaultInjected)
+	}
+}
+
+// failingClientBlobStore fails to create any client after the first one
+type failingClientBlobStore struct {
+	BlobStore
+	clientCount int32
+}
+
+func (s *failingClientBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
+	if atomic.AddInt32(&s.clientCount, 1) > 1 {
+		return nil, longtaillib.ErrEIO
+	}
+	return s.BlobStore.NewClient(ctx)
+}
+
+func TestCloseFailedWorkers(t *testing.T) {
+	memStore, _ := NewMemBlobStore("close_failed_workers")
+	defer ReleaseMemBlobStore("close_failed_workers")
+	blobStore := &failingClientBlobStore{BlobStore: memStore}
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStore(context.Background(), jobs, blobStore, "", 2, ReadWrite, DefaultRetryPolicy())
+	if err != nil {
+		t.Errorf("TestCloseFailedWorkers() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+
+	// Requests to workers without a client complete with an error instead of waiting forever
+	_, errno := storeBlockFromSeed(t, storeAPI, 0)
+	if errno != longtaillib.EIO {
+		t.Errorf("TestCloseFailedWorkers() storeBlockFromSeed() %d != %d", errno, longtaillib.EIO)
+	}
+	_, errno = fetchBlockFromStore(t, storeAPI, 1)
+	if errno != longtaillib.EIO {
+		t.Errorf("TestCloseFailedWorkers() fetchBlockFromStore() %d != %d", errno, longtaillib.EIO)
+	}
+	_, errno = getExistingContent(t, storeAPI, []uint64{1}, 0)
+	if errno != longtaillib.EIO {
+		t.Errorf("TestCloseFailedWorkers() getExistingContent() %d != %d", errno, longtaillib.EIO)
+	}
+	if errno = flushBlockStore(storeAPI); errno != longtaillib.EIO {
+		t.Errorf("TestCloseFailedWorkers() flushBlockStore() %d != %d", errno, longtaillib.EIO)
+	}
+	err = storeAPI.Close()
+	if errors.Cause(err) != longtaillib.ErrEIO {
+		t.Errorf("TestCloseFailedWorkers() Close() %v != %v", err, longtaillib.ErrEIO)
+	}
+}
@@ -0,0 +1,405 @@
+package longtailstorelib
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// RepackOptions controls RepackStore
+type RepackOptions struct {
+	// MinBlockUsagePercent is the share of a block, in bytes, that must be used by the retained
+	// versions for the block to be kept as is
+	MinBlockUsagePercent uint32
+	// TargetBlockSize and MaxChunksPerBlock limit the size of the new blocks
+	TargetBlockSize   uint32
+	MaxChunksPerBlock uint32
+	// RetireOldBlocks deletes the repacked blocks once the store index no longer uses them
+	RetireOldBlocks bool
+	// DryRun reports what would be repacked without changing the store
+	DryRun      bool
+	WorkerCount int
+	RetryPolicy RetryPolicy
+}
+
+// RepackResult tells what RepackStore found in the store and what it rewrote
+type RepackResult struct {
+	// ReferencedBlockCount is the number of blocks needed by the retained versions
+	ReferencedBlockCount int
+	// SparseBlockCount and SparseByteCount are the referenced blocks below the usage threshold
+	// and the size of their chunks
+	SparseBlockCount int
+	SparseByteCount  int64
+	// LiveByteCount is the size of the chunks in the sparse blocks used by the retained versions
+	LiveByteCount int64
+	// NewBlockCount is the number of blocks the live chunks were written to
+	NewBlockCount int
+	// RetiredBlockCount is the number of sparse blocks that were deleted
+	RetiredBlockCount int
+}
+
+type flushCompletionAPI struct {
+	wg  sync.WaitGroup
+	err int
+}
+
+func (a *flushCompletionAPI) OnComplete(err int) {
+	a.err = err
+	a.wg.Done()
+}
+
+// flushBlockStore flushes blockStore and waits for it to complete
+func flushBlockStore(blockStore longtaillib.Longtail_BlockStoreAPI) int {
+	flushComplete := &flushCompletionAPI{}
+	flushComplete.wg.Add(1)
+	errno := blockStore.Flush(longtaillib.CreateAsyncFlushAPI(flushComplete))
+	if errno != 0 {
+		flushComplete.wg.Done()
+		return errno
+	}
+	flushComplete.wg.Wait()
+	return flushComplete.err
+}
+
+// readVersionIndexes reads the version indexes in versionIndexURIs
+func readVersionIndexes(ctx context.Context, versionIndexURIs []string) ([]longtaillib.Longtail_VersionIndex, error) {
+	versionIndexes := make([]longtaillib.Longtail_VersionIndex, 0, len(versionIndexURIs))
+	for _, uri := range versionIndexURIs {
+		vbuffer, err := ReadFromURI(ctx, uri)
+		if err == nil {
+			versionIndex, errno := longtaillib.ReadVersionIndexFromBuffer(vbuffer)
+			if errno == 0 {
+				versionIndexes = append(versionIndexes, versionIndex)
+				continue
+			}
+			err = errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "longtaillib.ReadVersionIndexFromBuffer() failed for %s", uri)
+		} else {
+			err = errors.Wrapf(err, "failed reading version index %s", uri)
+		}
+		for _, versionIndex := range versionIndexes {
+			versionIndex.Dispose()
+		}
+		return nil, err
+	}
+	return versionIndexes, nil
+}
+
+// getBlockUsage returns the size of the chunks of each block in storeIndex and how much of it is
+// used by requiredChunkHashes
+func getBlockUsage(storeIndex longtaillib.Longtail_StoreIndex, requiredChunkHashes []uint64) (map[uint64]int64, map[uint64]int64) {
+	required := make(map[uint64]bool, len(requiredChunkHashes))
+	for _, chunkHash := range requiredChunkHashes {
+		required[chunkHash] = true
+	}
+	chunkHashes := storeIndex.GetChunkHashes()
+	chunkSizes := storeIndex.GetChunkSizes()
+	chunksOffsets := storeIndex.GetBlockChunksOffsets()
+	chunkCounts := storeIndex.GetBlockChunkCounts()
+	blockSizes := map[uint64]int64{}
+	liveSizes := map[uint64]int64{}
+	for b, blockHash := range storeIndex.GetBlockHashes() {
+		for c := chunksOffsets[b]; c < chunksOffsets[b]+chunkCounts[b]; c++ {
+			blockSizes[blockHash] += int64(chunkSizes[c])
+			if required[chunkHashes[c]] {
+				liveSizes[blockHash] += int64(chunkSizes[c])
+			}
+		}
+	}
+	return blockSizes, liveSizes
+}
+
+// excludeStoreIndexBlocks returns a store index with the blocks of storeIndex that are not in
+// excludedBlocks. A chunk that is also in an excluded block can make that block stay
+func excludeStoreIndexBlocks(storeIndex longtaillib.Longtail_StoreIndex, excludedBlocks map[uint64]bool) (longtaillib.Longtail_StoreIndex, error) {
+	chunkHashes := storeIndex.GetChunkHashes()
+	chunksOffsets := storeIndex.GetBlockChunksOffsets()
+	chunkCounts := storeIndex.GetBlockChunkCounts()
+	keptChunkHashes := []uint64{}
+	for b, blockHash := range storeIndex.GetBlockHashes() {
+		if excludedBlocks[blockHash] {
+			continue
+		}
+		keptChunkHashes = append(keptChunkHashes, chunkHashes[chunksOffsets[b]:chunksOffsets[b]+chunkCounts[b]]...)
+	}
+	keptStoreIndex, errno := longtaillib.GetExistingStoreIndex(storeIndex, keptChunkHashes, 0)
+	if errno != 0 {
+		return longtaillib.Longtail_StoreIndex{}, errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "longtaillib.GetExistingStoreIndex() failed")
+	}
+	return keptStoreIndex, nil
+}
+
+// writeRepackedBlocks writes the chunks of versionIndexes that are not in keptStoreIndex to new
+// blocks, reading them from the blocks in sourceStoreIndex. It returns the number of new blocks
+func writeRepackedBlocks(
+	ctx context.Context,
+	jobAPI longtaillib.Longtail_JobAPI,
+	blobStore BlobStore,
+	sourceStoreIndex longtaillib.Longtail_StoreIndex,
+	keptStoreIndex longtaillib.Longtail_StoreIndex,
+	versionIndexes []longtaillib.Longtail_VersionIndex,
+	options RepackOptions) (newBlockCount int, err error) {
+	workerCount := options.WorkerCount
+	if workerCount < 1 {
+		workerCount = 1
+	}
+	remoteStore, err := NewRemoteBlockStore(ctx, jobAPI, blobStore, "", workerCount, ReadWrite, options.RetryPolicy)
+	if err != nil {
+		return 0, err
+	}
+	// The new blocks are added to the store index as a delta when the store is flushed
+	remoteBlockStore := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer func() {
+		closeErr := remoteBlockStore.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	compressionRegistry := longtaillib.CreateFullCompressionRegistry()
+	defer compressionRegistry.Dispose()
+	blockStore := longtaillib.CreateCompressBlockStore(remoteBlockStore, compressionRegistry)
+	defer blockStore.Dispose()
+	hashRegistry := longtaillib.CreateFullHashRegistry()
+	defer hashRegistry.Dispose()
+
+	repackedStoreIndex, err := keptStoreIndex.Copy()
+	if err != nil {
+		return 0, err
+	}
+	for _, versionIndex := range versionIndexes {
+		hashAPI, errno := hashRegistry.GetHashAPI(versionIndex.GetHashIdentifier())
+		if errno != 0 {
+			err = errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "hashRegistry.GetHashAPI(%d) failed", versionIndex.GetHashIdentifier())
+			break
+		}
+		missingStoreIndex, errno := longtaillib.CreateMissingContent(hashAPI, repackedStoreIndex, versionIndex, options.TargetBlockSize, options.MaxChunksPerBlock)
+		if errno != 0 {
+			err = errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "longtaillib.CreateMissingContent() failed")
+			break
+		}
+		if missingStoreIndex.GetBlockCount() > 0 {
+			// The version is read from the old blocks and its missing chunks written to new blocks
+			sourceStorage := longtaillib.CreateBlockStoreStorageAPI(hashAPI, jobAPI, blockStore, sourceStoreIndex, versionIndex)
+			errno = longtaillib.WriteContent(sourceStorage, blockStore, jobAPI, nil, missingStoreIndex, versionIndex, "")
+			sourceStorage.Dispose()
+			if errno != 0 {
+				missingStoreIndex.Dispose()
+				err = errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "longtaillib.WriteContent() failed")
+				break
+			}
+		}
+		newBlockCount += int(missingStoreIndex.GetBlockCount())
+		// Later versions reuse the new blocks
+		err = mergeIntoStoreIndex(&repackedStoreIndex, missingStoreIndex)
+		missingStoreIndex.Dispose()
+		if err != nil {
+			break
+		}
+	}
+	repackedStoreIndex.Dispose()
+	if err == nil {
+		if errno := flushBlockStore(blockStore); errno != 0 {
+			err = errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "blockStore.Flush() failed")
+		}
+	}
+	return newBlockCount, err
+}
+
+// removeBlocksFromStoreIndex replaces the store index with one without the blocks in removedBlocks,
+// using a conditional write that fails with ErrStoreIndexContention if the store index changes
+// meanwhile. It returns the removed blocks that are still in the store index, either because they share
+// chunks with other blocks or because another writer added them back, those blocks must not be deleted
+func removeBlocksFromStoreIndex(
+	ctx context.Context,
+	s *remoteStore,
+	client BlobClient,
+	removedBlocks map[uint64]bool) (map[uint64]bool, error) {
+	objHandle, err := client.NewObject(storeIndexKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "client.NewObject(%s) failed", storeIndexKey)
+	}
+	exists, err := objHandle.LockWriteVersion(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "objHandle.LockWriteVersion(%s) failed", storeIndexKey)
+	}
+	if !exists {
+		return nil, errors.Wrapf(longtaillib.ErrENOENT, "%s has no store index", s.String())
+	}
+	deltaKeys, err := listStoreIndexDeltas(ctx, s, client)
+	if err != nil {
+		return nil, err
+	}
+	storeIndex, err := readStoreIndexObject(ctx, s, client, storeIndexKey)
+	if err != nil {
+		return nil, err
+	}
+	_, err = readStoreIndexDeltas(ctx, s, client, &storeIndex, deltaKeys)
+	if err != nil {
+		storeIndex.Dispose()
+		return nil, err
+	}
+	updatedStoreIndex, err := excludeStoreIndexBlocks(storeIndex, removedBlocks)
+	storeIndex.Dispose()
+	if err != nil {
+		return nil, err
+	}
+	remainingBlocks := map[uint64]bool{}
+	for _, blockHash := range updatedStoreIndex.GetBlockHashes() {
+		if removedBlocks[blockHash] {
+			remainingBlocks[blockHash] = true
+		}
+	}
+	blob, errno := longtaillib.WriteStoreIndexToBuffer(updatedStoreIndex)
+	updatedStoreIndex.Dispose()
+	if errno != 0 {
+		return nil, errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "longtaillib.WriteStoreIndexToBuffer() failed")
+	}
+	ok, err := objHandle.Write(ctx, blob)
+	if err != nil {
+		return nil, errors.Wrapf(err, "objHandle.Write(%s) failed", storeIndexKey)
+	}
+	if !ok {
+		return nil, errors.Wrapf(ErrStoreIndexContention, "%s was changed by another writer", storeIndexKey)
+	}
+	err = deleteMergedStoreIndexDeltas(ctx, s, deltaKeys, s.workerCount)
+	if err != nil {
+		return nil, err
+	}
+	removedKeys := []string{}
+	for blockHash := range removedBlocks {
+		if !remainingBlocks[blockHash] {
+			removedKeys = append(removedKeys, GetBlockPath("chunks", blockHash))
+		}
+	}
+	unindexedKeys, err := excludeIndexedBlockKeys(ctx, s, client, removedKeys)
+	if err != nil {
+		return nil, err
+	}
+	unindexedBlocks := map[uint64]bool{}
+	for _, key := range unindexedKeys {
+		blockHash, _ := parseBlockPath(key)
+		unindexedBlocks[blockHash] = true
+	}
+	for blockHash := range removedBlocks {
+		if !unindexedBlocks[blockHash] {
+			remainingBlocks[blockHash] = true
+		}
+	}
+	return remainingBlocks, nil
+}
+
+// RepackStore rewrites the chunks used by the versions in versionIndexURIs that are in blocks below
+// options.MinBlockUsagePercent into new dense blocks and writes a store index that uses the new blocks
+// instead of the sparse ones. Blocks that are not used by the versions are left to PruneStore.
+//
+// The new blocks are added like an upload adds blocks and the store index is replaced with a
+// conditional write, RepackStore fails with ErrStoreIndexContention if it was changed meanwhile. An
+// upload that started before the store index was written can still reuse a sparse block, so only
+// use options.RetireOldBlocks when no uploads are running
+func RepackStore(
+	ctx context.Context,
+	jobAPI longtaillib.Longtail_JobAPI,
+	blobStore BlobStore,
+	versionIndexURIs []string,
+	options RepackOptions) (RepackResult, error) {
+	versionIndexes, err := readVersionIndexes(ctx, versionIndexURIs)
+	if err != nil {
+		return RepackResult{}, errors.Wrap(err, "RepackStore")
+	}
+	defer func() {
+		for _, versionIndex := range versionIndexes {
+			versionIndex.Dispose()
+		}
+	}()
+	return repackStoreBlocks(ctx, jobAPI, blobStore, versionIndexes, options)
+}
+
+// repackStoreBlocks repacks the sparse blocks used by versionIndexes, see RepackStore
+func repackStoreBlocks(
+	ctx context.Context,
+	jobAPI longtaillib.Longtail_JobAPI,
+	blobStore BlobStore,
+	versionIndexes []longtaillib.Longtail_VersionIndex,
+	options RepackOptions) (RepackResult, error) {
+	result := RepackResult{}
+	blobStore = requireAllMirrors(blobStore)
+	client, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return result, errors.Wrap(err, blobStore.String())
+	}
+	defer client.Close()
+	s := newMaintenanceRemoteStore(blobStore, client, options.WorkerCount, options.RetryPolicy)
+
+	chunkHashSet := map[uint64]bool{}
+	for _, versionIndex := range versionIndexes {
+		for _, chunkHash := range versionIndex.GetChunkHashes() {
+			chunkHashSet[chunkHash] = true
+		}
+	}
+	requiredChunkHashes := make([]uint64, 0, len(chunkHashSet))
+	for chunkHash := range chunkHashSet {
+		requiredChunkHashes = append(requiredChunkHashes, chunkHash)
+	}
+
+	storeIndex, err := readStoreStoreIndex(ctx, s, client)
+	if err != nil {
+		return result, errors.Wrap(err, "RepackStore")
+	}
+	defer storeIndex.Dispose()
+	referencedStoreIndex, err := createPrunedStoreIndex(storeIndex, requiredChunkHashes, nil)
+	if err != nil {
+		return result, errors.Wrap(err, "RepackStore")
+	}
+	defer referencedStoreIndex.Dispose()
+
+	blockSizes, liveSizes := getBlockUsage(referencedStoreIndex, requiredChunkHashes)
+	sparseBlocks := map[uint64]bool{}
+	for blockHash, blockSize := range blockSizes {
+		if liveSizes[blockHash]*100 < blockSize*int64(options.MinBlockUsagePercent) {
+			sparseBlocks[blockHash] = true
+			result.SparseByteCount += blockSize
+			result.LiveByteCount += liveSizes[blockHash]
+		}
+	}
+	result.ReferencedBlockCount = len(blockSizes)
+	result.SparseBlockCount = len(sparseBlocks)
+	if options.DryRun || len(sparseBlocks) == 0 {
+		return result, nil
+	}
+
+	keptStoreIndex, err := excludeStoreIndexBlocks(referencedStoreIndex, sparseBlocks)
+	if err != nil {
+		return result, errors.Wrap(err, "RepackStore")
+	}
+	result.NewBlockCount, err = writeRepackedBlocks(ctx, jobAPI, blobStore, referencedStoreIndex, keptStoreIndex, versionIndexes, options)
+	keptStoreIndex.Dispose()
+	if err != nil {
+		return result, errors.Wrap(err, "RepackStore")
+	}
+
+	// The store index is read again, it now has the new blocks and any blocks uploaded meanwhile
+	indexedBlocks, err := removeBlocksFromStoreIndex(ctx, s, client, sparseBlocks)
+	if errors.Cause(err) == ErrStoreIndexContention {
+		return result, errors.Wrap(err, "RepackStore: the new blocks are kept but the sparse blocks are still used")
+	}
+	if err != nil {
+		return result, errors.Wrap(err, "RepackStore")
+	}
+	retiredBlocks := []string{}
+	for blockHash := range sparseBlocks {
+		if !indexedBlocks[blockHash] {
+			retiredBlocks = append(retiredBlocks, GetBlockPath("chunks", blockHash))
+		}
+	}
+
+	if options.RetireOldBlocks {
+		result.RetiredBlockCount, err = deleteBlobs(ctx, s, retiredBlocks, options.WorkerCount)
+		if err != nil {
+			return result, errors.Wrapf(err, "RepackStore: retired %d of %d repacked blocks", result.RetiredBlockCount, len(retiredBlocks))
+		}
+	}
+	log.Printf("Repacked %d blocks into %d blocks in %s\n", result.SparseBlockCount, result.NewBlockCount, s.String())
+	return result, nil
+}
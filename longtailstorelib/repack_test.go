@@ -0,0 +1,124 @@
+package longtailstorelib
+
+import (
+	"context"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+// uploadTestVersion writes files to blobStore like an upsync and returns the version index
+func uploadTestVersion(t *testing.T, jobs longtaillib.Longtail_JobAPI, blobStore BlobStore, files map[string][]byte) longtaillib.Longtail_VersionIndex {
+	storageAPI := longtaillib.CreateInMemStorageAPI()
+	defer storageAPI.Dispose()
+	for path, data := range files {
+		storageAPI.WriteToStorage("content", path, data)
+	}
+	fileInfos, errno := longtaillib.GetFilesRecursively(storageAPI, longtaillib.Longtail_PathFilterAPI{}, "content")
+	if errno != 0 {
+		t.Errorf("uploadTestVersion() GetFilesRecursively() %d != %d", errno, 0)
+	}
+	defer fileInfos.Dispose()
+	hashAPI := longtaillib.CreateBlake3HashAPI()
+	defer hashAPI.Dispose()
+	chunkerAPI := longtaillib.CreateHPCDCChunkerAPI()
+	defer chunkerAPI.Dispose()
+	versionIndex, errno := longtaillib.CreateVersionIndex(
+		storageAPI,
+		hashAPI,
+		chunkerAPI,
+		jobs,
+		nil,
+		"content",
+		fileInfos,
+		make([]uint32, fileInfos.GetFileCount()),
+		32768)
+	if errno != 0 {
+		t.Errorf("uploadTestVersion() CreateVersionIndex() %d != %d", errno, 0)
+	}
+
+	remoteStore, _ := NewRemoteBlockStore(context.Background(), jobs, blobStore, "", runtime.NumCPU(), ReadWrite, DefaultRetryPolicy())
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+	existingStoreIndex, errno := getExistingContent(t, storeAPI, versionIndex.GetChunkHashes(), 0)
+	if errno != 0 {
+		t.Errorf("uploadTestVersion() getExistingContent() %d != %d", errno, 0)
+	}
+	defer existingStoreIndex.Dispose()
+	missingStoreIndex, errno := longtaillib.CreateMissingContent(hashAPI, existingStoreIndex, versionIndex, 8388608, 1024)
+	if errno != 0 {
+		t.Errorf("uploadTestVersion() CreateMissingContent() %d != %d", errno, 0)
+	}
+	defer missingStoreIndex.Dispose()
+	errno = longtaillib.WriteContent(storageAPI, storeAPI, jobs, nil, missingStoreIndex, versionIndex, "content")
+	if errno != 0 {
+		t.Errorf("uploadTestVersion() WriteContent() %d != %d", errno, 0)
+	}
+	if errno = flushBlockStore(storeAPI); errno != 0 {
+		t.Errorf("uploadTestVersion() flushBlockStore() %d != %d", errno, 0)
+	}
+	return versionIndex
+}
+
+func TestRepackStore(t *testing.T) {
+	ctx := context.Background()
+	memStore, _ := NewMemBlobStore("repack")
+	defer ReleaseMemBlobStore("repack")
+	client, _ := memStore.NewClient(ctx)
+	defer client.Close()
+	s := newMaintenanceRemoteStore(memStore, client, 2, DefaultRetryPolicy())
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+
+	small := make([]byte, 16384)
+	rand.Read(small)
+	large := make([]byte, 262144)
+	rand.Read(large)
+	// Both files end up in one block, the retained version only uses the small one
+	oldVersionIndex := uploadTestVersion(t, jobs, memStore, map[string][]byte{"small.bin": small, "large.bin": large})
+	oldVersionIndex.Dispose()
+	versionIndex := uploadTestVersion(t, jobs, memStore, map[string][]byte{"small.bin": small})
+	defer versionIndex.Dispose()
+	versionIndexes := []longtaillib.Longtail_VersionIndex{versionIndex}
+
+	result, err := repackStoreBlocks(ctx, jobs, memStore, versionIndexes, RepackOptions{MinBlockUsagePercent: 50, DryRun: true})
+	if err != nil {
+		t.Errorf("TestRepackStore() repackStoreBlocks() %v != %v", err, nil)
+	}
+	if result.ReferencedBlockCount != 1 || result.SparseBlockCount != 1 || result.LiveByteCount != int64(len(small)) || result.NewBlockCount != 0 {
+		t.Errorf("TestRepackStore() repackStoreBlocks() dry run %+v", result)
+	}
+
+	result, err = repackStoreBlocks(ctx, jobs, memStore, versionIndexes, RepackOptions{
+		MinBlockUsagePercent: 50,
+		TargetBlockSize:      8388608,
+		MaxChunksPerBlock:    1024,
+		RetireOldBlocks:      true,
+		WorkerCount:          2,
+		RetryPolicy:          DefaultRetryPolicy()})
+	if err != nil || result.SparseBlockCount != 1 || result.NewBlockCount != 1 || result.RetiredBlockCount != 1 {
+		t.Errorf("TestRepackStore() repackStoreBlocks() %+v, %v", result, err)
+	}
+	if blocks, _ := listStoreBlocks(ctx, s, client); len(blocks) != 1 {
+		t.Errorf("TestRepackStore() len(blocks) %d != %d", len(blocks), 1)
+	}
+	storeIndex, err := readStoreStoreIndex(ctx, s, client)
+	if err != nil || storeIndex.GetBlockCount() != 1 {
+		t.Errorf("TestRepackStore() readStoreStoreIndex() %d, %v != %d, %v", storeIndex.GetBlockCount(), err, 1, nil)
+	}
+	defer storeIndex.Dispose()
+	// The retained version is fully covered by the new block
+	versionStoreIndex, err := createPrunedStoreIndex(storeIndex, versionIndex.GetChunkHashes(), nil)
+	if err != nil {
+		t.Errorf("TestRepackStore() createPrunedStoreIndex() %v != %v", err, nil)
+	}
+	versionStoreIndex.Dispose()
+
+	// The new block is dense, there is nothing more to repack
+	result, err = repackStoreBlocks(ctx, jobs, memStore, versionIndexes, RepackOptions{MinBlockUsagePercent: 50})
+	if err != nil || result.SparseBlockCount != 0 {
+		t.Errorf("TestRepackStore() repackStoreBlocks() %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,157 @@
+package longtailstorelib
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy controls how the remote block store retries failed blob operations, the remote block store
+// uses the DefaultRetryPolicy values for an unset attempt count or backoff
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts for an operation, including the first one
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry, each following delay is multiplied
+	// by BackoffMultiplier up to MaxBackoff
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+	// Jitter randomizes each delay by up to this fraction of the delay, in the range 0 to 1
+	Jitter float64
+	// MaxElapsedTime stops retrying once the next attempt would start later than this after
+	// the first attempt, zero means no limit
+	MaxElapsedTime time.Duration
+	// IsRetryable classifies errors, if nil the BlobStore classification is used if it implements
+	// BlobErrorClassifier, otherwise IsRetryableBlobError
+	IsRetryable func(err error) bool
+}
+
+// BlobErrorClassifier can be implemented by a BlobStore to tell which errors from its
+// operations are transient and worth retrying
+type BlobErrorClassifier interface {
+	IsRetryableError(err error) bool
+}
+
+// DefaultRetryPolicy returns the retry policy used unless the caller has specific needs
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:       5,
+		InitialBackoff:    250 * time.Millisecond,
+		MaxBackoff:        10 * time.Second,
+		BackoffMultiplier: 2.0,
+		Jitter:            0.2,
+		MaxElapsedTime:    time.Minute,
+	}
+}
+
+// withDefaults returns the policy with the unset attempt count and backoff taken from DefaultRetryPolicy,
+// a zero RetryPolicy would otherwise make a single attempt and retry store index updates without delay.
+// Jitter and MaxElapsedTime are kept as zero is a valid setting for them
+func (policy RetryPolicy) withDefaults() RetryPolicy {
+	defaultPolicy := DefaultRetryPolicy()
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = defaultPolicy.MaxAttempts
+	}
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = defaultPolicy.InitialBackoff
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = defaultPolicy.MaxBackoff
+	}
+	if policy.BackoffMultiplier <= 0 {
+		policy.BackoffMultiplier = defaultPolicy.BackoffMultiplier
+	}
+	return policy
+}
+
+// IsRetryableBlobError is the default error classification, errors that signal a missing object,
+// missing permission or an invalid request are not retried, neither is a cancelled operation
+func IsRetryableBlobError(err error) bool {
+	switch errors.Cause(err) {
+	case context.Canceled, context.DeadlineExceeded:
+		return false
+	case longtaillib.ErrENOENT, longtaillib.ErrEACCES, longtaillib.ErrEROFS, longtaillib.ErrEINVAL:
+		return false
+	}
+	return true
+}
+
+// isRetryableHTTPStatus tells if a failed request with the status code could succeed if retried
+func isRetryableHTTPStatus(statusCode int) bool {
+	return statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+func (policy *RetryPolicy) backoff(retry int) time.Duration {
+	delay := float64(policy.InitialBackoff)
+	for i := 1; i < retry; i++ {
+		delay *= policy.BackoffMultiplier
+		if delay >= float64(policy.MaxBackoff) {
+			break
+		}
+	}
+	if policy.MaxBackoff > 0 && delay > float64(policy.MaxBackoff) {
+		delay = float64(policy.MaxBackoff)
+	}
+	if policy.Jitter > 0 {
+		delay += delay * policy.Jitter * (2.0*rand.Float64() - 1.0)
+	}
+	if delay < 0 {
+		return 0
+	}
+	return time.Duration(delay)
+}
+
+// run calls op until it succeeds, fails with an error that is not retryable, the policy runs out
+// of attempts or time, or ctx is done. It returns the number of retries made and the last error
+func (policy *RetryPolicy) run(ctx context.Context, isRetryable func(err error) bool, description string, op func() error) (int, error) {
+	startTime := time.Now()
+	retryCount := 0
+	for {
+		err := op()
+		if err == nil {
+			return retryCount, nil
+		}
+		if ctx.Err() != nil || !isRetryable(err) || retryCount+1 >= policy.MaxAttempts {
+			return retryCount, err
+		}
+		delay := policy.backoff(retryCount + 1)
+		if policy.MaxElapsedTime > 0 && time.Since(startTime)+delay > policy.MaxElapsedTime {
+			return retryCount, err
+		}
+		log.Printf("Retrying %s in %s: %v\n", description, delay, err)
+		if sleepWithContext(ctx, delay) != nil {
+			return retryCount, err
+		}
+		retryCount++
+	}
+}
+
+// sleepWithContext waits for the duration or until the context is done, it returns the context error if the wait was cut short
+func sleepWithContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// getRetryClassifier picks the error classification for operations on blobStore
+func (policy *RetryPolicy) getRetryClassifier(blobStore BlobStore) func(err error) bool {
+	if policy.IsRetryable != nil {
+		return policy.IsRetryable
+	}
+	if classifier, ok := blobStore.(BlobErrorClassifier); ok {
+		return func(err error) bool {
+			return IsRetryableBlobError(err) && classifier.IsRetryableError(err)
+		}
+	}
+	return IsRetryableBlobError
+}
@@ -0,0 +1,183 @@
+package longtailstorelib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+func newTestRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:       4,
+		InitialBackoff:    time.Millisecond,
+		MaxBackoff:        4 * time.Millisecond,
+		BackoffMultiplier: 2.0,
+	}
+}
+
+func TestRetryPolicyRetriesTransientErrors(t *testing.T) {
+	policy := newTestRetryPolicy()
+	attempts := 0
+	retryCount, err := policy.run(context.Background(), IsRetryableBlobError, "test", func() error {
+		attempts++
+		if attempts < 3 {
+			return fmt.Errorf("transient error")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("TestRetryPolicyRetriesTransientErrors() policy.run() %v != %v", err, nil)
+	}
+	if retryCount != 2 {
+		t.Errorf("TestRetryPolicyRetriesTransientErrors() retryCount %d != %d", retryCount, 2)
+	}
+}
+
+func TestRetryPolicyMaxAttempts(t *testing.T) {
+	policy := newTestRetryPolicy()
+	attempts := 0
+	retryCount, err := policy.run(context.Background(), IsRetryableBlobError, "test", func() error {
+		attempts++
+		return fmt.Errorf("transient error")
+	})
+	if err == nil {
+		t.Errorf("TestRetryPolicyMaxAttempts() policy.run() err == nil")
+	}
+	if attempts != policy.MaxAttempts {
+		t.Errorf("TestRetryPolicyMaxAttempts() attempts %d != %d", attempts, policy.MaxAttempts)
+	}
+	if retryCount != policy.MaxAttempts-1 {
+		t.Errorf("TestRetryPolicyMaxAttempts() retryCount %d != %d", retryCount, policy.MaxAttempts-1)
+	}
+}
+
+func TestRetryPolicyFatalError(t *testing.T) {
+	policy := newTestRetryPolicy()
+	attempts := 0
+	_, err := policy.run(context.Background(), IsRetryableBlobError, "test", func() error {
+		attempts++
+		return errors.Wrap(longtaillib.ErrENOENT, "missing")
+	})
+	if errors.Cause(err) != longtaillib.ErrENOENT {
+		t.Errorf("TestRetryPolicyFatalError() policy.run() %v != %v", err, longtaillib.ErrENOENT)
+	}
+	if attempts != 1 {
+		t.Errorf("TestRetryPolicyFatalError() attempts %d != %d", attempts, 1)
+	}
+}
+
+func TestRetryPolicyMaxElapsedTime(t *testing.T) {
+	policy := newTestRetryPolicy()
+	policy.MaxAttempts = 1000
+	policy.InitialBackoff = 10 * time.Millisecond
+	policy.MaxBackoff = 10 * time.Millisecond
+	policy.MaxElapsedTime = 35 * time.Millisecond
+	attempts := 0
+	_, err := policy.run(context.Background(), IsRetryableBlobError, "test", func() error {
+		attempts++
+		return fmt.Errorf("transient error")
+	})
+	if err == nil {
+		t.Errorf("TestRetryPolicyMaxElapsedTime() policy.run() err == nil")
+	}
+	if attempts > 4 {
+		t.Errorf("TestRetryPolicyMaxElapsedTime() attempts %d > %d", attempts, 4)
+	}
+}
+
+func TestRetryPolicyCancelled(t *testing.T) {
+	policy := newTestRetryPolicy()
+	policy.InitialBackoff = time.Hour
+	policy.MaxBackoff = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	_, err := policy.run(ctx, IsRetryableBlobError, "test", func() error {
+		attempts++
+		cancel()
+		return fmt.Errorf("transient error")
+	})
+	if err == nil {
+		t.Errorf("TestRetryPolicyCancelled() policy.run() err == nil")
+	}
+	if attempts != 1 {
+		t.Errorf("TestRetryPolicyCancelled() attempts %d != %d", attempts, 1)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff:    100 * time.Millisecond,
+		MaxBackoff:        time.Second,
+		BackoffMultiplier: 3.0,
+	}
+	expected := []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond, time.Second, time.Second}
+	for i, e := range expected {
+		if delay := policy.backoff(i + 1); delay != e {
+			t.Errorf("TestRetryPolicyBackoff() policy.backoff(%d) %v != %v", i+1, delay, e)
+		}
+	}
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := policy.backoff(1)
+		if delay < 50*time.Millisecond || delay > 150*time.Millisecond {
+			t.Errorf("TestRetryPolicyBackoff() policy.backoff(1) %v outside jitter range", delay)
+		}
+	}
+}
+
+func TestRetryPolicyWithDefaults(t *testing.T) {
+	policy := RetryPolicy{}.withDefaults()
+	defaultPolicy := DefaultRetryPolicy()
+	if policy.MaxAttempts != defaultPolicy.MaxAttempts || policy.InitialBackoff != defaultPolicy.InitialBackoff || policy.MaxBackoff != defaultPolicy.MaxBackoff || policy.BackoffMultiplier != defaultPolicy.BackoffMultiplier {
+		t.Errorf("TestRetryPolicyWithDefaults() RetryPolicy{}.withDefaults() %+v != %+v", policy, defaultPolicy)
+	}
+	if policy.Jitter != 0 || policy.MaxElapsedTime != 0 {
+		t.Errorf("TestRetryPolicyWithDefaults() RetryPolicy{}.withDefaults() %v, %v != %v, %v", policy.Jitter, policy.MaxElapsedTime, 0, 0)
+	}
+	policy = RetryPolicy{MaxAttempts: 1}.withDefaults()
+	if policy.MaxAttempts != 1 {
+		t.Errorf("TestRetryPolicyWithDefaults() policy.MaxAttempts %d != %d", policy.MaxAttempts, 1)
+	}
+	s := newMaintenanceRemoteStore(&memBlobStore{}, nil, 1, RetryPolicy{})
+	if s.storeIndexUpdatePolicy.InitialBackoff != defaultPolicy.InitialBackoff {
+		t.Errorf("TestRetryPolicyWithDefaults() storeIndexUpdatePolicy.InitialBackoff %v != %v", s.storeIndexUpdatePolicy.InitialBackoff, defaultPolicy.InitialBackoff)
+	}
+}
+
+func TestRetryPolicyClassifier(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	blobStore, _ := NewTestBlobStore("the_path")
+	isRetryable := policy.getRetryClassifier(blobStore)
+	if isRetryable(context.Canceled) {
+		t.Errorf("TestRetryPolicyClassifier() isRetryable(context.Canceled) %t != %t", true, false)
+	}
+	if !isRetryable(fmt.Errorf("transient error")) {
+		t.Errorf("TestRetryPolicyClassifier() isRetryable(transient error) %t != %t", false, true)
+	}
+
+	fsBlobStore, _ := NewFSBlobStore("the_path")
+	isRetryable = policy.getRetryClassifier(fsBlobStore)
+	if isRetryable(&os.PathError{Op: "open", Path: "the_path", Err: os.ErrNotExist}) {
+		t.Errorf("TestRetryPolicyClassifier() fs isRetryable(os.ErrNotExist) %t != %t", true, false)
+	}
+
+	httpStore := &httpBlobStore{}
+	isRetryable = policy.getRetryClassifier(httpStore)
+	if isRetryable(errors.Wrap(&httpStatusError{statusCode: 403}, "test")) {
+		t.Errorf("TestRetryPolicyClassifier() isRetryable(403) %t != %t", true, false)
+	}
+	if !isRetryable(errors.Wrap(&httpStatusError{statusCode: 503}, "test")) {
+		t.Errorf("TestRetryPolicyClassifier() isRetryable(503) %t != %t", false, true)
+	}
+
+	policy.IsRetryable = func(err error) bool { return false }
+	isRetryable = policy.getRetryClassifier(blobStore)
+	if isRetryable(fmt.Errorf("transient error")) {
+		t.Errorf("TestRetryPolicyClassifier() custom isRetryable() %t != %t", true, false)
+	}
+}
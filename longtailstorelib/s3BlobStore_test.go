@@ -0,0 +1,132 @@
+package longtailstorelib
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestS3BlobStoreURI(t *testing.T) {
+	u, err := url.Parse("s3://longtail-storage/test-storage/store?endpoint=http://127.0.0.1:9000&path-style=true&region=eu-north-1")
+	if err != nil {
+		t.Errorf("url.Parse() err == %q", err)
+	}
+	blobStore, err := NewS3BlobStore(u)
+	if err != nil {
+		t.Errorf("NewS3BlobStore() err == %q", err)
+	}
+	if blobStore.String() != "s3://longtail-storage/test-storage/store/" {
+		t.Errorf("TestS3BlobStoreURI() String() %s != %s", blobStore.String(), "s3://longtail-storage/test-storage/store/")
+	}
+
+	u, _ = url.Parse("gs://longtail-storage/test-storage/store")
+	_, err = NewS3BlobStore(u)
+	if err == nil {
+		t.Errorf("NewS3BlobStore() err == nil for invalid scheme")
+	}
+
+	u, _ = url.Parse("s3://longtail-storage/store?path-style=maybe")
+	_, err = NewS3BlobStore(u)
+	if err == nil {
+		t.Errorf("NewS3BlobStore() err == nil for invalid path-style")
+	}
+}
+
+func TestS3BlobStoreIsRetryableError(t *testing.T) {
+	u, _ := url.Parse("s3://longtail-storage/test-storage/store")
+	blobStore, _ := NewS3BlobStore(u)
+	classifier := blobStore.(BlobErrorClassifier)
+	slowDown := errors.Wrap(awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), 503, "request"), "test.txt")
+	if !classifier.IsRetryableError(slowDown) {
+		t.Errorf("TestS3BlobStoreIsRetryableError() IsRetryableError(503) %t != %t", false, true)
+	}
+	accessDenied := errors.Wrap(awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "request"), "test.txt")
+	if classifier.IsRetryableError(accessDenied) {
+		t.Errorf("TestS3BlobStoreIsRetryableError() IsRetryableError(403) %t != %t", true, false)
+	}
+}
+
+func TestS3BlobStoreVersioning(t *testing.T) {
+	// This test requires a local S3 compatible server (such as MinIO) with a bucket named longtail-storage
+	// and is disabled
+	t.Skip()
+
+	u, err := url.Parse("s3://longtail-storage/test-storage/store?endpoint=http://127.0.0.1:9000&path-style=true&access-key=minioadmin&secret-key=minioadmin")
+	if err != nil {
+		t.Errorf("url.Parse() err == %q", err)
+	}
+	blobStore, err := NewS3BlobStore(u)
+	if err != nil {
+		t.Errorf("NewS3BlobStore() err == %q", err)
+	}
+	ctx := context.Background()
+	client, err := blobStore.NewClient(ctx)
+	if err != nil {
+		t.Errorf("blobStore.NewClient() err == %q", err)
+	}
+	defer client.Close()
+	object, err := client.NewObject("test.txt")
+	if err != nil {
+		t.Errorf("client.NewObject() err == %q", err)
+	}
+	err = object.Delete(ctx)
+	if err != nil {
+		t.Errorf("object.Delete() err == %q", err)
+	}
+	exists, err := object.LockWriteVersion(ctx)
+	if err != nil {
+		t.Errorf("object.LockWriteVersion() err == %q", err)
+	}
+	if exists {
+		t.Errorf("object.LockWriteVersion() exists != false")
+	}
+	ok, err := object.Write(ctx, []byte("apa"))
+	if !ok {
+		t.Errorf("object.Write() ok != true")
+	}
+	if err != nil {
+		t.Errorf("object.Write() err == %q", err)
+	}
+	ok, err = object.Write(ctx, []byte("skapa"))
+	if ok {
+		t.Errorf("object.Write() ok != false")
+	}
+	if err != nil {
+		t.Errorf("object.Write() err == %q", err)
+	}
+	exists, err = object.LockWriteVersion(ctx)
+	if err != nil {
+		t.Errorf("object.LockWriteVersion() err == %q", err)
+	}
+	if !exists {
+		t.Errorf("object.LockWriteVersion() exists == false")
+	}
+	ok, err = object.Write(ctx, []byte("skapa"))
+	if !ok {
+		t.Errorf("object.Write() ok == false")
+	}
+	if err != nil {
+		t.Errorf("object.Write() err == %q", err)
+	}
+	data, err := object.Read(ctx)
+	if err != nil {
+		t.Errorf("object.Read() err == %q", err)
+	}
+	if string(data) != "skapa" {
+		t.Errorf("object.Read() %s != %s", string(data), "skapa")
+	}
+	objects, err := client.GetObjects(ctx)
+	if err != nil {
+		t.Errorf("client.GetObjects() err == %q", err)
+	}
+	if len(objects) != 1 || objects[0].Name != "test.txt" {
+		t.Errorf("client.GetObjects() %v != [test.txt]", objects)
+	}
+	err = object.Delete(ctx)
+	if err != nil {
+		t.Errorf("object.Delete() err == %q", err)
+	}
+}
@@ -1,52 +1,210 @@
 package longtailstorelib
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"net/url"
-)
+	"strconv"
+	"strings"
 
-// TODO: Not yet implemented, shell here to show how what it would require to support S3
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
 
 type s3BlobStore struct {
+	bucketName string
+	prefix     string
+	config     *aws.Config
+	profile    string
 }
 
 type s3BlobClient struct {
-	ctx   context.Context
-	store *s3BlobStore
+	store  *s3BlobStore
+	client *s3.S3
+}
+
+type s3WriteCondition struct {
+	doesNotExist bool
+	eTag         string
 }
 
 type s3BlobObject struct {
-	ctx    context.Context
-	client *s3BlobClient
+	client         *s3BlobClient
+	path           string
+	writeCondition *s3WriteCondition
+	contentType    string
+	metadata       map[string]string
 }
 
-// NewS3BlobStore ...
+const (
+	// S3 reports a failed If-Match/If-None-Match with 412, a concurrent conditional write with 409
+	s3PreconditionFailed      = 412
+	s3ConditionalRequestClash = 409
+)
+
+// NewS3BlobStore creates a BlobStore for an s3://bucket/prefix URI
+//
+// The following optional query parameters are supported:
+//
+//	endpoint   - custom endpoint, for example http://127.0.0.1:9000 for a local S3 compatible server
+//	region     - bucket region, defaults to the AWS_REGION environment or us-east-1
+//	path-style - set to true to use path style addressing, needed for most S3 compatible servers
+//	profile    - named profile in the shared credentials file
+//	access-key/secret-key - static credentials, otherwise the default AWS credential chain is used
 func NewS3BlobStore(u *url.URL) (BlobStore, error) {
 	if u.Scheme != "s3" {
-		return nil, fmt.Errorf("invalid scheme '%s', expected 'gs'", u.Scheme)
+		return nil, fmt.Errorf("invalid scheme '%s', expected 's3'", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing bucket name in '%s'", u.String())
+	}
+	prefix := u.Path
+	if len(u.Path) > 0 {
+		prefix = u.Path[1:] // strip initial slash
 	}
-	s := &s3BlobStore{}
+
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	query := u.Query()
+	config := aws.NewConfig()
+	if endpoint := query.Get("endpoint"); endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	if region := query.Get("region"); region != "" {
+		config = config.WithRegion(region)
+	}
+	if pathStyle := query.Get("path-style"); pathStyle != "" {
+		forcePathStyle, err := strconv.ParseBool(pathStyle)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid path-style value '%s'", pathStyle)
+		}
+		config = config.WithS3ForcePathStyle(forcePathStyle)
+	}
+	accessKey := query.Get("access-key")
+	secretKey := query.Get("secret-key")
+	if accessKey != "" || secretKey != "" {
+		config = config.WithCredentials(credentials.NewStaticCredentials(accessKey, secretKey, ""))
+	}
+
+	s := &s3BlobStore{
+		bucketName: u.Host,
+		prefix:     prefix,
+		config:     config,
+		profile:    query.Get("profile")}
 	return s, nil
 }
 
 func (blobStore *s3BlobStore) NewClient(ctx context.Context) (BlobClient, error) {
-	return &s3BlobClient{store: blobStore, ctx: ctx}, nil
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *blobStore.config,
+		Profile:           blobStore.profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, blobStore.bucketName)
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		sess.Config.Region = aws.String("us-east-1")
+	}
+	return &s3BlobClient{store: blobStore, client: s3.New(sess)}, nil
 }
 
 func (blobStore *s3BlobStore) String() string {
-	return ""
+	return "s3://" + blobStore.bucketName + "/" + blobStore.prefix
+}
+
+// IsRetryableError implements BlobErrorClassifier
+func (blobStore *s3BlobStore) IsRetryableError(err error) bool {
+	cause := errors.Cause(err)
+	if isS3NotFound(cause) {
+		return false
+	}
+	if e, ok := cause.(awserr.RequestFailure); ok {
+		return isRetryableHTTPStatus(e.StatusCode())
+	}
+	return true
 }
 
 func (blobClient *s3BlobClient) NewObject(path string) (BlobObject, error) {
+	s3Path := blobClient.store.prefix + path
 	return &s3BlobObject{
-			ctx:    blobClient.ctx,
-			client: blobClient},
+			client:         blobClient,
+			path:           s3Path,
+			writeCondition: nil},
 		nil
 }
 
-func (blobClient *s3BlobClient) GetObjects() ([]BlobProperties, error) {
-	return nil, fmt.Errorf("S3 storage not yet implemented")
+func (blobClient *s3BlobClient) GetObjects(ctx context.Context) ([]BlobProperties, error) {
+	var items []BlobProperties
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(blobClient.store.bucketName),
+		Prefix: aws.String(blobClient.store.prefix),
+	}
+	err := blobClient.client.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			itemName := aws.StringValue(object.Key)[len(blobClient.store.prefix):]
+			items = append(items, BlobProperties{Size: aws.Int64Value(object.Size), Name: itemName})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, blobClient.store.String())
+	}
+	return items, nil
+}
+
+type s3BlobObjectIterator struct {
+	ctx    context.Context
+	client *s3BlobClient
+	input  *s3.ListObjectsV2Input
+	items  []BlobProperties
+	done   bool
+}
+
+func (blobClient *s3BlobClient) ListObjects(ctx context.Context, prefix string, delimiter string) BlobObjectIterator {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(blobClient.store.bucketName),
+		Prefix: aws.String(blobClient.store.prefix + prefix),
+	}
+	if delimiter != "" {
+		input.Delimiter = aws.String(delimiter)
+	}
+	return &s3BlobObjectIterator{ctx: ctx, client: blobClient, input: input}
+}
+
+func (it *s3BlobObjectIterator) Next() (BlobProperties, error) {
+	for len(it.items) == 0 {
+		if it.done {
+			return BlobProperties{}, ErrBlobIteratorDone
+		}
+		page, err := it.client.client.ListObjectsV2WithContext(it.ctx, it.input)
+		if err != nil {
+			return BlobProperties{}, errors.Wrap(err, it.client.store.String())
+		}
+		prefixLength := len(it.client.store.prefix)
+		for _, commonPrefix := range page.CommonPrefixes {
+			it.items = append(it.items, BlobProperties{Name: aws.StringValue(commonPrefix.Prefix)[prefixLength:], IsPrefix: true})
+		}
+		for _, object := range page.Contents {
+			it.items = append(it.items, BlobProperties{Size: aws.Int64Value(object.Size), Name: aws.StringValue(object.Key)[prefixLength:]})
+		}
+		it.input.ContinuationToken = page.NextContinuationToken
+		it.done = !aws.BoolValue(page.IsTruncated)
+	}
+	item := it.items[0]
+	it.items = it.items[1:]
+	return item, nil
 }
 
 func (blobClient *s3BlobClient) Close() {
@@ -56,22 +214,189 @@ func (blobClient *s3BlobClient) String() string {
 	return blobClient.store.String()
 }
 
-func (blobObject *s3BlobObject) Read() ([]byte, error) {
-	return nil, fmt.Errorf("S3 storage not yet implemented")
+func isS3NotFound(err error) bool {
+	if e, ok := err.(awserr.RequestFailure); ok {
+		return e.StatusCode() == http.StatusNotFound
+	}
+	if e, ok := err.(awserr.Error); ok {
+		return e.Code() == s3.ErrCodeNoSuchKey || e.Code() == "NotFound"
+	}
+	return false
+}
+
+func (blobObject *s3BlobObject) headObject(ctx context.Context) (*s3.HeadObjectOutput, error) {
+	return blobObject.client.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(blobObject.client.store.bucketName),
+		Key:    aws.String(blobObject.path),
+	})
+}
+
+func (blobObject *s3BlobObject) Read(ctx context.Context) ([]byte, error) {
+	output, err := blobObject.client.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(blobObject.client.store.bucketName),
+		Key:    aws.String(blobObject.path),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.path)
+	}
+	data, err := ioutil.ReadAll(output.Body)
+	err2 := output.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.path)
+	} else if err2 != nil {
+		return nil, err2
+	}
+	return data, nil
+}
+
+func (blobObject *s3BlobObject) LockWriteVersion(ctx context.Context) (bool, error) {
+	output, err := blobObject.headObject(ctx)
+	if isS3NotFound(err) {
+		blobObject.writeCondition = &s3WriteCondition{doesNotExist: true}
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, blobObject.path)
+	}
+
+	blobObject.writeCondition = &s3WriteCondition{eTag: aws.StringValue(output.ETag)}
+	return true, nil
 }
 
-func (blobObject *s3BlobObject) LockWriteVersion() (bool, error) {
-	return false, fmt.Errorf("S3 storage not yet implemented")
+func (blobObject *s3BlobObject) Exists(ctx context.Context) (bool, error) {
+	_, err := blobObject.headObject(ctx)
+	if isS3NotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, blobObject.path)
+	}
+	return true, nil
 }
 
-func (blobObject *s3BlobObject) Exists() (bool, error) {
-	return false, fmt.Errorf("S3 storage not yet implemented")
+func (blobObject *s3BlobObject) Write(ctx context.Context, data []byte) (bool, error) {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(blobObject.client.store.bucketName),
+		Key:         aws.String(blobObject.path),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(defaultBlobContentType),
+	}
+	if blobObject.contentType != "" {
+		input.ContentType = aws.String(blobObject.contentType)
+	}
+	if len(blobObject.metadata) > 0 {
+		input.Metadata = aws.StringMap(blobObject.metadata)
+	}
+	req, _ := blobObject.client.client.PutObjectRequest(input)
+	req.SetContext(ctx)
+	if blobObject.writeCondition != nil {
+		// The conditional headers are not part of PutObjectInput in this SDK version so we set them
+		// directly on the request, they are included when the request is signed
+		if blobObject.writeCondition.doesNotExist {
+			req.HTTPRequest.Header.Set("If-None-Match", "*")
+		} else {
+			req.HTTPRequest.Header.Set("If-Match", blobObject.writeCondition.eTag)
+		}
+	}
+
+	err := req.Send()
+	if e, ok := err.(awserr.RequestFailure); ok {
+		if e.StatusCode() == s3PreconditionFailed || e.StatusCode() == s3ConditionalRequestClash {
+			return false, nil
+		}
+		return false, errors.Wrap(err, blobObject.path)
+	} else if err != nil {
+		return false, errors.Wrap(err, blobObject.path)
+	}
+	return true, nil
 }
 
-func (blobObject *s3BlobObject) Write(data []byte) (bool, error) {
-	return false, fmt.Errorf("S3 storage not yet implemented")
+func (blobObject *s3BlobObject) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	return blobObject.NewRangeReader(ctx, 0, -1)
 }
 
-func (blobObject *s3BlobObject) Delete() error {
-	return fmt.Errorf("S3 storage not yet implemented")
+func (blobObject *s3BlobObject) NewRangeReader(ctx context.Context, offset int64, length int64) (io.ReadCloser, error) {
+	// An empty range can not be expressed as a range request
+	if length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(blobObject.client.store.bucketName),
+		Key:    aws.String(blobObject.path),
+	}
+	if length >= 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	output, err := blobObject.client.client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.path)
+	}
+	return output.Body, nil
+}
+
+func (blobObject *s3BlobObject) NewWriter(ctx context.Context) (io.WriteCloser, error) {
+	// Conditional puts need the full content length up front so we buffer the data
+	return newBufferedBlobWriter(ctx, blobObject), nil
+}
+
+func (blobObject *s3BlobObject) GetAttributes(ctx context.Context) (BlobObjectAttributes, error) {
+	output, err := blobObject.headObject(ctx)
+	if isS3NotFound(err) {
+		return BlobObjectAttributes{}, errors.Wrap(longtaillib.ErrENOENT, blobObject.path)
+	}
+	if err != nil {
+		return BlobObjectAttributes{}, errors.Wrap(err, blobObject.path)
+	}
+	// S3 returns the metadata keys in canonical header form, we want them as they were written
+	metadata := make(map[string]string, len(output.Metadata))
+	for key, value := range output.Metadata {
+		metadata[strings.ToLower(key)] = aws.StringValue(value)
+	}
+	return BlobObjectAttributes{
+		Size:         aws.Int64Value(output.ContentLength),
+		LastModified: aws.TimeValue(output.LastModified),
+		Generation:   aws.StringValue(output.ETag),
+		ContentType:  aws.StringValue(output.ContentType),
+		Metadata:     metadata}, nil
+}
+
+func (blobObject *s3BlobObject) SetWriteAttributes(contentType string, metadata map[string]string) {
+	blobObject.contentType = contentType
+	blobObject.metadata = metadata
+}
+
+// Delete checks the write condition from LockWriteVersion with a HEAD request before the DELETE. The
+// DELETE also carries the ETag in an If-Match header, stores that do not support conditional deletes
+// ignore it and then a write between the HEAD and the DELETE is lost, so the check is not atomic there
+func (blobObject *s3BlobObject) Delete(ctx context.Context) error {
+	output, err := blobObject.headObject(ctx)
+	if isS3NotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, blobObject.path)
+	}
+	if blobObject.writeCondition != nil {
+		// An object that was created after it was locked as missing does not match the write condition
+		if blobObject.writeCondition.doesNotExist || aws.StringValue(output.ETag) != blobObject.writeCondition.eTag {
+			return fmt.Errorf("s3BlobObject: generation lock mismatch %s", blobObject.path)
+		}
+	}
+	req, _ := blobObject.client.client.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket: aws.String(blobObject.client.store.bucketName),
+		Key:    aws.String(blobObject.path),
+	})
+	req.SetContext(ctx)
+	if blobObject.writeCondition != nil {
+		req.HTTPRequest.Header.Set("If-Match", blobObject.writeCondition.eTag)
+	}
+	err = req.Send()
+	if e, ok := err.(awserr.RequestFailure); ok && (e.StatusCode() == s3PreconditionFailed || e.StatusCode() == s3ConditionalRequestClash) {
+		return fmt.Errorf("s3BlobObject: generation lock mismatch %s", blobObject.path)
+	}
+	if err != nil {
+		return errors.Wrap(err, blobObject.path)
+	}
+	return nil
 }
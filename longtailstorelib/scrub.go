@@ -0,0 +1,392 @@
+package longtailstorelib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// Problems ScrubStore reports for a block
+const (
+	// ScrubBlockUnreadable is a block that does not match the checksum of the blob store or could not be parsed
+	ScrubBlockUnreadable = "unreadable"
+	// ScrubBlockReadFailed is a block that could not be downloaded, it is reported but never quarantined
+	// as the block may be fine
+	ScrubBlockReadFailed = "read failed"
+	// ScrubBlockMisnamed is a block whose name does not match its block hash
+	ScrubBlockMisnamed = "misnamed"
+	// ScrubBlockCorrupt is a block that could not be decompressed or has chunks that do not match their hash
+	ScrubBlockCorrupt = "corrupt"
+)
+
+// ScrubOptions controls ScrubStore
+type ScrubOptions struct {
+	// QuarantinePrefix moves the bad blocks under this prefix in the store and removes them from the
+	// store index, bad blocks that do not match their checksum are deleted. Blocks that could not be
+	// downloaded are left in place. When empty the bad blocks are only reported
+	QuarantinePrefix string
+	// WorkerCount is the number of blocks verified in parallel
+	WorkerCount int
+	RetryPolicy RetryPolicy
+}
+
+// ScrubBlockReport tells what is wrong with a block
+type ScrubBlockReport struct {
+	Key         string `json:"key"`
+	Problem     string `json:"problem"`
+	Detail      string `json:"detail"`
+	Quarantined bool   `json:"quarantined"`
+}
+
+// ScrubReport is the result of ScrubStore
+type ScrubReport struct {
+	BlockCount         int                `json:"block_count"`
+	VerifiedBlockCount int                `json:"verified_block_count"`
+	VerifiedChunkCount int                `json:"verified_chunk_count"`
+	BadBlocks          []ScrubBlockReport `json:"bad_blocks"`
+}
+
+// scrubBlockSource is a block store that hands out the blocks read by the scrub workers, so they are
+// decompressed by a compress block store layered on top of it
+type scrubBlockSource struct {
+	mutex  sync.Mutex
+	blocks map[uint64]longtaillib.Longtail_StoredBlock
+}
+
+// add makes storedBlock the next block returned for blockHash, the block is owned by the caller of
+// GetStoredBlock from then on
+func (b *scrubBlockSource) add(blockHash uint64, storedBlock longtaillib.Longtail_StoredBlock) {
+	b.mutex.Lock()
+	b.blocks[blockHash] = storedBlock
+	b.mutex.Unlock()
+}
+
+// PutStoredBlock ...
+func (b *scrubBlockSource) PutStoredBlock(storedBlock longtaillib.Longtail_StoredBlock, asyncCompleteAPI longtaillib.Longtail_AsyncPutStoredBlockAPI) int {
+	return longtaillib.EACCES
+}
+
+// PreflightGet ...
+func (b *scrubBlockSource) PreflightGet(blockHashes []uint64, asyncCompleteAPI longtaillib.Longtail_AsyncPreflightStartedAPI) int {
+	asyncCompleteAPI.OnComplete(blockHashes, 0)
+	return 0
+}
+
+// GetStoredBlock ...
+func (b *scrubBlockSource) GetStoredBlock(blockHash uint64, asyncCompleteAPI longtaillib.Longtail_AsyncGetStoredBlockAPI) int {
+	b.mutex.Lock()
+	storedBlock, ok := b.blocks[blockHash]
+	delete(b.blocks, blockHash)
+	b.mutex.Unlock()
+	if !ok {
+		return longtaillib.ENOENT
+	}
+	asyncCompleteAPI.OnComplete(storedBlock, 0)
+	return 0
+}
+
+// GetExistingContent ...
+func (b *scrubBlockSource) GetExistingContent(chunkHashes []uint64, minBlockUsagePercent uint32, asyncCompleteAPI longtaillib.Longtail_AsyncGetExistingContentAPI) int {
+	return longtaillib.EINVAL
+}
+
+// GetStats ...
+func (b *scrubBlockSource) GetStats() (longtaillib.BlockStoreStats, int) {
+	return longtaillib.BlockStoreStats{}, 0
+}
+
+// Flush ...
+func (b *scrubBlockSource) Flush(asyncCompleteAPI longtaillib.Longtail_AsyncFlushAPI) int {
+	asyncCompleteAPI.OnComplete(0)
+	return 0
+}
+
+// Close ...
+func (b *scrubBlockSource) Close() error {
+	return nil
+}
+
+type scrubGetBlockCompletionAPI struct {
+	wg          sync.WaitGroup
+	storedBlock longtaillib.Longtail_StoredBlock
+	err         int
+}
+
+func (a *scrubGetBlockCompletionAPI) OnComplete(storedBlock longtaillib.Longtail_StoredBlock, err int) {
+	a.storedBlock = storedBlock
+	a.err = err
+	a.wg.Done()
+}
+
+// listBlockKeys returns the keys of all blocks in the store, including blocks that are not stored
+// at the path of their name
+func listBlockKeys(ctx context.Context, s *remoteStore, client BlobClient) ([]string, error) {
+	var keys []string
+	_, err := s.retryPolicy.run(ctx, s.isRetryableError, "list blocks in store "+s.String(), func() error {
+		items, err := readBlobObjectIterator(client.ListObjects(ctx, "chunks/", ""))
+		if err != nil {
+			return err
+		}
+		keys = keys[:0]
+		for _, item := range items {
+			if strings.HasSuffix(item.Name, ".lsb") {
+				keys = append(keys, item.Name)
+			}
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+// verifyChunks checks that the chunks of the decompressed storedBlock match their hashes
+func verifyChunks(hashRegistry longtaillib.Longtail_HashRegistryAPI, storedBlock longtaillib.Longtail_StoredBlock) (int, error) {
+	blockIndex := storedBlock.GetBlockIndex()
+	hashAPI, errno := hashRegistry.GetHashAPI(blockIndex.GetHashIdentifier())
+	if errno != 0 {
+		return 0, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "unknown hash identifier %d", blockIndex.GetHashIdentifier())
+	}
+	chunkHashes := blockIndex.GetChunkHashes()
+	chunkSizes := blockIndex.GetChunkSizes()
+	blockData := storedBlock.GetChunksBlockData()
+	blockSize := 0
+	for _, chunkSize := range chunkSizes {
+		blockSize += int(chunkSize)
+	}
+	if blockSize != len(blockData) {
+		return 0, fmt.Errorf("chunk data is %d bytes, chunk sizes add up to %d", len(blockData), blockSize)
+	}
+	mismatchCount := 0
+	offset := 0
+	for c, chunkHash := range chunkHashes {
+		hash, errno := hashAPI.HashBuffer(blockData[offset : offset+int(chunkSizes[c])])
+		if errno != 0 {
+			return 0, errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "hashAPI.HashBuffer() failed")
+		}
+		if hash != chunkHash {
+			mismatchCount++
+		}
+		offset += int(chunkSizes[c])
+	}
+	if mismatchCount > 0 {
+		return 0, fmt.Errorf("%d of %d chunks do not match their hash", mismatchCount, len(chunkHashes))
+	}
+	return len(chunkHashes), nil
+}
+
+// scrubBlock reads, decompresses and verifies the block at key. It returns the number of verified
+// chunks, or a report if the block is bad. A block that no longer exists gives neither
+func scrubBlock(
+	ctx context.Context,
+	s *remoteStore,
+	client BlobClient,
+	blockSource *scrubBlockSource,
+	blockStore longtaillib.Longtail_BlockStoreAPI,
+	hashRegistry longtaillib.Longtail_HashRegistryAPI,
+	key string) (int, *ScrubBlockReport, error) {
+	blobData, _, err := readBlobWithRetry(ctx, s, client, key)
+	if errors.Cause(err) == longtaillib.ErrENOENT {
+		return 0, nil, nil
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, nil, err
+		}
+		if errors.Cause(err) == ErrBlobChecksumMismatch {
+			return 0, &ScrubBlockReport{Key: key, Problem: ScrubBlockUnreadable, Detail: err.Error()}, nil
+		}
+		return 0, &ScrubBlockReport{Key: key, Problem: ScrubBlockReadFailed, Detail: err.Error()}, nil
+	}
+	storedBlock, errno := longtaillib.ReadStoredBlockFromBuffer(blobData)
+	if errno != 0 {
+		return 0, &ScrubBlockReport{Key: key, Problem: ScrubBlockUnreadable, Detail: "not a valid block"}, nil
+	}
+	blockIndex := storedBlock.GetBlockIndex()
+	blockHash := blockIndex.GetBlockHash()
+	if expectedKey := GetBlockPath("chunks", blockHash); expectedKey != key {
+		storedBlock.Dispose()
+		return 0, &ScrubBlockReport{Key: key, Problem: ScrubBlockMisnamed, Detail: "content is block " + expectedKey}, nil
+	}
+
+	blockSource.add(blockHash, storedBlock)
+	getComplete := &scrubGetBlockCompletionAPI{}
+	getComplete.wg.Add(1)
+	errno = blockStore.GetStoredBlock(blockHash, longtaillib.CreateAsyncGetStoredBlockAPI(getComplete))
+	if errno != 0 {
+		getComplete.wg.Done()
+	}
+	getComplete.wg.Wait()
+	if errno == 0 {
+		errno = getComplete.err
+	}
+	if errno != 0 {
+		return 0, &ScrubBlockReport{Key: key, Problem: ScrubBlockCorrupt, Detail: fmt.Sprintf("decompression failed with error %d", errno)}, nil
+	}
+	chunkCount, err := verifyChunks(hashRegistry, getComplete.storedBlock)
+	getComplete.storedBlock.Dispose()
+	if err != nil {
+		return 0, &ScrubBlockReport{Key: key, Problem: ScrubBlockCorrupt, Detail: err.Error()}, nil
+	}
+	return chunkCount, nil, nil
+}
+
+// quarantineBlock moves the block at key under prefix. A block that fails the checksum check of the
+// blob store can not be copied and is only deleted, it returns false if the block was deleted without
+// a copy. Any other read error fails the quarantine and the block is left in place
+func quarantineBlock(ctx context.Context, s *remoteStore, client BlobClient, key string, prefix string) (bool, error) {
+	blobData, _, err := readBlobWithRetry(ctx, s, client, key)
+	if errors.Cause(err) == ErrBlobChecksumMismatch {
+		log.Printf("Bad block %s does not match its checksum, deleting it without a copy: %v\n", key, err)
+		_, err = deleteBlobs(ctx, s, []string{key}, 1)
+		return false, err
+	}
+	if err != nil {
+		return false, err
+	}
+	quarantineKey := strings.TrimRight(prefix, "/") + "/" + key
+	quarantineObject, err := client.NewObject(quarantineKey)
+	if err != nil {
+		return false, err
+	}
+	_, err = s.retryPolicy.run(ctx, s.isRetryableError, "write "+quarantineKey+" in store "+s.String(), func() error {
+		_, err := quarantineObject.Write(ctx, blobData)
+		return err
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "failed writing %s", quarantineKey)
+	}
+	_, err = deleteBlobs(ctx, s, []string{key}, 1)
+	return true, err
+}
+
+// ScrubStore downloads every block in blobStore and verifies that it can be parsed, that its name
+// matches its block hash and that it decompresses to chunks that match their hashes. With
+// options.QuarantinePrefix the bad blocks are removed from the store index and moved under the prefix. A
+// bad block that stays in the store index, as it has chunks the kept blocks also have, is reported but not moved
+func ScrubStore(ctx context.Context, blobStore BlobStore, options ScrubOptions) (ScrubReport, error) {
+	report := ScrubReport{BadBlocks: []ScrubBlockReport{}}
+	workerCount := options.WorkerCount
+	if workerCount < 1 {
+		workerCount = 1
+	}
+	blobStore = requireAllMirrors(blobStore)
+	client, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return report, errors.Wrap(err, blobStore.String())
+	}
+	defer client.Close()
+	s := newMaintenanceRemoteStore(blobStore, client, workerCount, options.RetryPolicy)
+
+	keys, err := listBlockKeys(ctx, s, client)
+	if err != nil {
+		return report, errors.Wrap(err, "ScrubStore")
+	}
+	report.BlockCount = len(keys)
+
+	blockSource := &scrubBlockSource{blocks: map[uint64]longtaillib.Longtail_StoredBlock{}}
+	sourceBlockStore := longtaillib.CreateBlockStoreAPI(blockSource)
+	defer sourceBlockStore.Dispose()
+	compressionRegistry := longtaillib.CreateFullCompressionRegistry()
+	defer compressionRegistry.Dispose()
+	blockStore := longtaillib.CreateCompressBlockStore(sourceBlockStore, compressionRegistry)
+	defer blockStore.Dispose()
+	hashRegistry := longtaillib.CreateFullHashRegistry()
+	defer hashRegistry.Dispose()
+
+	keyChan := make(chan string, len(keys))
+	for _, key := range keys {
+		keyChan <- key
+	}
+	close(keyChan)
+
+	var mutex sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	wg.Add(workerCount)
+	for w := 0; w < workerCount; w++ {
+		go func() {
+			defer wg.Done()
+			client, err := blobStore.NewClient(ctx)
+			if err != nil {
+				mutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mutex.Unlock()
+				return
+			}
+			defer client.Close()
+			for key := range keyChan {
+				chunkCount, blockReport, err := scrubBlock(ctx, s, client, blockSource, blockStore, hashRegistry, key)
+				mutex.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = errors.Wrapf(err, "failed scrubbing %s", key)
+				} else if blockReport != nil {
+					report.BadBlocks = append(report.BadBlocks, *blockReport)
+				} else if err == nil {
+					report.VerifiedBlockCount++
+					report.VerifiedChunkCount += chunkCount
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return report, errors.Wrap(firstErr, "ScrubStore")
+	}
+	sort.Slice(report.BadBlocks, func(i, j int) bool { return report.BadBlocks[i].Key < report.BadBlocks[j].Key })
+
+	if options.QuarantinePrefix == "" {
+		return report, nil
+	}
+	// Stop listing the bad blocks before they are moved, a block that is not at the path of a block
+	// hash is not in the store index. Blocks that could not be downloaded are kept
+	quarantineCount := 0
+	badBlocks := map[uint64]bool{}
+	for _, blockReport := range report.BadBlocks {
+		if blockReport.Problem == ScrubBlockReadFailed {
+			continue
+		}
+		quarantineCount++
+		if blockHash, ok := parseBlockPath(blockReport.Key); ok {
+			badBlocks[blockHash] = true
+		}
+	}
+	if quarantineCount == 0 {
+		return report, nil
+	}
+	indexedBlocks, err := removeBlocksFromStoreIndex(ctx, s, client, badBlocks)
+	if err != nil {
+		return report, errors.Wrap(err, "ScrubStore: failed removing bad blocks from the store index, no blocks were quarantined")
+	}
+	quarantinedCount := 0
+	for i, blockReport := range report.BadBlocks {
+		if blockReport.Problem == ScrubBlockReadFailed {
+			log.Printf("Block %s could not be read, it is not quarantined\n", blockReport.Key)
+			continue
+		}
+		// A bad block that the store index still lists must stay until it is replaced
+		if blockHash, ok := parseBlockPath(blockReport.Key); ok && indexedBlocks[blockHash] {
+			log.Printf("Bad block %s is still in the store index, it is not quarantined\n", blockReport.Key)
+			continue
+		}
+		copied, err := quarantineBlock(ctx, s, client, blockReport.Key, options.QuarantinePrefix)
+		if err != nil {
+			return report, errors.Wrapf(err, "ScrubStore: failed quarantining %s", blockReport.Key)
+		}
+		if !copied {
+			report.BadBlocks[i].Detail += ", it does not match its checksum and was deleted without a copy"
+		}
+		report.BadBlocks[i].Quarantined = true
+		quarantinedCount++
+	}
+	log.Printf("Quarantined %d bad blocks in %s under %s\n", quarantinedCount, s.String(), options.QuarantinePrefix)
+	return report, nil
+}
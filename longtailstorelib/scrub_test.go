@@ -0,0 +1,136 @@
+package longtailstorelib
+
+import (
+	"context"
+	"math/rand"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestScrubStore(t *testing.T) {
+	ctx := context.Background()
+	memStore, _ := NewMemBlobStore("scrub")
+	defer ReleaseMemBlobStore("scrub")
+	client, _ := memStore.NewClient(ctx)
+	defer client.Close()
+	s := newMaintenanceRemoteStore(memStore, client, 2, DefaultRetryPolicy())
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+
+	data := make([]byte, 65536)
+	rand.Read(data)
+	versionIndex := uploadTestVersion(t, jobs, memStore, map[string][]byte{"data.bin": data})
+	versionIndex.Dispose()
+	blocks, _ := listStoreBlocks(ctx, s, client)
+	goodKeys := map[string]bool{}
+	for _, block := range blocks {
+		goodKeys[block.Name] = true
+	}
+	rand.Read(data)
+	versionIndex = uploadTestVersion(t, jobs, memStore, map[string][]byte{"data.bin": data})
+	versionIndex.Dispose()
+	blocks, _ = listStoreBlocks(ctx, s, client)
+	if len(blocks) != 2 || len(goodKeys) != 1 {
+		t.Errorf("TestScrubStore() len(blocks) %d != %d", len(blocks), 2)
+	}
+	var goodKey, corruptKey string
+	for _, block := range blocks {
+		if goodKeys[block.Name] {
+			goodKey = block.Name
+		} else {
+			corruptKey = block.Name
+		}
+	}
+
+	// The last byte of a block is chunk data
+	blockData, _ := readTestObject(ctx, memStore, corruptKey)
+	blockData[len(blockData)-1] ^= 0xff
+	writeTestObject(ctx, memStore, corruptKey, blockData)
+	blockData, _ = readTestObject(ctx, memStore, goodKey)
+	misnamedKey := GetBlockPath("chunks", 0x5678)
+	writeTestObject(ctx, memStore, misnamedKey, blockData)
+	unreadableKey := GetBlockPath("chunks", 0x1234)
+	writeTestObject(ctx, memStore, unreadableKey, []byte("not a block"))
+
+	expectedProblems := map[string]string{
+		corruptKey:    ScrubBlockCorrupt,
+		misnamedKey:   ScrubBlockMisnamed,
+		unreadableKey: ScrubBlockUnreadable}
+	report, err := ScrubStore(ctx, memStore, ScrubOptions{WorkerCount: 2, RetryPolicy: DefaultRetryPolicy()})
+	if err != nil {
+		t.Errorf("TestScrubStore() ScrubStore() %v != %v", err, nil)
+	}
+	if report.BlockCount != 4 || report.VerifiedBlockCount != 1 || len(report.BadBlocks) != 3 {
+		t.Errorf("TestScrubStore() ScrubStore() %+v", report)
+	}
+	for _, blockReport := range report.BadBlocks {
+		if expectedProblems[blockReport.Key] != blockReport.Problem || blockReport.Quarantined {
+			t.Errorf("TestScrubStore() ScrubStore() %+v, expected problem %s", blockReport, expectedProblems[blockReport.Key])
+		}
+	}
+
+	report, err = ScrubStore(ctx, memStore, ScrubOptions{QuarantinePrefix: "quarantine", WorkerCount: 2, RetryPolicy: DefaultRetryPolicy()})
+	if err != nil || len(report.BadBlocks) != 3 {
+		t.Errorf("TestScrubStore() ScrubStore() %+v, %v", report, err)
+	}
+	for _, blockReport := range report.BadBlocks {
+		if !blockReport.Quarantined {
+			t.Errorf("TestScrubStore() ScrubStore() %s was not quarantined", blockReport.Key)
+		}
+		if _, err := readTestObject(ctx, memStore, "quarantine/"+blockReport.Key); err != nil {
+			t.Errorf("TestScrubStore() readTestObject(quarantine/%s) %v != %v", blockReport.Key, err, nil)
+		}
+	}
+	if blocks, _ := listStoreBlocks(ctx, s, client); len(blocks) != 1 {
+		t.Errorf("TestScrubStore() len(blocks) %d != %d", len(blocks), 1)
+	}
+	storeIndex, err := readStoreStoreIndex(ctx, s, client)
+	if err != nil || storeIndex.GetBlockCount() != 1 {
+		t.Errorf("TestScrubStore() readStoreStoreIndex() %d, %v != %d, %v", storeIndex.GetBlockCount(), err, 1, nil)
+	}
+	storeIndex.Dispose()
+}
+
+func TestScrubStoreReadFaults(t *testing.T) {
+	ctx := context.Background()
+	memStore, _ := NewMemBlobStore("scrub_read_faults")
+	defer ReleaseMemBlobStore("scrub_read_faults")
+	client, _ := memStore.NewClient(ctx)
+	defer client.Close()
+	s := newMaintenanceRemoteStore(memStore, client, 2, DefaultRetryPolicy())
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+
+	data := make([]byte, 65536)
+	rand.Read(data)
+	versionIndex := uploadTestVersion(t, jobs, memStore, map[string][]byte{"data.bin": data})
+	versionIndex.Dispose()
+	blocks, _ := listStoreBlocks(ctx, s, client)
+
+	// Blocks that can not be downloaded may be fine, they must not be removed from the store index or deleted
+	faultStore, _ := NewFaultInjectionBlobStore(memStore, FaultInjectionOptions{ReadErrorRate: 1})
+	retryPolicy := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, BackoffMultiplier: 2.0}
+	report, err := ScrubStore(ctx, faultStore, ScrubOptions{QuarantinePrefix: "quarantine", WorkerCount: 2, RetryPolicy: retryPolicy})
+	if err != nil {
+		t.Errorf("TestScrubStoreReadFaults() ScrubStore() %v != %v", err, nil)
+	}
+	if len(report.BadBlocks) != len(blocks) {
+		t.Errorf("TestScrubStoreReadFaults() len(report.BadBlocks) %d != %d", len(report.BadBlocks), len(blocks))
+	}
+	for _, blockReport := range report.BadBlocks {
+		if blockReport.Problem != ScrubBlockReadFailed || blockReport.Quarantined {
+			t.Errorf("TestScrubStoreReadFaults() ScrubStore() %+v, expected problem %s", blockReport, ScrubBlockReadFailed)
+		}
+	}
+	if remainingBlocks, _ := listStoreBlocks(ctx, s, client); len(remainingBlocks) != len(blocks) {
+		t.Errorf("TestScrubStoreReadFaults() len(blocks) %d != %d", len(remainingBlocks), len(blocks))
+	}
+	storeIndex, err := readStoreStoreIndex(ctx, s, client)
+	if err != nil || int(storeIndex.GetBlockCount()) != len(blocks) {
+		t.Errorf("TestScrubStoreReadFaults() readStoreStoreIndex() %d, %v != %d, %v", storeIndex.GetBlockCount(), err, len(blocks), nil)
+	}
+	storeIndex.Dispose()
+}
@@ -0,0 +1,231 @@
+package longtailstorelib
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// tokenBucket limits the average number of bytes per second passing through it. A caller that takes
+// more than is available puts the bucket in debt and waits until it is paid back, so all callers
+// sharing the bucket share the rate
+type tokenBucket struct {
+	mutex      sync.Mutex
+	rate       float64
+	capacity   float64
+	tokens     float64
+	lastUpdate time.Time
+}
+
+func newTokenBucket(bytesPerSecond int64) *tokenBucket {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:       float64(bytesPerSecond),
+		capacity:   float64(bytesPerSecond),
+		tokens:     float64(bytesPerSecond),
+		lastUpdate: time.Now()}
+}
+
+// take removes count bytes from the bucket and waits until it is no longer in debt, a nil bucket does not limit
+func (b *tokenBucket) take(ctx context.Context, count int) error {
+	if b == nil || count <= 0 {
+		return nil
+	}
+	b.mutex.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.lastUpdate).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.lastUpdate = now
+	b.tokens -= float64(count)
+	delay := time.Duration(0)
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mutex.Unlock()
+	return sleepWithContext(ctx, delay)
+}
+
+type throttledBlobStore struct {
+	blobStore  BlobStore
+	readLimit  *tokenBucket
+	writeLimit *tokenBucket
+}
+
+type throttledBlobClient struct {
+	store  *throttledBlobStore
+	client BlobClient
+}
+
+type throttledBlobObject struct {
+	store  *throttledBlobStore
+	object BlobObject
+}
+
+type throttledReader struct {
+	ctx    context.Context
+	reader io.ReadCloser
+	limit  *tokenBucket
+}
+
+type throttledWriter struct {
+	ctx    context.Context
+	writer io.WriteCloser
+	limit  *tokenBucket
+}
+
+// NewThrottledBlobStore wraps blobStore so the content read and written through all clients of the
+// returned store is limited to the given number of bytes per second, zero means no limit.
+// Listing and attribute requests are not limited
+func NewThrottledBlobStore(blobStore BlobStore, maxReadBytesPerSecond int64, maxWriteBytesPerSecond int64) (BlobStore, error) {
+	if maxReadBytesPerSecond < 0 || maxWriteBytesPerSecond < 0 {
+		return nil, errors.Wrapf(longtaillib.ErrEINVAL, "invalid rate limit, read %d, write %d bytes per second", maxReadBytesPerSecond, maxWriteBytesPerSecond)
+	}
+	s := &throttledBlobStore{
+		blobStore:  blobStore,
+		readLimit:  newTokenBucket(maxReadBytesPerSecond),
+		writeLimit: newTokenBucket(maxWriteBytesPerSecond)}
+	return s, nil
+}
+
+func (s *throttledBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
+	client, err := s.blobStore.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledBlobClient{store: s, client: client}, nil
+}
+
+func (s *throttledBlobStore) String() string {
+	return s.blobStore.String()
+}
+
+// IsRetryableError forwards to the classification of the wrapped store
+func (s *throttledBlobStore) IsRetryableError(err error) bool {
+	if classifier, ok := s.blobStore.(BlobErrorClassifier); ok {
+		return classifier.IsRetryableError(err)
+	}
+	return true
+}
+
+func (blobClient *throttledBlobClient) NewObject(path string) (BlobObject, error) {
+	object, err := blobClient.client.NewObject(path)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledBlobObject{store: blobClient.store, object: object}, nil
+}
+
+func (blobClient *throttledBlobClient) GetObjects(ctx context.Context) ([]BlobProperties, error) {
+	return blobClient.client.GetObjects(ctx)
+}
+
+func (blobClient *throttledBlobClient) ListObjects(ctx context.Context, prefix string, delimiter string) BlobObjectIterator {
+	return blobClient.client.ListObjects(ctx, prefix, delimiter)
+}
+
+func (blobClient *throttledBlobClient) Close() {
+	blobClient.client.Close()
+}
+
+func (blobClient *throttledBlobClient) String() string {
+	return blobClient.client.String()
+}
+
+func (blobObject *throttledBlobObject) Exists(ctx context.Context) (bool, error) {
+	return blobObject.object.Exists(ctx)
+}
+
+func (blobObject *throttledBlobObject) LockWriteVersion(ctx context.Context) (bool, error) {
+	return blobObject.object.LockWriteVersion(ctx)
+}
+
+// Read pays for the data after it is read, the debt delays the following transfers so the average
+// rate is kept without an extra request for the size of the object
+func (blobObject *throttledBlobObject) Read(ctx context.Context) ([]byte, error) {
+	data, err := blobObject.object.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = blobObject.store.readLimit.take(ctx, len(data))
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Write pays for the data before it is sent
+func (blobObject *throttledBlobObject) Write(ctx context.Context, data []byte) (bool, error) {
+	err := blobObject.store.writeLimit.take(ctx, len(data))
+	if err != nil {
+		return false, err
+	}
+	return blobObject.object.Write(ctx, data)
+}
+
+func (blobObject *throttledBlobObject) Delete(ctx context.Context) error {
+	return blobObject.object.Delete(ctx)
+}
+
+func (blobObject *throttledBlobObject) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	reader, err := blobObject.object.NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledReader{ctx: ctx, reader: reader, limit: blobObject.store.readLimit}, nil
+}
+
+func (blobObject *throttledBlobObject) NewRangeReader(ctx context.Context, offset int64, length int64) (io.ReadCloser, error) {
+	reader, err := blobObject.object.NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledReader{ctx: ctx, reader: reader, limit: blobObject.store.readLimit}, nil
+}
+
+func (blobObject *throttledBlobObject) NewWriter(ctx context.Context) (io.WriteCloser, error) {
+	writer, err := blobObject.object.NewWriter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledWriter{ctx: ctx, writer: writer, limit: blobObject.store.writeLimit}, nil
+}
+
+func (blobObject *throttledBlobObject) GetAttributes(ctx context.Context) (BlobObjectAttributes, error) {
+	return blobObject.object.GetAttributes(ctx)
+}
+
+func (blobObject *throttledBlobObject) SetWriteAttributes(contentType string, metadata map[string]string) {
+	blobObject.object.SetWriteAttributes(contentType, metadata)
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if limitErr := r.limit.take(r.ctx, n); limitErr != nil && err == nil {
+		err = limitErr
+	}
+	return n, err
+}
+
+func (r *throttledReader) Close() error {
+	return r.reader.Close()
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	err := w.limit.take(w.ctx, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return w.writer.Write(p)
+}
+
+func (w *throttledWriter) Close() error {
+	return w.writer.Close()
+}
@@ -0,0 +1,87 @@
+package longtailstorelib
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	ctx := context.Background()
+	bucket := newTokenBucket(10000)
+	startTime := time.Now()
+	bucket.take(ctx, 10000)
+	if elapsed := time.Since(startTime); elapsed > 50*time.Millisecond {
+		t.Errorf("TestTokenBucket() bucket.take() of capacity waited %v", elapsed)
+	}
+	bucket.take(ctx, 2000)
+	if elapsed := time.Since(startTime); elapsed < 150*time.Millisecond {
+		t.Errorf("TestTokenBucket() bucket.take() over capacity waited %v < %v", elapsed, 150*time.Millisecond)
+	}
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	err := bucket.take(cancelCtx, 100000)
+	if err != context.Canceled {
+		t.Errorf("TestTokenBucket() bucket.take() %v != %v", err, context.Canceled)
+	}
+
+	var unlimited *tokenBucket
+	err = unlimited.take(ctx, 100000)
+	if err != nil {
+		t.Errorf("TestTokenBucket() unlimited.take() %v != %v", err, nil)
+	}
+}
+
+func TestThrottledBlobStore(t *testing.T) {
+	ctx := context.Background()
+	memStore, _ := NewMemBlobStore("throttled_store")
+	defer ReleaseMemBlobStore("throttled_store")
+	blobStore, err := NewThrottledBlobStore(memStore, 4000, 2000)
+	if err != nil {
+		t.Errorf("TestThrottledBlobStore() NewThrottledBlobStore() %v != %v", err, nil)
+	}
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+
+	data := make([]byte, 3000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	obj, _ := client.NewObject("chunks/0000/0000000000000000.lsb")
+	startTime := time.Now()
+	ok, err := obj.Write(ctx, data)
+	if !ok || err != nil {
+		t.Errorf("TestThrottledBlobStore() obj.Write() %t, %v != %t, %v", ok, err, true, nil)
+	}
+	if elapsed := time.Since(startTime); elapsed < 400*time.Millisecond {
+		t.Errorf("TestThrottledBlobStore() obj.Write() took %v < %v", elapsed, 400*time.Millisecond)
+	}
+
+	reader, _ := obj.NewReader(ctx)
+	readData, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Errorf("TestThrottledBlobStore() ioutil.ReadAll() %v != %v", err, nil)
+	}
+	if len(readData) != len(data) {
+		t.Errorf("TestThrottledBlobStore() len(readData) %d != %d", len(readData), len(data))
+	}
+	startTime = time.Now()
+	readData, err = obj.Read(ctx)
+	if err != nil {
+		t.Errorf("TestThrottledBlobStore() obj.Read() %v != %v", err, nil)
+	}
+	if len(readData) != len(data) {
+		t.Errorf("TestThrottledBlobStore() len(readData) %d != %d", len(readData), len(data))
+	}
+	if elapsed := time.Since(startTime); elapsed < 400*time.Millisecond {
+		t.Errorf("TestThrottledBlobStore() obj.Read() took %v < %v", elapsed, 400*time.Millisecond)
+	}
+
+	_, err = NewThrottledBlobStore(memStore, -1, 0)
+	if err == nil {
+		t.Errorf("TestThrottledBlobStore() NewThrottledBlobStore() err == nil")
+	}
+}
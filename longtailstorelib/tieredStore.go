@@ -0,0 +1,327 @@
+package longtailstorelib
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+const tieredPullThroughOption = "pull-through"
+
+// TierStats counts the reads that were served and the reads that missed in one tier of a tiered store
+type TierStats struct {
+	Name   string
+	Hits   uint64
+	Misses uint64
+}
+
+// TierStatsProvider is implemented by stores that read from several tiers, such as the store
+// created by NewTieredBlobStore
+type TierStatsProvider interface {
+	GetTierStats() []TierStats
+}
+
+type blobStoreTier struct {
+	blobStore BlobStore
+	hits      uint64
+	misses    uint64
+}
+
+type tieredBlobStore struct {
+	tiers       []*blobStoreTier
+	pullThrough bool
+}
+
+type tieredBlobClient struct {
+	store   *tieredBlobStore
+	clients []BlobClient
+}
+
+type tieredBlobObject struct {
+	client  *tieredBlobClient
+	path    string
+	objects []BlobObject
+	// firstTier is the first tier the object is read from, objects that can change are only read
+	// from the last tier
+	firstTier int
+}
+
+// isImmutableBlobPath is true for the objects that never change once written, blocks and version
+// indexes, other objects such as the store index may be stale in all tiers but the last one
+func isImmutableBlobPath(path string) bool {
+	return strings.HasSuffix(path, ".lsb") || strings.HasSuffix(path, ".lvi")
+}
+
+// NewTieredBlobStore creates a read only store that reads each object from the first of tiers that
+// has it, typically a local mirror followed by the main store. With pullThrough an object found in
+// a later tier is written to the tiers before it so the next read is served from the first tier.
+// Only blocks and version indexes are tiered, the store index and other objects that change are
+// read and listed from the last tier which is expected to be up to date
+func NewTieredBlobStore(tiers []BlobStore, pullThrough bool) (BlobStore, error) {
+	if len(tiers) == 0 {
+		return nil, errors.Wrap(longtaillib.ErrEINVAL, "tiered store needs at least one store")
+	}
+	s := &tieredBlobStore{tiers: make([]*blobStoreTier, len(tiers)), pullThrough: pullThrough}
+	for i, blobStore := range tiers {
+		s.tiers[i] = &blobStoreTier{blobStore: blobStore}
+	}
+	return s, nil
+}
+
+// newTieredBlobStoreForURL creates a store for tiered:<uri>|<uri>[|pull-through=true], the store
+// is read only
+func newTieredBlobStoreForURL(u *url.URL, options BlobStoreOptions) (BlobStore, error) {
+	if options.AccessType != ReadOnly {
+		return nil, errors.Wrapf(longtaillib.ErrEROFS, "tiered storage is read only, can not open %s for writing", u.String())
+	}
+	uris, uriOptions := getCompositeURIElements(u)
+	if len(uris) == 0 {
+		return nil, errors.Wrapf(longtaillib.ErrEINVAL, "invalid tiered uri `%s`, expected tiered:<uri>%s<uri>", u.String(), compositeURISeparator)
+	}
+	pullThrough := false
+	for name, value := range uriOptions {
+		if name != tieredPullThroughOption {
+			return nil, errors.Wrapf(longtaillib.ErrEINVAL, "unknown option `%s` in `%s`", name, u.String())
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.Wrapf(longtaillib.ErrEINVAL, "invalid pull-through option in `%s`", u.String())
+		}
+		pullThrough = enabled
+	}
+	tiers := make([]BlobStore, 0, len(uris))
+	for i, uri := range uris {
+		tierOptions := options
+		if pullThrough && i < len(uris)-1 {
+			// Objects are written to all tiers but the last one
+			tierOptions.AccessType = ReadWrite
+		}
+		blobStore, err := CreateBlobStoreForURI(uri, tierOptions)
+		if err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, blobStore)
+	}
+	return NewTieredBlobStore(tiers, pullThrough)
+}
+
+func (s *tieredBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
+	clients := make([]BlobClient, 0, len(s.tiers))
+	for _, tier := range s.tiers {
+		client, err := tier.blobStore.NewClient(ctx)
+		if err != nil {
+			for _, c := range clients {
+				c.Close()
+			}
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return &tieredBlobClient{store: s, clients: clients}, nil
+}
+
+func (s *tieredBlobStore) String() string {
+	names := make([]string, len(s.tiers))
+	for i, tier := range s.tiers {
+		names[i] = tier.blobStore.String()
+	}
+	return "tiered:" + strings.Join(names, compositeURISeparator)
+}
+
+// IsRetryableError forwards to the classification of the last tier, the store that is expected to have all objects
+func (s *tieredBlobStore) IsRetryableError(err error) bool {
+	if classifier, ok := s.tiers[len(s.tiers)-1].blobStore.(BlobErrorClassifier); ok {
+		return classifier.IsRetryableError(err)
+	}
+	return true
+}
+
+// GetTierStats implements TierStatsProvider
+func (s *tieredBlobStore) GetTierStats() []TierStats {
+	stats := make([]TierStats, len(s.tiers))
+	for i, tier := range s.tiers {
+		stats[i] = TierStats{
+			Name:   tier.blobStore.String(),
+			Hits:   atomic.LoadUint64(&tier.hits),
+			Misses: atomic.LoadUint64(&tier.misses)}
+	}
+	return stats
+}
+
+func (blobClient *tieredBlobClient) NewObject(path string) (BlobObject, error) {
+	objects := make([]BlobObject, len(blobClient.clients))
+	for i, client := range blobClient.clients {
+		object, err := client.NewObject(path)
+		if err != nil {
+			return nil, err
+		}
+		objects[i] = object
+	}
+	firstTier := 0
+	if !isImmutableBlobPath(path) {
+		firstTier = len(objects) - 1
+	}
+	return &tieredBlobObject{client: blobClient, path: path, objects: objects, firstTier: firstTier}, nil
+}
+
+// listTiers merges the listings of the tiers, objects that can change are only listed from the last tier
+func (blobClient *tieredBlobClient) listTiers(list func(client BlobClient) ([]BlobProperties, error)) ([]BlobProperties, error) {
+	lastClient := blobClient.clients[len(blobClient.clients)-1]
+	return getObjectsUnion(blobClient.clients, func(client BlobClient) ([]BlobProperties, error) {
+		items, err := list(client)
+		if err != nil || client == lastClient {
+			return items, err
+		}
+		immutableItems := []BlobProperties{}
+		for _, item := range items {
+			if isImmutableBlobPath(item.Name) {
+				immutableItems = append(immutableItems, item)
+			}
+		}
+		return immutableItems, nil
+	})
+}
+
+// GetObjects lists the union of the objects in the tiers that can be listed
+func (blobClient *tieredBlobClient) GetObjects(ctx context.Context) ([]BlobProperties, error) {
+	return blobClient.listTiers(func(client BlobClient) ([]BlobProperties, error) {
+		return client.GetObjects(ctx)
+	})
+}
+
+// ListObjects lists the union of the objects in the tiers that can be listed, the listings are
+// merged so all pages are fetched before the first object is returned
+func (blobClient *tieredBlobClient) ListObjects(ctx context.Context, prefix string, delimiter string) BlobObjectIterator {
+	items, err := blobClient.listTiers(func(client BlobClient) ([]BlobProperties, error) {
+		return readBlobObjectIterator(client.ListObjects(ctx, prefix, delimiter))
+	})
+	if err != nil {
+		return newSliceBlobObjectIterator(nil, err)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return newSliceBlobObjectIterator(items, nil)
+}
+
+func (blobClient *tieredBlobClient) Close() {
+	for _, client := range blobClient.clients {
+		client.Close()
+	}
+}
+
+func (blobClient *tieredBlobClient) String() string {
+	return blobClient.store.String()
+}
+
+// findTier returns the index of the first tier that has the object and updates the tier stats,
+// it returns -1 if no tier has the object. A tier that fails is counted as a miss unless it is the last one
+func (blobObject *tieredBlobObject) findTier(ctx context.Context) (int, error) {
+	tiers := blobObject.client.store.tiers
+	for i := blobObject.firstTier; i < len(blobObject.objects); i++ {
+		object := blobObject.objects[i]
+		exists, err := object.Exists(ctx)
+		if err != nil && i < len(blobObject.objects)-1 {
+			log.Printf("tieredBlobObject: failed to look for %s in %s, trying the next tier: %v\n", blobObject.path, blobObject.client.clients[i].String(), err)
+		} else if err != nil {
+			return -1, err
+		}
+		if exists {
+			atomic.AddUint64(&tiers[i].hits, 1)
+			return i, nil
+		}
+		atomic.AddUint64(&tiers[i].misses, 1)
+	}
+	return -1, nil
+}
+
+// Exists is true if any tier has the object, like findTier a tier that fails is skipped unless it is the last one
+func (blobObject *tieredBlobObject) Exists(ctx context.Context) (bool, error) {
+	for i := blobObject.firstTier; i < len(blobObject.objects); i++ {
+		exists, err := blobObject.objects[i].Exists(ctx)
+		if err != nil && i < len(blobObject.objects)-1 {
+			continue
+		}
+		if err != nil || exists {
+			return exists, err
+		}
+	}
+	return false, nil
+}
+
+func (blobObject *tieredBlobObject) LockWriteVersion(ctx context.Context) (bool, error) {
+	return false, errors.Wrapf(longtaillib.ErrEROFS, "tieredBlobObject: %s is read only", blobObject.path)
+}
+
+// Read reads from the first tier that has the object, with pull through the object is copied to the tiers before it
+func (blobObject *tieredBlobObject) Read(ctx context.Context) ([]byte, error) {
+	tier, err := blobObject.findTier(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tier == -1 {
+		return nil, errors.Wrapf(longtaillib.ErrENOENT, "tieredBlobObject: %s does not exist in any tier", blobObject.path)
+	}
+	data, err := blobObject.objects[tier].Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if blobObject.client.store.pullThrough {
+		for i := blobObject.firstTier; i < tier; i++ {
+			_, err := blobObject.objects[i].Write(ctx, data)
+			if err != nil {
+				// The object was read, failing to cache it only costs performance
+				log.Printf("tieredBlobObject: failed to copy %s to %s: %v\n", blobObject.path, blobObject.client.clients[i].String(), err)
+			}
+		}
+	}
+	return data, nil
+}
+
+func (blobObject *tieredBlobObject) Write(ctx context.Context, data []byte) (bool, error) {
+	return false, errors.Wrapf(longtaillib.ErrEROFS, "tieredBlobObject: %s is read only", blobObject.path)
+}
+
+func (blobObject *tieredBlobObject) Delete(ctx context.Context) error {
+	return errors.Wrapf(longtaillib.ErrEROFS, "tieredBlobObject: %s is read only", blobObject.path)
+}
+
+func (blobObject *tieredBlobObject) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	return blobObject.NewRangeReader(ctx, 0, -1)
+}
+
+// NewRangeReader streams from the first tier that has the object, the object is not pulled through
+func (blobObject *tieredBlobObject) NewRangeReader(ctx context.Context, offset int64, length int64) (io.ReadCloser, error) {
+	tier, err := blobObject.findTier(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tier == -1 {
+		return nil, errors.Wrapf(longtaillib.ErrENOENT, "tieredBlobObject: %s does not exist in any tier", blobObject.path)
+	}
+	return blobObject.objects[tier].NewRangeReader(ctx, offset, length)
+}
+
+func (blobObject *tieredBlobObject) NewWriter(ctx context.Context) (io.WriteCloser, error) {
+	return nil, errors.Wrapf(longtaillib.ErrEROFS, "tieredBlobObject: %s is read only", blobObject.path)
+}
+
+func (blobObject *tieredBlobObject) GetAttributes(ctx context.Context) (BlobObjectAttributes, error) {
+	for _, object := range blobObject.objects[blobObject.firstTier:] {
+		attributes, err := object.GetAttributes(ctx)
+		if errors.Cause(err) == longtaillib.ErrENOENT {
+			continue
+		}
+		return attributes, err
+	}
+	return BlobObjectAttributes{}, errors.Wrapf(longtaillib.ErrENOENT, "tieredBlobObject: %s does not exist in any tier", blobObject.path)
+}
+
+func (blobObject *tieredBlobObject) SetWriteAttributes(contentType string, metadata map[string]string) {
+}
@@ -0,0 +1,153 @@
+package longtailstorelib
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+func TestTieredBlobStoreRead(t *testing.T) {
+	ctx := context.Background()
+	local, _ := NewMemBlobStore("tier_local")
+	defer ReleaseMemBlobStore("tier_local")
+	mainStore, _ := NewMemBlobStore("tier_main")
+	defer ReleaseMemBlobStore("tier_main")
+	writeTestObject(ctx, mainStore, "chunks/0000/0000000000000000.lsb", []byte("block"))
+
+	blobStore, err := NewTieredBlobStore([]BlobStore{local, mainStore}, true)
+	if err != nil {
+		t.Errorf("TestTieredBlobStoreRead() NewTieredBlobStore() %v != %v", err, nil)
+	}
+	data, err := readTestObject(ctx, blobStore, "chunks/0000/0000000000000000.lsb")
+	if err != nil || string(data) != "block" {
+		t.Errorf("TestTieredBlobStoreRead() Read() %s, %v != %s, %v", string(data), err, "block", nil)
+	}
+	data, err = readTestObject(ctx, local, "chunks/0000/0000000000000000.lsb")
+	if err != nil || string(data) != "block" {
+		t.Errorf("TestTieredBlobStoreRead() Read() of pulled through object %s, %v != %s, %v", string(data), err, "block", nil)
+	}
+	readTestObject(ctx, blobStore, "chunks/0000/0000000000000000.lsb")
+
+	stats := blobStore.(TierStatsProvider).GetTierStats()
+	if stats[0].Hits != 1 || stats[0].Misses != 1 {
+		t.Errorf("TestTieredBlobStoreRead() stats[0] %d, %d != %d, %d", stats[0].Hits, stats[0].Misses, 1, 1)
+	}
+	if stats[1].Hits != 1 || stats[1].Misses != 0 {
+		t.Errorf("TestTieredBlobStoreRead() stats[1] %d, %d != %d, %d", stats[1].Hits, stats[1].Misses, 1, 0)
+	}
+
+	_, err = readTestObject(ctx, blobStore, "chunks/0001/0001000000000000.lsb")
+	if errors.Cause(err) != longtaillib.ErrENOENT {
+		t.Errorf("TestTieredBlobStoreRead() Read() %v != %v", err, longtaillib.ErrENOENT)
+	}
+	_, err = writeTestObject(ctx, blobStore, "store.lsi", []byte("index"))
+	if errors.Cause(err) != longtaillib.ErrEROFS {
+		t.Errorf("TestTieredBlobStoreRead() Write() %v != %v", err, longtaillib.ErrEROFS)
+	}
+}
+
+func TestTieredBlobStoreFailingTier(t *testing.T) {
+	ctx := context.Background()
+	local, _ := NewMemBlobStore("tier_local")
+	defer ReleaseMemBlobStore("tier_local")
+	mainStore, _ := NewMemBlobStore("tier_main")
+	defer ReleaseMemBlobStore("tier_main")
+	writeTestObject(ctx, mainStore, "chunks/0000/0000000000000000.lsb", []byte("block"))
+
+	// A cache tier that fails is a miss, only a failing last tier fails the read
+	failingLocal, _ := NewFaultInjectionBlobStore(local, FaultInjectionOptions{ExistsErrorRate: 1})
+	blobStore, _ := NewTieredBlobStore([]BlobStore{failingLocal, mainStore}, false)
+	data, err := readTestObject(ctx, blobStore, "chunks/0000/0000000000000000.lsb")
+	if err != nil || string(data) != "block" {
+		t.Errorf("TestTieredBlobStoreFailingTier() Read() %s, %v != %s, %v", string(data), err, "block", nil)
+	}
+	stats := blobStore.(TierStatsProvider).GetTierStats()
+	if stats[0].Hits != 0 || stats[0].Misses != 1 {
+		t.Errorf("TestTieredBlobStoreFailingTier() stats[0] %d, %d != %d, %d", stats[0].Hits, stats[0].Misses, 0, 1)
+	}
+
+	failingMain, _ := NewFaultInjectionBlobStore(mainStore, FaultInjectionOptions{ExistsErrorRate: 1})
+	blobStore, _ = NewTieredBlobStore([]BlobStore{local, failingMain}, false)
+	_, err = readTestObject(ctx, blobStore, "chunks/0000/0000000000000000.lsb")
+	if err == nil {
+		t.Errorf("TestTieredBlobStoreFailingTier() Read() err == nil")
+	}
+}
+
+func TestTieredBlobStoreNoPullThrough(t *testing.T) {
+	ctx := context.Background()
+	local, _ := NewMemBlobStore("tier_local")
+	defer ReleaseMemBlobStore("tier_local")
+	mainStore, _ := NewMemBlobStore("tier_main")
+	defer ReleaseMemBlobStore("tier_main")
+	writeTestObject(ctx, mainStore, "store.lsi", []byte("index"))
+
+	blobStore, _ := NewTieredBlobStore([]BlobStore{local, mainStore}, false)
+	data, err := readTestObject(ctx, blobStore, "store.lsi")
+	if err != nil || string(data) != "index" {
+		t.Errorf("TestTieredBlobStoreNoPullThrough() Read() %s, %v != %s, %v", string(data), err, "index", nil)
+	}
+	client, _ := local.NewClient(ctx)
+	defer client.Close()
+	object, _ := client.NewObject("store.lsi")
+	exists, _ := object.Exists(ctx)
+	if exists {
+		t.Errorf("TestTieredBlobStoreNoPullThrough() object.Exists() %t != %t", exists, false)
+	}
+}
+
+func TestTieredBlobStoreStaleStoreIndex(t *testing.T) {
+	ctx := context.Background()
+	local, _ := NewMemBlobStore("tier_local")
+	defer ReleaseMemBlobStore("tier_local")
+	mainStore, _ := NewMemBlobStore("tier_main")
+	defer ReleaseMemBlobStore("tier_main")
+	writeTestObject(ctx, local, "store.lsi", []byte("stale index"))
+	writeTestObject(ctx, local, "store-deltas/stale.lsi", []byte("stale delta"))
+	writeTestObject(ctx, mainStore, "store.lsi", []byte("index"))
+
+	blobStore, _ := NewTieredBlobStore([]BlobStore{local, mainStore}, true)
+	data, err := readTestObject(ctx, blobStore, "store.lsi")
+	if err != nil || string(data) != "index" {
+		t.Errorf("TestTieredBlobStoreStaleStoreIndex() Read() %s, %v != %s, %v", string(data), err, "index", nil)
+	}
+	data, _ = readTestObject(ctx, local, "store.lsi")
+	if string(data) != "stale index" {
+		t.Errorf("TestTieredBlobStoreStaleStoreIndex() Read() of local store index %s != %s", string(data), "stale index")
+	}
+
+	client, _ := blobStore.NewClient(ctx)
+	defer client.Close()
+	items, err := readBlobObjectIterator(client.ListObjects(ctx, "store-deltas/", ""))
+	if err != nil || len(items) != 0 {
+		t.Errorf("TestTieredBlobStoreStaleStoreIndex() ListObjects() %d, %v != %d, %v", len(items), err, 0, nil)
+	}
+}
+
+func TestTieredBlobStoreURI(t *testing.T) {
+	ctx := context.Background()
+	defer ReleaseMemBlobStore("tier_uri_local")
+	defer ReleaseMemBlobStore("tier_uri_main")
+	WriteToURI(ctx, "mem://tier_uri_main/index/version.lvi", []byte("version index"))
+
+	uri := "tiered:mem://tier_uri_local/index/version.lvi|mem://tier_uri_main/index/version.lvi|pull-through=true"
+	data, err := ReadFromURI(ctx, uri)
+	if err != nil || string(data) != "version index" {
+		t.Errorf("TestTieredBlobStoreURI() ReadFromURI() %s, %v != %s, %v", string(data), err, "version index", nil)
+	}
+	data, err = ReadFromURI(ctx, "mem://tier_uri_local/index/version.lvi")
+	if err != nil || string(data) != "version index" {
+		t.Errorf("TestTieredBlobStoreURI() ReadFromURI() of pulled through object %s, %v != %s, %v", string(data), err, "version index", nil)
+	}
+
+	err = WriteToURI(ctx, uri, []byte("version index"))
+	if errors.Cause(err) != longtaillib.ErrEROFS {
+		t.Errorf("TestTieredBlobStoreURI() WriteToURI() %v != %v", err, longtaillib.ErrEROFS)
+	}
+	_, err = CreateBlobStoreForURI("tiered:mem://tier_uri_local|mem://tier_uri_main|pull-through=maybe", BlobStoreOptions{AccessType: ReadOnly})
+	if err == nil {
+		t.Errorf("TestTieredBlobStoreURI() CreateBlobStoreForURI() err == nil")
+	}
+}